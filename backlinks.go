@@ -0,0 +1,183 @@
+package tiddlybucket
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog/log"
+)
+
+//Links in wikitext: [[Target]] or [[text|Target]], and [ext[URL]] or [ext[text|URL]]
+var (
+	wikiLinkPattern = regexp.MustCompile(`\[\[(.*?)\]\]`)
+	extLinkPattern  = regexp.MustCompile(`\[ext\[(.*?)\]\]`)
+)
+
+//Which tiddlers link to which, for /{wiki}/backlinks/. Built from all tiddlers on its first request, then kept up to date
+//by the writes through the server.
+type backlinkIndex struct {
+	links     map[string][]string            //link keys in each tiddler, by title
+	backlinks map[string]map[string]struct{} //titles of the tiddlers linking to each link key
+}
+
+func newBacklinkIndex(tids []Tiddler) *backlinkIndex {
+	idx := &backlinkIndex{links: map[string][]string{}, backlinks: map[string]map[string]struct{}{}}
+	for _, tid := range tids {
+		if title, ok := fieldAsString(tid["title"]); ok {
+			idx.update(title, tid)
+		}
+	}
+	return idx
+}
+
+//The key of a link target, ignoring case with caseInsensitiveTitles set
+func linkKey(target string) string {
+	if caseInsensitiveTitles {
+		return strings.ToLower(target)
+	}
+	return target
+}
+
+//Returns the targets of the links in a tiddler's text, each once. Only wikitext is parsed, so binary tiddlers, scripts and
+//plugins (whose text is the JSON of the tiddlers they bundle) have none.
+func tiddlerLinks(tid Tiddler) []string {
+	text, ok := fieldAsString(tid["text"])
+	if !ok || text == "" {
+		return nil
+	}
+	if tiddlerType := tid.Field("type"); tiddlerType != "" && tiddlerType != "text/vnd.tiddlywiki" {
+		return nil
+	}
+	seen := map[string]bool{}
+	targets := []string{}
+	for _, pattern := range []*regexp.Regexp{wikiLinkPattern, extLinkPattern} {
+		for _, m := range pattern.FindAllStringSubmatch(text, -1) {
+			target := m[1]
+			if i := strings.Index(target, "|"); i >= 0 {
+				target = target[i+1:]
+			}
+			target = strings.TrimSpace(target)
+			if target == "" || seen[linkKey(target)] {
+				continue
+			}
+			seen[linkKey(target)] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+//Replaces the links of a tiddler, or removes them when tid is nil
+func (idx *backlinkIndex) update(title string, tid Tiddler) {
+	for _, key := range idx.links[title] {
+		delete(idx.backlinks[key], title)
+		if len(idx.backlinks[key]) == 0 {
+			delete(idx.backlinks, key)
+		}
+	}
+	delete(idx.links, title)
+	if tid == nil {
+		return
+	}
+	keys := []string{}
+	for _, target := range tiddlerLinks(tid) {
+		key := linkKey(target)
+		if idx.backlinks[key] == nil {
+			idx.backlinks[key] = map[string]struct{}{}
+		}
+		idx.backlinks[key][title] = struct{}{}
+		keys = append(keys, key)
+	}
+	if len(keys) > 0 {
+		idx.links[title] = keys
+	}
+}
+
+//Returns the titles of the tiddlers linking to the target, sorted
+func (idx *backlinkIndex) linksTo(target string) []string {
+	titles := make([]string, 0, len(idx.backlinks[linkKey(target)]))
+	for title := range idx.backlinks[linkKey(target)] {
+		titles = append(titles, title)
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+//Updates the backlink index, if it was built, after a tiddler was written or deleted (tid nil) through the server
+func (h *handlerWithStore) updateBacklinks(title string, tid Tiddler) {
+	h.muBacklinks.Lock()
+	defer h.muBacklinks.Unlock()
+	if h.backlinks == nil {
+		return
+	}
+	if caseInsensitiveTitles {
+		//the tiddler may have been indexed under a title differing by case
+		for linked := range h.backlinks.links {
+			if linked != title && sameTitle(linked, title) {
+				h.backlinks.update(linked, nil)
+			}
+		}
+	}
+	h.backlinks.update(title, tid)
+}
+
+//Drops the backlink index, to be built again on its next request
+func (h *handlerWithStore) resetBacklinks() {
+	h.muBacklinks.Lock()
+	defer h.muBacklinks.Unlock()
+	h.backlinks = nil
+}
+
+func (hr *HandlerSelector) getBacklinks(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.getBacklinks(w, r)
+}
+
+//Lists the titles of the tiddlers whose text links to the tiddler (or external URL) given in the path
+func (h *handlerWithStore) getBacklinks(w http.ResponseWriter, r *http.Request) {
+	targetRaw := chi.URLParam(r, "*")
+	if targetRaw == "" {
+		http.Error(w, "tiddler name not provided", http.StatusBadRequest)
+		return
+	}
+	target, err := url.PathUnescape(targetRaw)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not unescape tiddler name: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	titles, err := h.backlinksTo(target)
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	renderJSON(w, r, titles)
+}
+
+//Returns the titles of the tiddlers linking to the target, building the backlink index first if needed. It is built while
+//holding the lock, so that a write waits for it and then updates the tiddlers it read.
+func (h *handlerWithStore) backlinksTo(target string) ([]string, error) {
+	h.muBacklinks.Lock()
+	defer h.muBacklinks.Unlock()
+	if h.backlinks == nil {
+		tids, err := h.Store.GetAllTiddlers()
+		if err != nil {
+			return nil, err
+		}
+		h.backlinks = newBacklinkIndex(tids)
+		log.Debug().Str("wiki", h.wiki).Int("num_tiddlers", len(tids)).Msg("built backlink index")
+	}
+	return h.backlinks.linksTo(target), nil
+}
@@ -0,0 +1,127 @@
+package tiddlybucket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_tiddlerLinks(t *testing.T) {
+	tests := []struct {
+		name string
+		tid  Tiddler
+		want []string
+	}{
+		{"plain link", Tiddler{"text": "see [[Other Note]] too"}, []string{"Other Note"}},
+		{"link with text", Tiddler{"text": "see [[the other one|Other Note]]"}, []string{"Other Note"}},
+		{"external link", Tiddler{"text": "[ext[https://example.com]] and [ext[docs|https://example.com/docs]]"}, []string{"https://example.com", "https://example.com/docs"}},
+		{"each once", Tiddler{"text": "[[A]] [[B]] [[again|A]]"}, []string{"A", "B"}},
+		{"wikitext type", Tiddler{"type": "text/vnd.tiddlywiki", "text": "[[A]]"}, []string{"A"}},
+		{"empty link", Tiddler{"text": "[[]] [[ | ]]"}, []string{}},
+		{"no links", Tiddler{"text": "just [text]"}, []string{}},
+		{"script", Tiddler{"type": "application/javascript", "text": "x = [[A]]"}, nil},
+		{"binary", Tiddler{"type": "image/png", "text": []byte("[[A]]")}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tiddlerLinks(tt.tid); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tiddlerLinks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getBacklinks(t *testing.T) {
+	store := NewMemoryStore()
+	for _, tid := range []Tiddler{
+		{"title": "Target", "text": "linked to"},
+		{"title": "First", "text": "see [[Target]]"},
+		{"title": "Second", "text": "also [[that one|Target]] and [ext[https://example.com]]"},
+		{"title": "Unrelated", "text": "nothing here"},
+	} {
+		if err := store.WriteTiddler(tid); err != nil {
+			t.Fatalf("WriteTiddler() error = %v", err)
+		}
+	}
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	withParams := func(r *http.Request, keys, values []string) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, &chi.Context{URLParams: chi.RouteParams{Keys: keys, Values: values}}))
+	}
+	backlinks := func(target string) []string {
+		escaped := url.PathEscape(target)
+		w := httptest.NewRecorder()
+		h.getBacklinks(w, withParams(httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/backlinks/"+escaped, nil), []string{"*"}, []string{escaped}))
+		if w.Code != http.StatusOK {
+			t.Fatalf("getBacklinks(%q) status = %d", target, w.Code)
+		}
+		var titles []string
+		if err := json.NewDecoder(w.Body).Decode(&titles); err != nil {
+			t.Fatalf("getBacklinks(%q) is not a JSON list: %v", target, err)
+		}
+		return titles
+	}
+	put := func(title, text string) {
+		w := httptest.NewRecorder()
+		h.putTiddler(w, withParams(httptest.NewRequest(http.MethodPut, "http://foobar.com/notes/recipes/default/tiddlers/"+title,
+			strings.NewReader(`{"title":"`+title+`","text":"`+text+`"}`)), []string{"recipe", "*"}, []string{"default", title}))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("putTiddler(%s) status = %d", title, w.Code)
+		}
+	}
+
+	if got, want := backlinks("Target"), []string{"First", "Second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backlinks of Target = %v, want %v", got, want)
+	}
+	if got, want := backlinks("https://example.com"), []string{"Second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backlinks of https://example.com = %v, want %v", got, want)
+	}
+	if got := backlinks("Missing"); len(got) != 0 {
+		t.Errorf("backlinks of Missing = %v, want none", got)
+	}
+
+	// links added and removed by saving
+	put("Unrelated", "now about [[Target]]")
+	put("First", "no longer linking")
+	if got, want := backlinks("Target"), []string{"Second", "Unrelated"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backlinks of Target after saving = %v, want %v", got, want)
+	}
+
+	// links removed by deleting
+	w := httptest.NewRecorder()
+	h.deleteTiddler(w, withParams(httptest.NewRequest(http.MethodDelete, "http://foobar.com/notes/bags/default/tiddlers/Second", nil),
+		[]string{"bag", "*"}, []string{"default", "Second"}))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleteTiddler() status = %d", w.Code)
+	}
+	if got, want := backlinks("Target"), []string{"Unrelated"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backlinks of Target after deleting = %v, want %v", got, want)
+	}
+	if got := backlinks("https://example.com"); len(got) != 0 {
+		t.Errorf("backlinks of https://example.com after deleting = %v, want none", got)
+	}
+
+	// and by deleting in bulk
+	put("First", "back to [[Target]]")
+	w = httptest.NewRecorder()
+	h.deleteTiddlers(w, httptest.NewRequest(http.MethodPost, "http://foobar.com/notes/recipes/default/tiddlers/delete", strings.NewReader(`["First"]`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleteTiddlers() status = %d", w.Code)
+	}
+	if got, want := backlinks("Target"), []string{"Unrelated"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backlinks of Target after deleting in bulk = %v, want %v", got, want)
+	}
+
+	// the index kept up to date matches one built again from the store
+	kept := backlinks("Target")
+	h.resetCaches()
+	if got := backlinks("Target"); !reflect.DeepEqual(got, kept) {
+		t.Errorf("backlinks of Target rebuilt = %v, want %v as kept up to date", got, kept)
+	}
+}
@@ -4,7 +4,12 @@ import (
 	//"encoding/csv"
 	"flag"
 	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/fkmiec/tiddlyverse"
 	"github.com/rs/zerolog"
@@ -23,20 +28,152 @@ func main() {
 	flag.String("port", "8080", "the port to serve this page on")
 	flag.String("debug_level", "info", "specify the debug level. options are: trace, debug, info, warn, error, fatal")
 	flag.String("credentials_file", "", "the name of the credentials CSV in the root wiki directory")
+	flag.String("wiki_location_file", "", "a file to read the wiki location from (e.g. a mounted secret), instead of the argument or WIKI_LOCATION")
+	flag.String("credentials_file_file", "", "a file to read the credentials_file setting from (e.g. a mounted secret)")
 	flag.String("readers", authTokenAnon, "specify the security principals with read access to the wiki")
 	flag.String("writers", authTokenAnon, "specify the security principals with write access to the wiki")
+	flag.Int("max_filename_length", 255, "the longest tiddler filename to write before falling back to a hashed filename (at least 45)")
+	flag.Duration("anon_session_max_age", 0, "give anonymous users a session cookie lasting this long (e.g. 1h), so per-client limits apply per session rather than per IP address (0 disables sessions)")
+	flag.Int("max_concurrent_per_client", 0, "how many requests a single user (or IP address when anonymous) may have in flight before getting 429 Too Many Requests (0 is unlimited)")
+	flag.Int("max_concurrent_index_builds", 4, "how many wikis may build their tiddler index at once at startup. Lower it to bound peak memory with many large wikis")
+	flag.Int("store_workers", 15, "how many tiddler files or objects each wiki's store reads, copies or deletes at once, e.g. when building its index. Lower it on small hosts, raise it for large buckets")
+	flag.Duration("store_read_timeout", 0, "how long to wait for reading a single object from a GCS or S3 bucket (0 waits indefinitely)")
+	flag.Duration("store_write_timeout", 0, "how long to wait for writing or deleting a single object in a GCS or S3 bucket (0 waits indefinitely)")
+	flag.Duration("store_list_timeout", 0, "how long to wait for listing the tiddlers of a GCS or S3 bucket, e.g. when building the index (0 waits indefinitely)")
+	flag.Int("store_read_retries", 0, "how many times to retry a failed or timed out object read")
+	flag.Int("store_write_retries", 0, "how many times to retry a failed or timed out object write or delete")
+	flag.Int("store_list_retries", 0, "how many times to retry a failed or timed out listing of the tiddlers")
+	flag.String("s3_endpoint", "", "the URL of an S3-compatible store to use instead of AWS for s3:// locations, e.g. http://localhost:9000 for MinIO")
+	flag.String("s3_region", "", "the region of the S3 bucket, overriding the AWS configuration. Stores other than AWS need one set")
+	flag.Bool("s3_force_path_style", false, "address S3 buckets as <endpoint>/<bucket> rather than <bucket>.<endpoint>, as MinIO needs")
+	flag.String("fallback_location", "", "a second wiki location, e.g. a local replica of the bucket, to read tiddlers from when the wiki location fails")
+	flag.String("index_dir", "", "the folder of each wiki's index.html, relative to the wiki's folder (the wiki's folder itself by default)")
+	flag.String("tiddlers_dir", "tiddlers", "the folder of each wiki's tiddler files, relative to the wiki's folder")
+	flag.Bool("case_insensitive_titles", false, "treat tiddler titles that differ only by case as the same tiddler, as case-insensitive filesystems do")
+	flag.Bool("preserve_empty_fields", false, "keep an empty text field apart from a missing one in tiddler files, so a tiddler's fields survive being saved and read back")
+	flag.Bool("normalize_titles", false, "trim the whitespace around the titles of tiddlers saved by clients and collapse the runs of whitespace within them")
+	flag.Int("max_revisions", 0, "keep this many earlier revisions of each tiddler, fetched with ?revision=N. 0 keeps no history")
+	flag.String("index_templates", "", "comma separated pattern=template rules sending the template in each wiki's folder instead of index.html to the User-Agents matching the regular expression (e.g. Mobile=index-mobile.html)")
+	flag.String("index_exclude", "", "comma separated title prefixes to leave out of the tiddlers injected into each wiki's index (e.g. plugins already in the template)")
+	flag.String("webhook_url", "", "a URL to POST the wiki, title, operation (put or delete) and username of each tiddler saved or deleted by a client to, as JSON in the background, e.g. to notify a chat channel")
+	flag.String("sync_log_dir", "", "folder of the <wiki>.sync.log files written while a wiki's sync logging is turned on at /<wiki>/debug/sync-log. Empty logs to the server log")
+	flag.Bool("disable_management", false, "answer 404 for the landing page and the pages and API creating, renaming and deleting wikis, for wikis provisioned out-of-band")
+	flag.String("redact_fields", "", "comma separated tiddler fields to leave out of the tiddlers served to users who are not allowed to write")
+	flag.Bool("skinny_hash", false, "add a hash of each tiddler's content to the tiddler list sent to TiddlyWiki")
+	flag.Bool("gzip_index", false, "read each wiki's index.html from a gzipped index.html.gz, creating it on first use and after index.html changes, so loading the wiki transfers less from the bucket")
+	flag.Bool("stream_index", false, "build each wiki's page for every request and stream it rather than caching it in memory, for very large wikis on small servers")
+	flag.Bool("lazy_index", false, "embed only the system tiddlers in full in each wiki's page and let TiddlyWiki load the text of the others when they are first shown, for very large wikis")
+	flag.Bool("download_sync_config", false, "keep the $:/config/tiddlyweb/host and TiddlyWeb plugin tiddlers in wikis downloaded from /<wiki>/download, which then try to sync with this server")
+	flag.Duration("rebuild_log_interval", time.Minute, "how often each wiki may log the cache rebuilds caused by writes, with their count and duration since the last line (a negative value logs every rebuild)")
+	flag.Duration("wiki_retry_interval", 10*time.Second, "how long to wait before retrying a wiki whose store failed to load, doubling with each attempt up to 10m. Other wikis are served meanwhile (a negative value makes such a failure stop the server)")
+	flag.Duration("shutdown_timeout", 30*time.Second, "how long to wait on SIGINT or SIGTERM for requests in flight to finish and the stores to be closed before stopping")
+	flag.Duration("reconcile_interval", 0, "how often to compare each wiki's store with the tiddlers loaded and reload it when tiddler files were added, removed or changed outside the server, e.g. in the bucket (0 turns it off)")
+	flag.Bool("backlinks", false, "serve /<wiki>/backlinks/<title>, listing the tiddlers that link to a tiddler, from an index kept in memory")
+	flag.Bool("check_store_changes", false, "check whether the tiddlers were changed outside the server before serving a cached wiki page, and reload them if so")
+	flag.String("default_tiddler_type", "text/vnd.tiddlywiki", "the type given to tiddlers read from .tid files without one (a .meta file without one takes the type of the file it describes)")
+	flag.Int("max_skinny_list", 0, "largest tiddler list sent without ?limit= or ?offset=; a longer one is refused with 413 (0 sends any)")
+	flag.Int("max_wiki_tiddlers", 0, "answer the tiddler list of wikis with more tiddlers than this with 507 instead of reading them all (0 turns it off)")
+	flag.Int("attachment_threshold", 0, "save binary tiddlers of at least this many bytes to the wiki's files folder, referenced with _canonical_uri (0 keeps them inline)")
+	flag.String("sort_by", tiddlybucket.SortByTitle, "the order of the tiddler list sent to TiddlyWiki and of the tiddlers embedded in each wiki's page: title, modified or created (newest first)")
+	flag.String("conflict_strategy", tiddlybucket.ConflictClientWins, "how to handle a tiddler write based on an outdated revision: client-wins, server-wins or reject")
+	flag.Bool("csp_nonce", false, "send a Content-Security-Policy header with the wiki page and a per-response nonce on its script tags")
+	flag.String("encryption_passphrase", "", "encrypt the text of tiddlers tagged $:/tags/Encrypt at rest with a key derived from this passphrase. Losing it makes them unreadable")
+	flag.String("encryption_passphrase_file", "", "a file to read the encryption_passphrase setting from (e.g. a mounted secret)")
+	flag.Bool("encrypt_all", false, "with encryption_passphrase, encrypt the text of every tiddler rather than only the tagged ones")
+	flag.String("public_routes", "", "comma separated routes reachable without credentials when readers are restricted: favicon, index (each wiki's page without its tiddlers) and readyz")
+	flag.String("allowed_origins", "", "comma separated origins (e.g. https://tools.example.com) whose pages may call the server cross-origin with the user's credentials, or * for any origin without credentials. Empty sends no CORS headers")
+	flag.String("response_headers", "", "comma separated Name=value headers to add to every response (e.g. X-Frame-Options=SAMEORIGIN). X-Content-Type-Options=nosniff is sent unless given an empty value")
+	flag.String("tls_cert_file", "", "serve HTTPS with this certificate file and tls_key_file; HTTP/2 is negotiated with clients that support it")
+	flag.String("tls_key_file", "", "the private key file for tls_cert_file")
+	flag.String("http_redirect_addr", "", "with tls_cert_file, also listen for plain HTTP on this address (e.g. :80) and redirect every request to HTTPS")
+	flag.Bool("h2c", false, "accept HTTP/2 without TLS (h2c), for running behind a proxy that speaks it to the server")
+	flag.Bool("disable_http2", false, "only serve HTTP/1.1, even over TLS")
+	flag.String("bag_rules", "", "comma separated prefix=bag rules putting tiddlers in a bag by title prefix (e.g. $:/=system); other tiddlers go in the bag given by --bag")
+	flag.String("bag", "default", "the recipe/bag name reported to TiddlyWiki (a wiki can override it with a $:/config/tiddlybucket/bag tiddler)")
 
 	viper.BindEnv("host")
 	viper.BindEnv("port")
 	viper.BindEnv("wiki_location")
 	viper.BindEnv("debug_level")
+	viper.BindEnv("wiki_location_file")
+	viper.BindEnv("credentials_file_file")
+	viper.BindEnv("bag")
+	viper.BindEnv("tls_cert_file")
+	viper.BindEnv("tls_key_file")
+	viper.BindEnv("http_redirect_addr")
+	viper.BindEnv("h2c")
+	viper.BindEnv("disable_http2")
+	viper.BindEnv("bag_rules")
+	viper.BindEnv("default_tiddler_type")
+	viper.BindEnv("response_headers")
+	viper.BindEnv("allowed_origins")
+	viper.BindEnv("public_routes")
+	viper.BindEnv("encryption_passphrase")
+	viper.BindEnv("encryption_passphrase_file")
+	viper.BindEnv("encrypt_all")
+	viper.BindEnv("max_filename_length")
+	viper.BindEnv("case_insensitive_titles")
+	viper.BindEnv("preserve_empty_fields")
+	viper.BindEnv("normalize_titles")
+	viper.BindEnv("max_revisions")
+	viper.BindEnv("s3_endpoint")
+	viper.BindEnv("s3_region")
+	viper.BindEnv("s3_force_path_style")
+	viper.BindEnv("fallback_location")
+	viper.BindEnv("index_dir")
+	viper.BindEnv("tiddlers_dir")
+	for _, op := range []string{"read", "write", "list"} {
+		viper.BindEnv("store_" + op + "_timeout")
+		viper.BindEnv("store_" + op + "_retries")
+	}
+	viper.BindEnv("max_concurrent_index_builds")
+	viper.BindEnv("store_workers")
+	viper.BindEnv("max_concurrent_per_client")
+	viper.BindEnv("anon_session_max_age")
+	viper.BindEnv("index_templates")
+	viper.BindEnv("index_exclude")
+	viper.BindEnv("sync_log_dir")
+	viper.BindEnv("webhook_url")
+	viper.BindEnv("disable_management")
+	viper.BindEnv("redact_fields")
+	viper.BindEnv("csp_nonce")
+	viper.BindEnv("conflict_strategy")
+	viper.BindEnv("sort_by")
+	viper.BindEnv("reconcile_interval")
+	viper.BindEnv("backlinks")
+	viper.BindEnv("max_skinny_list")
+	viper.BindEnv("max_wiki_tiddlers")
+	viper.BindEnv("attachment_threshold")
+	viper.BindEnv("check_store_changes")
+	viper.BindEnv("rebuild_log_interval")
+	viper.BindEnv("wiki_retry_interval")
+	viper.BindEnv("shutdown_timeout")
+	viper.BindEnv("gzip_index")
+	viper.BindEnv("stream_index")
+	viper.BindEnv("lazy_index")
+	viper.BindEnv("download_sync_config")
+	viper.BindEnv("skinny_hash")
 
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 	pflag.Parse()
 	viper.BindPFlags(pflag.CommandLine)
 
-	if pflag.NArg() > 0 {
-		viper.Set("wiki_location", pflag.Arg(0))
+	args := pflag.Args()
+	showConfig := len(args) > 0 && args[0] == "config"
+	if showConfig {
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		viper.Set("wiki_location", args[0])
+	}
+	for _, key := range fileSettings {
+		if err := readSettingFromFile(key); err != nil {
+			panic(err.Error())
+		}
+	}
+	if showConfig {
+		printConfig(os.Stdout, args)
+		return
 	}
 	if !viper.IsSet("wiki_location") {
 		panic("wiki location must be specified as an environment variable or as the last argument to this call")
@@ -56,10 +193,183 @@ func main() {
 	}
 
 	// created a TiddlerStore
-	locationSplit := strings.Split(viper.GetString("wiki_location"), "://")
+	locationSplit := strings.SplitN(viper.GetString("wiki_location"), "://", 2)
+	if len(locationSplit) != 2 {
+		log.Fatal().Str("wiki_location", viper.GetString("wiki_location")).Msgf("wiki location must be given as <type>://<path>, where type is one of %s", strings.Join(tiddlybucket.StorageTypes, ", "))
+	}
 	storageType := locationSplit[0]
 	storageLocation := locationSplit[1]
+	if err := tiddlybucket.CheckStorageType(storageType); err != nil {
+		log.Fatal().Err(err).Msg("wiki location not recognized")
+	}
+
+	bagRules, err := tiddlybucket.ParseBagRules(splitList(viper.GetString("bag_rules")))
+	if err != nil {
+		panic(fmt.Sprintf("bag_rules not recognized: %v", err))
+	}
+
+	indexTemplates, err := tiddlybucket.ParseIndexTemplates(splitList(viper.GetString("index_templates")))
+	if err != nil {
+		panic(fmt.Sprintf("index_templates not recognized: %v", err))
+	}
 
-	log.Fatal().Err(tiddlybucket.ListenAndServe(fmt.Sprintf("%s:%s", viper.GetString("host"), viper.GetString("port")), viper.GetString("credentials_file"), viper.GetString("readers"), viper.GetString("writers"), storageType, storageLocation)).
-		Msg("server shutdown with error")
+	responseHeaders, err := tiddlybucket.ParseResponseHeaders(splitList(viper.GetString("response_headers")))
+	if err != nil {
+		panic(fmt.Sprintf("response_headers not recognized: %v", err))
+	}
+
+	opts := tiddlybucket.Options{
+		Bag:                   viper.GetString("bag"),
+		BagRules:              bagRules,
+		MaxFilenameLength:     viper.GetInt("max_filename_length"),
+		CaseInsensitiveTitles: viper.GetBool("case_insensitive_titles"),
+		PreserveEmptyFields:   viper.GetBool("preserve_empty_fields"),
+		NormalizeTitles:       viper.GetBool("normalize_titles"),
+		MaxRevisions:          viper.GetInt("max_revisions"),
+		StoreLimits: tiddlybucket.StoreLimits{
+			Read:  tiddlybucket.OperationLimits{Timeout: viper.GetDuration("store_read_timeout"), Retries: viper.GetInt("store_read_retries")},
+			Write: tiddlybucket.OperationLimits{Timeout: viper.GetDuration("store_write_timeout"), Retries: viper.GetInt("store_write_retries")},
+			List:  tiddlybucket.OperationLimits{Timeout: viper.GetDuration("store_list_timeout"), Retries: viper.GetInt("store_list_retries")},
+		},
+		S3Endpoint: tiddlybucket.S3Endpoint{
+			URL:            viper.GetString("s3_endpoint"),
+			Region:         viper.GetString("s3_region"),
+			ForcePathStyle: viper.GetBool("s3_force_path_style"),
+		},
+		FallbackLocation: viper.GetString("fallback_location"),
+		StoreLayout: tiddlybucket.StoreLayout{
+			IndexDir:    viper.GetString("index_dir"),
+			TiddlersDir: viper.GetString("tiddlers_dir"),
+		},
+		MaxIndexBuilds:         viper.GetInt("max_concurrent_index_builds"),
+		StoreWorkers:           viper.GetInt("store_workers"),
+		MaxConcurrentPerClient: viper.GetInt("max_concurrent_per_client"),
+		AnonSessionMaxAge:      viper.GetDuration("anon_session_max_age"),
+		IndexTemplates:         indexTemplates,
+		IndexExclude:           splitList(viper.GetString("index_exclude")),
+		SyncLogDir:             viper.GetString("sync_log_dir"),
+		WebhookURL:             viper.GetString("webhook_url"),
+		DisableManagement:      viper.GetBool("disable_management"),
+		RedactFields:           splitList(viper.GetString("redact_fields")),
+		CSPNonce:               viper.GetBool("csp_nonce"),
+		ConflictStrategy:       viper.GetString("conflict_strategy"),
+		SortBy:                 viper.GetString("sort_by"),
+		ReconcileInterval:      viper.GetDuration("reconcile_interval"),
+		Backlinks:              viper.GetBool("backlinks"),
+		MaxSkinnyList:          viper.GetInt("max_skinny_list"),
+		MaxWikiTiddlers:        viper.GetInt("max_wiki_tiddlers"),
+		AttachmentThreshold:    viper.GetInt("attachment_threshold"),
+		CheckStoreChanges:      viper.GetBool("check_store_changes"),
+		RebuildLogInterval:     viper.GetDuration("rebuild_log_interval"),
+		WikiRetryInterval:      viper.GetDuration("wiki_retry_interval"),
+		ShutdownTimeout:        viper.GetDuration("shutdown_timeout"),
+		GzipIndex:              viper.GetBool("gzip_index"),
+		StreamIndex:            viper.GetBool("stream_index"),
+		LazyIndex:              viper.GetBool("lazy_index"),
+		DownloadSyncConfig:     viper.GetBool("download_sync_config"),
+		SkinnyHash:             viper.GetBool("skinny_hash"),
+		ResponseHeaders:        responseHeaders,
+		AllowedOrigins:         splitList(viper.GetString("allowed_origins")),
+		DefaultTiddlerType:     viper.GetString("default_tiddler_type"),
+		PublicRoutes:           splitList(viper.GetString("public_routes")),
+		EncryptionPassphrase:   viper.GetString("encryption_passphrase"),
+		EncryptAll:             viper.GetBool("encrypt_all"),
+		TLSCertFile:            viper.GetString("tls_cert_file"),
+		TLSKeyFile:             viper.GetString("tls_key_file"),
+		HTTPRedirectAddr:       viper.GetString("http_redirect_addr"),
+		H2C:                    viper.GetBool("h2c"),
+		DisableHTTP2:           viper.GetBool("disable_http2"),
+	}
+
+	if err := tiddlybucket.ListenAndServe(fmt.Sprintf("%s:%s", viper.GetString("host"), viper.GetString("port")), viper.GetString("credentials_file"), viper.GetString("readers"), viper.GetString("writers"), storageType, storageLocation, opts); err != nil {
+		log.Fatal().Err(err).Msg("server shutdown with error")
+	}
+	log.Info().Msg("server shut down")
+}
+
+// Settings that can also be read from the file named by the <setting>_file setting, for secret and configmap mounts.
+var fileSettings = []string{"wiki_location", "credentials_file", "encryption_passphrase"}
+
+// Sets key from the contents of the file named by key_file, if one is given. The file must exist and hold a non-blank value.
+func readSettingFromFile(key string) error {
+	path := viper.GetString(key + "_file")
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read %s from %s_file '%s': %v", key, key, path, err)
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		return fmt.Errorf("%s_file '%s' is empty", key, path)
+	}
+	viper.Set(key, value)
+	return nil
+}
+
+// Splits a comma separated setting, dropping blank entries.
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Prints every effective setting, where it came from and redacts anything that looks like a secret.
+// args are the positional arguments left after the config subcommand.
+func printConfig(w io.Writer, args []string) {
+	settings := viper.AllSettings()
+	keys := make([]string, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s = %s (%s)\n", k, redactSetting(k, viper.GetString(k)), settingSource(k, args))
+	}
+}
+
+func settingSource(key string, args []string) string {
+	if path := viper.GetString(key + "_file"); path != "" {
+		return "file " + path
+	}
+	if key == "wiki_location" && len(args) > 0 {
+		return "argument"
+	}
+	// A value from the environment or a config file counts even when it equals the default,
+	// unless a flag given on the command line overrides it, as viper does.
+	flagged := false
+	if f := pflag.Lookup(key); f != nil {
+		flagged = f.Changed
+	}
+	if _, ok := os.LookupEnv(strings.ToUpper(key)); ok && !flagged {
+		return "env"
+	}
+	if viper.InConfig(key) && !flagged {
+		return "file"
+	}
+	if flagged {
+		return "flag"
+	}
+	return "default"
+}
+
+func redactSetting(key, value string) string {
+	if value == "" {
+		return value
+	}
+	for _, secret := range []string{"password", "passphrase", "secret", "token", "key"} {
+		if strings.Contains(key, secret) {
+			return "********"
+		}
+	}
+	// credentials can be embedded in the storage URI
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return strings.Replace(value, u.User.String()+"@", "********@", 1)
+	}
+	return value
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func Test_settingSource_wikiLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		env    bool
+		config string
+		want   string
+	}{
+		{"argument", []string{"file:///wikis"}, false, "", "argument"},
+		{"argument over env", []string{"file:///wikis"}, true, "", "argument"},
+		{"env", nil, true, "", "env"},
+		{"config file", nil, false, "wiki_location: file:///wikis\n", "file"},
+		{"default", nil, false, "", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Reset()
+			defer viper.Reset()
+			viper.SetDefault("wiki_location", "file://.")
+			if tt.env {
+				t.Setenv("WIKI_LOCATION", "file:///from/env")
+			}
+			if tt.config != "" {
+				viper.SetConfigType("yaml")
+				if err := viper.ReadConfig(strings.NewReader(tt.config)); err != nil {
+					t.Fatalf("ReadConfig() error = %v", err)
+				}
+			}
+			// the args left once the config subcommand is taken off, as main passes them
+			if got := settingSource("wiki_location", tt.args); got != tt.want {
+				t.Errorf("settingSource(wiki_location, %v) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+}
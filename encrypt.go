@@ -0,0 +1,219 @@
+package tiddlybucket
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptTag           = "$:/tags/Encrypt"
+	encryptedTextPrefix  = "aes-256-gcm:"    //marks an encrypted text field, followed by the base64 nonce and ciphertext
+	encryptionSaltFile   = "encryption.salt" //random salt for the wiki's key, kept next to its index.html
+	encryptionSaltLength = 16
+)
+
+//Encrypts the text (or base64 binary content) of tiddlers tagged $:/tags/Encrypt, or of all tiddlers, before the wrapped store
+//writes them, and decrypts it on the way out. The other fields stay in the clear, so the index and skinny list work unchanged.
+//Each wiki's key is derived from the passphrase with scrypt and a random salt stored in the wiki.
+type encryptedStore struct {
+	TiddlerStore
+	aead       cipher.AEAD
+	encryptAll bool
+}
+
+//Wraps a wiki's store, reading its salt or creating one for a wiki that has none yet
+func newEncryptedStore(store TiddlerStore, passphrase string, encryptAll bool) (*encryptedStore, error) {
+	if passphrase == "" {
+		return nil, errors.New("an encryption passphrase is required")
+	}
+	salt, err := readEncryptionSalt(store)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive encryption key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{TiddlerStore: store, aead: aead, encryptAll: encryptAll}, nil
+}
+
+//Reads the wiki's salt, creating it when the wiki has none yet. Any other failure to read it is returned, since a salt written
+//over the existing one would make every encrypted tiddler unreadable.
+func readEncryptionSalt(store TiddlerStore) ([]byte, error) {
+	r, err := store.ReadFile(encryptionSaltFile)
+	if err != nil && !isNotFound(err) {
+		return nil, fmt.Errorf("could not read %s: %w", encryptionSaltFile, err)
+	}
+	if err == nil {
+		defer r.Close()
+		encoded, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %w", encryptionSaltFile, err)
+		}
+		salt, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || len(salt) < encryptionSaltLength {
+			return nil, fmt.Errorf("%s is not a valid salt", encryptionSaltFile)
+		}
+		return salt, nil
+	}
+	// Losing this file makes the encrypted tiddlers unreadable, so it is only ever created once
+	salt := make([]byte, encryptionSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err := store.WriteFile(encryptionSaltFile, []byte(base64.StdEncoding.EncodeToString(salt))); err != nil {
+		return nil, fmt.Errorf("could not write %s: %w", encryptionSaltFile, err)
+	}
+	log.Info().Msg("created encryption salt for wiki")
+	return salt, nil
+}
+
+//Closes the wrapped store
+func (s *encryptedStore) Close() error {
+	return closeStore(s.TiddlerStore)
+}
+
+func (s *encryptedStore) shouldEncrypt(t Tiddler) bool {
+	if s.encryptAll {
+		return true
+	}
+	tags, ok := tagsAsString(t["tags"])
+	if !ok {
+		return false
+	}
+	for _, tag := range parseTagList(tags) {
+		if tag == encryptTag {
+			return true
+		}
+	}
+	return false
+}
+
+//Seals the text with the title as additional data, so an encrypted text cannot be moved to another tiddler unnoticed
+func (s *encryptedStore) encryptText(title, text string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(text), []byte(title))
+	return encryptedTextPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *encryptedStore) decryptText(title, text string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(text, encryptedTextPrefix))
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return "", fmt.Errorf("encrypted text of %s is malformed", title)
+	}
+	nonce, ciphertext := sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(title))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt %s, the passphrase may be wrong: %w", title, err)
+	}
+	return string(plain), nil
+}
+
+//Returns a decrypted copy, leaving the store's cached tiddler as written
+func (s *encryptedStore) decrypt(t Tiddler) (Tiddler, error) {
+	text, ok := t["text"].(string)
+	if !ok || !strings.HasPrefix(text, encryptedTextPrefix) {
+		return t, nil
+	}
+	plain, err := s.decryptText(t.Field("title"), text)
+	if err != nil {
+		return nil, err
+	}
+	decrypted := make(Tiddler, len(t))
+	for k, v := range t {
+		decrypted[k] = v
+	}
+	decrypted["text"] = plain
+	return decrypted, nil
+}
+
+//Returns an encrypted copy of a tiddler that should be encrypted, or the tiddler itself
+func (s *encryptedStore) encrypt(t Tiddler) (Tiddler, error) {
+	text, ok := t["text"].(string)
+	if content, binary := t["text"].([]byte); binary {
+		//sealed as the base64 text TiddlyWiki sends, since an encrypted tiddler is kept in a .tid file
+		text, ok = base64.StdEncoding.EncodeToString(content), true
+	}
+	if !ok || !s.shouldEncrypt(t) {
+		return t, nil
+	}
+	sealed, err := s.encryptText(t.Field("title"), text)
+	if err != nil {
+		return nil, err
+	}
+	encrypted := make(Tiddler, len(t))
+	for k, v := range t {
+		encrypted[k] = v
+	}
+	encrypted["text"] = sealed
+	return encrypted, nil
+}
+
+func (s *encryptedStore) WriteTiddler(t Tiddler) error {
+	encrypted, err := s.encrypt(t)
+	if err != nil {
+		return err
+	}
+	return s.TiddlerStore.WriteTiddler(encrypted)
+}
+
+//Encrypts a tiddler kept outside the index, such as an earlier revision, as WriteTiddler would
+func (s *encryptedStore) WriteTiddlerFile(path string, t Tiddler) error {
+	encrypted, err := s.encrypt(t)
+	if err != nil {
+		return err
+	}
+	return s.TiddlerStore.WriteTiddlerFile(path, encrypted)
+}
+
+func (s *encryptedStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	t, err := s.TiddlerStore.ReadTiddlerFile(path)
+	if err != nil {
+		return t, err
+	}
+	return s.decrypt(t)
+}
+
+func (s *encryptedStore) GetTiddler(title string) (Tiddler, error) {
+	t, err := s.TiddlerStore.GetTiddler(title)
+	if err != nil {
+		return t, err
+	}
+	return s.decrypt(t)
+}
+
+//Tiddlers that cannot be decrypted are left encrypted and logged, rather than failing the whole wiki
+func (s *encryptedStore) GetAllTiddlers() ([]Tiddler, error) {
+	tids, err := s.TiddlerStore.GetAllTiddlers()
+	if err != nil {
+		return tids, err
+	}
+	decrypted := make([]Tiddler, len(tids))
+	for i, t := range tids {
+		if decrypted[i], err = s.decrypt(t); err != nil {
+			log.Error().Str("title", t.Field("title")).Err(err).Msg("could not decrypt tiddler")
+			decrypted[i] = t
+		}
+	}
+	return decrypted, nil
+}
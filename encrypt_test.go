@@ -0,0 +1,171 @@
+package tiddlybucket
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_encryptedStore_roundTrip(t *testing.T) {
+	tests := []struct {
+		name          string
+		encryptAll    bool
+		tiddler       Tiddler
+		wantEncrypted bool
+	}{
+		{"tagged", false, Tiddler{"title": "Secret", "tags": "private $:/tags/Encrypt", "text": "the code is 1234"}, true},
+		{"tagged with brackets", false, Tiddler{"title": "Secret", "tags": "[[my notes]] $:/tags/Encrypt", "text": "the code is 1234"}, true},
+		{"untagged", false, Tiddler{"title": "Public", "tags": "private", "text": "hello"}, false},
+		{"all", true, Tiddler{"title": "Public", "text": "hello"}, true},
+		{"binary", true, Tiddler{"title": "logo.png", "type": "image/png", "text": "iVBORw0KGgo="}, true},
+		{"no text", true, Tiddler{"title": "Empty"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backing := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+			s, err := newEncryptedStore(backing, "correct horse battery staple", tt.encryptAll)
+			if err != nil {
+				t.Fatalf("newEncryptedStore() error = %v", err)
+			}
+			text := tt.tiddler.Field("text")
+			if err := s.WriteTiddler(tt.tiddler); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			if tt.tiddler.Field("text") != text {
+				t.Errorf("WriteTiddler() modified the caller's tiddler")
+			}
+
+			title := tt.tiddler.Field("title")
+			stored := backing.tiddlersByTitle[title]
+			if got := strings.HasPrefix(stored.Field("text"), encryptedTextPrefix); got != tt.wantEncrypted {
+				t.Errorf("WriteTiddler() stored encrypted = %v, want %v: %v", got, tt.wantEncrypted, stored)
+			}
+			if tt.wantEncrypted && strings.Contains(stored.Field("text"), tt.tiddler.Field("text")) {
+				t.Errorf("WriteTiddler() stored the text in the clear")
+			}
+			if stored.Field("tags") != tt.tiddler.Field("tags") || stored.Field("type") != tt.tiddler.Field("type") {
+				t.Errorf("WriteTiddler() changed the metadata: %v", stored)
+			}
+
+			got, err := s.GetTiddler(title)
+			if err != nil {
+				t.Fatalf("GetTiddler() error = %v", err)
+			}
+			if got.Field("text") != tt.tiddler.Field("text") {
+				t.Errorf("GetTiddler() text = %q, want %q", got.Field("text"), tt.tiddler.Field("text"))
+			}
+			all, err := s.GetAllTiddlers()
+			if err != nil || len(all) != 1 || all[0].Field("text") != tt.tiddler.Field("text") {
+				t.Errorf("GetAllTiddlers() = %v, %v", all, err)
+			}
+			if strings.HasPrefix(stored.Field("text"), encryptedTextPrefix) != tt.wantEncrypted {
+				t.Errorf("reading decrypted the stored tiddler in place")
+			}
+		})
+	}
+}
+
+func Test_encryptedStore_keys(t *testing.T) {
+	backing := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+	s, err := newEncryptedStore(backing, "passphrase one", true)
+	if err != nil {
+		t.Fatalf("newEncryptedStore() error = %v", err)
+	}
+	salt := backing.files[encryptionSaltFile]
+	if salt == "" {
+		t.Fatalf("newEncryptedStore() did not store a salt")
+	}
+	s.WriteTiddler(Tiddler{"title": "Secret", "text": "hidden"})
+
+	tests := []struct {
+		name       string
+		passphrase string
+		title      string
+		wantText   string
+		wantErr    bool
+	}{
+		{"same passphrase after restart", "passphrase one", "Secret", "hidden", false},
+		{"wrong passphrase", "passphrase two", "Secret", "", true},
+		{"text moved to another title", "passphrase one", "Moved", "", true},
+	}
+	backing.tiddlersByTitle["Moved"] = Tiddler{"title": "Moved", "text": backing.tiddlersByTitle["Secret"]["text"]}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reopened, err := newEncryptedStore(backing, tt.passphrase, true)
+			if err != nil {
+				t.Fatalf("newEncryptedStore() error = %v", err)
+			}
+			if backing.files[encryptionSaltFile] != salt {
+				t.Errorf("newEncryptedStore() replaced the existing salt")
+			}
+			got, err := reopened.GetTiddler(tt.title)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetTiddler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.Field("text") != tt.wantText {
+				t.Errorf("GetTiddler() text = %q, want %q", got.Field("text"), tt.wantText)
+			}
+			// the wiki still loads, with the undecryptable tiddlers left encrypted
+			if all, err := reopened.GetAllTiddlers(); err != nil || len(all) != 2 {
+				t.Errorf("GetAllTiddlers() = %v, %v", all, err)
+			}
+		})
+	}
+}
+
+func Test_newEncryptedStore_invalidSalt(t *testing.T) {
+	tests := []struct {
+		name       string
+		passphrase string
+		salt       string
+	}{
+		{"no passphrase", "", ""},
+		{"salt not base64", "passphrase", "not base64!"},
+		{"salt too short", "passphrase", "c2FsdA=="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backing := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}, files: map[string]string{}}
+			if tt.salt != "" {
+				backing.files[encryptionSaltFile] = tt.salt
+			}
+			if _, err := newEncryptedStore(backing, tt.passphrase, false); err == nil {
+				t.Errorf("newEncryptedStore() accepted an unusable key")
+			}
+		})
+	}
+}
+
+func Test_newEncryptedStore_saltUnreadable(t *testing.T) {
+	backing := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}, files: map[string]string{}}
+	store := &failingTiddlerStore{TiddlerStore: backing, err: errors.New("connection reset by peer")}
+	if _, err := newEncryptedStore(store, "passphrase", true); err == nil {
+		t.Errorf("newEncryptedStore() succeeded without reading the salt")
+	}
+	if _, ok := backing.files[encryptionSaltFile]; ok {
+		t.Errorf("newEncryptedStore() wrote a new salt when the existing one could not be read")
+	}
+}
+
+func Test_handlerWithStore_keepRevision_encrypted(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.MaxRevisions = 2
+	backing := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}, files: map[string]string{}}
+	es, err := newEncryptedStore(backing, "passphrase", true)
+	if err != nil {
+		t.Fatalf("newEncryptedStore() error = %v", err)
+	}
+	// another decorator around the encrypted store still has the history encrypted
+	h := &handlerWithStore{Store: NewFallbackStore(es, NewMemoryStore())}
+	if err := h.keepRevision("Secret", Tiddler{"title": "Secret", "text": "the code is 1234", "revision": "1"}); err != nil {
+		t.Fatalf("keepRevision() error = %v", err)
+	}
+	stored, ok := backing.files[revisionPath("Secret", 1)]
+	if !ok || strings.Contains(stored, "the code is 1234") {
+		t.Errorf("keepRevision() wrote %q, want the text encrypted", stored)
+	}
+	got, err := h.readRevision("Secret", 1)
+	if err != nil || got.Field("text") != "the code is 1234" {
+		t.Errorf("readRevision() = %v, %v, want the text decrypted", got, err)
+	}
+}
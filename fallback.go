@@ -0,0 +1,79 @@
+package tiddlybucket
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/rs/zerolog/log"
+)
+
+//Reads tiddlers and files from a secondary store, such as a local replica of a bucket, when the primary fails for any reason
+//but the tiddler or file not being there. Everything else, writes included, goes to the primary only.
+type fallbackStore struct {
+	TiddlerStore
+	secondary TiddlerStore
+}
+
+//Wraps a primary store so that its failed reads are answered from the secondary
+func NewFallbackStore(primary, secondary TiddlerStore) TiddlerStore {
+	return &fallbackStore{TiddlerStore: primary, secondary: secondary}
+}
+
+func (s *fallbackStore) ReadFile(path string) (io.ReadCloser, error) {
+	r, err := s.TiddlerStore.ReadFile(path)
+	if err == nil || isNotFound(err) {
+		return r, err
+	}
+	log.Warn().Str("path", path).Err(err).Msg("primary store failed, reading file from fallback store")
+	return s.secondary.ReadFile(path)
+}
+
+func (s *fallbackStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	tid, err := s.TiddlerStore.ReadTiddlerFile(path)
+	if err == nil || isNotFound(err) {
+		return tid, err
+	}
+	log.Warn().Str("path", path).Err(err).Msg("primary store failed, reading tiddler file from fallback store")
+	return s.secondary.ReadTiddlerFile(path)
+}
+
+func (s *fallbackStore) GetTiddler(title string) (Tiddler, error) {
+	tid, err := s.TiddlerStore.GetTiddler(title)
+	if err == nil || isNotFound(err) {
+		return tid, err
+	}
+	log.Warn().Str("title", title).Err(err).Msg("primary store failed, reading tiddler from fallback store")
+	return s.secondary.GetTiddler(title)
+}
+
+func (s *fallbackStore) GetAllTiddlers() ([]Tiddler, error) {
+	tids, err := s.TiddlerStore.GetAllTiddlers()
+	if err == nil || isNotFound(err) {
+		return tids, err
+	}
+	log.Warn().Err(err).Msg("primary store failed, reading tiddlers from fallback store")
+	return s.secondary.GetAllTiddlers()
+}
+
+//Closes both stores, reporting the primary's error first
+func (s *fallbackStore) Close() error {
+	err := closeStore(s.TiddlerStore)
+	if secondaryErr := closeStore(s.secondary); err == nil {
+		err = secondaryErr
+	}
+	return err
+}
+
+//Reports whether a store error means the file or object does not exist, whichever the kind of store
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.Is(err, fs.ErrNotExist) ||
+		errors.Is(err, storage.ErrObjectNotExist) ||
+		(errors.As(err, &aerr) && aerr.Code() == s3.ErrCodeNoSuchKey) ||
+		bloberror.HasCode(err, bloberror.BlobNotFound)
+}
@@ -0,0 +1,124 @@
+package tiddlybucket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// failingTiddlerStore fails every read with err, as a bucket does during an outage
+type failingTiddlerStore struct {
+	TiddlerStore
+	err error
+}
+
+func (s *failingTiddlerStore) ReadFile(path string) (io.ReadCloser, error) { return nil, s.err }
+func (s *failingTiddlerStore) GetTiddler(title string) (Tiddler, error)    { return nil, s.err }
+func (s *failingTiddlerStore) GetAllTiddlers() ([]Tiddler, error)          { return nil, s.err }
+
+func Test_fallbackStore(t *testing.T) {
+	outage := errors.New("connection refused")
+	tests := []struct {
+		name       string
+		primaryErr error
+		wantText   string
+		wantErr    bool
+	}{
+		{"primary answers", nil, "primary", false},
+		{"primary fails", outage, "replica", false},
+		{"primary fails after retries", fmt.Errorf("could not open object 'a.tid': %w", outage), "replica", false},
+		{"not found in primary", fmt.Errorf("could not open file 'a.tid': %w", fs.ErrNotExist), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary, secondary := NewMemoryStore(), NewMemoryStore()
+			for store, text := range map[TiddlerStore]string{primary: "primary", secondary: "replica"} {
+				if err := store.WriteTiddler(Tiddler{"title": "A", "text": text}); err != nil {
+					t.Fatalf("WriteTiddler() error = %v", err)
+				}
+				if err := store.WriteFile("index.html", []byte(text)); err != nil {
+					t.Fatalf("WriteFile() error = %v", err)
+				}
+			}
+			if tt.primaryErr != nil {
+				primary = &failingTiddlerStore{TiddlerStore: primary, err: tt.primaryErr}
+			}
+			s := NewFallbackStore(primary, secondary)
+
+			tid, err := s.GetTiddler("A")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetTiddler() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && tid.Field("text") != tt.wantText {
+				t.Errorf("GetTiddler() text = %q, want %q", tid.Field("text"), tt.wantText)
+			}
+			tids, err := s.GetAllTiddlers()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetAllTiddlers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(tids) != 1 || tids[0].Field("text") != tt.wantText) {
+				t.Errorf("GetAllTiddlers() = %v, want the %s tiddler", tids, tt.wantText)
+			}
+			r, err := s.ReadFile("index.html")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				data, _ := io.ReadAll(r)
+				r.Close()
+				if string(data) != tt.wantText {
+					t.Errorf("ReadFile() = %q, want %q", data, tt.wantText)
+				}
+			}
+
+			// writes only reach the primary
+			if err := s.WriteTiddler(Tiddler{"title": "B", "text": "new"}); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			if _, err := secondary.GetTiddler("B"); err == nil {
+				t.Errorf("WriteTiddler() wrote to the secondary store")
+			}
+		})
+	}
+}
+
+func Test_fallbackStore_missingTiddler(t *testing.T) {
+	secondary := NewMemoryStore()
+	if err := secondary.WriteTiddler(Tiddler{"title": "Deleted", "text": "stale"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	// a tiddler deleted from the primary is not resurrected from a stale replica
+	s := NewFallbackStore(NewMemoryStore(), secondary)
+	if tid, err := s.GetTiddler("Deleted"); err == nil {
+		t.Errorf("GetTiddler() = %v, want the primary's not found error", tid)
+	} else if !isNotFound(err) {
+		t.Errorf("GetTiddler() error = %v, want a not found error", err)
+	}
+}
+
+func Test_isNotFound(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"file", fmt.Errorf("could not open file 'a.tid': %w", fs.ErrNotExist), true},
+		{"google bucket", fmt.Errorf("could not open object 'a.tid': %w", storage.ErrObjectNotExist), true},
+		{"s3 bucket", fmt.Errorf("could not open object 'a.tid': %w", awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil)), true},
+		{"s3 access denied", fmt.Errorf("could not open object 'a.tid': %w", awserr.New("AccessDenied", "access denied", nil)), false},
+		{"timeout", fmt.Errorf("could not open object 'a.tid': %w", errors.New("context deadline exceeded")), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isNotFound(tt.err); got != tt.want {
+				t.Errorf("isNotFound(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
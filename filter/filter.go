@@ -0,0 +1,299 @@
+// Package filter evaluates a subset of the TiddlyWiki filter syntax against tiddlers, so that a client can ask the server
+// for a narrowed list of them.
+//
+// A filter is a sequence of runs separated by whitespace. A run is either a title, written bare, quoted or as [[Title]],
+// or a bracketed list of steps such as [tag[Foo]!prefix[$:/]]. A run adds its tiddlers to the result, a run prefixed
+// with + narrows the result so far and a run prefixed with - removes its tiddlers from it. The supported steps are:
+//
+//	all[tiddlers]       every tiddler
+//	title[T]            the tiddler titled T
+//	tag[T]              tiddlers tagged T
+//	prefix[P]           tiddlers whose title starts with P
+//	suffix[S]           tiddlers whose title ends with S
+//	field:name[V]       tiddlers whose field name equals V
+//	has[name]           tiddlers with a non-empty field name
+//	is[system]          system tiddlers, whose titles start with $:/
+//	is[tiddler]         every tiddler
+//
+// Each step but all[tiddlers] can be negated with a leading !. Variables, text references, filter run prefixes other
+// than + and -, and any other operator make the expression unsupported.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned by Parse for expressions outside the supported subset
+var ErrUnsupported = errors.New("unsupported filter expression")
+
+type step struct {
+	operator string
+	suffix   string
+	negate   bool
+	operand  string
+}
+
+type run struct {
+	prefix byte // 0 for a union, '+' to narrow, '-' to remove
+	steps  []step
+}
+
+// A parsed filter expression
+type Filter struct {
+	runs []run
+}
+
+// Parses a filter expression, failing with ErrUnsupported for anything outside the supported subset
+func Parse(expr string) (*Filter, error) {
+	f := &Filter{}
+	rest := strings.TrimSpace(expr)
+	for rest != "" {
+		var r run
+		if rest[0] == '+' || rest[0] == '-' {
+			r.prefix = rest[0]
+			rest = rest[1:]
+		}
+		if rest == "" {
+			return nil, fmt.Errorf("%w: dangling run prefix in %q", ErrUnsupported, expr)
+		}
+
+		switch {
+		case strings.HasPrefix(rest, "[["):
+			end := strings.Index(rest, "]]")
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated title in %q", ErrUnsupported, expr)
+			}
+			r.steps = []step{{operator: "title", operand: rest[2:end]}}
+			rest = rest[end+2:]
+		case rest[0] == '[':
+			steps, remaining, err := parseSteps(rest[1:])
+			if err != nil {
+				return nil, fmt.Errorf("%w in %q", err, expr)
+			}
+			r.steps = steps
+			rest = remaining
+		case rest[0] == '"' || rest[0] == '\'':
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				return nil, fmt.Errorf("%w: unterminated title in %q", ErrUnsupported, expr)
+			}
+			r.steps = []step{{operator: "title", operand: rest[1 : end+1]}}
+			rest = rest[end+2:]
+		default:
+			end := strings.IndexAny(rest, " \t\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			if strings.ContainsAny(rest[:end], "[]{}<>") {
+				return nil, fmt.Errorf("%w: %q", ErrUnsupported, rest[:end])
+			}
+			r.steps = []step{{operator: "title", operand: rest[:end]}}
+			rest = rest[end:]
+		}
+
+		if rest != "" && !strings.ContainsAny(rest[:1], " \t\n") {
+			return nil, fmt.Errorf("%w: runs must be separated by whitespace in %q", ErrUnsupported, expr)
+		}
+		rest = strings.TrimLeft(rest, " \t\n")
+		f.runs = append(f.runs, r)
+	}
+	return f, nil
+}
+
+// Parses the steps of a bracketed run up to its closing bracket, returning what follows it
+func parseSteps(s string) ([]step, string, error) {
+	steps := make([]step, 0)
+	for {
+		if strings.HasPrefix(s, "]") {
+			if len(steps) == 0 {
+				return nil, "", fmt.Errorf("%w: empty run", ErrUnsupported)
+			}
+			return steps, s[1:], nil
+		}
+
+		var st step
+		if strings.HasPrefix(s, "!") {
+			st.negate = true
+			s = s[1:]
+		}
+		open := strings.IndexAny(s, "[{<]")
+		if open < 0 || s[open] != '[' {
+			return nil, "", fmt.Errorf("%w: only literal [operands] are supported", ErrUnsupported)
+		}
+		st.operator = s[:open]
+		if i := strings.IndexByte(st.operator, ':'); i >= 0 {
+			st.operator, st.suffix = st.operator[:i], st.operator[i+1:]
+		}
+		s = s[open+1:]
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return nil, "", fmt.Errorf("%w: unterminated operand", ErrUnsupported)
+		}
+		st.operand = s[:end]
+		s = s[end+1:]
+
+		if err := st.validate(); err != nil {
+			return nil, "", err
+		}
+		steps = append(steps, st)
+	}
+}
+
+func (st step) validate() error {
+	switch st.operator {
+	case "all":
+		if st.negate || st.suffix != "" || st.operand != "tiddlers" {
+			return fmt.Errorf("%w: only all[tiddlers] is supported", ErrUnsupported)
+		}
+	case "title", "tag", "prefix", "suffix", "has":
+		if st.suffix != "" {
+			return fmt.Errorf("%w: %s does not take a suffix", ErrUnsupported, st.operator)
+		}
+	case "field":
+		if st.suffix == "" {
+			return fmt.Errorf("%w: field needs the name of a field, as in field:name[value]", ErrUnsupported)
+		}
+	case "is":
+		if st.suffix != "" || (st.operand != "system" && st.operand != "tiddler") {
+			return fmt.Errorf("%w: only is[system] and is[tiddler] are supported", ErrUnsupported)
+		}
+	default:
+		return fmt.Errorf("%w: unknown operator %q", ErrUnsupported, st.operator)
+	}
+	return nil
+}
+
+func (st step) match(tid map[string]interface{}) bool {
+	title := fieldValue(tid["title"])
+	var matched bool
+	switch st.operator {
+	case "all":
+		matched = true
+	case "title":
+		matched = title == st.operand
+	case "tag":
+		for _, tag := range tagList(tid["tags"]) {
+			if tag == st.operand {
+				matched = true
+				break
+			}
+		}
+	case "prefix":
+		matched = strings.HasPrefix(title, st.operand)
+	case "suffix":
+		matched = strings.HasSuffix(title, st.operand)
+	case "field":
+		value, ok := tid[st.suffix]
+		matched = (ok && fieldValue(value) == st.operand) || (!ok && st.operand == "")
+	case "has":
+		value, ok := tid[st.operand]
+		matched = ok && fieldValue(value) != ""
+	case "is":
+		matched = st.operand == "tiddler" || strings.HasPrefix(title, "$:/")
+	}
+	return matched != st.negate
+}
+
+func (r run) match(tid map[string]interface{}) bool {
+	for _, st := range r.steps {
+		if !st.match(tid) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reports which of the tiddlers the filter selects
+func (f *Filter) selects(tids []map[string]interface{}) []bool {
+	selected := make([]bool, len(tids))
+	for _, r := range f.runs {
+		for i, tid := range tids {
+			switch r.prefix {
+			case '+':
+				selected[i] = selected[i] && r.match(tid)
+			case '-':
+				selected[i] = selected[i] && !r.match(tid)
+			default:
+				selected[i] = selected[i] || r.match(tid)
+			}
+		}
+	}
+	return selected
+}
+
+// Returns the tiddlers selected by the filter expression, in their original order. An empty or unsupported expression
+// selects every tiddler.
+func Apply[T ~map[string]interface{}](expr string, tids []T) []T {
+	f, err := Parse(expr)
+	if err != nil || len(f.runs) == 0 {
+		return tids
+	}
+	maps := make([]map[string]interface{}, len(tids))
+	for i := range tids {
+		maps[i] = tids[i]
+	}
+	selected := f.selects(maps)
+	result := make([]T, 0, len(tids))
+	for i := range tids {
+		if selected[i] {
+			result = append(result, tids[i])
+		}
+	}
+	return result
+}
+
+func fieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}, []string:
+		tags := tagList(v)
+		for i, tag := range tags {
+			if strings.ContainsAny(tag, " \t\n") {
+				tags[i] = "[[" + tag + "]]"
+			}
+		}
+		return strings.Join(tags, " ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// Reads a tags field, either a TiddlyWiki tag list or a JSON list of tags
+func tagList(value interface{}) []string {
+	tags := make([]string, 0)
+	switch v := value.(type) {
+	case []string:
+		tags = append(tags, v...)
+	case []interface{}:
+		for _, tag := range v {
+			tags = append(tags, fmt.Sprint(tag))
+		}
+	case string:
+		list := v
+		for {
+			list = strings.TrimLeft(list, " \t\n")
+			if list == "" {
+				break
+			}
+			if strings.HasPrefix(list, "[[") {
+				if end := strings.Index(list, "]]"); end >= 0 {
+					tags = append(tags, list[2:end])
+					list = list[end+2:]
+					continue
+				}
+			}
+			end := strings.IndexAny(list, " \t\n")
+			if end < 0 {
+				end = len(list)
+			}
+			tags = append(tags, list[:end])
+			list = list[end:]
+		}
+	}
+	return tags
+}
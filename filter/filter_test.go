@@ -0,0 +1,92 @@
+package filter
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type tiddler map[string]interface{}
+
+func titles(tids []tiddler) []string {
+	got := []string{}
+	for _, tid := range tids {
+		got = append(got, tid["title"].(string))
+	}
+	return got
+}
+
+func TestApply(t *testing.T) {
+	tids := []tiddler{
+		{"title": "$:/core"},
+		{"title": "$:/temp/search", "text": "x"},
+		{"title": "Apples", "tags": "Fruit [[Red Things]]", "color": "red"},
+		{"title": "Bananas", "tags": []interface{}{"Fruit"}, "color": "yellow"},
+		{"title": "Bread", "tags": "Bakery", "color": ""},
+		{"title": "Cherries", "tags": "Fruit [[Red Things]]", "color": "red", "modifier": "Ann"},
+	}
+	tests := []struct {
+		name   string
+		filter string
+		want   []string
+	}{
+		{"empty", "", []string{"$:/core", "$:/temp/search", "Apples", "Bananas", "Bread", "Cherries"}},
+		{"tag", "[tag[Fruit]]", []string{"Apples", "Bananas", "Cherries"}},
+		{"bracketed tag", "[tag[Red Things]]", []string{"Apples", "Cherries"}},
+		{"negated tag", "[!tag[Fruit]]", []string{"$:/core", "$:/temp/search", "Bread"}},
+		{"prefix", "[prefix[B]]", []string{"Bananas", "Bread"}},
+		{"suffix", "[suffix[s]]", []string{"Apples", "Bananas", "Cherries"}},
+		{"field", "[field:color[red]]", []string{"Apples", "Cherries"}},
+		{"empty field matches missing fields", "[field:color[]]", []string{"$:/core", "$:/temp/search", "Bread"}},
+		{"has", "[has[color]]", []string{"Apples", "Bananas", "Cherries"}},
+		{"steps narrow", "[tag[Fruit]field:color[red]!has[modifier]]", []string{"Apples"}},
+		{"union", "[tag[Bakery]] [[Bananas]] Cherries", []string{"Bananas", "Bread", "Cherries"}},
+		{"quoted titles", `"Apples" 'Bread'`, []string{"Apples", "Bread"}},
+		{"missing title", "[[Durian]]", []string{}},
+		{"narrowing run", "[tag[Fruit]] +[prefix[C]]", []string{"Cherries"}},
+		{"removing run", "[is[tiddler]] -[is[system]] -[[Bread]]", []string{"Apples", "Bananas", "Cherries"}},
+		{"tiddlyweb sync filter", "[all[tiddlers]] -[[$:/isEncrypted]] -[prefix[$:/temp/]] -[prefix[$:/status/]] -[[$:/boot/boot.js]] -[[$:/core]]",
+			[]string{"Apples", "Bananas", "Bread", "Cherries"}},
+		{"unsupported operator", "[tag[Fruit]sort[title]]", []string{"$:/core", "$:/temp/search", "Apples", "Bananas", "Bread", "Cherries"}},
+		{"unsupported variable", "[tag<currentTiddler>]", []string{"$:/core", "$:/temp/search", "Apples", "Bananas", "Bread", "Cherries"}},
+		{"unterminated", "[tag[Fruit]", []string{"$:/core", "$:/temp/search", "Apples", "Bananas", "Bread", "Cherries"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := titles(Apply(tt.filter, tids)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr bool
+	}{
+		{"title", "[[A Title]]", false},
+		{"steps", "[!is[system]tag[Foo]field:type[text/vnd.tiddlywiki]]", false},
+		{"prefixed runs", "[all[tiddlers]] +[has[text]] -[prefix[$:/]]", false},
+		{"text reference", "[tag{!!title}]", true},
+		{"named run prefix", "[tag[Foo]] :filter[has[text]]", true},
+		{"all shadows", "[all[shadows]]", true},
+		{"field without name", "[field[x]]", true},
+		{"suffixed prefix", "[prefix:caseinsensitive[x]]", true},
+		{"empty run", "[]", true},
+		{"unseparated runs", "[tag[Foo]][tag[Bar]]", true},
+		{"dangling prefix", "[tag[Foo]] -", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.filter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse(%q) error = %v, wantErr %v", tt.filter, err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrUnsupported) {
+				t.Errorf("Parse(%q) error = %v, want ErrUnsupported", tt.filter, err)
+			}
+		})
+	}
+}
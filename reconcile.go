@@ -0,0 +1,182 @@
+package tiddlybucket
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//The tiddler files of a store as a reconcile listed them
+type storeListing struct {
+	modTimes  map[string]time.Time //every tiddler file listed, by path
+	unindexed map[string]time.Time //files that stayed out of the index after a reload, e.g. a second file of the same title
+	muWritten sync.Mutex           //guards written, so that a write does not wait for a reconcile listing the store
+	written   map[string]bool      //titles of the tiddlers written through the server since the store was last listed
+}
+
+//Records tiddlers written through the server, whose files a reconcile then does not take for changes made outside it
+func (l *storeListing) wrote(titles ...string) {
+	l.muWritten.Lock()
+	defer l.muWritten.Unlock()
+	if l.written == nil {
+		l.written = make(map[string]bool)
+	}
+	for _, title := range titles {
+		l.written[title] = true
+	}
+}
+
+//Returns the titles written through the server since the last call, or with reset false, only reports them
+func (l *storeListing) writtenTitles(reset bool) map[string]bool {
+	l.muWritten.Lock()
+	defer l.muWritten.Unlock()
+	written := make(map[string]bool, len(l.written))
+	for title := range l.written {
+		written[title] = true
+	}
+	if reset {
+		l.written = nil
+	}
+	return written
+}
+
+//What a reconcile found changed in a store, by path
+type storeChanges struct {
+	Added   []string `json:"added"`
+	Changed []string `json:"changed"`
+	Removed []string `json:"removed"`
+}
+
+func (c storeChanges) empty() bool {
+	return len(c.Added) == 0 && len(c.Changed) == 0 && len(c.Removed) == 0
+}
+
+//Compares a fresh listing of the wiki's backing store with its index and, when tiddler files were added, removed or changed
+//since the last listing, re-reads those files and updates the caches for their tiddlers. This picks up edits made outside
+//the server, e.g. to a bucket. The files of the tiddlers written through the server are left out, as the caches already have
+//them. The first call only takes the listing to compare the next ones with, besides finding files added or removed.
+func (h *handlerWithStore) reconcile() (storeChanges, error) {
+	h.muReconcile.Lock()
+	defer h.muReconcile.Unlock()
+	//the writes up to the listing show in it, those after it in the next one
+	written := h.reconciled.writtenTitles(true)
+	listed, err := h.Store.ListModified()
+	if err != nil {
+		h.reconciled.wrote(titlesOf(written)...)
+		return storeChanges{}, err
+	}
+
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	//a tiddler written since the listing may have a file the listing missed
+	for title := range h.reconciled.writtenTitles(false) {
+		written[title] = true
+	}
+	indexed := make(map[string]string)
+	for title, path := range h.Store.TiddlerPaths() {
+		indexed[path] = title
+	}
+
+	changes := storeChanges{Added: []string{}, Changed: []string{}, Removed: []string{}}
+	for path, modified := range listed {
+		title, ok := indexed[path]
+		switch previous, seen := h.reconciled.modTimes[path]; {
+		case !ok:
+			if ignored, ok := h.reconciled.unindexed[path]; !ok || !ignored.Equal(modified) {
+				changes.Added = append(changes.Added, path)
+			}
+		case seen && !previous.Equal(modified) && !written[title]:
+			changes.Changed = append(changes.Changed, path)
+		}
+	}
+	for path, title := range indexed {
+		if _, ok := listed[path]; !ok && !written[title] {
+			changes.Removed = append(changes.Removed, path)
+		}
+	}
+	if changes.empty() {
+		h.reconciled.modTimes = listed
+		return changes, nil
+	}
+
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Changed)
+	sort.Strings(changes.Removed)
+	start := time.Now()
+	paths := append(append(append([]string{}, changes.Added...), changes.Changed...), changes.Removed...)
+	titles, err := h.Store.ReloadPaths(paths)
+	if err != nil {
+		h.reconciled.wrote(titlesOf(written)...)
+		return changes, err
+	}
+	h.reconciled.modTimes = listed
+	for _, title := range titles {
+		tid, err := h.Store.GetTiddler(title)
+		if err != nil {
+			tid = nil
+		}
+		h.updateTiddlerCaches(title, tid)
+	}
+	indexed = make(map[string]string)
+	for title, path := range h.Store.TiddlerPaths() {
+		indexed[path] = title
+	}
+	h.reconciled.unindexed = make(map[string]time.Time)
+	for path, modified := range listed {
+		if _, ok := indexed[path]; !ok {
+			h.reconciled.unindexed[path] = modified
+		}
+	}
+	log.Info().
+		Str("wiki", h.wiki).
+		Strs("added", changes.Added).
+		Strs("changed", changes.Changed).
+		Strs("removed", changes.Removed).
+		Strs("titles", titles).
+		Dur("ellapsed", time.Since(start)).
+		Msg("re-read tiddler files changed outside the server")
+	return changes, nil
+}
+
+func titlesOf(set map[string]bool) []string {
+	titles := make([]string, 0, len(set))
+	for title := range set {
+		titles = append(titles, title)
+	}
+	return titles
+}
+
+//Reconciles every wiki with its backing store right away and then every interval, until stop is closed. A store that
+//cannot list its files, such as a mirror, is left out.
+func (hr *HandlerSelector) reconcileStores(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	unlisted := make(map[*handlerWithStore]bool)
+	for {
+		hr.mu.RLock()
+		handlers := make([]*handlerWithStore, 0, len(hr.handlerMap))
+		for _, h := range hr.handlerMap {
+			handlers = append(handlers, h)
+		}
+		hr.mu.RUnlock()
+		for _, h := range handlers {
+			if unlisted[h] {
+				continue
+			}
+			if _, err := h.reconcile(); errors.Is(err, errNotImplemented) {
+				log.Info().Str("wiki", h.wiki).Msg("store cannot list its files, not reconciling it")
+				unlisted[h] = true
+			} else if err != nil {
+				log.Warn().Str("wiki", h.wiki).Err(err).Msg("could not reconcile store")
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package tiddlybucket
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_handlerWithStore_reconcile(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.WriteTiddler(Tiddler{"title": "Existing", "text": "kept"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	h := &handlerWithStore{Store: store, wiki: "notes", indexCache: &bytes.Buffer{}}
+	paths := store.TiddlerPaths()
+	existing := paths["Existing"]
+
+	changes, err := h.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	if !changes.empty() {
+		t.Fatalf("first reconcile() = %+v, want no changes", changes)
+	}
+
+	// a tiddler file uploaded straight to the bucket, by-passing the server
+	if _, err := h.skinnyTiddlers(); err != nil {
+		t.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+	h.setIndexCache([]byte("<html>cached</html>"), time.Now())
+	if err := store.WriteFile("tiddlers/External.tid", []byte("title: External\ntype: text/vnd.tiddlywiki\n\nadded outside")); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, ok := store.TiddlerPaths()["External"]; ok {
+		t.Fatalf("TiddlerPaths() indexed the external tiddler before reconciling")
+	}
+	changes, err = h.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	external := store.TiddlerPaths()["External"]
+	if want := (storeChanges{Added: []string{external}, Changed: []string{}, Removed: []string{}}); external == "" || !reflect.DeepEqual(changes, want) {
+		t.Errorf("reconcile() = %+v, want %+v", changes, want)
+	}
+	tid, err := store.GetTiddler("External")
+	if err != nil {
+		t.Fatalf("GetTiddler() error = %v after reconciling", err)
+	}
+	if tid.Field("text") != "added outside" {
+		t.Errorf("GetTiddler() text = %q", tid.Field("text"))
+	}
+	if page, _ := h.cachedIndex(""); page != "" {
+		t.Errorf("reconcile() left the cached index fresh")
+	}
+	if titles := skinnyTitles(h); !reflect.DeepEqual(titles, []string{"Existing", "External"}) {
+		t.Errorf("skinny list after reconcile() = %v, want the external tiddler added", titles)
+	}
+
+	if changes, err := h.reconcile(); err != nil || !changes.empty() {
+		t.Errorf("reconcile() = %+v, %v without anything changed, want no changes", changes, err)
+	}
+
+	// writes through the server are not changes made outside it
+	time.Sleep(time.Millisecond)
+	own := Tiddler{"title": "Existing", "text": "saved through the server"}
+	if err := store.WriteTiddler(own); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	h.tiddlerChanged("Existing", own)
+	if changes, err := h.reconcile(); err != nil || !changes.empty() {
+		t.Errorf("reconcile() = %+v, %v after a write through the server, want no changes", changes, err)
+	}
+
+	// modification times are compared, so make sure the edit gets a later one
+	time.Sleep(time.Millisecond)
+	if err := store.WriteFile("tiddlers/External.tid", []byte("title: External\ntype: text/vnd.tiddlywiki\n\nedited outside")); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := store.DeleteFile(existing); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	changes, err = h.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile() error = %v", err)
+	}
+	if want := (storeChanges{Added: []string{}, Changed: []string{external}, Removed: []string{existing}}); !reflect.DeepEqual(changes, want) {
+		t.Errorf("reconcile() = %+v, want %+v", changes, want)
+	}
+	if tid, err := store.GetTiddler("External"); err != nil || tid.Field("text") != "edited outside" {
+		t.Errorf("GetTiddler() = %v, %v, want the edited tiddler", tid, err)
+	}
+	if _, err := store.GetTiddler("Existing"); err == nil {
+		t.Errorf("GetTiddler() still finds the tiddler removed outside the server")
+	}
+	if titles := skinnyTitles(h); !reflect.DeepEqual(titles, []string{"External"}) {
+		t.Errorf("skinny list after reconcile() = %v, want the removed tiddler gone", titles)
+	}
+}
+
+func skinnyTitles(h *handlerWithStore) []string {
+	titles := []string{}
+	h.muSkinnyListCache.RLock()
+	defer h.muSkinnyListCache.RUnlock()
+	for _, tid := range h.skinnyListCache {
+		titles = append(titles, tid.Field("title"))
+	}
+	sort.Strings(titles)
+	return titles
+}
+
+// A store that cannot list its files, as a mirror
+type unlistedStore struct {
+	TiddlerStore
+	mu    sync.Mutex
+	lists int
+}
+
+func (s *unlistedStore) ListModified() (map[string]time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists++
+	return nil, errNotImplemented
+}
+
+func TestHandlerSelector_reconcileStores_unlisted(t *testing.T) {
+	store := &unlistedStore{TiddlerStore: NewMemoryStore()}
+	hr := &HandlerSelector{handlerMap: map[string]*handlerWithStore{"mirror": {Store: store, wiki: "mirror"}}}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		hr.reconcileStores(time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	<-done
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lists != 1 {
+		t.Errorf("reconcileStores() listed the store %d times, want it left out after the first", store.lists)
+	}
+}
+
+func TestHandlerSelector_reconcileStores(t *testing.T) {
+	store := NewMemoryStore()
+	hr := &HandlerSelector{handlerMap: map[string]*handlerWithStore{"notes": {Store: store, wiki: "notes"}}}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		hr.reconcileStores(time.Millisecond, stop)
+		close(done)
+	}()
+
+	if err := store.WriteFile("tiddlers/External.tid", []byte("title: External\n\nadded outside")); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := store.TiddlerPaths()["External"]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("reconcileStores() did not pick up the tiddler added outside the server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("reconcileStores() did not return once stopped")
+	}
+}
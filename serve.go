@@ -1,45 +1,223 @@
 package tiddlybucket
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"html"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/fkmiec/tiddlyverse/filter"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const (
-	bag                    = "default"
+	defaultBag             = "default"
 	AuthAnonUsername       = "GUEST" // https://github.com/Jermolene/TiddlyWiki5/blob/master/plugins/tiddlywiki/tiddlyweb/tiddlywebadaptor.js#L91
 	authTokenAuthenticated = "(authenticated)"
+	authTokenAnon          = "(anon)"
+	bagConfigTiddler       = "$:/config/tiddlybucket/bag"
+	indexExcludeTiddler    = "$:/config/tiddlybucket/index-exclude"
+	bagRulesTiddler        = "$:/config/tiddlybucket/bag-rules"
+	allowIPsTiddler        = "$:/config/tiddlybucket/allow-ips"
+	denyIPsTiddler         = "$:/config/tiddlybucket/deny-ips"
+	indexGzipFile          = "index.html.gz"
+	anonSessionCookie      = "tiddlyverse_session"
 )
 
+//How putTiddler resolves a write whose revision does not match the stored tiddler's
+const (
+	ConflictClientWins = "client-wins" //write the client's version anyway (the default)
+	ConflictServerWins = "server-wins" //keep the stored version and send it back to the client
+	ConflictReject     = "reject"      //refuse the write with 412 Precondition Failed
+)
+
+//Orders the tiddlers are sent in by the skinny list and embedded in the index page, set by Options.SortBy
+const (
+	SortByTitle    = "title"    //alphabetically by title (the default)
+	SortByModified = "modified" //most recently modified first
+	SortByCreated  = "created"  //most recently created first
+)
+
+//Puts tiddlers whose title starts with Prefix into Bag, e.g. $:/ into a system bag
+type BagRule struct {
+	Prefix, Bag string
+}
+
+//Parses bag rules written as prefix=bag
+func ParseBagRules(rules []string) ([]BagRule, error) {
+	parsed := make([]BagRule, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || strings.TrimSpace(rule[i+1:]) == "" {
+			return nil, fmt.Errorf("bag rule %q is not of the form prefix=bag", rule)
+		}
+		parsed = append(parsed, BagRule{Prefix: rule[:i], Bag: strings.TrimSpace(rule[i+1:])})
+	}
+	return parsed, nil
+}
+
+//An index template, in the wiki's folder, sent instead of index.html to the User-Agents matching the pattern
+type IndexTemplate struct {
+	UserAgent *regexp.Regexp
+	Template  string
+}
+
+//Parses index template rules written as pattern=template, where the pattern is a regular expression matched against the User-Agent
+func ParseIndexTemplates(rules []string) ([]IndexTemplate, error) {
+	parsed := make([]IndexTemplate, 0, len(rules))
+	for _, rule := range rules {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 || strings.TrimSpace(rule[i+1:]) == "" {
+			return nil, fmt.Errorf("index template rule %q is not of the form pattern=template", rule)
+		}
+		pattern, err := regexp.Compile(rule[:i])
+		if err != nil {
+			return nil, fmt.Errorf("index template rule %q: %w", rule, err)
+		}
+		parsed = append(parsed, IndexTemplate{UserAgent: pattern, Template: strings.TrimSpace(rule[i+1:])})
+	}
+	return parsed, nil
+}
+
+//Returns the index template of the first rule of Options.IndexTemplates matching the User-Agent, or "" for index.html
+func indexTemplateFor(userAgent string) string {
+	for _, rule := range serverOptions.IndexTemplates {
+		if rule.UserAgent.MatchString(userAgent) {
+			return rule.Template
+		}
+	}
+	return ""
+}
+
+//Headers sent with every response unless overridden by Options.ResponseHeaders
+var defaultResponseHeaders = map[string]string{
+	"X-Content-Type-Options": "nosniff",
+}
+
+//Title prefixes of the tiddlers that make a wiki sync with the server, left out of downloaded wikis
+var syncConfigPrefixes = []string{"$:/config/tiddlyweb/", "$:/plugins/tiddlywiki/tiddlyweb"}
+
+//Parses response headers written as Name=value. The value may itself contain "=" and may be empty, to drop a default header.
+func ParseResponseHeaders(headers []string) (map[string]string, error) {
+	parsed := make(map[string]string, len(headers))
+	for _, header := range headers {
+		i := strings.Index(header, "=")
+		if i <= 0 || strings.TrimSpace(header[:i]) == "" {
+			return nil, fmt.Errorf("response header %q is not of the form Name=value", header)
+		}
+		parsed[http.CanonicalHeaderKey(strings.TrimSpace(header[:i]))] = strings.TrimSpace(header[i+1:])
+	}
+	return parsed, nil
+}
+
+//Optional server settings. The zero value keeps the default behavior.
+type Options struct {
+	Bag                    string            //recipe/bag name reported to TiddlyWiki for wikis that do not set their own in $:/config/tiddlybucket/bag
+	BagRules               []BagRule         //bags for tiddlers by title prefix, in addition to those listed in a wiki's $:/config/tiddlybucket/bag-rules. Other tiddlers go in Bag
+	MaxFilenameLength      int               //longest tiddler filename before falling back to a hashed name. 0 keeps the default of 255
+	CaseInsensitiveTitles  bool              //treat titles differing only by case as the same tiddler
+	NormalizeTitles        bool              //trim the whitespace around the titles of tiddlers written by clients and collapse the runs within them, keeping the title sent in original-title
+	MaxRevisions           int               //keep this many earlier revisions of each tiddler in the tiddlers folder's .history, served with ?revision=N. 0 keeps no history
+	PreserveEmptyFields    bool              //keep an empty text apart from a missing one when writing and reading tiddler files, so a tiddler's fields survive a round trip
+	AnonSessionMaxAge      time.Duration     //give anonymous users a session cookie lasting this long, which limits like MaxConcurrentPerClient apply to instead of their IP address. 0 disables it
+	MaxConcurrentPerClient int               //how many requests each user (or IP address when anonymous) may have in flight. 0 is unlimited
+	StoreLimits            StoreLimits       //timeouts and retries of object store reads, writes and listings. The zero value waits indefinitely and tries once
+	S3Endpoint             S3Endpoint        //endpoint, region and addressing of an S3-compatible store other than AWS. The zero value uses AWS
+	FallbackLocation       string            //a second wiki location, such as a local replica of the bucket, that tiddler reads fall back to when the store fails. Writes only go to the store
+	StoreLayout            StoreLayout       //folders of each wiki's index template and tiddlers. The zero value keeps index.html in the wiki's folder and the tiddlers in tiddlers
+	MaxIndexBuilds         int               //how many wikis may build their index at once at startup. 0 keeps the default of 4
+	StoreWorkers           int               //how many tiddler files or objects each store reads, copies or deletes at once, e.g. when building its index. 0 keeps the default of 15
+	SkinnyHash             bool              //add a hash of each tiddler's content to the skinny tiddler list
+	GzipIndex              bool              //read the index template from index.html.gz, writing it from index.html when missing
+	StreamIndex            bool              //build each wiki's index for every request and stream it to the client, rather than keeping the page in memory
+	LazyIndex              bool              //embed only the system tiddlers in full in each wiki's index, leaving TiddlyWiki to fetch the text of the others when they are first shown
+	DownloadSyncConfig     bool              //keep the host config and TiddlyWeb plugin in downloaded wikis, which otherwise leave them out to work offline
+	RebuildLogInterval     time.Duration     //how often each wiki may log the cache rebuilds caused by writes, summarizing those in between. 0 keeps the default of a minute, a negative interval logs every rebuild
+	ShutdownTimeout        time.Duration     //how long a graceful shutdown on SIGINT or SIGTERM waits for requests in flight and the shutdown hooks. 0 keeps the default of 30s
+	ShutdownHooks          []ShutdownHook    //cleanup run in order on graceful shutdown, before the stores are closed
+	WikiRetryInterval      time.Duration     //delay before retrying a wiki whose store failed to build, doubling with each attempt. Zero keeps 10s, a negative value makes such a failure stop the server
+	ReconcileInterval      time.Duration     //how often to compare each wiki's backing store with its index and reload it when tiddler files were added, removed or changed outside the server. 0 turns it off
+	Backlinks              bool              //serve /{wiki}/backlinks/{title}, listing the tiddlers whose text links to the title, from an index kept in memory
+	CheckStoreChanges      bool              //before serving a cached index or favicon, reload the tiddlers if the store was modified since (e.g. by an external sync of the bucket or another instance)
+	MaxSkinnyList          int               //largest tiddler list sent without ?limit= or ?offset=, a longer one is refused with 413 pointing at paging. 0 sends any
+	MaxWikiTiddlers        int               //wikis with more tiddlers than this answer the tiddler list with 507 instead of reading them all, a safety valve for runaway wikis. 0 turns it off
+	AttachmentThreshold    int               //binary tiddlers of at least this many bytes are saved to the wiki's files folder and referenced with _canonical_uri. 0 keeps them inline
+	ConflictStrategy       string            //one of ConflictClientWins (the default), ConflictServerWins or ConflictReject
+	SortBy                 string            //order of the skinny list and of the tiddlers embedded in the index: SortByTitle (the default), SortByModified or SortByCreated
+	PublicRoutes           []string          //routes reachable without credentials when readers are restricted: PublicFavicon, PublicIndex or PublicReadyz
+	CSPNonce               bool              //send a Content-Security-Policy with a per-response nonce added to every script tag of the index
+	EncryptionPassphrase   string            //encrypt the text of tiddlers tagged $:/tags/Encrypt at rest with a key derived from this passphrase. Empty disables encryption
+	EncryptAll             bool              //with EncryptionPassphrase, encrypt the text of every tiddler rather than only the tagged ones
+	TLSCertFile            string            //serve HTTPS with this certificate and TLSKeyFile, negotiating HTTP/2 unless DisableHTTP2 is set
+	TLSKeyFile             string            //key of TLSCertFile
+	HTTPRedirectAddr       string            //with TLS, also listen for plain HTTP on this address and redirect every request to HTTPS
+	H2C                    bool              //speak HTTP/2 without TLS (h2c), for running behind a proxy that does
+	DisableHTTP2           bool              //only speak HTTP/1.1, even over TLS
+	ResponseHeaders        map[string]string //headers added to every response on top of defaultResponseHeaders. An empty value drops a default
+	IndexTemplates         []IndexTemplate   //templates in each wiki's folder sent instead of index.html to the matching User-Agents, e.g. a lighter shell for phones. The first match wins
+	IndexExclude           []string          //title prefixes left out of the tiddler store injected into every wiki's index, in addition to those listed in $:/config/tiddlybucket/index-exclude
+	DisableManagement      bool              //answer 404 for the landing page, the routes creating, renaming and deleting wikis and the management API, for wikis provisioned out-of-band
+	SyncLogDir             string            //folder of the <wiki>.sync.log files written while a wiki's sync logging is turned on at /{wiki}/debug/sync-log. Empty logs to the server log
+	DefaultTiddlerType     string            //type given to tiddlers read from .tid files without one. Empty keeps text/vnd.tiddlywiki; a .meta file without one takes its content's type
+	AllowedOrigins         []string          //origins (e.g. https://tools.example.com) whose pages may call the server cross-origin with the user's credentials, or * for any origin without credentials. Empty sends no CORS headers
+	WebhookURL             string            //POST the wiki, title, operation and username of each tiddler written or deleted by a client to this URL, in the background. Empty sends nothing
+	RedactFields           []string          //fields left out of the tiddlers sent to users who are not allowed to write, in getTiddler, the skinny list, search and the index. They stay stored
+}
+
 var serverHostAndPort string
 var storageType string
 var storagePath string
 var wikisPath string
 var templatesPath string
 var trashPath string
+var fallbackType string           //storage type of the fallback location, empty without one
+var fallbackPath string           //the fallback location without its storage type
+var storeLayout StoreLayout       //the folders of each wiki, passed to the stores created for them
+var serverCredentials Credentials //the readers and writers in effect, for reporting them
 var handlerSelector *HandlerSelector
+var serverOptions Options
+var maxConcurrentIndexBuilds = 4
+
+var serverReaders, serverWriters string //the readers and writers given to ListenAndServe, for wikis with credentials of their own
+
+var reScriptTag = regexp.MustCompile(`(?i)<script\b`)
 
 type Credentials struct {
 	UserPasswordsClearText map[string]string
@@ -52,53 +230,64 @@ func (c Credentials) userCanWrite(user string, isAuthenticated bool) bool {
 		return true
 	}
 
-	for _, r := range c.Writers {
-		if r == user && isAuthenticated {
+	return isAuthenticated && matchesPrincipal(c.Writers, user)
+}
+
+func (c Credentials) userCanRead(user string, isAuthenticated bool) bool {
+	if c.Readers == nil || len(c.Readers) == 0 {
+		return true
+	}
+
+	return isAuthenticated && matchesPrincipal(c.Readers, user)
+}
+
+//Reports whether an authenticated user is one of the principals, given as exact usernames, the (authenticated) token or
+//glob patterns such as *@example.com or team-*
+func matchesPrincipal(principals []string, user string) bool {
+	for _, p := range principals {
+		p = strings.TrimSpace(p)
+		if p == user || p == authTokenAuthenticated {
 			return true
 		}
+		if strings.ContainsAny(p, "*?[") {
+			if ok, err := path.Match(p, user); err != nil {
+				log.Warn().Str("pattern", p).Err(err).Msg("ignoring malformed reader/writer pattern")
+			} else if ok {
+				return true
+			}
+		}
 	}
-
 	return false
 }
 
 type HandlerSelector struct {
-	handlerMap map[string]*handlerWithStore                               //maps wiki name to handler
-	store      TiddlerStore                                               //store used to manage wikis, templates and trash folders required for multiple wikis
-	storeFunc  func(path string, requireIndex bool) (TiddlerStore, error) //storage type-specific function to create a new store
+	mu           sync.RWMutex                                                                   //guards handlerMap and degraded, which wikis recovering in the background change
+	handlerMap   map[string]*handlerWithStore                                                   //maps wiki name to handler
+	degraded     map[string]*degradedWiki                                                       //wikis whose store could not be built, retried in the background
+	store        TiddlerStore                                                                   //store used to manage wikis, templates and trash folders required for multiple wikis
+	storeFunc    func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) //storage type-specific function to create a new store
+	fallbackFunc func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) //creates the secondary store of each wiki that reads fall back to, nil without a fallback location
 }
 
 func NewHandlerSelector() (*HandlerSelector, error) {
 	var storeImpl TiddlerStore
-	var storeFunc func(path string, requireIndex bool) (TiddlerStore, error)
+	var storeFunc func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error)
 	var handlerSelector HandlerSelector
 	var err error
 
 	//Create the HandlerSelector's TiddlerStore implementation, which will be used for operations on parent wiki folder, template and trash folders
-	switch storageType {
-
-	case "file":
-		storeFunc = NewFileStore
-		storeImpl, err = storeFunc(storagePath, false)
-		if err != nil {
-			return nil, err
-		}
-	case "gs":
-		storeFunc = NewGoogleBucketStore
-		storeImpl, err = storeFunc(wikisPath, false)
-		if err != nil {
-			return nil, err
-		}
-	case "s3":
-		storeFunc = NewAwsS3Store
-		storeImpl, err = storeFunc(wikisPath, false)
-		if err != nil {
-			return nil, err
+	storeFunc, err = storeFuncFor(storageType, storagePath)
+	if err == nil {
+		//Buckets are managed from their wikis folder, local stores from the top-level folder
+		root := wikisPath
+		if storageType == "file" || storageType == "memory" {
+			root = storagePath
 		}
-	default:
-		err = fmt.Errorf("error: storage type not supported")
+		storeImpl, err = storeFunc(root, false, storeLayout)
 	}
 	if err != nil {
-		log.Panic().Str("storage_type", storageType).Err(err).Msg("could not create TiddlerStore")
+		log.Error().Str("storage_type", storageType).Err(err).Msg("could not create TiddlerStore")
+		return nil, err
 	}
 
 	handlerSelector = HandlerSelector{
@@ -106,9 +295,16 @@ func NewHandlerSelector() (*HandlerSelector, error) {
 		store:      storeImpl,
 		storeFunc:  storeFunc,
 	}
+	if fallbackType != "" {
+		if handlerSelector.fallbackFunc, err = storeFuncFor(fallbackType, fallbackPath); err != nil {
+			return nil, fmt.Errorf("fallback location: %w", err)
+		}
+	}
 
-	//Create wikis, templates and trash folders if not already present
-	handlerSelector.store.CreateRequiredFolders(storagePath)
+	//Create wikis, templates and trash folders if not already present. For buckets, this checks that the bucket is writable
+	if err := handlerSelector.store.CreateRequiredFolders(storagePath); err != nil {
+		return nil, fmt.Errorf("could not create the required folders in %s: %w", storagePath, err)
+	}
 
 	//Get list of directories in the wiki location. Each subdirectory hosts a separate wiki.
 	wikis, err := storeImpl.GetWikiList(wikisPath)
@@ -116,40 +312,179 @@ func NewHandlerSelector() (*HandlerSelector, error) {
 		return nil, err
 	}
 	//Add a handler for each wiki to handlerSelector.
-	for _, wiki := range wikis {
-		err := handlerSelector.addHandler(wiki)
-		if err != nil {
-			return nil, err
-		}
+	if err := handlerSelector.addHandlers(wikis, maxConcurrentIndexBuilds); err != nil {
+		return nil, err
 	}
 	return &handlerSelector, nil
 }
 
-//Returns the list of wikis and their descriptions. Todo: Replace 2-dimensional array with array of struct
-func (hr *HandlerSelector) getWikiList() [][]string {
+//The storage types, the schemes a wiki location can start with
+var StorageTypes = []string{"file", "gs", "s3", "azblob", "memory", "proxy"}
+
+//Checks that a storage type is one of StorageTypes, so that a mistyped wiki location is reported before any store is created
+func CheckStorageType(storeType string) error {
+	for _, t := range StorageTypes {
+		if storeType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("storage type %q not supported, expected one of %s (the scheme of the location, e.g. file:///srv/tiddlyverse or gs://my-bucket)", storeType, strings.Join(StorageTypes, ", "))
+}
+
+//Returns the function creating the stores of a storage type, the scheme of a wiki location, for the rest of the location
+func storeFuncFor(storeType string, location string) (func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error), error) {
+	switch storeType {
+	case "file":
+		return NewFileStore, nil
+	case "gs":
+		return NewGoogleBucketStore, nil
+	case "s3":
+		return NewAwsS3Store, nil
+	case "azblob":
+		return NewAzureBlobStore, nil
+	case "memory":
+		return newMemoryStoreFunc(), nil
+	case "proxy":
+		return newProxyStoreFunc(location), nil
+	}
+	return nil, CheckStorageType(storeType)
+}
+
+//Adds a handler for each of the given wikis, building at most maxBuilds indexes at once since each build holds all of a wiki's tiddlers in memory.
+func (hr *HandlerSelector) addHandlers(wikis []string, maxBuilds int) error {
+	if maxBuilds < 1 {
+		maxBuilds = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	sem := make(chan struct{}, maxBuilds)
+	for _, wiki := range wikis {
+		wg.Add(1)
+		go func(wiki string) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			default:
+				log.Info().Str("wiki", wiki).Int("max_concurrent_index_builds", maxBuilds).Msg("waiting for other index builds to finish")
+				sem <- struct{}{}
+			}
+			defer func() { <-sem }()
+
+			handler, err := hr.newHandler(wiki)
+			if err != nil && wikiRetryInterval >= 0 {
+				//One failing wiki should not keep the others from being served
+				hr.markDegraded(wiki, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			hr.setHandler(wiki, handler)
+		}(wiki)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+//A wiki as listed on the landing page and by /api/server
+type wikiInfo struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Tiddlers    int       `json:"tiddlers"`
+	Modified    time.Time `json:"modified"` //when its tiddlers last changed, zero unless asked for or if the store could not tell
+
+	IndexRebuilds      int64 `json:"index_rebuilds"` //how often the index and skinny list caches were built since startup
+	SkinnyListRebuilds int64 `json:"skinny_list_rebuilds"`
+}
+
+//Returns the wikis with their descriptions and tiddler counts, sorted by name. Finding when each was last modified lists the
+//tiddlers of every store, so it is done only with withModified set.
+func (hr *HandlerSelector) getWikiList(withModified bool) []wikiInfo {
 	var description string
-	wikis := make([][]string, len(hr.handlerMap))
-	i := 0
-	for name := range hr.handlerMap {
-		tid, err := hr.handlerMap[name].Store.GetTiddler("$:/SiteDescription")
+	hr.mu.RLock()
+	handlers := make(map[string]*handlerWithStore, len(hr.handlerMap))
+	for name, h := range hr.handlerMap {
+		handlers[name] = h
+	}
+	hr.mu.RUnlock()
+	wikis := make([]wikiInfo, 0, len(handlers))
+	for name, h := range handlers {
+		tid, err := h.Store.GetTiddler("$:/SiteDescription")
 		if err != nil {
 			description = "To include a description, add a tiddler titled $:/SiteDescription to the wiki"
 		} else {
 			description = tid.Field("text")
 		}
-		wikis[i] = make([]string, 2)
-		wikis[i][0] = name
-		wikis[i][1] = description
-		i++
+		var modified time.Time
+		if withModified {
+			if modified, err = h.Store.LastModified(); err != nil {
+				log.Warn().Str("wiki", name).Err(err).Msg("could not find when wiki was last modified")
+			}
+		}
+		wikis = append(wikis, wikiInfo{
+			Name:        name,
+			Description: description,
+			Tiddlers:    len(h.Store.TiddlerPaths()),
+			Modified:    modified,
+
+			IndexRebuilds:      h.indexRebuilds.count(),
+			SkinnyListRebuilds: h.skinnyListRebuilds.count(),
+		})
 	}
 	sort.SliceStable(wikis, func(i, j int) bool {
-		return wikis[i][0] < wikis[j][0]
+		return wikis[i].Name < wikis[j].Name
 	})
 	return wikis
 }
 
+//Keeps the wikis whose name starts with prefix and orders them by name, modified or count (of tiddlers), asc or desc. Ties stay ordered by name.
+func sortWikiList(wikis []wikiInfo, prefix, by, order string) ([]wikiInfo, error) {
+	filtered := make([]wikiInfo, 0, len(wikis))
+	for _, wiki := range wikis {
+		if strings.HasPrefix(wiki.Name, prefix) {
+			filtered = append(filtered, wiki)
+		}
+	}
+	var less func(a, b wikiInfo) bool
+	switch by {
+	case "", "name":
+		less = func(a, b wikiInfo) bool { return a.Name < b.Name }
+	case "modified":
+		less = func(a, b wikiInfo) bool { return a.Modified.Before(b.Modified) }
+	case "count":
+		less = func(a, b wikiInfo) bool { return a.Tiddlers < b.Tiddlers }
+	default:
+		return nil, fmt.Errorf("unknown sort %q, expected name, modified or count", by)
+	}
+	switch order {
+	case "", "asc":
+	case "desc":
+		asc := less
+		less = func(a, b wikiInfo) bool { return asc(b, a) }
+	default:
+		return nil, fmt.Errorf("unknown order %q, expected asc or desc", order)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if less(filtered[i], filtered[j]) == less(filtered[j], filtered[i]) {
+			return filtered[i].Name < filtered[j].Name
+		}
+		return less(filtered[i], filtered[j])
+	})
+	return filtered, nil
+}
+
 //Return handler for a given wiki name
 func (hr *HandlerSelector) getHandlerWithStore(wiki string) (*handlerWithStore, error) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
 	h, ok := hr.handlerMap[wiki]
 	if !ok {
 		return nil, errors.New("No wiki found: " + wiki)
@@ -157,19 +492,208 @@ func (hr *HandlerSelector) getHandlerWithStore(wiki string) (*handlerWithStore,
 	return h, nil
 }
 
+//Closes the server's store and the store of each wiki, releasing the object store clients. Run on shutdown.
+func (hr *HandlerSelector) closeStores(ctx context.Context) error {
+	hr.mu.RLock()
+	stores := []TiddlerStore{hr.store}
+	for _, h := range hr.handlerMap {
+		stores = append(stores, h.Store)
+	}
+	hr.mu.RUnlock()
+	var firstErr error
+	for _, store := range stores {
+		if err := closeStore(store); err != nil {
+			log.Error().Err(err).Msg("could not close store")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
 //Add a handler for a given wiki name
 func (hr *HandlerSelector) addHandler(wiki string) error {
-	wikiPath := filepath.Join(wikisPath, wiki)
-	store, err := hr.storeFunc(wikiPath, true)
+	handler, err := hr.newHandler(wiki)
 	if err != nil {
 		return err
 	}
-	handler := &handlerWithStore{Store: store}
+	hr.setHandler(wiki, handler)
+	return nil
+}
+
+func (hr *HandlerSelector) setHandler(wiki string, handler *handlerWithStore) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	hr.handlerMap[wiki] = handler
+	delete(hr.degraded, wiki)
+}
+
+//Removes the handler of a deleted or renamed wiki, stopping its recovery if it is degraded
+func (hr *HandlerSelector) removeHandler(wiki string) {
+	hr.mu.Lock()
+	defer hr.mu.Unlock()
+	delete(hr.handlerMap, wiki)
+	delete(hr.degraded, wiki)
+}
+
+//A wiki whose store failed to build. Its routes answer 503 while its store is rebuilt in the background, with the
+//delay between attempts doubling from wikiRetryInterval up to wikiRetryMaxInterval.
+type degradedWiki struct {
+	Error     string    `json:"error"`
+	Since     time.Time `json:"since"`
+	Attempts  int       `json:"attempts"`
+	NextRetry time.Time `json:"next_retry"`
+}
+
+//Delay before retrying to build a degraded wiki's store. A negative value turns recovery off, so a wiki failing at startup stops the server.
+var wikiRetryInterval = 10 * time.Second
+
+const wikiRetryMaxInterval = 10 * time.Minute
+
+//Registers the wiki as degraded and starts rebuilding its store in the background
+func (hr *HandlerSelector) markDegraded(wiki string, err error) {
+	log.Error().Str("wiki", wiki).Err(err).Dur("retry_in", wikiRetryInterval).Msg("could not build wiki, serving it as unavailable until a retry succeeds")
+	d := &degradedWiki{Error: err.Error(), Since: time.Now(), Attempts: 1, NextRetry: time.Now().Add(wikiRetryInterval)}
+	hr.mu.Lock()
+	if hr.degraded == nil {
+		hr.degraded = make(map[string]*degradedWiki)
+	}
+	hr.degraded[wiki] = d
+	hr.mu.Unlock()
+	go hr.recoverWiki(wiki, d)
+}
+
+func (hr *HandlerSelector) recoverWiki(wiki string, d *degradedWiki) {
+	interval := wikiRetryInterval
+	for {
+		time.Sleep(interval)
+		hr.mu.RLock()
+		current := hr.degraded[wiki]
+		hr.mu.RUnlock()
+		if current != d {
+			return //deleted or renamed meanwhile
+		}
+		handler, err := hr.newHandler(wiki)
+		if err == nil {
+			log.Info().Str("wiki", wiki).Int("attempts", d.Attempts+1).Msg("wiki recovered")
+			hr.setHandler(wiki, handler)
+			return
+		}
+		if interval *= 2; interval > wikiRetryMaxInterval {
+			interval = wikiRetryMaxInterval
+		}
+		log.Warn().Str("wiki", wiki).Err(err).Dur("retry_in", interval).Msg("wiki is still unavailable")
+		hr.mu.Lock()
+		d.Error, d.Attempts, d.NextRetry = err.Error(), d.Attempts+1, time.Now().Add(interval)
+		hr.mu.Unlock()
+	}
+}
+
+//Returns a copy of the state of a degraded wiki, or false if the wiki is not degraded
+func (hr *HandlerSelector) degradedState(wiki string) (degradedWiki, bool) {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	d, ok := hr.degraded[wiki]
+	if !ok {
+		return degradedWiki{}, false
+	}
+	return *d, true
+}
+
+//Answers 503 for every route of a degraded wiki but its status, telling clients when the next attempt to recover it is due
+func (hr *HandlerSelector) unavailableWhileDegraded(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if len(parts) == 2 && parts[1] == "status" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if d, ok := hr.degradedState(parts[0]); ok {
+			retryAfter := int(time.Until(d.NextRetry).Seconds()) + 1
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, fmt.Sprintf("wiki %s is unavailable: %s", parts[0], d.Error), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Answers 403 for every route of a wiki the client's address may not reach, before authentication or the route's handler runs
+func (hr *HandlerSelector) restrictClientNetworks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wiki := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+		h, err := hr.getHandlerWithStore(wiki)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !h.allowsClient(net.ParseIP(host)) {
+			log.Warn().Str("wiki", wiki).Str("ip", host).Msg("client address may not reach wiki")
+			http.Error(w, fmt.Sprintf("wiki %s is not reachable from %s", wiki, host), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Reports the server ready once its wikis are set up. Degraded wikis are listed but do not make it unready, since the
+//other wikis are served and restarting the server would not fix a wiki's store.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	handlerSelector.mu.RLock()
+	degraded := make(map[string]degradedWiki, len(handlerSelector.degraded))
+	for wiki, d := range handlerSelector.degraded {
+		degraded[wiki] = *d
+	}
+	handlerSelector.mu.RUnlock()
+	status := "ok"
+	if len(degraded) > 0 {
+		status = "degraded"
+	}
+	render.JSON(w, r, map[string]interface{}{
+		"status":         status,
+		"degraded_wikis": degraded,
+	})
+}
+
+//Creates the store and handler for a given wiki name, building its index. Fails if its host config tiddler cannot be written, since TiddlyWiki would load the wiki but be unable to sync.
+func (hr *HandlerSelector) newHandler(wiki string) (*handlerWithStore, error) {
+	wikiPath := filepath.Join(wikisPath, wiki)
+	store, err := hr.storeFunc(wikiPath, true, storeLayout)
+	if err != nil {
+		return nil, err
+	}
+	if hr.fallbackFunc != nil {
+		//A wiki missing from the fallback location is still served, only without a store to fall back to
+		if secondary, err := hr.fallbackFunc(filepath.Join(fallbackPath, "wikis", wiki), true, storeLayout); err != nil {
+			log.Warn().Str("wiki", wiki).Err(err).Msg("could not open fallback store, reads will not fall back")
+		} else {
+			store = NewFallbackStore(store, secondary)
+		}
+	}
+	if serverOptions.EncryptionPassphrase != "" {
+		if store, err = newEncryptedStore(store, serverOptions.EncryptionPassphrase, serverOptions.EncryptAll); err != nil {
+			return nil, fmt.Errorf("could not set up encryption for wiki %s: %w", wiki, err)
+		}
+	}
+	wikiCreds, err := loadWikiCredentials(store)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the credentials of wiki %s: %w", wiki, err)
+	}
+	handler := &handlerWithStore{Store: store, wiki: wiki, creds: wikiCreds}
 	//Enable custom path so TiddlyWiki doesn't request files relative to server root, but rather relative to this new wiki folder
 	//Write the system tiddler $:/config/tiddlyweb/host with the value http://<server host/port>/<wiki folder>/<new wiki name> into tiddlers folder.
-	handler.setCustomPath(wiki)
-	hr.handlerMap[wiki] = handler
-	return nil
+	if err := handler.setCustomPath(wiki); err != nil {
+		return nil, fmt.Errorf("could not write $:/config/tiddlyweb/host for wiki %s, so it would not be able to sync: %w", wiki, err)
+	}
+	return handler, nil
 }
 
 func (hr *HandlerSelector) index(w http.ResponseWriter, r *http.Request) {
@@ -183,6 +707,28 @@ func (hr *HandlerSelector) index(w http.ResponseWriter, r *http.Request) {
 	h.index(w, r)
 }
 
+func (hr *HandlerSelector) download(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.download(w, r)
+}
+
+func (hr *HandlerSelector) sitemap(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.sitemap(w, r)
+}
+
 func (hr *HandlerSelector) favicon(w http.ResponseWriter, r *http.Request) {
 	wiki := chi.URLParam(r, "wiki")
 	h, err := hr.getHandlerWithStore(wiki)
@@ -207,6 +753,14 @@ func (hr *HandlerSelector) loginBasic(w http.ResponseWriter, r *http.Request) {
 
 func (hr *HandlerSelector) status(w http.ResponseWriter, r *http.Request) {
 	wiki := chi.URLParam(r, "wiki")
+	if d, ok := hr.degradedState(wiki); ok {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, map[string]interface{}{
+			"degraded": true,
+			"wiki":     d,
+		})
+		return
+	}
 	h, err := hr.getHandlerWithStore(wiki)
 	if err != nil {
 		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
@@ -260,498 +814,2874 @@ func (hr *HandlerSelector) deleteTiddler(w http.ResponseWriter, r *http.Request)
 	h.deleteTiddler(w, r)
 }
 
-type handlerWithStore struct {
-	Store                                           TiddlerStore
-	indexCache, faviconCache                        *bytes.Buffer
-	skinnyListCache                                 []Tiddler
-	muSkinnyListCache, muIndexCache, muFaviconCache sync.RWMutex
+func (hr *HandlerSelector) importTiddlers(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.importTiddlers(w, r)
 }
 
-//Adds a custom path tiddler to the wiki so TiddlyWiki will request files relative the new wiki folder rather than server root.
-func (h *handlerWithStore) setCustomPath(wikiName string) error {
-	tid, err := h.Store.GetTiddler("$:/config/tiddlyweb/host")
+func (hr *HandlerSelector) createTiddler(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
 	if err != nil {
-		timestamp := time.Now().Format("20060102150405999")
-		tid = Tiddler{}
-		tid["created"] = timestamp
-		tid["modified"] = timestamp
-		tid["title"] = "$:/config/tiddlyweb/host"
-		tid.setField("text", "http://"+serverHostAndPort+"/"+wikiName+"/")
-	} else {
-		tid.setField("text", "http://"+serverHostAndPort+"/"+wikiName+"/")
-	}
-	if err := h.Store.WriteTiddler(tid); err != nil {
-		log.Error().Err(err).Msg("Failed to write custom path tiddler in store.")
-		return err
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
-	return nil
+	h.createTiddler(w, r)
 }
 
-func (h *handlerWithStore) setIndexCache(b []byte) {
-	h.muIndexCache.Lock()
-	defer h.muIndexCache.Unlock()
-	h.indexCache = bytes.NewBuffer(b)
+func (hr *HandlerSelector) patchTiddler(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.patchTiddler(w, r)
 }
 
-func (h *handlerWithStore) getIndexCache() string {
-	h.muIndexCache.RLock()
-	defer h.muIndexCache.RUnlock()
-	if h.indexCache == nil {
-		return ""
+func (hr *HandlerSelector) renameTag(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
-	return h.indexCache.String()
+	h.renameTag(w, r)
 }
 
-func (h *handlerWithStore) setFaviconCache(b []byte) {
-	h.muFaviconCache.Lock()
-	defer h.muFaviconCache.Unlock()
-	h.faviconCache = bytes.NewBuffer(b)
+func (hr *HandlerSelector) debugFiles(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.debugFiles(w, r)
 }
 
-func (h *handlerWithStore) getFaviconCache() []byte {
-	h.muFaviconCache.RLock()
-	defer h.muFaviconCache.RUnlock()
-	if h.faviconCache == nil {
-		return nil
+func (hr *HandlerSelector) getSyncLog(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
-	return h.faviconCache.Bytes()
+	h.getSyncLog(w, r)
 }
 
-func (h *handlerWithStore) setSkinnyListCache(t []Tiddler) {
-	h.muSkinnyListCache.Lock()
-	defer h.muSkinnyListCache.Unlock()
-	h.skinnyListCache = make([]Tiddler, 0)
-	h.skinnyListCache = append(h.skinnyListCache, t...)
+func (hr *HandlerSelector) setSyncLog(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.setSyncLog(w, r)
 }
 
-func (h *handlerWithStore) getSkinnyListCache() []Tiddler {
-	h.muSkinnyListCache.RLock()
-	defer h.muSkinnyListCache.RUnlock()
-	return h.skinnyListCache
+func (hr *HandlerSelector) compact(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	h.compact(w, r)
 }
 
-func (h *handlerWithStore) resetCaches() {
-	if h.indexCache != nil {
-		h.muIndexCache.Lock()
-		defer h.muIndexCache.Unlock()
-		h.indexCache.Reset()
+func (hr *HandlerSelector) exportTar(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
+	h.exportTar(w, r)
+}
 
-	if h.faviconCache != nil {
-		h.muFaviconCache.Lock()
-		defer h.muFaviconCache.Unlock()
-		h.faviconCache.Reset()
+func (hr *HandlerSelector) searchTiddlers(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
+	h.searchTiddlers(w, r)
+}
 
-	if h.skinnyListCache != nil {
-		h.muSkinnyListCache.Lock()
-		defer h.muSkinnyListCache.Unlock()
-		h.skinnyListCache = make([]Tiddler, 0)
+func (hr *HandlerSelector) importTar(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
+	h.importTar(w, r)
 }
 
-//Creates the landing page at server root. Todo: Externalize the HTML.
-func serverRootIndex(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	var pageBytes bytes.Buffer
-	pageBytes.WriteString("<html>")
-	pageBytes.WriteString("<head>")
-	pageBytes.WriteString("<script>")
-	pageBytes.WriteString("function renameWiki(wiki){var newName=prompt(\"Enter a new name for \" + wiki + \":\", wiki); if(newName == null) return; else window.location.href=\"renameWiki?currentName=\" + wiki + \"&newName=\" + newName;}")
-	pageBytes.WriteString("function deleteWiki(wiki){if(confirm(\"Are you sure you want to delete \" + wiki + \"?\") == true) {window.location.href=\"deleteWiki?name=\" + wiki;}}")
-	pageBytes.WriteString("</script>")
-	pageBytes.WriteString("<style>table, th, td { border: 1px solid; border-collapse: collapse; } th, td { padding: 10px; text-align: left; } tr:hover {background-color: #FAFAD2;}</style>")
-	pageBytes.WriteString("</head>")
-	pageBytes.WriteString("<body>")
-	pageBytes.WriteString("<h1>Welcome to your TiddlyWiki server</h1>")
-	pageBytes.WriteString("<p>This server hosts one or more TiddlyWiki wikis. Below is a list of the current wikis.")
-	pageBytes.WriteString("<p><table style='border:1'><tr><th>Wiki</th><th>Description</th><th>Action</th></tr>")
-	wikis := handlerSelector.getWikiList()
-	for _, wiki := range wikis {
-		pageBytes.WriteString("<tr><td><a href='" + wiki[0] + "')>" + wiki[0] + "</a></td><td>" + wiki[1] + "</td><td><a href='javascript:renameWiki(\"" + wiki[0] + "\")'>Rename</a>&nbsp;&nbsp;<a href='javascript:deleteWiki(\"" + wiki[0] + "\")'>Delete</a></td></tr>")
+func (hr *HandlerSelector) deleteTiddlers(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
+	if err != nil {
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
 	}
-	pageBytes.WriteString("</table>")
-	pageBytes.WriteString("<p><a href=\"addWiki\">Click here to create a new wiki</a>")
-	pageBytes.WriteString("</body>")
-	pageBytes.WriteString("</html>")
-
-	page := pageBytes.String()
-
-	log.Info().
-		Int("len", len(page)).
-		Dur("ellapsed", time.Since(start)).
-		Float64("ellapsed_min", time.Since(start).Minutes()).
-		Msg("sending Server Root index")
-
-	render.HTML(w, r, page)
+	h.deleteTiddlers(w, r)
 }
 
-//Creates the add new wiki page. Todo: Externalize the HTML.
-func addWiki(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	var pageBytes bytes.Buffer
-	pageBytes.WriteString("<html>")
-	pageBytes.WriteString("<head>")
-	pageBytes.WriteString("<script>")
-	pageBytes.WriteString("function createNewWiki(template) {\nvar name = document.getElementById('wikiname').value;\nwindow.location.href='createNewWiki?name=' + name + '&template=' + template;\n}")
-	pageBytes.WriteString("</script>")
-	pageBytes.WriteString("<style>table, th, td { border: 1px solid; border-collapse: collapse; } th, td { padding: 10px; text-align: left; } tr:hover {background-color: #FAFAD2;}</style>")
-	pageBytes.WriteString("</head>")
-	pageBytes.WriteString("<body>")
-	pageBytes.WriteString("<h1>Create New TiddlyWiki</h1>")
-	pageBytes.WriteString("<p>Confirm or update the name of the new wiki and then click the chosen template for the wiki. Clicking the template link will initiate creation and redirect you to your new wiki.")
-	pageBytes.WriteString("<p><span><b>Wiki Name: </b></span><input type='text' id='wikiname' value='MyNewWiki'/>")
-	pageBytes.WriteString("<p><table style='border:1'><tr><th>Template</th><th>Description</th></tr>")
-	templates, err := handlerSelector.store.GetWikiTemplateList(templatesPath)
+func (hr *HandlerSelector) getFile(w http.ResponseWriter, r *http.Request) {
+	wiki := chi.URLParam(r, "wiki")
+	h, err := hr.getHandlerWithStore(wiki)
 	if err != nil {
-		log.Warn().Err(err).Msg("Error processing templates for the addWiki page.")
+		log.Warn().Err(err).Msg("Wiki not found: " + wiki)
 		http.Redirect(w, r, "/", http.StatusInternalServerError)
 		return
 	}
-	for _, template := range templates {
-		pageBytes.WriteString("<tr><td><a href='javascript:createNewWiki(\"" + template[1] + "\")'>" + template[0] + "</a></td><td>" + template[2] + "</td></tr>")
-	}
-	pageBytes.WriteString("</table>")
-	pageBytes.WriteString("<p><p>New template wikis can be added to the templates folder on the server.")
-	pageBytes.WriteString("<p>Each template is a TiddlyWiki .html file with a unique name (ie. not index.html), together with a .txt file with the same name and a short description.")
-	pageBytes.WriteString("<p><p><a href=\"/\">Home</a>")
-	pageBytes.WriteString("</body>")
-	pageBytes.WriteString("</html>")
-
-	page := pageBytes.String()
+	h.getFile(w, r)
+}
 
-	log.Info().
-		Int("len", len(page)).
-		Dur("ellapsed", time.Since(start)).
-		Float64("ellapsed_min", time.Since(start).Minutes()).
-		Msg("sending addWiki")
+type handlerWithStore struct {
+	Store                                           TiddlerStore
+	wiki                                            string //name of the wiki, for logging
+	indexCache, faviconCache                        *bytes.Buffer
+	indexBuiltAt                                    time.Time               //when the tiddlers in indexCache were read, guarded by muIndexCache
+	faviconCachedAt                                 time.Time               //when the icon in faviconCache was read, guarded by muFaviconCache
+	indexChangedAt                                  time.Time               //when a tiddler was last written through the server, the cached pages built before are stale, guarded by muIndexCache
+	skinnyListChangedAt                             time.Time               //when a tiddler was last written through the server, guarded by muSkinnyListCache
+	variantCaches                                   map[string]indexVariant //pages built from the templates of Options.IndexTemplates, by template, guarded by muIndexCache
+	skinnyListCache                                 []Tiddler
+	muSkinnyListCache, muIndexCache, muFaviconCache sync.RWMutex
+	muWrite                                         sync.Mutex //serializes the writes of single tiddlers, from reading the tiddler replaced, or picking a free title, to updating the caches
+	syncLog                                         *syncLog   //the wiki's sync requests are logged while set, guarded by muSyncLog
+	muSyncLog                                       sync.Mutex
+	reconciled                                      storeListing //the store's listing as last reconciled, guarded by muReconcile
+	muReconcile                                     sync.Mutex
+	creds                                           *wikiCredentials //the wiki's own credentials, nil to use the server's
+	backlinks                                       *backlinkIndex   //built on the first request of /{wiki}/backlinks/, guarded by muBacklinks
+	muBacklinks                                     sync.Mutex
+	indexRebuilds, skinnyListRebuilds               cacheRebuilds
+}
 
-	render.HTML(w, r, page)
+//Counts how often a cache was built, since every write resets the caches and the next read rebuilds them from all tiddlers
+type cacheRebuilds struct {
+	mu           sync.Mutex
+	total        int64
+	unlogged     int64         //builds since the last log line
+	unloggedTook time.Duration //time spent on them
+	lastLoggedAt time.Time
 }
 
-//Create a new wiki with provided name and template params
-func createNewWiki(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+//How often each wiki may log its cache rebuilds. Zero or less logs every rebuild.
+var rebuildLogInterval = time.Minute
 
-	var err error
-	wikiName := r.URL.Query().Get("name")
-	templateFilename := r.URL.Query().Get("template")
-	wikiPath := filepath.Join(wikisPath, wikiName)
-	templateFilePath := filepath.Join(templatesPath, templateFilename)
-	err = handlerSelector.store.CreateWikiFolder(wikiPath, templateFilePath)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to create new wiki. Failed to create new wiki folder.")
-		http.Error(w, fmt.Sprintf("Unable to create new wiki. Failed to create new wiki folder: %s", err.Error()), http.StatusInternalServerError)
-		return
-	}
-	err = handlerSelector.addHandler(wikiName)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to create new wiki. Failed to create new store.")
-		http.Error(w, fmt.Sprintf("Unable to create new wiki. Failed to create new store: %s", err.Error()), http.StatusInternalServerError)
+//Counts a cache build and logs it, summarizing the builds since the last line when rebuildLogInterval has passed
+func (c *cacheRebuilds) record(wiki, cache string, tiddlers int, took time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total++
+	c.unlogged++
+	c.unloggedTook += took
+	if time.Since(c.lastLoggedAt) < rebuildLogInterval {
 		return
 	}
 	log.Info().
-		Dur("ellapsed", time.Since(start)).
-		Float64("ellapsed_min", time.Since(start).Minutes()).
-		Msg("sending createNewWiki")
+		Str("wiki", wiki).
+		Str("cache", cache).
+		Int("num_tiddlers", tiddlers).
+		Dur("ellapsed", took).
+		Int64("rebuilds", c.unlogged).
+		Dur("rebuilds_ellapsed", c.unloggedTook).
+		Int64("total_rebuilds", c.total).
+		Msg("rebuilt cache")
+	c.unlogged, c.unloggedTook, c.lastLoggedAt = 0, 0, time.Now()
+}
 
-	http.Redirect(w, r, "/"+wikiName, http.StatusFound)
+func (c *cacheRebuilds) count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
 }
 
-func deleteWiki(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	var err error
-	wikiName := r.URL.Query().Get("name")
-	wikiPath := filepath.Join(wikisPath, wikiName)
-	err = handlerSelector.store.CopyFolder(wikiPath, filepath.Join(trashPath, wikiName))
+//Adds a custom path tiddler to the wiki so TiddlyWiki will request files relative the new wiki folder rather than server root.
+func (h *handlerWithStore) setCustomPath(wikiName string) error {
+	tid, err := h.Store.GetTiddler("$:/config/tiddlyweb/host")
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to delete wiki. Failed to copy to trash.")
-		http.Error(w, fmt.Sprintf("Unable to delete wiki. Failed to copy to trash: %s", err.Error()), http.StatusInternalServerError)
-		return
+		timestamp := formatTiddlerTime(time.Now())
+		tid = Tiddler{}
+		tid["created"] = timestamp
+		tid["modified"] = timestamp
+		tid["title"] = "$:/config/tiddlyweb/host"
+		tid.setField("text", "http://"+serverHostAndPort+"/"+wikiName+"/")
+	} else {
+		tid.setField("text", "http://"+serverHostAndPort+"/"+wikiName+"/")
 	}
-	err = handlerSelector.store.DeleteFolder(wikiPath)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to delete wiki. Failed to delete wiki folder.")
-		http.Error(w, fmt.Sprintf("Unable to delete wiki. Failed to delete wiki folder: %s", err.Error()), http.StatusInternalServerError)
-		return
+	if err := h.Store.WriteTiddler(tid); errors.Is(err, ErrReadOnlyStore) {
+		log.Info().Str("wiki", wikiName).Msg("wiki is read-only, leaving its custom path tiddler as the store has it")
+	} else if err != nil {
+		log.Error().Err(err).Msg("Failed to write custom path tiddler in store.")
+		return err
 	}
-	delete(handlerSelector.handlerMap, wikiName)
-	log.Info().
-		Dur("ellapsed", time.Since(start)).
-		Float64("ellapsed_min", time.Since(start).Minutes()).
-		Msg("sending deleteWiki")
-
-	http.Redirect(w, r, "/", http.StatusFound)
+	return nil
 }
 
-func renameWiki(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	var err error
-	oldWikiName := r.URL.Query().Get("currentName")
-	newWikiName := r.URL.Query().Get("newName")
-	oldWikiPath := filepath.Join(wikisPath, oldWikiName)
-	newWikiPath := filepath.Join(wikisPath, newWikiName)
-
-	err = handlerSelector.store.CopyFolder(oldWikiPath, newWikiPath)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to rename wiki. Failed to rename folder.")
-		http.Error(w, fmt.Sprintf("Unable to rename wiki. Failed to rename folder: %s", err.Error()), http.StatusInternalServerError)
-		return
+//Returns the recipe/bag name reported to TiddlyWiki. A $:/config/tiddlybucket/bag tiddler in the wiki overrides the server-wide setting.
+func (h *handlerWithStore) bag() string {
+	if h.Store != nil {
+		if tid, err := h.Store.GetTiddler(bagConfigTiddler); err == nil {
+			if name := strings.TrimSpace(tid.Field("text")); name != "" {
+				return name
+			}
+		}
 	}
-	err = handlerSelector.store.DeleteFolder(oldWikiPath)
-	if err != nil {
-		log.Error().Err(err).Msg("Unable to rename wiki. Failed to delete original folder.")
-		http.Error(w, fmt.Sprintf("Unable to rename wiki. Failed to delete original folder: %s", err.Error()), http.StatusInternalServerError)
-		return
+	if serverOptions.Bag != "" {
+		return serverOptions.Bag
 	}
-	delete(handlerSelector.handlerMap, oldWikiName)
+	return defaultBag
+}
 
-	err = handlerSelector.addHandler(newWikiName)
-	if err != nil {
-		log.Error().Err(err).Msg("could not create store for renamed wiki")
-		http.Error(w, fmt.Sprintf("could not create store for renamed wiki: %s", err.Error()), http.StatusInternalServerError)
-		return
+//Returns the wiki's bag rules from its $:/config/tiddlybucket/bag-rules tiddler (one prefix=bag per line) followed by the server-wide rules
+func (h *handlerWithStore) bagRules() []BagRule {
+	rules := make([]BagRule, 0)
+	if h.Store != nil {
+		if tid, err := h.Store.GetTiddler(bagRulesTiddler); err == nil {
+			for _, line := range strings.Split(tid.Field("text"), "\n") {
+				if line = strings.TrimSpace(line); line == "" {
+					continue
+				}
+				parsed, err := ParseBagRules([]string{line})
+				if err != nil {
+					log.Warn().Err(err).Msg("ignoring bag rule in " + bagRulesTiddler)
+					continue
+				}
+				rules = append(rules, parsed...)
+			}
+		}
 	}
+	return append(rules, serverOptions.BagRules...)
+}
 
-	log.Info().
-		Dur("ellapsed", time.Since(start)).
-		Float64("ellapsed_min", time.Since(start).Minutes()).
-		Msg("sending renameWiki")
+//Returns the bag of the longest rule prefix matching the title, or else the given default bag
+func bagForTitle(title string, rules []BagRule, defaultBag string) string {
+	bag, longest := defaultBag, -1
+	for _, rule := range rules {
+		if strings.HasPrefix(title, rule.Prefix) && len(rule.Prefix) > longest {
+			bag, longest = rule.Bag, len(rule.Prefix)
+		}
+	}
+	return bag
+}
 
-	http.Redirect(w, r, "/", http.StatusFound)
+//Returns the bag reported for a tiddler
+func (h *handlerWithStore) bagFor(title string) string {
+	return bagForTitle(title, h.bagRules(), h.bag())
 }
 
-//Todo: Should errors here be fatal? In a multi-wiki situation where one wiki may be having an issue? Possibly change to return http.Error
-func (h *handlerWithStore) index(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
-	page := h.getIndexCache()
-	log.Trace().Int("len", len(page)).Str("page", page).Msg("retrieved index.html from cache")
-	if len(page) <= 0 {
-		var pageBytes bytes.Buffer
-		log.Trace().Msg("creating index cache")
+//Returns the title prefixes to leave out of the index, e.g. plugins already baked into the template. Read from the wiki's $:/config/tiddlybucket/index-exclude tiddler (one prefix per line) plus the server-wide setting.
+func (h *handlerWithStore) indexExcludePrefixes() []string {
+	prefixes := append([]string{}, serverOptions.IndexExclude...)
+	if h.Store != nil {
+		if tid, err := h.Store.GetTiddler(indexExcludeTiddler); err == nil {
+			for _, line := range strings.Split(tid.Field("text"), "\n") {
+				if prefix := strings.TrimSpace(line); prefix != "" {
+					prefixes = append(prefixes, prefix)
+				}
+			}
+		}
+	}
+	return prefixes
+}
+
+//Returns the networks listed one per line in a config tiddler of the wiki, as CIDR ranges (10.0.0.0/8) or single addresses.
+//Other lines are logged and skipped.
+func (h *handlerWithStore) configNetworks(title string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	if h.Store == nil {
+		return networks
+	}
+	tid, err := h.Store.GetTiddler(title)
+	if err != nil {
+		return networks
+	}
+	for _, line := range strings.Split(tid.Field("text"), "\n") {
+		entry := strings.TrimSpace(line)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Warn().Str("wiki", h.wiki).Str("tiddler", title).Str("entry", line).Msg("skipping entry that is not a network")
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+//Reports whether a client address may reach the wiki: it is in none of the networks of the wiki's $:/config/tiddlybucket/deny-ips
+//tiddler and, if its $:/config/tiddlybucket/allow-ips tiddler lists any networks, in one of those. An address that cannot be parsed
+//is only allowed when neither tiddler lists a network.
+func (h *handlerWithStore) allowsClient(ip net.IP) bool {
+	denied, allowed := h.configNetworks(denyIPsTiddler), h.configNetworks(allowIPsTiddler)
+	if ip == nil {
+		return len(denied) == 0 && len(allowed) == 0
+	}
+	for _, network := range denied {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Drops the tiddlers whose title starts with one of the given prefixes
+func excludeTiddlers(tids []Tiddler, prefixes []string) []Tiddler {
+	if len(prefixes) == 0 {
+		return tids
+	}
+	included := make([]Tiddler, 0, len(tids))
+	for _, tid := range tids {
+		title := tid.Field("title")
+		excluded := false
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(title, prefix) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			included = append(included, tid)
+		}
+	}
+	return included
+}
+
+//Leaves the text out of every tiddler but the system ones the page needs to boot, marking them _is_skinny so that
+//TiddlyWiki lazily loads their text through getTiddler when it is first displayed. The stored tiddlers are not modified.
+func skinnyIndexTiddlers(tids []Tiddler) []Tiddler {
+	skinny := make([]Tiddler, len(tids))
+	for i, tid := range tids {
+		if _, hasText := tid["text"]; !hasText || strings.HasPrefix(tid.Field("title"), "$:/") {
+			skinny[i] = tid
+			continue
+		}
+		skinny[i] = make(Tiddler, len(tid))
+		for k, v := range tid {
+			if k != "text" {
+				skinny[i][k] = v
+			}
+		}
+		skinny[i]["_is_skinny"] = ""
+	}
+	return skinny
+}
+
+//Reads the wiki's index.html. With GzipIndex, a gzipped copy in index.html.gz is read instead when it is current, and otherwise
+//written from index.html, so cold cache loads transfer fewer bytes from the bucket. A template chosen by User-Agent is read as it is.
+func (h *handlerWithStore) readIndexTemplate(name string) ([]byte, error) {
+	if name != "" {
+		r, err := h.Store.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	if serverOptions.GzipIndex && h.gzipIndexCurrent() {
+		if gzReader, err := h.Store.ReadFile(indexGzipFile); err == nil {
+			defer gzReader.Close()
+			zr, err := gzip.NewReader(gzReader)
+			if err != nil {
+				return nil, fmt.Errorf("could not read %s: %w", indexGzipFile, err)
+			}
+			defer zr.Close()
+			return io.ReadAll(zr)
+		}
+	}
+
+	indexReader, err := h.Store.ReadFile("index.html")
+	if err != nil {
+		return nil, err
+	}
+	defer indexReader.Close()
+	template, err := io.ReadAll(indexReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverOptions.GzipIndex {
+		var compressed bytes.Buffer
+		zw := gzip.NewWriter(&compressed)
+		if _, err := zw.Write(template); err == nil && zw.Close() == nil {
+			if err := h.Store.WriteFile(indexGzipFile, compressed.Bytes()); err != nil {
+				log.Warn().Err(err).Msg("could not write the gzipped index, will keep reading index.html")
+			} else {
+				log.Info().Int("len", len(template)).Int("gzipped_len", compressed.Len()).Msg("wrote gzipped index")
+			}
+		}
+	}
+	return template, nil
+}
+
+//Reports whether index.html.gz holds the wiki's current index.html: it was written no earlier than index.html last changed,
+//or index.html is gone
+func (h *handlerWithStore) gzipIndexCurrent() bool {
+	gzModified, err := h.Store.FileModified(indexGzipFile)
+	if err != nil {
+		return false
+	}
+	modified, err := h.Store.FileModified("index.html")
+	if isNotFound(err) {
+		return true
+	}
+	if err != nil {
+		log.Warn().Str("wiki", h.wiki).Err(err).Msg("could not find when index.html was last modified, reading it rather than index.html.gz")
+		return false
+	}
+	return !gzModified.Before(modified)
+}
+
+//Opens the wiki's index template for streaming, from index.html.gz when GzipIndex is set and it is current, otherwise from index.html.
+//Unlike readIndexTemplate, a missing or outdated index.html.gz is not written.
+func (h *handlerWithStore) openIndexTemplate(name string) (io.ReadCloser, error) {
+	if name != "" {
+		return h.Store.ReadFile(name)
+	}
+	if serverOptions.GzipIndex && h.gzipIndexCurrent() {
+		if gzReader, err := h.Store.ReadFile(indexGzipFile); err == nil {
+			zr, err := gzip.NewReader(gzReader)
+			if err != nil {
+				gzReader.Close()
+				return nil, fmt.Errorf("could not read %s: %w", indexGzipFile, err)
+			}
+			return gzipReadCloser{zr, gzReader}, nil
+		}
+	}
+	return h.Store.ReadFile("index.html")
+}
+
+//Closes both the gzip reader and the file it reads
+type gzipReadCloser struct {
+	*gzip.Reader
+	file io.ReadCloser
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+func (h *handlerWithStore) setIndexCache(b []byte, builtAt time.Time) {
+	h.muIndexCache.Lock()
+	defer h.muIndexCache.Unlock()
+	h.indexCache = bytes.NewBuffer(b)
+	h.indexBuiltAt = builtAt
+}
+
+//A page built from an index template chosen by User-Agent, cached apart from the default index
+type indexVariant struct {
+	page    []byte
+	builtAt time.Time
+}
+
+//Suffix of the cache key of the index pages without the redacted fields (see Options.RedactFields)
+const redactedIndexVariant = "?redacted"
+
+//Returns the cached page built from template and when its tiddlers were read. An empty template is the default index.html.
+//A page built from tiddlers read before a tiddler was written through the server is stale and not returned.
+func (h *handlerWithStore) cachedIndex(template string) (string, time.Time) {
+	if template == "" {
+		page := h.getIndexCache()
+		h.muIndexCache.RLock()
+		defer h.muIndexCache.RUnlock()
+		if h.indexBuiltAt.Before(h.indexChangedAt) {
+			return "", time.Time{}
+		}
+		return page, h.indexBuiltAt
+	}
+	h.muIndexCache.RLock()
+	defer h.muIndexCache.RUnlock()
+	variant := h.variantCaches[template]
+	if variant.builtAt.Before(h.indexChangedAt) {
+		return "", time.Time{}
+	}
+	return string(variant.page), variant.builtAt
+}
+
+//Caches the page built from template. An empty template is the default index.html.
+func (h *handlerWithStore) cacheIndex(template string, page []byte, builtAt time.Time) {
+	if template == "" {
+		h.setIndexCache(page, builtAt)
+		return
+	}
+	h.muIndexCache.Lock()
+	defer h.muIndexCache.Unlock()
+	if h.variantCaches == nil {
+		h.variantCaches = make(map[string]indexVariant)
+	}
+	h.variantCaches[template] = indexVariant{page: page, builtAt: builtAt}
+}
+
+//Reports whether the tiddlers were changed in the backing store after a cache was filled at builtAt, e.g. by another program or
+//another instance of the server writing to the bucket
+func (h *handlerWithStore) storeChangedSince(builtAt time.Time) bool {
+	lastModified, err := h.Store.LastModified()
+	if err != nil {
+		log.Warn().Err(err).Msg("could not check when the store was last modified")
+		return false
+	}
+	return lastModified.After(builtAt)
+}
+
+func (h *handlerWithStore) getIndexCache() string {
+	h.muIndexCache.RLock()
+	defer h.muIndexCache.RUnlock()
+	if h.indexCache == nil {
+		return ""
+	}
+	return h.indexCache.String()
+}
+
+func (h *handlerWithStore) setFaviconCache(b []byte, cachedAt time.Time) {
+	h.muFaviconCache.Lock()
+	defer h.muFaviconCache.Unlock()
+	h.faviconCache = bytes.NewBuffer(b)
+	h.faviconCachedAt = cachedAt
+}
+
+func (h *handlerWithStore) getFaviconCache() ([]byte, time.Time) {
+	h.muFaviconCache.RLock()
+	defer h.muFaviconCache.RUnlock()
+	if h.faviconCache == nil {
+		return nil, time.Time{}
+	}
+	return h.faviconCache.Bytes(), h.faviconCachedAt
+}
+
+//Caches the skinny list built from the tiddlers read at builtAt, unless a tiddler was written through the server since
+func (h *handlerWithStore) setSkinnyListCache(t []Tiddler, builtAt time.Time) {
+	h.muSkinnyListCache.Lock()
+	defer h.muSkinnyListCache.Unlock()
+	if builtAt.Before(h.skinnyListChangedAt) {
+		return
+	}
+	h.skinnyListCache = make([]Tiddler, 0)
+	h.skinnyListCache = append(h.skinnyListCache, t...)
+}
+
+func (h *handlerWithStore) getSkinnyListCache() []Tiddler {
+	h.muSkinnyListCache.RLock()
+	defer h.muSkinnyListCache.RUnlock()
+	return h.skinnyListCache
+}
+
+func (h *handlerWithStore) resetCaches() {
+	h.markIndexStale()
+	h.resetBacklinks()
+	if h.indexCache != nil || h.variantCaches != nil {
+		h.muIndexCache.Lock()
+		defer h.muIndexCache.Unlock()
+		if h.indexCache != nil {
+			h.indexCache.Reset()
+		}
+		h.variantCaches = nil
+	}
+
+	if h.faviconCache != nil {
+		h.muFaviconCache.Lock()
+		defer h.muFaviconCache.Unlock()
+		h.faviconCache.Reset()
+	}
+
+	h.muSkinnyListCache.Lock()
+	defer h.muSkinnyListCache.Unlock()
+	h.skinnyListChangedAt = time.Now()
+	if h.skinnyListCache != nil {
+		h.skinnyListCache = make([]Tiddler, 0)
+	}
+}
+
+//Marks the cached index pages stale, so that they are rebuilt on their next request. Pages whose build was under way are stale too.
+func (h *handlerWithStore) markIndexStale() {
+	h.muIndexCache.Lock()
+	defer h.muIndexCache.Unlock()
+	h.indexChangedAt = time.Now()
+}
+
+//Updates the caches after a single tiddler was written through the server, or deleted when tid is nil, and records the write
+//so that reconcile does not take the tiddler's file for one changed outside the server
+func (h *handlerWithStore) tiddlerChanged(title string, tid Tiddler) {
+	h.reconciled.wrote(title)
+	h.updateTiddlerCaches(title, tid)
+}
+
+//Updates the caches after a single tiddler changed, or was deleted when tid is nil, rather than resetting them all, so that
+//a save does not make the next request read every tiddler of the wiki again. The tiddler's entry in the skinny list and its
+//links in the backlink index are replaced or removed, the index pages are marked stale and the favicon is dropped if it changed.
+func (h *handlerWithStore) updateTiddlerCaches(title string, tid Tiddler) {
+	var skinny Tiddler
+	if tid != nil {
+		skinny, _ = skinnyTiddler(tid)
+	}
+
+	h.markIndexStale()
+	h.updateBacklinks(title, tid)
+	if title == "$:/favicon.ico" {
+		h.muFaviconCache.Lock()
+		if h.faviconCache != nil {
+			h.faviconCache.Reset()
+		}
+		h.muFaviconCache.Unlock()
+	}
+
+	h.muSkinnyListCache.Lock()
+	defer h.muSkinnyListCache.Unlock()
+	h.skinnyListChangedAt = time.Now()
+	if len(h.skinnyListCache) == 0 {
+		return //built on the next request
+	}
+	//a copy, as requests may still be reading the cached list
+	updated := make([]Tiddler, 0, len(h.skinnyListCache)+1)
+	for _, t := range h.skinnyListCache {
+		if !sameTitle(t.Field("title"), title) {
+			updated = append(updated, t)
+		}
+	}
+	if skinny != nil {
+		updated = append(updated, skinny)
+	}
+	h.skinnyListCache = sortTiddlers(updated, serverOptions.SortBy)
+}
+
+//Reports whether two titles name the same tiddler, ignoring case with caseInsensitiveTitles set
+func sameTitle(a, b string) bool {
+	return a == b || (caseInsensitiveTitles && strings.EqualFold(a, b))
+}
+
+//Creates the landing page at server root. ?prefix= filters the wikis by name, ?sort=name|modified|count and ?order=asc|desc order them. Todo: Externalize the HTML.
+func serverRootIndex(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	query := r.URL.Query()
+	wikis, err := sortWikiList(handlerSelector.getWikiList(query.Get("sort") == "modified"), query.Get("prefix"), query.Get("sort"), query.Get("order"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var pageBytes bytes.Buffer
+	pageBytes.WriteString("<html>")
+	pageBytes.WriteString("<head>")
+	pageBytes.WriteString("<script>")
+	pageBytes.WriteString("function renameWiki(wiki){var newName=prompt(\"Enter a new name for \" + wiki + \":\", wiki); if(newName == null) return; else window.location.href=\"renameWiki?currentName=\" + wiki + \"&newName=\" + newName;}")
+	pageBytes.WriteString("function deleteWiki(wiki){if(confirm(\"Are you sure you want to delete \" + wiki + \"?\") == true) {window.location.href=\"deleteWiki?name=\" + wiki;}}")
+	pageBytes.WriteString("</script>")
+	pageBytes.WriteString("<style>table, th, td { border: 1px solid; border-collapse: collapse; } th, td { padding: 10px; text-align: left; } tr:hover {background-color: #FAFAD2;}</style>")
+	pageBytes.WriteString("</head>")
+	pageBytes.WriteString("<body>")
+	pageBytes.WriteString("<h1>Welcome to your TiddlyWiki server</h1>")
+	pageBytes.WriteString("<p>This server hosts one or more TiddlyWiki wikis. Below is a list of the current wikis.")
+	pageBytes.WriteString("<p><table style='border:1'><tr><th>Wiki</th><th>Description</th><th>Action</th></tr>")
+	for _, wiki := range wikis {
+		pageBytes.WriteString("<tr><td><a href='" + wiki.Name + "')>" + wiki.Name + "</a></td><td>" + wiki.Description + "</td><td><a href='javascript:renameWiki(\"" + wiki.Name + "\")'>Rename</a>&nbsp;&nbsp;<a href='javascript:deleteWiki(\"" + wiki.Name + "\")'>Delete</a></td></tr>")
+	}
+	if len(wikis) == 0 && query.Get("prefix") == "" {
+		pageBytes.WriteString("<tr><td colspan='3'>No wikis yet</td></tr>")
+	} else if len(wikis) == 0 {
+		pageBytes.WriteString("<tr><td colspan='3'>No wikis match " + html.EscapeString(query.Get("prefix")) + "</td></tr>")
+	}
+	pageBytes.WriteString("</table>")
+	pageBytes.WriteString("<p><a href=\"addWiki\">Click here to create a new wiki</a>")
+	pageBytes.WriteString("</body>")
+	pageBytes.WriteString("</html>")
+
+	page := pageBytes.String()
+
+	log.Info().
+		Int("len", len(page)).
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("sending Server Root index")
+
+	render.HTML(w, r, page)
+}
+
+//Creates the add new wiki page. Todo: Externalize the HTML.
+func addWiki(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var pageBytes bytes.Buffer
+	pageBytes.WriteString("<html>")
+	pageBytes.WriteString("<head>")
+	pageBytes.WriteString("<script>")
+	pageBytes.WriteString("function createNewWiki(template) {\nvar name = document.getElementById('wikiname').value;\nwindow.location.href='createNewWiki?name=' + name + '&template=' + template;\n}")
+	pageBytes.WriteString("</script>")
+	pageBytes.WriteString("<style>table, th, td { border: 1px solid; border-collapse: collapse; } th, td { padding: 10px; text-align: left; } tr:hover {background-color: #FAFAD2;}</style>")
+	pageBytes.WriteString("</head>")
+	pageBytes.WriteString("<body>")
+	pageBytes.WriteString("<h1>Create New TiddlyWiki</h1>")
+	pageBytes.WriteString("<p>Confirm or update the name of the new wiki and then click the chosen template for the wiki. Clicking the template link will initiate creation and redirect you to your new wiki.")
+	pageBytes.WriteString("<p><span><b>Wiki Name: </b></span><input type='text' id='wikiname' value='MyNewWiki'/>")
+	pageBytes.WriteString("<p><table style='border:1'><tr><th>Template</th><th>Description</th></tr>")
+	templates, err := handlerSelector.store.GetWikiTemplateList(templatesPath)
+	if err != nil {
+		log.Warn().Err(err).Msg("Error processing templates for the addWiki page.")
+		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		return
+	}
+	for _, template := range templates {
+		pageBytes.WriteString("<tr><td><a href='javascript:createNewWiki(\"" + template[1] + "\")'>" + template[0] + "</a></td><td>" + template[2] + "</td></tr>")
+	}
+	pageBytes.WriteString("</table>")
+	pageBytes.WriteString("<p><p>New template wikis can be added to the templates folder on the server.")
+	pageBytes.WriteString("<p>Each template is a TiddlyWiki .html file with a unique name (ie. not index.html), together with a .txt file with the same name and a short description.")
+	pageBytes.WriteString("<p><p><a href=\"/\">Home</a>")
+	pageBytes.WriteString("</body>")
+	pageBytes.WriteString("</html>")
+
+	page := pageBytes.String()
+
+	log.Info().
+		Int("len", len(page)).
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("sending addWiki")
+
+	render.HTML(w, r, page)
+}
+
+//Create a new wiki with provided name and template params
+func createNewWiki(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	var err error
+	wikiName := r.URL.Query().Get("name")
+	templateFilename := r.URL.Query().Get("template")
+	wikiPath := filepath.Join(wikisPath, wikiName)
+	templateFilePath := filepath.Join(templatesPath, templateFilename)
+	err = handlerSelector.store.CreateWikiFolder(wikiPath, templateFilePath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to create new wiki. Failed to create new wiki folder.")
+		http.Error(w, fmt.Sprintf("Unable to create new wiki. Failed to create new wiki folder: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	err = handlerSelector.addHandler(wikiName)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to create new wiki. Failed to create new store.")
+		//Roll back so a wiki that cannot sync is not left behind
+		if delErr := handlerSelector.store.DeleteFolder(wikiPath); delErr != nil {
+			log.Error().Err(delErr).Str("wiki", wikiName).Msg("Failed to remove folder of wiki that could not be created.")
+		}
+		http.Error(w, fmt.Sprintf("Unable to create new wiki. Failed to create new store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	log.Info().
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("sending createNewWiki")
+
+	http.Redirect(w, r, "/"+wikiName, http.StatusFound)
+}
+
+func deleteWiki(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var err error
+	wikiName := r.URL.Query().Get("name")
+	wikiPath := filepath.Join(wikisPath, wikiName)
+	err = handlerSelector.store.CopyFolder(wikiPath, filepath.Join(trashPath, wikiName))
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to delete wiki. Failed to copy to trash.")
+		http.Error(w, fmt.Sprintf("Unable to delete wiki. Failed to copy to trash: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	//The wiki is in the trash either way, only listed without its deletion time
+	if err := recordTrashed(wikiName, time.Now()); err != nil {
+		log.Warn().Err(err).Str("wiki", wikiName).Msg("could not record when wiki was moved to the trash")
+	}
+	err = handlerSelector.store.DeleteFolder(wikiPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to delete wiki. Failed to delete wiki folder.")
+		http.Error(w, fmt.Sprintf("Unable to delete wiki. Failed to delete wiki folder: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	handlerSelector.removeHandler(wikiName)
+	log.Info().
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("sending deleteWiki")
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func renameWiki(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	var err error
+	oldWikiName := r.URL.Query().Get("currentName")
+	newWikiName := r.URL.Query().Get("newName")
+	oldWikiPath := filepath.Join(wikisPath, oldWikiName)
+	newWikiPath := filepath.Join(wikisPath, newWikiName)
+
+	err = handlerSelector.store.CopyFolder(oldWikiPath, newWikiPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to rename wiki. Failed to rename folder.")
+		http.Error(w, fmt.Sprintf("Unable to rename wiki. Failed to rename folder: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	//Set up the renamed wiki before removing the original, so the original is kept if the copy can't be made to sync
+	err = handlerSelector.addHandler(newWikiName)
+	if err != nil {
+		log.Error().Err(err).Msg("could not create store for renamed wiki")
+		if delErr := handlerSelector.store.DeleteFolder(newWikiPath); delErr != nil {
+			log.Error().Err(delErr).Str("wiki", newWikiName).Msg("Failed to remove copy of wiki that could not be renamed.")
+		}
+		http.Error(w, fmt.Sprintf("could not create store for renamed wiki: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	err = handlerSelector.store.DeleteFolder(oldWikiPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to rename wiki. Failed to delete original folder.")
+		http.Error(w, fmt.Sprintf("Unable to rename wiki. Failed to delete original folder: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	handlerSelector.removeHandler(oldWikiName)
+
+	log.Info().
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("sending renameWiki")
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+//Describes the server for a management UI: the storage, who may read and write, the wikis with their tiddler counts and access, the templates and the trash.
+//Templates and trash are left empty, with a warning logged, for storage types that cannot list them yet. ?modified=true adds
+//when each wiki was last modified.
+func serverInfo(w http.ResponseWriter, r *http.Request) {
+	type templateInfo struct {
+		Name        string `json:"name"`
+		File        string `json:"file"`
+		Description string `json:"description"`
+	}
+
+	//A wiki with who may read and write it: its own readers and writers, where it sets them, or else the server's
+	type wikiAccess struct {
+		wikiInfo
+		Readers []string `json:"readers"`
+		Writers []string `json:"writers"`
+	}
+
+	wikis := []wikiAccess{}
+	for _, wiki := range handlerSelector.getWikiList(r.URL.Query().Get("modified") == "true") {
+		creds := serverCredentials
+		if h, err := handlerSelector.getHandlerWithStore(wiki.Name); err == nil && h.creds != nil {
+			creds = h.creds.credentials()
+		}
+		readers, writers := accessLists(creds)
+		wikis = append(wikis, wikiAccess{wiki, readers, writers})
+	}
+
+	templates := []templateInfo{}
+	if templateList, err := handlerSelector.store.GetWikiTemplateList(templatesPath); err != nil {
+		log.Warn().Err(err).Msg("could not list templates")
+	} else {
+		for _, template := range templateList {
+			templates = append(templates, templateInfo{Name: template[0], File: template[1], Description: template[2]})
+		}
+	}
+
+	trash, err := handlerSelector.store.GetWikiList(trashPath)
+	if err != nil || trash == nil {
+		log.Warn().Err(err).Msg("could not list trash")
+		trash = []string{}
+	}
+
+	readers, writers := accessLists(serverCredentials)
+
+	render.JSON(w, r, map[string]interface{}{
+		"storage": map[string]string{
+			"type":     storageType,
+			"location": storagePath,
+		},
+		"access": map[string][]string{
+			"readers": readers,
+			"writers": writers,
+		},
+		"wikis":     wikis,
+		"templates": templates,
+		"trash":     trash,
+	})
+}
+
+//Lists who may read and write with some credentials. An empty list lets everyone in, including anonymous users
+func accessLists(creds Credentials) ([]string, []string) {
+	readers, writers := []string{}, []string{}
+	readers = append(readers, creds.Readers...)
+	writers = append(writers, creds.Writers...)
+	return readers, writers
+}
+
+//Default and largest page size of the trash listing
+const (
+	trashPageSize    = 50
+	trashMaxPageSize = 500
+)
+
+//File in the folder of each trashed wiki recording its trashEntry
+const trashRecordFile = ".trashed"
+
+//A wiki in the trash. Wikis trashed before deleteWiki wrote trashRecordFile have neither a deletion time nor a size.
+type trashEntry struct {
+	Name    string     `json:"name"`
+	Deleted *time.Time `json:"deleted,omitempty"`
+	Size    *int64     `json:"size,omitempty"` //bytes of the wiki's index template and tiddler files when it was deleted
+}
+
+//Writes the trashRecordFile of a wiki just copied to the trash, with its size read from its store while it is still served
+func recordTrashed(wiki string, deleted time.Time) error {
+	entry := trashEntry{Name: wiki, Deleted: &deleted}
+	if h, err := handlerSelector.getHandlerWithStore(wiki); err == nil {
+		if size, err := wikiSize(h.Store); err != nil {
+			log.Warn().Err(err).Str("wiki", wiki).Msg("could not find the size of wiki moved to the trash")
+		} else {
+			entry.Size = &size
+		}
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	store, err := handlerSelector.storeFunc(filepath.Join(trashPath, wiki), false, storeLayout)
+	if err != nil {
+		return err
+	}
+	defer closeStore(store)
+	return store.WriteFile(trashRecordFile, b)
+}
+
+//Adds up the bytes of a wiki's index template and the files backing its tiddlers
+func wikiSize(store TiddlerStore) (int64, error) {
+	paths, err := store.ListPaths()
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, p := range append(paths, "index.html", indexGzipFile) {
+		rc, err := store.ReadFile(p)
+		if err != nil {
+			if p == "index.html" || p == indexGzipFile {
+				continue //a wiki has either or both
+			}
+			return 0, err
+		}
+		n, err := io.Copy(io.Discard, rc)
+		rc.Close()
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+//Reads the trashRecordFile of a trashed wiki, leaving the entry with only its name when there is none
+func readTrashEntry(wiki string) trashEntry {
+	entry := trashEntry{}
+	store, err := handlerSelector.storeFunc(filepath.Join(trashPath, wiki), false, storeLayout)
+	if err == nil {
+		defer closeStore(store)
+		var rc io.ReadCloser
+		if rc, err = store.ReadFile(trashRecordFile); err == nil {
+			err = json.NewDecoder(rc).Decode(&entry)
+			rc.Close()
+		}
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("wiki", wiki).Msg("no record of when wiki was moved to the trash")
+		entry = trashEntry{}
+	}
+	entry.Name = wiki
+	return entry
+}
+
+//Lists the trash a page at a time for a management UI. ?limit= sets the page size and ?offset= the number of entries skipped.
+//The most recently deleted wikis come first, then those without a deletion time by name. size adds up the sizes of all
+//the entries that have one.
+func listTrash(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r.URL.Query().Get("limit"), r.URL.Query().Get("offset"), trashPageSize, trashMaxPageSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	trash, err := handlerSelector.store.GetWikiList(trashPath)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to list trash")
+		http.Error(w, fmt.Sprintf("Unable to list trash: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	entries := make([]trashEntry, 0, len(trash))
+	var size int64
+	for _, wiki := range trash {
+		entry := readTrashEntry(wiki)
+		if entry.Size != nil {
+			size += *entry.Size
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (a.Deleted == nil) != (b.Deleted == nil) {
+			return a.Deleted != nil
+		}
+		if a.Deleted != nil && !a.Deleted.Equal(*b.Deleted) {
+			return a.Deleted.After(*b.Deleted)
+		}
+		return a.Name < b.Name
+	})
+
+	render.JSON(w, r, map[string]interface{}{
+		"trash":  pageOf(entries, limit, offset),
+		"total":  len(entries),
+		"size":   size,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
+
+//Parses the limit and offset of a paged listing. An empty limit is defaultLimit and a limit above maxLimit is capped.
+func parsePage(rawLimit string, rawOffset string, defaultLimit int, maxLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+	var err error
+	if rawLimit != "" {
+		if limit, err = strconv.Atoi(rawLimit); err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("limit must be a positive number: %s", rawLimit)
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	if rawOffset != "" {
+		if offset, err = strconv.Atoi(rawOffset); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must not be negative: %s", rawOffset)
+		}
+	}
+	return limit, offset, nil
+}
+
+//Returns at most limit of the entries after the first offset. An offset past the end is an empty page.
+func pageOf(entries []trashEntry, limit int, offset int) []trashEntry {
+	if offset >= len(entries) {
+		return []trashEntry{}
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[offset:end]
+}
+
+//Todo: Should errors here be fatal? In a multi-wiki situation where one wiki may be having an issue? Possibly change to return http.Error
+func (h *handlerWithStore) index(w http.ResponseWriter, r *http.Request) {
+	if publicOnly, _ := r.Context().Value("publicOnly").(bool); publicOnly {
+		h.indexShell(w, r)
+		return
+	}
+	template := indexTemplateFor(r.UserAgent())
+	if serverOptions.StreamIndex {
+		h.streamIndex(w, r, template)
+		return
+	}
+	start := time.Now()
+	//the page without the redacted fields is cached apart from the full one
+	redacted := redactedFields(r)
+	cacheKey := template
+	if len(redacted) > 0 {
+		cacheKey += redactedIndexVariant
+	}
+	page, builtAt := h.cachedIndex(cacheKey)
+	log.Trace().Int("len", len(page)).Str("template", template).Str("page", page).Msg("retrieved index.html from cache")
+	if len(page) > 0 && serverOptions.CheckStoreChanges && h.storeChangedSince(builtAt) {
+		log.Info().Msg("store changed since the index was built, reloading tiddlers")
+		if err := h.Store.Reload(); err != nil {
+			log.Error().Err(err).Msg("could not reload tiddlers from store")
+			http.Error(w, fmt.Sprintf("could not reload tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		h.resetCaches()
+		page = ""
+	}
+	if len(page) <= 0 {
+		log.Trace().Msg("creating index cache")
+		builtAt := time.Now()
+
+		// Grab the tiddlers and clean them up
+		tids, err := h.Store.GetAllTiddlers()
+		if err != nil {
+			log.Error().Err(err).Msg("could not read tiddlers from store")
+			http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		tids = redactTiddlers(excludeTiddlers(tids, h.indexExcludePrefixes()), redacted)
+		page, err = h.renderIndexPage(template, tids, serverOptions.LazyIndex)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.cacheIndex(cacheKey, []byte(page), builtAt)
+		h.indexRebuilds.record(h.wiki, "index", len(tids), time.Since(builtAt))
+	}
+
+	//The cached page is shared between responses, so the nonce is added at send time
+	if serverOptions.CSPNonce {
+		nonce, err := newCSPNonce()
+		if err != nil {
+			log.Error().Err(err).Msg("could not generate CSP nonce")
+			http.Error(w, fmt.Sprintf("could not generate CSP nonce: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		page = withScriptNonce(page, nonce)
+		//TiddlyWiki evaluates its modules at runtime, so eval has to stay allowed
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf("script-src 'nonce-%s' 'unsafe-eval'; object-src 'none'; base-uri 'none'", nonce))
+	}
+
+	log.Info().
+		Int("len", len(page)).
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("sending index")
+
+	render.HTML(w, r, page)
+}
+
+//Renders the wiki's index template with the tiddlers embedded in its store area and the raw markup tiddlers injected.
+//An empty template is the default index.html, otherwise it names a template in the wiki's folder (see Options.IndexTemplates).
+//With lazy, only the system tiddlers are embedded with their text (see skinnyIndexTiddlers).
+func (h *handlerWithStore) renderIndexPage(templateName string, tids []Tiddler, lazy bool) (string, error) {
+	template, err := h.readIndexTemplate(templateName)
+	if err != nil {
+		log.Error().Err(err).Msg("can't open the index file!")
+		return "", fmt.Errorf("can't open the index file!: %s", "index.html")
+	}
+	var pageBytes bytes.Buffer
+	if err := h.writeIndexPage(&pageBytes, bytes.NewReader(template), tids, lazy); err != nil {
+		return "", err
+	}
+	return pageBytes.String(), nil
+}
+
+//Builds the index for every request and writes it to the client as it is read from the template, so neither the template
+//nor the page is held in memory. Once the page has started, errors can only be logged as the status has been sent.
+func (h *handlerWithStore) streamIndex(w http.ResponseWriter, r *http.Request, templateName string) {
+	start := time.Now()
+	tids, err := h.Store.GetAllTiddlers()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	tids = redactTiddlers(excludeTiddlers(tids, h.indexExcludePrefixes()), redactedFields(r))
+	template, err := h.openIndexTemplate(templateName)
+	if err != nil {
+		log.Error().Err(err).Msg("can't open the index file!")
+		http.Error(w, fmt.Sprintf("can't open the index file!: %s", "index.html"), http.StatusInternalServerError)
+		return
+	}
+	defer template.Close()
+
+	var out io.Writer = w
+	if serverOptions.CSPNonce {
+		nonce, err := newCSPNonce()
+		if err != nil {
+			log.Error().Err(err).Msg("could not generate CSP nonce")
+			http.Error(w, fmt.Sprintf("could not generate CSP nonce: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		out = nonceWriter{w, nonce}
+		w.Header().Set("Content-Security-Policy", fmt.Sprintf("script-src 'nonce-%s' 'unsafe-eval'; object-src 'none'; base-uri 'none'", nonce))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := h.writeIndexPage(out, template, tids, serverOptions.LazyIndex); err != nil {
+		log.Error().Err(err).Msg("could not stream index")
+		return
+	}
+	h.indexRebuilds.record(h.wiki, "index", len(tids), time.Since(start))
+
+	log.Info().
+		Dur("ellapsed", time.Since(start)).
+		Float64("ellapsed_min", time.Since(start).Minutes()).
+		Msg("streamed index")
+}
+
+//Writes the page to out as each line of the template is read. See renderIndexPage.
+func (h *handlerWithStore) writeIndexPage(out io.Writer, template io.Reader, tids []Tiddler, lazy bool) error {
+	pageBytes := &pageWriter{w: out}
+	rawMarkupTiddlers := make(map[string][]Tiddler)
+	rawMarkupTiddlers["head"] = make([]Tiddler, 0)
+	rawMarkupTiddlers["body-top"] = make([]Tiddler, 0)
+	rawMarkupTiddlers["body-bottom"] = make([]Tiddler, 0)
+	bag, bagRules := h.bag(), h.bagRules()
+	tids = sortTiddlers(tids, serverOptions.SortBy)
+	for i, tid := range tids {
+
+		// This is here because the TiddlyWeb plugin will not issue a DELETE request if the tiddler is not in a bag
+		// https://github.com/Jermolene/TiddlyWiki5/blob/master/plugins/tiddlywiki/tiddlyweb/tiddlywebadaptor.js#L250-L253
+		if _, ok := tid["bag"]; !ok {
+			title, _ := fieldAsString(tid["title"])
+			tids[i]["bag"] = bagForTitle(title, bagRules, bag)
+		}
+		// TiddlyWeb format is not expected in this store
+		log.Trace().Interface("tid", tid).Msg("checking to see if it is a rawmarkup tiddler")
+		if tagsRaw, ok := tid["tags"]; ok {
+			tags, ok := tagsAsString(tagsRaw)
+			if !ok {
+				log.Warn().Interface("title", tid["title"]).Str("tags_type", fmt.Sprintf("%T", tagsRaw)).Interface("tagsRaw", tagsRaw).Msg("unexpected type for tags field")
+				continue
+			}
+			if strings.Contains(tags, "$:/tags/RawMarkup") && tids[i]["text"] != nil {
+				if strings.Contains(tags, "/TopBody") {
+					rawMarkupTiddlers["body-top"] = append(rawMarkupTiddlers["body-top"], tid)
+				} else if strings.Contains(tags, "/BottomBody") {
+					rawMarkupTiddlers["body-bottom"] = append(rawMarkupTiddlers["body-bottom"], tid)
+				} else {
+					rawMarkupTiddlers["head"] = append(rawMarkupTiddlers["head"], tid)
+				}
+			}
+		}
+	}
+	log.Trace().Interface("rawMarkupTiddlers", rawMarkupTiddlers).Send()
+	if lazy {
+		tids = skinnyIndexTiddlers(tids)
+	}
+
+	// Read in the index file and include the tiddlers into the store
+	reader := bufio.NewReader(template)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Error().Err(err).Msg("could not read line in index file")
+			return fmt.Errorf("could not read line in index file: %w", err)
+		}
+		pageBytes.WriteString(line)
+		if strings.Contains(line, "<!--~~ Ordinary tiddlers ~~-->") {
+			pageBytes.WriteString(`<script class="tiddlywiki-tiddler-store" type="application/json">` + "\n")
+			//The encoder escapes '<' as \u003c, so tiddler text cannot close the script tag. It writes straight to the page
+			if err := json.NewEncoder(pageBytes).Encode(tids); err != nil {
+				log.Error().Err(err).Msg("could not encode tiddlers into json for index")
+				return fmt.Errorf("could not encode tiddlers into json for index: %w", err)
+			}
+			pageBytes.WriteString("</script>\n")
+		} else if strings.Contains(line, "<!--~~ Raw markup for the top of the head section ~~-->") {
+			for _, tid := range rawMarkupTiddlers["head"] {
+				pageBytes.WriteString(tid["text"].(string))
+			}
+		} else if strings.Contains(line, "<!--~~ Raw markup for the top of the body section ~~-->") {
+			for _, tid := range rawMarkupTiddlers["body-top"] {
+				pageBytes.WriteString(tid["text"].(string))
+			}
+		} else if strings.Contains(line, "<!--~~ Raw markup for the bottom of the body section ~~-->") {
+			for _, tid := range rawMarkupTiddlers["body-bottom"] {
+				pageBytes.WriteString(tid["text"].(string))
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return pageBytes.err
+}
+
+//Writes a page unbuffered, so each template line, raw markup tiddler and the tiddler store are a single write, and keeps
+//the first error, after which nothing more is written (e.g. once the client has gone).
+type pageWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (p *pageWriter) Write(b []byte) (int, error) {
+	if p.err != nil {
+		return 0, p.err
+	}
+	var n int
+	n, p.err = p.w.Write(b)
+	return n, p.err
+}
+
+func (p *pageWriter) WriteString(s string) {
+	io.WriteString(p, s)
+}
+
+//Sends the wiki's page without its tiddlers, for visitors without credentials when the index is a public route. Only the
+//host config is included, so TiddlyWiki syncs with (and asks to log in to) this wiki rather than the server's root.
+func (h *handlerWithStore) indexShell(w http.ResponseWriter, r *http.Request) {
+	tids := []Tiddler{}
+	if tid, err := h.Store.GetTiddler("$:/config/tiddlyweb/host"); err == nil {
+		tids = append(tids, tid)
+	}
+	page, err := h.renderIndexPage("", tids, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render.HTML(w, r, page)
+}
+
+//Most URLs a single sitemap may list
+const sitemapMaxURLs = 50000
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+//Sends a sitemap listing a permalink to each of the wiki's tiddlers, drafts and system tiddlers aside, for search engines
+//to index a published wiki. The links are made from the wiki's $:/config/tiddlyweb/host, or from the request without one.
+func (h *handlerWithStore) sitemap(w http.ResponseWriter, r *http.Request) {
+	skinny, err := h.skinnyTiddlers()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	skinny = redactTiddlers(skinny, redactedFields(r))
+	base := h.siteURL(r)
+	urlSet := sitemapURLSet{Xmlns: "http://www.sitemaps.org/schemas/sitemap/0.9", URLs: []sitemapURL{}}
+	for _, tid := range skinny {
+		if _, ok := tid["draft.of"]; ok {
+			continue
+		}
+		if len(urlSet.URLs) == sitemapMaxURLs {
+			log.Warn().Str("wiki", h.wiki).Int("tiddlers", len(skinny)).Msg("sitemap truncated to its maximum number of URLs")
+			break
+		}
+		//the permalink TiddlyWiki makes, with the title encoded as encodeURIComponent does
+		title := tid["title"].(string)
+		u := sitemapURL{Loc: base + "#" + strings.ReplaceAll(url.QueryEscape(title), "+", "%20")}
+		if modified, ok := fieldAsString(tid["modified"]); ok {
+			if t, err := parseTiddlerTime(modified); err == nil {
+				u.LastMod = t.Format(time.RFC3339)
+			}
+		}
+		urlSet.URLs = append(urlSet.URLs, u)
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(urlSet); err != nil {
+		log.Error().Err(err).Str("wiki", h.wiki).Msg("could not write sitemap")
+	}
+}
+
+//Returns the URL the wiki is published at, ending in a slash: the text of its $:/config/tiddlyweb/host with TiddlyWiki's
+//$protocol$ and $host$ placeholders filled in from the request, or the request's own wiki URL without the tiddler
+func (h *handlerWithStore) siteURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	site := scheme + "://" + r.Host + "/" + url.PathEscape(h.wiki) + "/"
+	if tid, err := h.Store.GetTiddler("$:/config/tiddlyweb/host"); err == nil {
+		if host := strings.TrimSpace(tid.Field("text")); host != "" {
+			site = strings.NewReplacer("$protocol$", scheme+":", "$host$", r.Host).Replace(host)
+		}
+	}
+	if !strings.HasSuffix(site, "/") {
+		site += "/"
+	}
+	return site
+}
+
+//Sends the wiki as a standalone single-file wiki, with all tiddlers embedded in full. Unless DownloadSyncConfig is set,
+//the host config and TiddlyWeb plugin tiddlers are left out so the file does not try to sync with this server when opened.
+func (h *handlerWithStore) download(w http.ResponseWriter, r *http.Request) {
+	tids, err := h.Store.GetAllTiddlers()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	tids = redactTiddlers(excludeTiddlers(tids, h.indexExcludePrefixes()), redactedFields(r))
+	if !serverOptions.DownloadSyncConfig {
+		tids = excludeTiddlers(tids, syncConfigPrefixes)
+	}
+	page, err := h.renderIndexPage("", tids, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := path.Base(h.wiki)
+	if name == "." || name == "/" {
+		name = "wiki"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".html"))
+	render.HTML(w, r, page)
+}
+
+//Streams the files backing the wiki's tiddlers as a tar archive, as they are stored, so .tid files, .meta files and their
+//binary companions can be unpacked into the wiki folder of another server. Entries are relative to the wiki's folder.
+func (h *handlerWithStore) exportTar(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	paths, err := h.Store.ListPaths()
+	if err != nil {
+		log.Error().Err(err).Msg("could not list tiddler files")
+		http.Error(w, fmt.Sprintf("could not list tiddler files: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	name := path.Base(h.wiki)
+	if name == "." || name == "/" {
+		name = "wiki"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar"))
+
+	tw := tar.NewWriter(w)
+	for _, p := range paths {
+		b, err := readAllFromStore(h.Store, p)
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: p, Mode: 0644, Size: int64(len(b)), ModTime: start})
+		}
+		if err == nil {
+			_, err = tw.Write(b)
+		}
+		if err != nil {
+			//The status has been sent, so drop the connection rather than end a partial archive that looks complete
+			log.Error().Err(err).Str("path", p).Msg("could not export tiddler file")
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		log.Error().Err(err).Msg("could not finish tar export")
+		return
+	}
+	log.Info().Int("num_files", len(paths)).Dur("ellapsed", time.Since(start)).Msg("exported tiddler files")
+}
+
+//Largest tar archive accepted by importTar, and largest file within it. Vars so that tests can lower them
+var (
+	maxImportTarSize      int64 = 1 << 30
+	maxImportTarEntrySize int64 = 64 << 20
+)
+
+//Writes the .tid and .meta files of a tar archive, such as one from export.tar, into the wiki's tiddlers folder as they are.
+//Entries may be given relative to the wiki's folder or to the tiddlers folder. Each .tid and .meta file must have a title,
+//each .meta file its companion file and each companion file its .meta file, or the entry is reported as failed and not written.
+func (h *handlerWithStore) importTar(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	tiddlersDir := storeLayout.withDefaults().TiddlersDir
+	files := make(map[string][]byte)
+	failed := make(map[string]string)
+	tr := tar.NewReader(http.MaxBytesReader(w, r.Body, maxImportTarSize))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			importTarFailed(w, err)
+			return
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			failed[hdr.Name] = "not a path within the tiddlers folder"
+			continue
+		}
+		name = strings.TrimPrefix(name, tiddlersDir+"/")
+		//A content file is checked through its .meta file, so that neither may be hidden or in a hidden folder such as the history
+		if !isTiddlerFile(name) && !isTiddlerFile(name+".meta") {
+			failed[hdr.Name] = "hidden files and the files in hidden folders are not tiddler files"
+			continue
+		}
+		if hdr.Size > maxImportTarEntrySize {
+			failed[hdr.Name] = fmt.Sprintf("larger than the %d bytes allowed for a file", maxImportTarEntrySize)
+			continue
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			importTarFailed(w, err)
+			return
+		}
+		files[name] = b
+	}
+
+	titles := make(map[string]string)
+	for name, b := range files {
+		isMeta := strings.HasSuffix(name, ".meta")
+		if !isMeta && !strings.HasSuffix(name, ".tid") {
+			if _, ok := files[name+".meta"]; !ok {
+				failed[name] = "binary file has no .meta file"
+			}
+			continue
+		}
+		if _, ok := files[strings.TrimSuffix(name, ".meta")]; isMeta && !ok {
+			failed[name] = "the file the .meta file describes is missing"
+			continue
+		}
+		title, err := getTiddlerFileTile(bytes.NewReader(b))
+		if err != nil || title == "" {
+			failed[name] = "not a tiddler file with a title"
+			continue
+		}
+		titles[name] = title
+	}
+
+	imported := make([]string, 0, len(titles))
+	written := 0
+	for name, b := range files {
+		if _, ok := failed[name]; ok {
+			continue
+		}
+		if _, ok := failed[name+".meta"]; ok {
+			failed[name] = "its .meta file is not a tiddler file"
+			continue
+		}
+		if title, ok := titles[name]; ok {
+			//A tiddler of the same title kept in a file of another name would leave two files for one title
+			if _, err := h.Store.GetTiddler(title); err == nil {
+				if err := h.Store.DeleteTiddler(title); err != nil {
+					log.Warn().Err(err).Str("title", title).Msg("could not remove the tiddler replaced by an imported file")
+				}
+			}
+		}
+		if err := h.Store.WriteFile(path.Join(tiddlersDir, name), b); err != nil {
+			log.Error().Err(err).Str("file", name).Msg("could not import tiddler file")
+			failed[name] = err.Error()
+			continue
+		}
+		written++
+		if title, ok := titles[name]; ok {
+			imported = append(imported, title)
+		}
+	}
+	sort.Strings(imported)
+	h.reconciled.wrote(imported...)
+
+	if err := h.Store.Reload(); err != nil {
+		log.Error().Err(err).Msg("could not reload store after tar import")
+		http.Error(w, fmt.Sprintf("could not reload store after tar import: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	h.resetCaches()
+	log.Info().Int("num_files", written).Int("num_failed", len(failed)).Dur("ellapsed", time.Since(start)).Msg("imported tiddler files")
+
+	render.JSON(w, r, map[string]interface{}{
+		"imported": imported,
+		"files":    written,
+		"failed":   failed,
+	})
+}
+
+//Answers an archive that could not be read, with 413 when it is larger than maxImportTarSize
+func importTarFailed(w http.ResponseWriter, err error) {
+	log.Error().Err(err).Msg("could not read tar archive from request")
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("tar archive is larger than the %d bytes allowed", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, fmt.Sprintf("could not read tar archive from request: %s", err.Error()), http.StatusBadRequest)
+}
+
+//Adds a nonce to the script tags of each write of a streamed page. The page is written a template line, raw markup tiddler
+//or the tiddler store at a time, so a script tag is never split between writes.
+type nonceWriter struct {
+	w     io.Writer
+	nonce string
+}
+
+func (n nonceWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(n.w, withScriptNonce(string(p), n.nonce)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func newCSPNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+//Adds the nonce to every script tag of the page, including those of the template and raw markup tiddlers. The tiddler store JSON escapes '<', so its contents are untouched.
+func withScriptNonce(page, nonce string) string {
+	return reScriptTag.ReplaceAllLiteralString(page, `<script nonce="`+nonce+`"`)
+}
+
+//Serves $:/favicon.ico. A favicon saved through another instance serving the same bucket changes the store's files, so it is
+//picked up once the reconciler reloads the wiki or, with Options.CheckStoreChanges, on the next request.
+func (h *handlerWithStore) favicon(w http.ResponseWriter, r *http.Request) {
+	icon, cachedAt := h.getFaviconCache()
+	if len(icon) > 0 && serverOptions.CheckStoreChanges && h.storeChangedSince(cachedAt) {
+		log.Info().Str("wiki", h.wiki).Msg("store changed since the favicon was cached, reloading tiddlers")
+		if err := h.Store.Reload(); err != nil {
+			log.Error().Err(err).Msg("could not reload tiddlers from store")
+			http.Error(w, fmt.Sprintf("could not reload tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		h.resetCaches()
+		icon = nil
+	}
+
+	if len(icon) == 0 {
+		cachedAt = time.Now()
+		tid, err := h.Store.GetTiddler("$:/favicon.ico")
+		if err != nil {
+			log.Warn().Err(err).Msg("could not find $:/favicon.ico")
+			http.Error(w, fmt.Sprintf("could not find $:/favicon.ico: %s", err.Error()), http.StatusNotFound)
+			return
+		}
+		var buf bytes.Buffer
+		buf.Write(tid["text"].([]byte))
+		icon = buf.Bytes()
+		h.setFaviconCache(icon, cachedAt)
+	}
+
+	//$:/favicon.ico may hold a PNG or GIF as well as an icon
+	w.Header().Set("Content-Type", contentTypeFor("", icon))
+	w.Write(icon)
+}
+
+//Serves a file from the wiki's files folder, falling back to the content of a binary tiddler with that title.
+//A file stored gzipped at rest (e.g. files/logo.svg.gz) is sent as-is to clients that accept gzip and inflated for the others,
+//as is the content of a tiddler kept gzipped (e.g. tiddlers/logo.svg.gz with its logo.svg.gz.meta).
+func (h *handlerWithStore) getFile(w http.ResponseWriter, r *http.Request) {
+	nameRaw := chi.URLParam(r, "*")
+	if nameRaw == "" {
+		log.Error().Msg("file name not provided")
+		http.Error(w, "file name not provided", http.StatusBadRequest)
+		return
+	}
+	name, err := url.PathUnescape(nameRaw)
+	if err != nil {
+		log.Error().Str("nameRaw", nameRaw).Err(err).Msg("could not unescape file name")
+		http.Error(w, fmt.Sprintf("could not read file name: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	filePath := path.Join("files", path.Clean("/"+name))
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if acceptsGzip(r) {
+		if b, err := readAllFromStore(h.Store, filePath+".gz"); err == nil {
+			log.Debug().Str("path", filePath).Msg("serving gzipped file as-is")
+			//the content is compressed, so only the extension can tell its type
+			w.Header().Set("Content-Type", contentTypeFor(name, nil))
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(b)
+			return
+		}
+	}
+	if b, err := readAllFromStore(h.Store, filePath); err == nil {
+		w.Header().Set("Content-Type", contentTypeFor(name, b))
+		w.Write(b)
+		return
+	}
+	if b, err := readAllFromStore(h.Store, filePath+".gz"); err == nil {
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err == nil {
+			b, err = io.ReadAll(zr)
+		}
+		if err != nil {
+			log.Error().Str("path", filePath).Err(err).Msg("could not inflate gzipped file")
+			http.Error(w, fmt.Sprintf("could not inflate gzipped file: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentTypeFor(name, b))
+		w.Write(b)
+		return
+	}
+
+	tid, err := h.Store.GetTiddler(name)
+	if err != nil {
+		log.Warn().Str("name", name).Err(err).Msg("could not find file or tiddler")
+		http.Error(w, fmt.Sprintf("could not find file or tiddler: %s", name), http.StatusNotFound)
+		return
+	}
+	var b []byte
+	switch text := tid["text"].(type) {
+	case []byte:
+		b = text
+	case string:
+		b = []byte(text)
+	}
+	contentType := tid.Field("type")
+	if contentType == "" {
+		contentType = contentTypeFor(name, b)
+	}
+	w.Header().Set("Content-Type", contentType)
+	if gzipped, ok := tid[gzippedContentField].([]byte); ok && acceptsGzip(r) {
+		log.Debug().Str("name", name).Msg("serving gzipped tiddler content as-is")
+		w.Header().Set("Content-Encoding", "gzip")
+		//the gzipped content is another representation, so it must not share the ETag of the inflated one
+		w.Header().Set("Etag", strings.TrimSuffix(binaryETag(tid, b), `"`)+`-gzip"`)
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(gzipped))
+		return
+	}
+	if _, binary := tid["text"].([]byte); binary {
+		//ServeContent answers If-None-Match with 304 and Range requests with the part asked for
+		w.Header().Set("Etag", binaryETag(tid, b))
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b))
+		return
+	}
+	w.Write(b)
+}
+
+//The ETag of a binary tiddler's content: the hash stored when it was written, or hashed now for a tiddler written before
+//hashes were stored or by another program
+func binaryETag(tid Tiddler, content []byte) string {
+	hash := tid.Field(binaryHashField)
+	if hash == "" {
+		hash = binaryContentHash(content)
+	}
+	return `"` + hash + `"`
+}
+
+//Types of common web files that Go's built-in table lacks or that vary with the host's mime.types, checked first
+var extraContentTypes = map[string]string{
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+	".map":   "application/json",
+	".tid":   "text/plain; charset=utf-8",
+}
+
+//Returns the Content-Type for a file by its extension, falling back to sniffing its first bytes (see http.DetectContentType).
+//Pass nil content when it cannot be sniffed, e.g. because it is compressed.
+func contentTypeFor(name string, content []byte) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ext != "" {
+		if t, ok := extraContentTypes[ext]; ok {
+			return t
+		}
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+	if len(content) == 0 {
+		return "application/octet-stream"
+	}
+	return http.DetectContentType(content)
+}
+
+//Reports whether the request's Accept-Encoding allows a gzip response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if name := strings.TrimSpace(parts[0]); name != "gzip" && name != "*" {
+			continue
+		}
+		if len(parts) > 1 {
+			if q := strings.TrimSpace(parts[1]); q == "q=0" || q == "q=0.0" || q == "q=0.00" || q == "q=0.000" {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (h *handlerWithStore) loginBasic(w http.ResponseWriter, r *http.Request) {
+	auth, ok := r.Context().Value("auth").(authContext)
+	log.Trace().Interface("auth", auth).Bool("ok", ok).Msg("checking logged in user?")
+	if auth.Username == "" || auth.Username == AuthAnonUsername {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Please provide your username and password to login"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	log.Info().Str("username", auth.Username).Msg("successfully logged in")
+	http.Redirect(w, r, "/", http.StatusFound) // TODO: server prefix
+}
+
+func (h *handlerWithStore) status(w http.ResponseWriter, r *http.Request) {
+	auth, ok := r.Context().Value("auth").(authContext)
+	log.Trace().Interface("auth", auth).Bool("ok", ok).Msg("found creds")
+	if !ok {
+		log.Warn().Msg("no auth context found!")
+	}
+	render.JSON(w, r, map[string]interface{}{
+		"username":             auth.Username,
+		"anonymous":            auth.CanBeAnonymous,
+		"read_only":            !auth.WritingAllowed,
+		"space":                map[string]interface{}{"recipe": h.bag()},
+		"tiddlywiki_version":   "5.2.3",  // TODO: How to identify this?
+		"tiddlybucket_version": "v0.0.0", // TODO: How to identify this?
+	})
+}
+
+//Returns the skinny list of the wiki's non-system tiddlers sorted by title, building and caching it when the cache is empty.
+//The tiddlers are the cache's own and must not be changed.
+func (h *handlerWithStore) skinnyTiddlers() ([]Tiddler, error) {
+	skinny := h.getSkinnyListCache()
+	if len(skinny) <= 0 {
+		log.Trace().Msg("creating skinny tiddler list")
+		builtAt := time.Now()
+		tids, err := h.Store.GetAllTiddlers()
+		if err != nil {
+			return nil, err
+		}
+
+		skinny = make([]Tiddler, 0)
+		for i := range tids {
+			if skinnyTid, ok := skinnyTiddler(tids[i]); ok {
+				skinny = append(skinny, skinnyTid)
+			}
+		}
+
+		// sorted so that the pages of a paged listing do not overlap
+		skinny = sortTiddlers(skinny, serverOptions.SortBy)
+		h.setSkinnyListCache(skinny, builtAt)
+		h.skinnyListRebuilds.record(h.wiki, "skinny_list", len(skinny), time.Since(builtAt))
+	}
+	return skinny, nil
+}
+
+//Returns the tiddler as listed in the skinny list, without its text unless it is a macro. System tiddlers and tiddlers without
+//a usable title are left out.
+func skinnyTiddler(tid Tiddler) (Tiddler, bool) {
+	// a malformed tiddler is left out or coerced rather than breaking the sync of the whole wiki
+	title, ok := fieldAsString(tid["title"])
+	if !ok {
+		log.Warn().Interface("title", tid["title"]).Str("title_type", fmt.Sprintf("%T", tid["title"])).Msg("skipping tiddler with an unusable title in skinny list")
+		return nil, false
+	}
+	if strings.HasPrefix(title, "$:/") {
+		return nil, false
+	}
+	var keeptext bool
+	tags, tagsOk := "", true
+	if tagsRaw, ok := tid["tags"]; ok {
+		// skinny list only unless the tiddler text if it's a macro
+		// basing this entirely on @rsc's comment here: https://github.com/rsc/tiddly/blob/master/tiddly.go#L160-L164
+		tags, tagsOk = tagsAsString(tagsRaw)
+		if !tagsOk {
+			log.Warn().Str("title", title).Str("tags_type", fmt.Sprintf("%T", tagsRaw)).Interface("tagsRaw", tagsRaw).Msg("dropping tags of unexpected type from skinny list")
+		}
+		if strings.Contains(tags, "$:/tags/Macro") {
+			keeptext = true
+		}
+	}
+	// copy each field independently to make sure you don't mess with the store cache
+	skinnyTid := make(Tiddler)
+	for k, v := range tid {
+		if k == "text" && !keeptext {
+			continue
+		}
+		if k == "tags" && !tagsOk {
+			continue
+		}
+		skinnyTid[k] = v
+	}
+	skinnyTid["title"] = title
+	// the syncer compares revisions to decide what to fetch, so tiddlers never written through the server get the revision putTiddler starts from
+	if revision, ok := fieldAsString(skinnyTid["revision"]); !ok || revision == "" {
+		skinnyTid["revision"] = "0"
+	}
+	if serverOptions.SkinnyHash {
+		skinnyTid["hash"] = contentHash(tid)
+	}
+	log.Trace().Str("title", title).Interface("skinny", skinnyTid).Msg("added to skinny list")
+	return skinnyTid, true
+}
+
+//Lists the non-system tiddlers without their text, as TiddlyWiki polls for, sorted by title. ?filter= narrows the list with
+//the subset of TiddlyWiki filters the filter package supports, listing everything for others. ?modifiedAfter= and ?modifiedBefore=
+//keep the tiddlers modified in a range. ?limit= and ?offset= return a page of the list instead, with its full length in
+//X-Total-Count and a Link header to the next page while there is one.
+func (h *handlerWithStore) getSkinnyTiddlerList(w http.ResponseWriter, r *http.Request) {
+	recipe := chi.URLParam(r, "recipe") // ignoring
+	expr := r.URL.Query().Get("filter")
+	log.Debug().Str("recipe", recipe).Str("filter", expr).Msg("getSkinnyTiddlerList()")
+
+	//counted from the store's index, so that the tiddlers of a runaway wiki are not all read to find out
+	if max := serverOptions.MaxWikiTiddlers; max > 0 {
+		if count := len(h.Store.TiddlerPaths()); count > max {
+			log.Warn().Str("wiki", h.wiki).Int("num_tiddlers", count).Int("max_wiki_tiddlers", max).Msg("wiki has too many tiddlers to list")
+			http.Error(w, fmt.Sprintf("wiki %s has %d tiddlers, more than the %d this server lists; delete or move some of them, or raise --max_wiki_tiddlers", h.wiki, count, max),
+				http.StatusInsufficientStorage)
+			return
+		}
+	}
+
+	skinny, err := h.skinnyTiddlers()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()),
+			http.StatusInternalServerError)
+		return
+	}
+
+	//redacted before filtering, so the fields cannot be probed with field filters either
+	skinny = redactTiddlers(skinny, redactedFields(r))
+	if expr != "" {
+		if _, err := filter.Parse(expr); err != nil {
+			log.Debug().Err(err).Str("filter", expr).Msg("listing every tiddler for an unsupported filter")
+		}
+		skinny = filter.Apply(expr, skinny)
+	}
+	query := r.URL.Query()
+	if query.Has("modifiedAfter") || query.Has("modifiedBefore") {
+		var err error
+		if skinny, err = modifiedBetween(skinny, query.Get("modifiedAfter"), query.Get("modifiedBefore")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("limit") || query.Has("offset") {
+		limit, offset, err := parsePage(query.Get("limit"), query.Get("offset"), skinnyPageSize, skinnyMaxPageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(skinny)))
+		if offset+limit < len(skinny) {
+			query.Set("limit", strconv.Itoa(limit))
+			query.Set("offset", strconv.Itoa(offset+limit))
+			next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+			w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+		}
+		switch {
+		case offset >= len(skinny):
+			skinny = []Tiddler{}
+		case offset+limit < len(skinny):
+			skinny = skinny[offset : offset+limit]
+		default:
+			skinny = skinny[offset:]
+		}
+	} else if max := serverOptions.MaxSkinnyList; max > 0 && len(skinny) > max {
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(skinny)))
+		http.Error(w, fmt.Sprintf("the list has %d tiddlers, more than the %d sent at once; page through it with ?limit= and ?offset=", len(skinny), max),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	renderJSON(w, r, skinny)
+}
+
+//Returns a copy of the tiddlers in the order of sortBy (see SortByTitle). Tiddlers are ordered by title among those with the
+//same date, and those without a date that can be parsed come last, so the order is the same from one request to the next.
+func sortTiddlers(tids []Tiddler, sortBy string) []Tiddler {
+	type sortKey struct {
+		tid   Tiddler
+		title string
+		date  time.Time
+		dated bool
+	}
+	keys := make([]sortKey, len(tids))
+	for i, tid := range tids {
+		keys[i].tid = tid
+		keys[i].title, _ = fieldAsString(tid["title"])
+		if sortBy == SortByModified || sortBy == SortByCreated {
+			value, _ := fieldAsString(tid[sortBy])
+			if date, err := parseTiddlerTime(value); err == nil {
+				keys[i].date, keys[i].dated = date, true
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.dated != b.dated {
+			return a.dated
+		}
+		if !a.date.Equal(b.date) {
+			return a.date.After(b.date)
+		}
+		return a.title < b.title
+	})
+	sorted := make([]Tiddler, len(keys))
+	for i := range keys {
+		sorted[i] = keys[i].tid
+	}
+	return sorted
+}
+
+//Returns the tiddlers whose modified field falls in the range, given as TiddlyWiki dates (e.g. 20230102 or 20230102150405000).
+//After is inclusive and before exclusive, so consecutive ranges neither overlap nor leave gaps, and either may be empty for an
+//open range. Tiddlers without a modified date that can be parsed are left out.
+func modifiedBetween(tids []Tiddler, after string, before string) ([]Tiddler, error) {
+	var from, until time.Time
+	var err error
+	if after != "" {
+		if from, err = parseTiddlerTime(after); err != nil {
+			return nil, fmt.Errorf("modifiedAfter: %w", err)
+		}
+	}
+	if before != "" {
+		if until, err = parseTiddlerTime(before); err != nil {
+			return nil, fmt.Errorf("modifiedBefore: %w", err)
+		}
+	}
+	matching := make([]Tiddler, 0)
+	for _, tid := range tids {
+		value, _ := fieldAsString(tid["modified"])
+		modified, err := parseTiddlerTime(value)
+		if err != nil {
+			continue
+		}
+		if (after == "" || !modified.Before(from)) && (before == "" || modified.Before(until)) {
+			matching = append(matching, tid)
+		}
+	}
+	return matching, nil
+}
+
+//Default and largest page size of the skinny tiddler list, when it is paged with ?limit= or ?offset=
+const (
+	skinnyPageSize    = 500
+	skinnyMaxPageSize = 5000
+)
+
+//Default and largest number of results of a search, as ?limit= sets
+const (
+	searchResults    = 50
+	searchMaxResults = 500
+)
+
+//Searches the titles and text of the non-system tiddlers for every word of ?q=, ignoring case. The matches are listed as
+//skinny tiddlers, best first by how often the words occur in them, and at most ?limit= of them with the number of matches
+//in X-Total-Count.
+func (h *handlerWithStore) searchTiddlers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	terms := strings.Fields(strings.ToLower(query.Get("q")))
+	if len(terms) == 0 {
+		http.Error(w, "a search needs a query in ?q=", http.StatusBadRequest)
+		return
+	}
+	limit, _, err := parsePage(query.Get("limit"), "", searchResults, searchMaxResults)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Debug().Strs("terms", terms).Int("limit", limit).Msg("searchTiddlers()")
+
+	tids, err := h.Store.GetAllTiddlers()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	type match struct {
+		tid   Tiddler
+		title string
+		score int
+	}
+	matches := make([]match, 0)
+	for _, tid := range tids {
+		title, ok := fieldAsString(tid["title"])
+		if !ok || strings.HasPrefix(title, "$:/") {
+			continue
+		}
+		// binary tiddlers are searched by title only
+		text, _ := fieldAsString(tid["text"])
+		lowerTitle, lowerText := strings.ToLower(title), strings.ToLower(text)
+		score := 0
+		for _, term := range terms {
+			count := strings.Count(lowerTitle, term) + strings.Count(lowerText, term)
+			if count == 0 {
+				score = 0
+				break
+			}
+			score += count
+		}
+		if score > 0 {
+			matches = append(matches, match{tid: tid, title: title, score: score})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].title < matches[j].title
+	})
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(matches)))
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	// copied without their text, leaving the store cache untouched
+	results := make([]Tiddler, 0, len(matches))
+	for _, m := range matches {
+		skinnyTid := make(Tiddler)
+		for k, v := range m.tid {
+			if k != "text" {
+				skinnyTid[k] = v
+			}
+		}
+		results = append(results, skinnyTid)
+	}
+	renderJSON(w, r, redactTiddlers(results, redactedFields(r)))
+}
+
+func (h *handlerWithStore) getTiddler(w http.ResponseWriter, r *http.Request) {
+	recipe := chi.URLParam(r, "recipe") // unused
+	tiddlerNameRaw := chi.URLParam(r, "*")
+	if tiddlerNameRaw == "" {
+		log.Error().Msg("tiddler name not provided")
+		http.Error(w, "tiddler name not provided", http.StatusBadRequest)
+		return
+	}
+	tiddlerName, err := url.PathUnescape(tiddlerNameRaw)
+	if err != nil {
+		log.Error().Str("tiddlerNameRaw", tiddlerNameRaw).Err(err).Msg("could not unescape tiddler name")
+		http.Error(w, fmt.Sprintf("could not read tiddler name: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	log.Debug().Str("recipe", recipe).Str("tiddlerName", tiddlerName).Msg("getTiddler")
+
+	if tiddlerName == "$:/StoryList" {
+		log.Info().Msg("skipped reading StoryList")
+		return
+	}
+
+	tid, err := h.Store.GetTiddler(tiddlerName)
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddler from store")
+		http.Error(w, fmt.Sprintf("could not read tiddler from store: %s", err.Error()), http.StatusNotFound)
+		return
+	}
+
+	//an earlier revision is read from the history, the current one is the tiddler itself
+	if rev := r.URL.Query().Get("revision"); rev != "" {
+		revision, err := strconv.Atoi(rev)
+		if err != nil || revision < 0 {
+			http.Error(w, fmt.Sprintf("invalid revision %q", rev), http.StatusBadRequest)
+			return
+		}
+		if current, _ := strconv.Atoi(tid.Field("revision")); revision != current {
+			if tid, err = h.readRevision(tiddlerName, revision); err != nil {
+				log.Error().Str("tiddlerName", tiddlerName).Int("revision", revision).Err(err).Msg("could not read tiddler revision from store")
+				http.Error(w, fmt.Sprintf("could not read revision %d of %s from store: %s", revision, tiddlerName, err.Error()), http.StatusNotFound)
+				return
+			}
+		}
+	}
+
+	log.Trace().Interface("tid", tid).Msg("found tiddler")
+
+	renderJSON(w, r, redactTiddler(tid, redactedFields(r)))
+}
+
+func (h *handlerWithStore) putTiddler(w http.ResponseWriter, r *http.Request) {
+	recipe := chi.URLParam(r, "recipe")
+	tiddlerNameRaw := chi.URLParam(r, "*")
+	if tiddlerNameRaw == "" {
+		log.Error().Msg("tiddler name not provided")
+		http.Error(w, "tiddler name not provided", http.StatusBadRequest)
+		return
+	}
+	tiddlerName, err := url.PathUnescape(tiddlerNameRaw)
+	if err != nil {
+		log.Error().Str("tiddlerNameRaw", tiddlerNameRaw).Err(err).Msg("could not unescape tiddler name")
+		http.Error(w, fmt.Sprintf("could not read tiddler name: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	log.Debug().Str("recipe", recipe).Str("tiddlerName", tiddlerName).Msg("putTiddler")
+
+	var newTiddler Tiddler
+	if err := newTiddler.Read(r.Body); err != nil {
+		log.Error().Err(err).Msg("could not read tiddler from request")
+		http.Error(w, fmt.Sprintf("could not read tiddler from request: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if err := flattenTiddlyWebFormat(newTiddler); err != nil {
+		http.Error(w, fmt.Sprintf("could not read tiddler from request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	log.Trace().Interface("newTiddler", newTiddler).Send()
+
+	if serverOptions.NormalizeTitles {
+		if normalized := normalizeTitle(tiddlerName); normalized != tiddlerName {
+			//only the tiddler this title was normalized into before may be written under it, never one of another title
+			if tid, err := h.Store.GetTiddler(normalized); err == nil && tid.Field(originalTitleField) != tiddlerName {
+				log.Warn().Str("title", tiddlerName).Str("normalized", normalized).Msg("normalized title is taken by another tiddler")
+				http.Error(w, fmt.Sprintf("title %q normalizes to %q, which is another tiddler", tiddlerName, normalized), http.StatusConflict)
+				return
+			}
+			log.Info().Str("title", tiddlerName).Str("normalized", normalized).Msg("normalized tiddler title")
+			newTiddler.setField(originalTitleField, tiddlerName)
+			newTiddler.setField("title", normalized)
+			tiddlerName = normalized
+		}
+	}
+
+	revision := 0
+	bag := h.bagFor(tiddlerName)
+	etag := func() string {
+		return fmt.Sprintf("\"%s/%s/%d:%x\"", bag, url.QueryEscape(tiddlerName), revision, md5.Sum(newTiddler.Bytes()))
+	}
+
+	// TODO: check out that the etag passed in matches
+	// TODO: the title of an existing tiddler is not overwritten
+
+	if tiddlerName == "$:/StoryList" {
+		log.Info().Msg("skipped writing StoryList")
+		w.Header().Add("Etag", etag())
+		render.NoContent(w, r)
+		return
+	}
+
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	// get the rev of the existing, if it does exist
+	var stored Tiddler
+	if tid, err := h.Store.GetTiddler(tiddlerName); err == nil {
+		stored = tid
+		old, _ := strconv.Atoi(tid.Field("revision"))
+		if incoming, ok := requestRevision(r); ok && incoming != old {
+			log.Warn().Str("tiddlerName", tiddlerName).Int("incoming_revision", incoming).Int("stored_revision", old).
+				Str("strategy", serverOptions.ConflictStrategy).Msg("revision conflict")
+			switch serverOptions.ConflictStrategy {
+			case ConflictReject:
+				http.Error(w, fmt.Sprintf("revision %d of %s does not match the stored revision %d", incoming, tiddlerName, old), http.StatusPreconditionFailed)
+				return
+			case ConflictServerWins:
+				w.Header().Add("Etag", fmt.Sprintf("\"%s/%s/%d:%x\"", bag, url.QueryEscape(tiddlerName), old, md5.Sum(tid.Bytes())))
+				render.JSON(w, r, redactTiddler(tid, redactedFields(r)))
+				return
+			}
+		}
+		revision = old + 1
+		newTiddler.setField("revision", strconv.Itoa(revision))
+		if err := h.keepRevision(tiddlerName, tid); err != nil {
+			log.Error().Err(err).Msg("could not keep tiddler revision in store")
+			http.Error(w, fmt.Sprintf("could not keep revision %d of %s in store: %s", old, tiddlerName, err.Error()), http.StatusInternalServerError)
+			return
+		}
+		//keep the stored creation date when the update does not send one
+		if _, ok := newTiddler["created"]; !ok && tid.Field("created") != "" {
+			newTiddler.setField("created", tid.Field("created"))
+		}
+	} else if _, ok := newTiddler["created"]; !ok {
+		//a new tiddler without a creation date is created now, so TiddlyWiki can show when
+		newTiddler.setField("created", formatTiddlerTime(time.Now()))
+	}
+
+	wiki := chi.URLParam(r, "wiki")
+	attachment, err := h.storeAttachment(wiki, newTiddler)
+	if errors.Is(err, errAttachmentExists) {
+		log.Warn().Str("tiddlerName", tiddlerName).Err(err).Msg("refused to overwrite file with tiddler attachment")
+		http.Error(w, fmt.Sprintf("could not write tiddler attachment to store: %s", err.Error()), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Error().Err(err).Msg("could not write tiddler attachment to store")
+		http.Error(w, fmt.Sprintf("could not write tiddler attachment to store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	//TiddlyWiki sends binary content base64 encoded, the store keeps it as is in a file next to the tiddler's .meta file
+	if text, ok := newTiddler["text"].(string); ok && reBinaryType.MatchString(newTiddler.Field("type")) {
+		content, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			log.Error().Str("tiddlerName", tiddlerName).Err(err).Msg("could not decode binary tiddler")
+			http.Error(w, fmt.Sprintf("could not decode the base64 text of binary tiddler %s: %s", tiddlerName, err.Error()), http.StatusBadRequest)
+			return
+		}
+		newTiddler["text"] = content
+	}
+
+	if err := h.Store.WriteTiddler(newTiddler); err != nil {
+		log.Error().Err(err).Msg("could not add tiddler to store")
+		if attachment != "" {
+			h.removeFile(attachment)
+		}
+		http.Error(w, fmt.Sprintf("could not add tiddler to store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	//the attachment of the content replaced is no longer referenced
+	if previous := attachmentPath(wiki, stored); previous != "" && previous != attachmentPath(wiki, newTiddler) {
+		h.removeFile(previous)
+	}
+	h.tiddlerChanged(tiddlerName, newTiddler)
+	h.notifyWebhook(r, WebhookPut, tiddlerName)
+
+	if log.Logger.GetLevel() <= zerolog.TraceLevel {
+		log.Trace().Interface("newTiddler", newTiddler).Msg("ostensibly wrote this?")
+		if tid, err := h.Store.GetTiddler(tiddlerName); err == nil {
+			log.Trace().Interface("tid", tid).Msg("reading it back")
+		}
+		log.Trace().Interface("newTiddler", newTiddler).Msg("ostensibly wrote this?")
+	}
+
+	w.Header().Add("Etag", etag())
+	render.NoContent(w, r)
+}
+
+//Field keeping the title a tiddler was written under before its title was normalized
+const originalTitleField = "original-title"
+
+//Trims the whitespace around a title and collapses the runs of whitespace within it to single spaces
+func normalizeTitle(title string) string {
+	return strings.Join(strings.Fields(title), " ")
+}
+
+//Path of a tiddler's earlier revision in the history kept with MaxRevisions, relative to the wiki's folder
+func revisionPath(title string, revision int) string {
+	dir := strings.TrimSuffix(tiddlerFilename(title), ".tid")
+	return path.Join(storeLayout.withDefaults().TiddlersDir, historyDir, dir, strconv.Itoa(revision)+".tid")
+}
+
+//Writes the stored tiddler to the history before a write with the next revision overwrites it, and removes the revision that
+//no longer fits in the last MaxRevisions. Every write bumping the revision calls it, holding muWrite. The store encrypts the
+//revision as it would the tiddler.
+func (h *handlerWithStore) keepRevision(title string, stored Tiddler) error {
+	if serverOptions.MaxRevisions <= 0 {
+		return nil
+	}
+	revision, _ := strconv.Atoi(stored.Field("revision"))
+	if err := h.Store.WriteTiddlerFile(revisionPath(title, revision), stored); err != nil {
+		return err
+	}
+	if expired := revision - serverOptions.MaxRevisions; expired >= 0 {
+		return h.Store.DeleteFile(revisionPath(title, expired))
+	}
+	return nil
+}
+
+//Reads an earlier revision of a tiddler from the history
+func (h *handlerWithStore) readRevision(title string, revision int) (Tiddler, error) {
+	return h.Store.ReadTiddlerFile(revisionPath(title, revision))
+}
+
+//Returned when a tiddler's attachment would overwrite a different file in the wiki's files folder
+var errAttachmentExists = errors.New("a different file of that name already exists")
+
+//Moves the content of a large binary tiddler into the wiki's files folder and points the tiddler at it with _canonical_uri, keeping the tiddler, skinny list and index small.
+//The file is then served by the /{wiki}/files/* route. Returns the path of the file written, or "" when none was, such as when
+//the attachment was stored before. A file of the same name with other content, which the server did not write, is not overwritten.
+func (h *handlerWithStore) storeAttachment(wiki string, t Tiddler) (string, error) {
+	if serverOptions.AttachmentThreshold <= 0 || !isAttachmentType(t.Field("type")) {
+		return "", nil
+	}
+	text, ok := t["text"].(string)
+	if !ok || len(text) < serverOptions.AttachmentThreshold {
+		return "", nil
+	}
+	data, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(data) < serverOptions.AttachmentThreshold {
+		return "", nil
+	}
+	name := attachmentFilename(t.Field("title"), t.Field("type"), data)
+	filePath := path.Join("files", name)
+	written := ""
+	existing, err := readAllFromStore(h.Store, filePath)
+	switch {
+	case err == nil && !bytes.Equal(existing, data):
+		return "", fmt.Errorf("%s: %w", filePath, errAttachmentExists)
+	case err != nil && !isNotFound(err):
+		return "", err
+	case err != nil:
+		if err := h.Store.WriteFile(filePath, data); err != nil {
+			return "", err
+		}
+		written = filePath
+		log.Debug().Str("title", t.Field("title")).Str("file", name).Int("bytes", len(data)).Msg("stored tiddler content as attachment")
+	}
+	delete(t, "text")
+	t.setField("_canonical_uri", "/"+url.PathEscape(wiki)+"/files/"+url.PathEscape(name))
+	return written, nil
+}
+
+//Returns the path of the attachment storeAttachment wrote for a tiddler, or "" when its _canonical_uri points anywhere else
+func attachmentPath(wiki string, t Tiddler) string {
+	uri := t.Field("_canonical_uri")
+	prefix := "/" + url.PathEscape(wiki) + "/files/"
+	if !strings.HasPrefix(uri, prefix) {
+		return ""
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(uri, prefix))
+	if err != nil || !reAttachmentName.MatchString(name) {
+		return ""
+	}
+	return path.Join("files", name)
+}
+
+//Removes a file from the store, logging rather than failing the request when it cannot
+func (h *handlerWithStore) removeFile(filePath string) {
+	if err := h.Store.DeleteFile(filePath); err != nil {
+		log.Warn().Str("path", filePath).Err(err).Msg("could not remove file from store")
+	}
+}
+
+//Binary content types that TiddlyWiki sends base64 encoded. SVG images are text and stay inline.
+func isAttachmentType(contentType string) bool {
+	if contentType == "image/svg+xml" {
+		return false
+	}
+	return reBinaryType.MatchString(contentType) || strings.HasPrefix(contentType, "image/") ||
+		strings.HasPrefix(contentType, "audio/") || strings.HasPrefix(contentType, "video/")
+}
+
+//Returns the revision the client based its write on, taken from an If-Match etag ("bag/title/revision:hash"). The revision field in the body is not used since the client keeps sending the one it loaded the tiddler with.
+func requestRevision(r *http.Request) (int, bool) {
+	return etagRevision(r.Header.Get("If-Match"))
+}
+
+//Returns the revision in an etag of a tiddler ("bag/title/revision:hash")
+func etagRevision(etag string) (int, bool) {
+	etag = strings.Trim(etag, `"`)
+	if etag == "" {
+		return 0, false
+	}
+	raw := etag[strings.LastIndex(etag, "/")+1:]
+	if i := strings.Index(raw, ":"); i >= 0 {
+		raw = raw[:i]
+	}
+	revision, err := strconv.Atoi(raw)
+	if err != nil {
+		return 0, false
+	}
+	return revision, true
+}
+
+//Hash of every field of the tiddler except its revision, so clients can tell whether the content changed even when revisions are unreliable
+func contentHash(t Tiddler) string {
+	content := make(Tiddler, len(t))
+	for k, v := range t {
+		if k != "revision" {
+			content[k] = v
+		}
+	}
+	//the same tags hash the same whether they were read from a file as a list or written as a TiddlyWiki list
+	if tags, ok := tagsAsString(t["tags"]); ok {
+		content["tags"] = tags
+	}
+	return fmt.Sprintf("%x", md5.Sum(content.Bytes()))
+}
+
+//Returns a scalar field value as a string, e.g. a title that was stored as a number
+func fieldAsString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64, int, int64, bool:
+		return fmt.Sprint(v), true
+	default:
+		return "", false
+	}
+}
+
+//Returns the tags field as a TiddlyWiki tag list, whether it is already a string or a list of strings
+func tagsAsString(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []string:
+		return formatTagList(v), true
+	case []interface{}:
+		tags := make([]string, len(v))
+		for i, t := range v {
+			tag, ok := t.(string)
+			if !ok {
+				return "", false
+			}
+			tags[i] = tag
+		}
+		return formatTagList(tags), true
+	default:
+		return "", false
+	}
+}
+
+//Converts a tiddler sent by the TiddlyWeb client (tags array, custom fields map) into the flat format kept in the store,
+//without the internalFields it may have been sent back with
+func flattenTiddlyWebFormat(newTiddler Tiddler) error {
+	// For some reason, the payload sent here is the only time this is an array and not a string
+	if foundTags, ok := newTiddler["tags"]; ok {
+		switch foundTags.(type) {
+		case []string, []interface{}:
+			if tags, ok := tagsAsString(foundTags); ok {
+				newTiddler["tags"] = tags
+			}
+		default:
+		}
+	}
+	// same for the fields
+	if foundFields, ok := newTiddler["fields"]; ok {
+		fields, ok := foundFields.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("fields must be an object of field names and values")
+		}
+		for f, v := range fields {
+			newTiddler[f] = v
+		}
+		delete(newTiddler, "fields")
+	}
+	for _, f := range internalFields {
+		delete(newTiddler, f)
+	}
+	return nil
+}
+
+//Imports a JSON array of tiddlers (e.g. exported from another wiki).
+//Imported tiddlers are stamped as created and modified now unless ?preserve-timestamps=true is given,
+//in which case created, modified and creator are kept verbatim so migrated history stays intact.
+//With ?atomic=true the tiddlers are imported all or nothing (see importAtomically).
+func (h *handlerWithStore) importTiddlers(w http.ResponseWriter, r *http.Request) {
+	preserveTimestamps := r.URL.Query().Get("preserve-timestamps") == "true"
+	var tids []Tiddler
+	if err := json.NewDecoder(r.Body).Decode(&tids); err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from request")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	log.Debug().Int("num_tiddlers", len(tids)).Bool("preserveTimestamps", preserveTimestamps).Str("idempotencyKey", idempotencyKey).Msg("importTiddlers")
 
-		// Grab the tiddlers and clean them up
-		tids, err := h.Store.GetAllTiddlers()
-		if err != nil {
-			log.Error().Err(err).Msg("could not read tiddlers from store")
-			http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
+	//held for the whole import, so that a save does not interleave with it, a retry with the same Idempotency-Key waits for the
+	//attempt under way before reading its progress, and the caches are reset once the import is written
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	var progress *importProgress
+	if idempotencyKey != "" {
+		var err error
+		if progress, err = readImportProgress(h.Store, idempotencyKey); err != nil {
+			log.Error().Err(err).Msg("could not read import progress")
+			http.Error(w, fmt.Sprintf("could not read import progress: %s", err.Error()), http.StatusInternalServerError)
 			return
 		}
-		rawMarkupTiddlers := make(map[string][]Tiddler)
-		rawMarkupTiddlers["head"] = make([]Tiddler, 0)
-		rawMarkupTiddlers["body-top"] = make([]Tiddler, 0)
-		rawMarkupTiddlers["body-bottom"] = make([]Tiddler, 0)
-		for i, tid := range tids {
+	}
+
+	if r.URL.Query().Get("atomic") == "true" {
+		h.importAtomically(w, r, tids, preserveTimestamps, progress)
+		return
+	}
 
-			// This is here because the TiddlyWeb plugin will not issue a DELETE request if the tiddler is not in a bag
-			// https://github.com/Jermolene/TiddlyWiki5/blob/master/plugins/tiddlywiki/tiddlyweb/tiddlywebadaptor.js#L250-L253
-			if _, ok := tid["bag"]; !ok {
-				tids[i]["bag"] = bag
+	timestamp := formatTiddlerTime(time.Now())
+	imported := make([]string, 0)
+	skipped := make([]string, 0)
+	failed := make(map[string]string)
+	for i, tid := range tids {
+		title, ok := tid["title"].(string)
+		if !ok || title == "" {
+			failed[fmt.Sprintf("#%d", i)] = "tiddler has no title"
+			continue
+		}
+		if progress != nil && progress.done[title] {
+			skipped = append(skipped, title)
+			continue
+		}
+		stored, err := h.prepareImportedTiddler(tid, timestamp, preserveTimestamps)
+		if err != nil {
+			failed[title] = err.Error()
+			continue
+		}
+		if stored != nil {
+			if err := h.keepRevision(title, stored); err != nil {
+				log.Error().Str("title", title).Err(err).Msg("could not keep tiddler revision in store")
+				failed[title] = err.Error()
+				continue
 			}
-			// TiddlyWeb format is not expected in this store
-			log.Trace().Interface("tid", tid).Msg("checking to see if it is a rawmarkup tiddler")
-			if tagsRaw, ok := tid["tags"]; ok {
-				switch tagsRaw.(type) {
-				case []interface{}:
-					tags := make([]string, len(tagsRaw.([]interface{})))
-					for j, t := range tagsRaw.([]interface{}) {
-						tags[j] = t.(string)
-					}
-					tids[i]["tags"] = strings.Join(tags, " ")
-				case []string:
-					tids[i]["tags"] = strings.Join(tagsRaw.([]string), " ")
-				case string, interface{}: // assume it's a string already
-				default:
-					log.Fatal().Str("title", tid["title"].(string)).Str("tags_type", fmt.Sprintf("%T", tagsRaw)).Interface("tagsRaw", tagsRaw).Msg("unexpected type for tags field")
-				}
-				if strings.Contains(tids[i]["tags"].(string), "$:/tags/RawMarkup") && tids[i]["text"] != nil {
-					if strings.Contains(tid["tags"].(string), "/TopBody") {
-						rawMarkupTiddlers["body-top"] = append(rawMarkupTiddlers["body-top"], tid)
-					} else if strings.Contains(tid["tags"].(string), "/BottomBody") {
-						rawMarkupTiddlers["body-bottom"] = append(rawMarkupTiddlers["body-bottom"], tid)
-					} else {
-						rawMarkupTiddlers["head"] = append(rawMarkupTiddlers["head"], tid)
-					}
+		}
+		if err := h.Store.WriteTiddler(tid); err != nil {
+			log.Error().Str("title", title).Err(err).Msg("could not import tiddler")
+			failed[title] = err.Error()
+			continue
+		}
+		h.reconciled.wrote(title)
+		h.notifyWebhook(r, WebhookPut, title)
+		imported = append(imported, title)
+		if progress != nil {
+			progress.add(title)
+			if len(imported)%importProgressInterval == 0 {
+				if err := progress.write(h.Store); err != nil {
+					log.Warn().Err(err).Msg("could not save import progress")
 				}
 			}
 		}
-		log.Trace().Interface("rawMarkupTiddlers", rawMarkupTiddlers).Send()
+	}
+	h.resetCaches()
+
+	result := map[string]interface{}{
+		"imported": imported,
+		"failed":   failed,
+	}
+	if progress != nil {
+		if err := progress.write(h.Store); err != nil {
+			log.Warn().Err(err).Msg("could not save import progress")
+		}
+		result["skipped"] = skipped
+		result["progress"] = map[string]int{
+			"total": len(tids),
+			"done":  len(imported) + len(skipped),
+		}
+	}
+	render.JSON(w, r, result)
+}
+
+//Readies an imported tiddler to be written over the stored one of the same title, if any, which is returned. It gets the
+//next revision, as putTiddler gives, so that syncing clients fetch it again.
+func (h *handlerWithStore) prepareImportedTiddler(tid Tiddler, timestamp string, preserveTimestamps bool) (Tiddler, error) {
+	if err := flattenTiddlyWebFormat(tid); err != nil {
+		return nil, err
+	}
+	if !preserveTimestamps {
+		tid["created"] = timestamp
+		tid["modified"] = timestamp
+	}
+	existing, err := h.Store.GetTiddler(tid["title"].(string))
+	if err != nil {
+		return nil, nil
+	}
+	old, _ := strconv.Atoi(existing.Field("revision"))
+	tid.setField("revision", strconv.Itoa(old+1))
+	return existing, nil
+}
 
-		// Read in the index file and include the tiddlers into the store
-		indexReader, err := h.Store.ReadFile("index.html")
+//Imports the tiddlers all or nothing. Every tiddler is checked before any is written, answering 422 with the failures if one
+//cannot be, and should a write still fail, the tiddlers written before it are rolled back: those they replaced are written again
+//and those that were new are deleted, which removes their objects from a bucket. Called holding muWrite, so that a rollback
+//never puts back a tiddler over one saved meanwhile.
+func (h *handlerWithStore) importAtomically(w http.ResponseWriter, r *http.Request, tids []Tiddler, preserveTimestamps bool, progress *importProgress) {
+	timestamp := formatTiddlerTime(time.Now())
+	staged := make([]Tiddler, 0, len(tids))
+	replaced := make([]importedTiddler, 0)
+	skipped := make([]string, 0)
+	failed := make(map[string]string)
+	for i, tid := range tids {
+		title, ok := tid["title"].(string)
+		if !ok || title == "" {
+			failed[fmt.Sprintf("#%d", i)] = "tiddler has no title"
+			continue
+		}
+		if progress != nil && progress.done[title] {
+			skipped = append(skipped, title)
+			continue
+		}
+		stored, err := h.prepareImportedTiddler(tid, timestamp, preserveTimestamps)
 		if err != nil {
-			log.Error().Err(err).Msg("can't open the index file!")
-			http.Error(w, fmt.Sprintf("can't open the index file!: %s", "index.html"), http.StatusInternalServerError)
+			failed[title] = err.Error()
+			continue
+		}
+		//the stores write tiddler files, so one that cannot be written as a file would fail midway
+		if err := (&TiddlerFile{tid: tid}).Write(io.Discard); err != nil {
+			failed[title] = err.Error()
+			continue
+		}
+		staged = append(staged, tid)
+		if stored != nil {
+			replaced = append(replaced, importedTiddler{title, stored})
+		}
+	}
+	if len(failed) > 0 {
+		log.Warn().Int("num_failed", len(failed)).Msg("atomic import refused, no tiddler was written")
+		render.Status(r, http.StatusUnprocessableEntity)
+		render.JSON(w, r, map[string]interface{}{"imported": []string{}, "failed": failed})
+		return
+	}
+	//the tiddlers replaced go to the history before any is written, so that a failure to keep one leaves them all as they were
+	for _, tid := range replaced {
+		if err := h.keepRevision(tid.title, tid.previous); err != nil {
+			log.Error().Str("title", tid.title).Err(err).Msg("could not keep tiddler revision in store, atomic import refused")
+			failed[tid.title] = err.Error()
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, map[string]interface{}{"imported": []string{}, "failed": failed})
 			return
 		}
-		reader := bufio.NewReader(indexReader)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil && err != io.EOF {
-				log.Error().Err(err).Msg("could not read line in index file")
-				http.Error(w, fmt.Sprintf("could not read line in index file: %s", err.Error()), http.StatusInternalServerError)
-				return
-			}
-			pageBytes.WriteString(line)
-			if strings.Contains(line, "<!--~~ Ordinary tiddlers ~~-->") {
-				pageBytes.WriteString(`<script class="tiddlywiki-tiddler-store" type="application/json">` + "\n")
-				var b bytes.Buffer
-				if err := json.NewEncoder(&b).Encode(tids); err != nil {
-					log.Error().Err(err).Msg("could not encode tiddlers into json for index")
-					http.Error(w, fmt.Sprintf("could not encode tiddlers into json for index: %s", err.Error()), http.StatusInternalServerError)
-					return
-				}
-				pageBytes.WriteString(strings.ReplaceAll(b.String(), "<", "\u003c"))
-				// pageBytes.WriteString(strings.ReplaceAll(strings.ReplaceAll(b.String(), "<", "\u003c"), "},{", "},\n{"))
-				pageBytes.WriteString("</script>\n")
-			} else if strings.Contains(line, "<!--~~ Raw markup for the top of the head section ~~-->") {
-				for _, tid := range rawMarkupTiddlers["head"] {
-					pageBytes.WriteString(tid["text"].(string))
-				}
-			} else if strings.Contains(line, "<!--~~ Raw markup for the top of the body section ~~-->") {
-				for _, tid := range rawMarkupTiddlers["body-top"] {
-					pageBytes.WriteString(tid["text"].(string))
-				}
-			} else if strings.Contains(line, "<!--~~ Raw markup for the bottom of the body section ~~-->") {
-				for _, tid := range rawMarkupTiddlers["body-bottom"] {
-					pageBytes.WriteString(tid["text"].(string))
-				}
-			}
-			if err == io.EOF {
-				break
+	}
+
+	written := make([]importedTiddler, 0, len(staged))
+	for _, tid := range staged {
+		title := tid["title"].(string)
+		previous, err := h.Store.GetTiddler(title)
+		if err != nil {
+			previous = nil
+		}
+		h.reconciled.wrote(title)
+		if err := h.Store.WriteTiddler(tid); err != nil {
+			log.Error().Str("title", title).Err(err).Msg("could not import tiddler, rolling back the atomic import")
+			failed[title] = err.Error()
+			result := map[string]interface{}{"imported": []string{}, "failed": failed}
+			if notRolledBack := h.rollbackImport(written); len(notRolledBack) > 0 {
+				result["not_rolled_back"] = notRolledBack
 			}
+			h.resetCaches()
+			render.Status(r, http.StatusInternalServerError)
+			render.JSON(w, r, result)
+			return
 		}
-
-		page = pageBytes.String()
-		h.setIndexCache([]byte(page))
+		written = append(written, importedTiddler{title, previous})
 	}
+	h.resetCaches()
 
-	log.Info().
-		Int("len", len(page)).
-		Dur("ellapsed", time.Since(start)).
-		Float64("ellapsed_min", time.Since(start).Minutes()).
-		Msg("sending index")
-
-	render.HTML(w, r, page)
+	imported := make([]string, 0, len(written))
+	for _, tid := range written {
+		imported = append(imported, tid.title)
+		h.notifyWebhook(r, WebhookPut, tid.title)
+	}
+	result := map[string]interface{}{"imported": imported, "failed": failed}
+	if progress != nil {
+		for _, title := range imported {
+			progress.add(title)
+		}
+		if err := progress.write(h.Store); err != nil {
+			log.Warn().Err(err).Msg("could not save import progress")
+		}
+		result["skipped"] = skipped
+		result["progress"] = map[string]int{"total": len(tids), "done": len(imported) + len(skipped)}
+	}
+	render.JSON(w, r, result)
 }
 
-func (h *handlerWithStore) favicon(w http.ResponseWriter, r *http.Request) {
-	icon := h.getFaviconCache()
+//A tiddler written by an atomic import, with the tiddler it replaced or nil if it was new
+type importedTiddler struct {
+	title    string
+	previous Tiddler
+}
 
-	if len(icon) == 0 {
-		tid, err := h.Store.GetTiddler("$:/favicon.ico")
+//Undoes the writes of an atomic import, latest first so a title imported twice gets back what it had before the import.
+//Returns why each tiddler that could not be put back failed.
+func (h *handlerWithStore) rollbackImport(written []importedTiddler) map[string]string {
+	failed := make(map[string]string)
+	for i := len(written) - 1; i >= 0; i-- {
+		var err error
+		if written[i].previous != nil {
+			err = h.Store.WriteTiddler(written[i].previous)
+		} else {
+			err = h.Store.DeleteTiddler(written[i].title)
+		}
 		if err != nil {
-			log.Warn().Err(err).Msg("could not find $:/favicon.ico")
-			http.Error(w, fmt.Sprintf("could not find $:/favicon.ico: %s", err.Error()), http.StatusNotFound)
-			return
+			log.Error().Str("title", written[i].title).Err(err).Msg("could not roll back imported tiddler")
+			failed[written[i].title] = err.Error()
 		}
-		var buf bytes.Buffer
-		buf.Write(tid["text"].([]byte))
-		icon = buf.Bytes()
-		h.setFaviconCache(icon)
 	}
+	log.Info().Int("num_tiddlers", len(written)-len(failed)).Msg("rolled back atomic import")
+	return failed
+}
 
-	w.Header().Set("Content-Type", "image/x-icon")
-	w.Write(icon)
+//How many imported tiddlers are written between saves of an import's progress marker
+const importProgressInterval = 100
+
+//The titles already written by an import with a given Idempotency-Key, kept in the wiki's imports folder
+//so that a retried import skips them. Markers are kept after the import completes, so a retry of a finished import is a no-op.
+type importProgress struct {
+	key      string
+	Imported []string `json:"imported"`
+	done     map[string]bool
 }
 
-func (h *handlerWithStore) loginBasic(w http.ResponseWriter, r *http.Request) {
-	auth, ok := r.Context().Value("auth").(authContext)
-	log.Trace().Interface("auth", auth).Bool("ok", ok).Msg("checking logged in user?")
-	if auth.Username == "" || auth.Username == AuthAnonUsername {
-		w.Header().Set("WWW-Authenticate", `Basic realm="Please provide your username and password to login"`)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+func importProgressPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join("imports", hex.EncodeToString(sum[:])+".json")
+}
+
+//Reads the progress of the import with the key, which is empty if it has not been seen before
+func readImportProgress(store TiddlerStore, key string) (*importProgress, error) {
+	progress := &importProgress{key: key, Imported: []string{}, done: make(map[string]bool)}
+	b, err := readAllFromStore(store, importProgressPath(key))
+	if err != nil {
+		//the stores report a missing file differently, so any read error is taken to mean there is no marker yet
+		return progress, nil
+	}
+	if err := json.Unmarshal(b, progress); err != nil {
+		return nil, fmt.Errorf("import progress for key %s is corrupt: %w", key, err)
 	}
+	for _, title := range progress.Imported {
+		progress.done[title] = true
+	}
+	return progress, nil
+}
 
-	log.Info().Str("username", auth.Username).Msg("successfully logged in")
-	http.Redirect(w, r, "/", http.StatusFound) // TODO: server prefix
+func (p *importProgress) add(title string) {
+	p.Imported = append(p.Imported, title)
+	p.done[title] = true
 }
 
-func (h *handlerWithStore) status(w http.ResponseWriter, r *http.Request) {
-	auth, ok := r.Context().Value("auth").(authContext)
-	log.Trace().Interface("auth", auth).Bool("ok", ok).Msg("found creds")
-	if !ok {
-		log.Warn().Msg("no auth context found!")
+func (p *importProgress) write(store TiddlerStore) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
 	}
-	render.JSON(w, r, map[string]interface{}{
-		"username":             auth.Username,
-		"anonymous":            auth.CanBeAnonymous,
-		"read_only":            !auth.WritingAllowed,
-		"space":                map[string]interface{}{"recipe": bag},
-		"tiddlywiki_version":   "5.2.3",  // TODO: How to identify this?
-		"tiddlybucket_version": "v0.0.0", // TODO: How to identify this?
-	})
+	return store.WriteFile(importProgressPath(p.key), b)
 }
 
-func (h *handlerWithStore) getSkinnyTiddlerList(w http.ResponseWriter, r *http.Request) {
-	recipe := chi.URLParam(r, "recipe")   // ignoring
-	filter := r.URL.Query().Get("filter") // ignoring
-	log.Debug().Str("recipe", recipe).Str("filter", filter).Msg("getSkinnyTiddlerList()")
+//Creates a tiddler under a title picked by the server (a timestamp, suffixed with a number if already taken) and returns its title and location
+func (h *handlerWithStore) createTiddler(w http.ResponseWriter, r *http.Request) {
+	var newTiddler Tiddler
+	if err := newTiddler.Read(r.Body); err != nil {
+		log.Error().Err(err).Msg("could not read tiddler from request")
+		http.Error(w, fmt.Sprintf("could not read tiddler from request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err := flattenTiddlyWebFormat(newTiddler); err != nil {
+		http.Error(w, fmt.Sprintf("could not read tiddler from request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
 
-	skinny := h.getSkinnyListCache()
-	if len(skinny) <= 0 {
-		log.Trace().Msg("creating skinny tiddler list")
-		tids, err := h.Store.GetAllTiddlers()
-		if err != nil {
-			log.Error().Err(err).Msg("could not read tiddlers from store")
-			http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()),
-				http.StatusInternalServerError)
-			return
-		}
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
 
-		skinny = make([]Tiddler, 0)
-		for i := range tids {
-			if strings.HasPrefix(tids[i]["title"].(string), "$:/") {
-				continue
-			}
-			var keeptext bool
-			if tagsRaw, ok := tids[i]["tags"]; ok {
-				// skinny list only unless the tiddler text if it's a macro
-				// basing this entirely on @rsc's comment here: https://github.com/rsc/tiddly/blob/master/tiddly.go#L160-L164
-				switch tagsRaw.(type) {
-				case []interface{}:
-					for _, t := range tagsRaw.([]interface{}) {
-						if !strings.Contains(t.(string), "$:/tags/Macro") {
-							keeptext = true
-							break
-						}
-					}
-					/*
-							case []string:
-						if !strings.Contains(strings.Join(tagsRaw.([]string), " "), "$:/tags/Macro") {
-							keeptext = true
-							break
-						}
-					*/
-				case string, interface{}:
-					if strings.Contains(tagsRaw.(string), "$:/tags/Macro") {
-						keeptext = true
-					}
-				default:
-					log.Fatal().Str("title", tids[i]["tags"].(string)).Str("tags_type", fmt.Sprintf("%T", tagsRaw)).Msg("unexpected type for tags field")
-				}
-			}
-			// copy each field independently to make sure you don't mess with the store cache
-			skinnyTid := make(Tiddler)
-			for k, v := range tids[i] {
-				if k == "text" && !keeptext {
-					continue
-				}
-				skinnyTid[k] = v
-			}
-			skinny = append(skinny, skinnyTid)
-			log.Trace().Str("title", skinnyTid["title"].(string)).Interface("skinny", skinnyTid).Msg("added to skinny list")
+	timestamp := formatTiddlerTime(time.Now())
+	title := timestamp
+	for i := 2; ; i++ {
+		if _, err := h.Store.GetTiddler(title); err != nil {
+			break
 		}
+		title = fmt.Sprintf("%s %d", timestamp, i)
+	}
+	newTiddler["title"] = title
+	if newTiddler.Field("created") == "" {
+		newTiddler["created"] = timestamp
+	}
+	if newTiddler.Field("modified") == "" {
+		newTiddler["modified"] = timestamp
+	}
+	log.Debug().Str("title", title).Msg("createTiddler")
 
-		h.setSkinnyListCache(skinny)
+	if err := h.Store.WriteTiddler(newTiddler); err != nil {
+		log.Error().Err(err).Msg("could not add tiddler to store")
+		http.Error(w, fmt.Sprintf("could not add tiddler to store: %s", err.Error()), http.StatusInternalServerError)
+		return
 	}
+	h.tiddlerChanged(title, newTiddler)
 
-	render.JSON(w, r, skinny)
+	w.Header().Set("Location", fmt.Sprintf("/%s/recipes/%s/tiddlers/%s", chi.URLParam(r, "wiki"), chi.URLParam(r, "recipe"), url.PathEscape(title)))
+	w.Header().Set("Etag", fmt.Sprintf("\"%s/%s/%d:%x\"", h.bagFor(title), url.QueryEscape(title), 0, md5.Sum(newTiddler.Bytes())))
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, map[string]string{"title": title})
 }
 
-func (h *handlerWithStore) getTiddler(w http.ResponseWriter, r *http.Request) {
-	recipe := chi.URLParam(r, "recipe") // unused
+//Merges a JSON object of fields into an existing tiddler, removing the fields set to null
+func (h *handlerWithStore) patchTiddler(w http.ResponseWriter, r *http.Request) {
 	tiddlerNameRaw := chi.URLParam(r, "*")
 	if tiddlerNameRaw == "" {
 		log.Error().Msg("tiddler name not provided")
@@ -761,121 +3691,248 @@ func (h *handlerWithStore) getTiddler(w http.ResponseWriter, r *http.Request) {
 	tiddlerName, err := url.PathUnescape(tiddlerNameRaw)
 	if err != nil {
 		log.Error().Str("tiddlerNameRaw", tiddlerNameRaw).Err(err).Msg("could not unescape tiddler name")
-		http.Error(w, fmt.Sprintf("could not read tiddler name: %s", err.Error()), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("could not read tiddler name: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
-	log.Debug().Str("recipe", recipe).Str("tiddlerName", tiddlerName).Msg("getTiddler")
-
-	if tiddlerName == "$:/StoryList" {
-		log.Info().Msg("skipped reading StoryList")
+	var patch Tiddler
+	if err := patch.Read(r.Body); err != nil {
+		log.Error().Err(err).Msg("could not read fields from request")
+		http.Error(w, fmt.Sprintf("could not read fields from request: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+	if err := flattenTiddlyWebFormat(patch); err != nil {
+		http.Error(w, fmt.Sprintf("could not read fields from request: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
+	log.Debug().Str("tiddlerName", tiddlerName).Interface("patch", patch).Msg("patchTiddler")
 
-	tid, err := h.Store.GetTiddler(tiddlerName)
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	existing, err := h.Store.GetTiddler(tiddlerName)
 	if err != nil {
-		log.Error().Err(err).Msg("could not read tiddler from store")
-		http.Error(w, fmt.Sprintf("could not read tiddler from store: %s", err.Error()), http.StatusNotFound)
+		log.Warn().Str("tiddlerName", tiddlerName).Err(err).Msg("could not find tiddler to patch")
+		http.Error(w, fmt.Sprintf("could not find tiddler %s", tiddlerName), http.StatusNotFound)
 		return
 	}
 
-	log.Trace().Interface("tid", tid).Msg("found tiddler")
+	// merge into a copy so a failed write leaves the store cache untouched
+	updated := make(Tiddler, len(existing)+len(patch))
+	for k, v := range existing {
+		updated[k] = v
+	}
+	for k, v := range patch {
+		switch k {
+		case "title", "revision":
+			continue // the title is taken from the path and the revision is the server's
+		}
+		if v == nil {
+			delete(updated, k)
+			continue
+		}
+		value, ok := fieldAsString(v)
+		if !ok {
+			http.Error(w, fmt.Sprintf("field %s must be a string, number, boolean or null", k), http.StatusBadRequest)
+			return
+		}
+		updated[k] = value
+	}
+	oldRevision, _ := fieldAsString(existing["revision"])
+	revision, _ := strconv.Atoi(oldRevision)
+	revision++
+	updated.setField("revision", strconv.Itoa(revision))
+	if err := h.keepRevision(tiddlerName, existing); err != nil {
+		log.Error().Err(err).Msg("could not keep tiddler revision in store")
+		http.Error(w, fmt.Sprintf("could not keep revision %d of %s in store: %s", revision-1, tiddlerName, err.Error()), http.StatusInternalServerError)
+		return
+	}
 
-	render.JSON(w, r, tid)
-}
+	if err := h.Store.WriteTiddler(updated); err != nil {
+		log.Error().Err(err).Msg("could not write patched tiddler to store")
+		http.Error(w, fmt.Sprintf("could not write patched tiddler to store: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	h.tiddlerChanged(tiddlerName, updated)
 
-func (h *handlerWithStore) putTiddler(w http.ResponseWriter, r *http.Request) {
-	h.resetCaches()
+	w.Header().Add("Etag", fmt.Sprintf("\"%s/%s/%d:%x\"", h.bagFor(tiddlerName), url.QueryEscape(tiddlerName), revision, md5.Sum(updated.Bytes())))
+	render.NoContent(w, r)
+}
 
-	recipe := chi.URLParam(r, "recipe")
-	tiddlerNameRaw := chi.URLParam(r, "*")
-	if tiddlerNameRaw == "" {
-		log.Error().Msg("tiddler name not provided")
-		http.Error(w, "tiddler name not provided", http.StatusBadRequest)
+//Replaces a tag on every tiddler carrying it. The body is {"old": "project-x", "new": "project-y"}.
+func (h *handlerWithStore) renameTag(w http.ResponseWriter, r *http.Request) {
+	var rename struct {
+		Old, New string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rename); err != nil {
+		log.Error().Err(err).Msg("could not read tag rename from request")
+		http.Error(w, fmt.Sprintf("could not read tag rename from request: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
-	tiddlerName, err := url.PathUnescape(tiddlerNameRaw)
-	if err != nil {
-		log.Error().Str("tiddlerNameRaw", tiddlerNameRaw).Err(err).Msg("could not unescape tiddler name")
-		http.Error(w, fmt.Sprintf("could not read tiddler name: %s", err.Error()), http.StatusInternalServerError)
+	if rename.Old == "" || rename.New == "" {
+		http.Error(w, "both the old and new tag must be given", http.StatusBadRequest)
 		return
 	}
-	log.Debug().Str("recipe", recipe).Str("tiddlerName", tiddlerName).Msg("putTiddler")
+	log.Debug().Str("old", rename.Old).Str("new", rename.New).Msg("renameTag")
 
-	var newTiddler Tiddler
-	if err := newTiddler.Read(r.Body); err != nil {
-		log.Error().Err(err).Msg("could not read tiddler from request")
-		http.Error(w, fmt.Sprintf("could not read tiddler from request: %s", err.Error()), http.StatusInternalServerError)
+	//held from reading the tiddlers to writing them back, so that a save meanwhile is not overwritten by the copy read before it
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	tids, err := h.Store.GetAllTiddlers()
+	if err != nil {
+		log.Error().Err(err).Msg("could not read tiddlers from store")
+		http.Error(w, fmt.Sprintf("could not read tiddlers from store: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
-	// For some reason, the payload sent here is the only time this is an array and not a string
-	if foundTags, ok := newTiddler["tags"]; ok {
-		switch foundTags.(type) {
-		case []string, []interface{}:
-			tags := make([]string, 0)
-			for _, t := range foundTags.([]interface{}) {
-				t := t.(string)
-				if len(strings.Split(t, " ")) > 1 {
-					t = fmt.Sprintf("[[%s]]", t)
-				}
-				tags = append(tags, t)
+
+	timestamp := formatTiddlerTime(time.Now())
+	changed := 0
+	failed := make(map[string]string)
+	for _, tid := range tids {
+		tagList, ok := tagsAsString(tid["tags"])
+		if !ok {
+			continue
+		}
+		tags := parseTagList(tagList)
+		renamed := make([]string, 0, len(tags))
+		found, hasNew := false, false
+		for _, tag := range tags {
+			hasNew = hasNew || tag == rename.New
+		}
+		for _, tag := range tags {
+			switch {
+			case tag == rename.Old && !hasNew:
+				renamed = append(renamed, rename.New)
+				found = true
+			case tag == rename.Old:
+				found = true
+			default:
+				renamed = append(renamed, tag)
 			}
-			newTiddler["tags"] = strings.Join(tags, " ")
-		default:
 		}
-	}
-	// same for the fields
-	if foundFields, ok := newTiddler["fields"]; ok {
-		for f, v := range foundFields.(map[string]interface{}) {
-			newTiddler[f] = v
+		if !found {
+			continue
 		}
-		delete(newTiddler, "fields")
+
+		// write a copy so a failed write leaves the store cache untouched
+		title, _ := fieldAsString(tid["title"])
+		updated := make(Tiddler, len(tid))
+		for k, v := range tid {
+			updated[k] = v
+		}
+		oldRevision, _ := fieldAsString(updated["revision"])
+		revision, _ := strconv.Atoi(oldRevision)
+		updated["tags"] = formatTagList(renamed)
+		updated["modified"] = timestamp
+		updated.setField("revision", strconv.Itoa(revision+1))
+		if err := h.keepRevision(title, tid); err != nil {
+			log.Error().Str("title", title).Err(err).Msg("could not keep tiddler revision in store")
+			failed[title] = err.Error()
+			continue
+		}
+		if err := h.Store.WriteTiddler(updated); err != nil {
+			log.Error().Str("title", title).Err(err).Msg("could not write renamed tags")
+			failed[title] = err.Error()
+			continue
+		}
+		h.reconciled.wrote(title)
+		changed++
+	}
+	if changed > 0 {
+		h.resetCaches()
 	}
-	log.Trace().Interface("newTiddler", newTiddler).Send()
 
-	revision := 0
-	etag := func() string {
-		return fmt.Sprintf("\"%s/%s/%d:%x\"", bag, url.QueryEscape(tiddlerName), revision, md5.Sum(newTiddler.Bytes()))
+	render.JSON(w, r, map[string]interface{}{
+		"changed": changed,
+		"failed":  failed,
+	})
+}
+
+//Lists the file backing each tiddler, along with the titles that share a file or differ only by case, to diagnose lossy filenames and duplicate titles.
+func (h *handlerWithStore) debugFiles(w http.ResponseWriter, r *http.Request) {
+	paths := h.Store.TiddlerPaths()
+
+	titlesByPath := make(map[string][]string)
+	for title, path := range paths {
+		titlesByPath[path] = append(titlesByPath[path], title)
+	}
+	sharedFiles := [][]string{}
+	for _, titles := range titlesByPath {
+		if len(titles) > 1 {
+			sort.Strings(titles)
+			sharedFiles = append(sharedFiles, titles)
+		}
+	}
+	sort.Slice(sharedFiles, func(i, j int) bool { return sharedFiles[i][0] < sharedFiles[j][0] })
+	caseCollisions := findCaseCollisions(paths)
+	if caseCollisions == nil {
+		caseCollisions = [][]string{}
 	}
 
-	// TODO: check out that the etag passed in matches
-	// TODO: the title of an existing tiddler is not overwritten
+	render.JSON(w, r, map[string]interface{}{
+		"files":           paths,
+		"shared_files":    sharedFiles,
+		"case_collisions": caseCollisions,
+	})
+}
 
-	if tiddlerName == "$:/StoryList" {
-		log.Info().Msg("skipped writing StoryList")
-		w.Header().Add("Etag", etag())
-		render.NoContent(w, r)
+//Removes the empty folders and orphaned .meta files deleted and renamed tiddlers left behind, rebuilding the index, and reports what was removed.
+func (h *handlerWithStore) compact(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	report, err := h.Store.Compact()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to compact wiki")
+		http.Error(w, fmt.Sprintf("Unable to compact wiki: %s", err.Error()), http.StatusInternalServerError)
 		return
 	}
+	h.resetCaches()
 
-	// get the rev of the existing, if it does exist
-	if tid, err := h.Store.GetTiddler(tiddlerName); err == nil {
-		old, _ := strconv.Atoi(tid.Field("revision"))
-		revision += old
-		newTiddler.setField("revision", strconv.Itoa(revision))
-	}
+	log.Info().
+		Int("empty_dirs", len(report.EmptyDirs)).
+		Int("orphaned_meta", len(report.OrphanedMeta)).
+		Dur("ellapsed", time.Since(start)).
+		Msg("sending compact")
 
-	if err := h.Store.WriteTiddler(newTiddler); err != nil {
-		log.Error().Err(err).Msg("could not add tiddler to store")
-		http.Error(w, fmt.Sprintf("could not add tiddler to store: %s", err.Error()), http.StatusInternalServerError)
+	render.JSON(w, r, report)
+}
+
+//Deletes each title of a JSON array of titles, reporting which were deleted and why the others failed. Each deleted tiddler
+//updates the caches and is reported to the webhook, as deleteTiddler does.
+func (h *handlerWithStore) deleteTiddlers(w http.ResponseWriter, r *http.Request) {
+	var titles []string
+	if err := json.NewDecoder(r.Body).Decode(&titles); err != nil {
+		log.Error().Err(err).Msg("could not read titles from request")
+		http.Error(w, fmt.Sprintf("could not read titles from request: %s", err.Error()), http.StatusBadRequest)
 		return
 	}
+	log.Debug().Int("num_titles", len(titles)).Msg("deleteTiddlers")
 
-	if log.Logger.GetLevel() <= zerolog.TraceLevel {
-		log.Trace().Interface("newTiddler", newTiddler).Msg("ostensibly wrote this?")
-		if tid, err := h.Store.GetTiddler(tiddlerName); err == nil {
-			log.Trace().Interface("tid", tid).Msg("reading it back")
+	deleted := make([]string, 0)
+	failed := make(map[string]string)
+	wiki := chi.URLParam(r, "wiki")
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	for _, title := range titles {
+		stored, _ := h.Store.GetTiddler(title)
+		if err := h.Store.DeleteTiddler(title); err != nil {
+			log.Error().Str("title", title).Err(err).Msg("could not delete tiddler from store")
+			failed[title] = err.Error()
+			continue
 		}
-		log.Trace().Interface("newTiddler", newTiddler).Msg("ostensibly wrote this?")
-		log.Trace().Str("title", newTiddler["title"].(string)).Msg("reseting index cache after PUT")
+		if attachment := attachmentPath(wiki, stored); attachment != "" {
+			h.removeFile(attachment)
+		}
+		h.tiddlerChanged(title, nil)
+		h.notifyWebhook(r, WebhookDelete, title)
+		deleted = append(deleted, title)
 	}
-
-	w.Header().Add("Etag", etag())
-	render.NoContent(w, r)
+
+	render.JSON(w, r, map[string]interface{}{
+		"deleted": deleted,
+		"failed":  failed,
+	})
 }
 
+//Deletes a tiddler, answering 204 as TiddlyWeb does so the syncer knows the delete went through
 func (h *handlerWithStore) deleteTiddler(w http.ResponseWriter, r *http.Request) {
-	h.resetCaches()
-
 	bag := chi.URLParam(r, "bag")
 	tiddlerNameRaw := chi.URLParam(r, "*")
 	if tiddlerNameRaw == "" {
@@ -886,14 +3943,25 @@ func (h *handlerWithStore) deleteTiddler(w http.ResponseWriter, r *http.Request)
 	tiddlerName, err := url.PathUnescape(tiddlerNameRaw)
 	if err != nil {
 		log.Error().Str("tiddlerNameRaw", tiddlerNameRaw).Err(err).Msg("could not unescape tiddler name")
-		http.Error(w, fmt.Sprintf("could not unescape tiddler name: %s", err.Error()), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("could not unescape tiddler name: %s", err.Error()), http.StatusBadRequest)
+		return
 	}
 	log.Debug().Str("bag", bag).Str("tiddlerName", tiddlerName).Msg("deleteTiddler")
 
+	h.muWrite.Lock()
+	defer h.muWrite.Unlock()
+	stored, _ := h.Store.GetTiddler(tiddlerName)
 	if err := h.Store.DeleteTiddler(tiddlerName); err != nil {
 		log.Error().Str("tiddlerName", tiddlerName).Err(err).Msg("could not delete tiddler from store")
 		http.Error(w, fmt.Errorf("could not delete tiddler from store: %s", err.Error()).Error(), http.StatusInternalServerError)
+		return
+	}
+	if attachment := attachmentPath(chi.URLParam(r, "wiki"), stored); attachment != "" {
+		h.removeFile(attachment)
 	}
+	h.tiddlerChanged(tiddlerName, nil)
+	h.notifyWebhook(r, WebhookDelete, tiddlerName)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func zerologger(logger zerolog.Logger) func(http.Handler) http.Handler {
@@ -927,11 +3995,348 @@ func zerologger(logger zerolog.Logger) func(http.Handler) http.Handler {
 	}
 }
 
+//Sets the default headers, as overridden by the configured ones, on every response
+func responseHeaders(configured map[string]string) func(http.Handler) http.Handler {
+	headers := make(map[string]string, len(defaultResponseHeaders)+len(configured))
+	for name, value := range defaultResponseHeaders {
+		headers[http.CanonicalHeaderKey(name)] = value
+	}
+	for name, value := range configured {
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(headers, name)
+		} else {
+			headers[name] = value
+		}
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range headers {
+				w.Header().Set(name, value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//Methods and request headers a cross-origin page may use, which are those TiddlyWeb clients send
+const (
+	corsAllowMethods  = "GET, HEAD, PUT, POST, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, If-Match, X-Requested-With"
+	corsExposeHeaders = "Etag, Location, Link, X-Total-Count"
+)
+
+//Sends the CORS headers letting pages of the allowed origins call the server, and answers their preflight requests.
+//A listed origin is echoed back with credentials allowed, so a page can send Basic Auth. * lets any origin read what
+//visitors without credentials may, as browsers never send credentials to a wildcard origin.
+func cors(allowedOrigins []string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(allowedOrigins))
+	var anyOrigin bool
+	for _, origin := range allowedOrigins {
+		if origin == "*" {
+			anyOrigin = true
+			continue
+		}
+		allowed[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			switch {
+			case origin == "":
+				next.ServeHTTP(w, r)
+				return
+			case allowed[strings.ToLower(origin)]:
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			case anyOrigin:
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			default:
+				//left without CORS headers, so the browser keeps the response from the page
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//Checks an allowed origin is * or a scheme and host, with no path, as browsers send them in the Origin header
+func checkOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(strings.TrimSuffix(origin, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+		return fmt.Errorf("allowed origin %q is not * or a scheme and host such as https://example.com", origin)
+	}
+	return nil
+}
+
+//Limits how many requests each client (its username, or its IP address when anonymous) may have in flight, answering 429 beyond that
+func limitPerClient(max int) func(http.Handler) http.Handler {
+	var (
+		mu       sync.Mutex
+		inFlight = make(map[string]int)
+	)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := clientKey(r)
+			mu.Lock()
+			if inFlight[client] >= max {
+				mu.Unlock()
+				log.Warn().Str("client", client).Int("max_concurrent_per_client", max).Msg("too many concurrent requests from client")
+				http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+				return
+			}
+			inFlight[client]++
+			mu.Unlock()
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if inFlight[client]--; inFlight[client] <= 0 {
+					delete(inFlight, client)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//Gives anonymous users a signed session cookie lasting maxAge, so their requests can be grouped (e.g. by limitPerClient) per session.
+//An expired, tampered or missing cookie gets a new session. The key is generated at startup, so sessions end when the server restarts.
+//Only a session sent back in its cookie is put in the request context: a client dropping the cookie would otherwise be a new client on
+//every request, so the requests without one are grouped by IP address.
+func anonymousSessions(maxAge time.Duration, key []byte) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth, ok := r.Context().Value("auth").(authContext); !ok || auth.Username != AuthAnonUsername {
+				next.ServeHTTP(w, r)
+				return
+			}
+			var session string
+			if cookie, err := r.Cookie(anonSessionCookie); err == nil {
+				session, _ = verifyAnonSession(cookie.Value, key, time.Now())
+			}
+			if session == "" {
+				id := make([]byte, 16)
+				if _, err := rand.Read(id); err != nil {
+					log.Error().Err(err).Msg("could not create anonymous session")
+					next.ServeHTTP(w, r)
+					return
+				}
+				session = base64.RawURLEncoding.EncodeToString(id)
+				http.SetCookie(w, &http.Cookie{
+					Name:     anonSessionCookie,
+					Value:    signAnonSession(session, time.Now().Add(maxAge), key),
+					Path:     "/",
+					MaxAge:   int(maxAge.Seconds()),
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				log.Debug().Str("session", session).Dur("max_age", maxAge).Msg("issued anonymous session")
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "anonSession", session)))
+		})
+	}
+}
+
+//Encodes an anonymous session as id.expiry.signature
+func signAnonSession(id string, expires time.Time, key []byte) string {
+	payload := id + "." + strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Returns the id of an anonymous session cookie value that is correctly signed and not expired at now
+func verifyAnonSession(value string, key []byte, now time.Time) (string, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signAnonSession(parts[0], time.Unix(expires, 0), key)), []byte(value)) {
+		return "", false
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+//Identifies the client of a request by username, by the anonymous session its cookie carries, or else by IP address
+func clientKey(r *http.Request) string {
+	if auth, ok := r.Context().Value("auth").(authContext); ok && auth.Username != "" && auth.Username != AuthAnonUsername {
+		return "user:" + auth.Username
+	}
+	if session, ok := r.Context().Value("anonSession").(string); ok && session != "" {
+		return "session:" + session
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+//Renders v like render.JSON, but indented when the request has ?pretty=1, for reading the API with curl. TiddlyWiki never asks for it, so syncing stays compact.
+func renderJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	if pretty, _ := strconv.ParseBool(r.URL.Query().Get("pretty")); !pretty {
+		render.JSON(w, r, v)
+		return
+	}
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("could not encode response as json")
+		http.Error(w, fmt.Sprintf("could not encode response as json: %s", err.Error()), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if status, ok := r.Context().Value(render.StatusCtxKey).(int); ok {
+		w.WriteHeader(status)
+	}
+	w.Write(append(b, '\n'))
+}
+
+//Rejects requests from users who are not allowed to write
+func requireWriter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, ok := r.Context().Value("auth").(authContext)
+		if !ok || !auth.WritingAllowed {
+			log.Warn().Str("username", auth.Username).Str("path", r.URL.Path).Msg("user is not allowed to write")
+			http.Error(w, "user is not allowed to write", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+//Returns the fields to leave out of the tiddlers sent in response to the request, which are RedactFields unless its user may write
+func redactedFields(r *http.Request) []string {
+	if auth, ok := r.Context().Value("auth").(authContext); ok && auth.WritingAllowed {
+		return nil
+	}
+	return serverOptions.RedactFields
+}
+
+//Fields the store keeps for the server's own use, such as the hash of a binary tiddler's content. They are left out of every
+//tiddler sent to clients and dropped from those they send.
+var internalFields = []string{binaryHashField, gzippedContentField}
+
+//Returns the tiddlers without the fields and internalFields, copying those that have any so the store cache is left untouched
+func redactTiddlers(tids []Tiddler, fields []string) []Tiddler {
+	fields = append(append([]string{}, internalFields...), fields...)
+	redacted := make([]Tiddler, len(tids))
+	for i, tid := range tids {
+		redacted[i] = removeFields(tid, fields)
+	}
+	return redacted
+}
+
+func redactTiddler(tid Tiddler, fields []string) Tiddler {
+	return removeFields(tid, append(append([]string{}, internalFields...), fields...))
+}
+
+func removeFields(tid Tiddler, fields []string) Tiddler {
+	for _, f := range fields {
+		if _, ok := tid[f]; !ok {
+			continue
+		}
+		copied := make(Tiddler, len(tid))
+		for k, v := range tid {
+			copied[k] = v
+		}
+		for _, f := range fields {
+			delete(copied, f)
+		}
+		return copied
+	}
+	return tid
+}
+
 type authContext struct {
 	Username                       string
 	CanBeAnonymous, WritingAllowed bool
 }
 
+//Routes that can be made reachable without credentials when readers are restricted, by Options.PublicRoutes
+const (
+	PublicFavicon = "favicon" //each wiki's favicon.ico
+	PublicIndex   = "index"   //each wiki's page, as an empty shell without its tiddlers
+	PublicReadyz  = "readyz"  //the /readyz readiness check, for probes
+)
+
+//Reports whether the request reads one of the public routes. The favicon and index routes are public only for the wikis
+//being served, so the management pages, which share their single segment paths, never are.
+func isPublicRoute(r *http.Request, public []string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	for _, route := range public {
+		switch {
+		case route == PublicFavicon && len(parts) == 2 && parts[1] == "favicon.ico" && isServedWiki(parts[0]):
+			return true
+		case route == PublicIndex && len(parts) == 1 && isServedWiki(parts[0]):
+			return true
+		case route == PublicReadyz && r.URL.Path == "/readyz":
+			return true
+		}
+	}
+	return false
+}
+
+//Reports whether a wiki of that name is served, leaving out the names of the management pages and the readiness check
+func isServedWiki(name string) bool {
+	if name == "" || name == "readyz" || handlerSelector == nil {
+		return false
+	}
+	for _, page := range managementPages {
+		if "/"+name == page {
+			return false
+		}
+	}
+	_, err := handlerSelector.getHandlerWithStore(name)
+	return err == nil
+}
+
+//Authenticates every request, refusing those without the credentials readers need unless they are for a public route.
+//Requests for a wiki with credentials of its own are checked against those instead.
+func requireReader(creds Credentials, public []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth, ok := basicAuthCtx(w, r, credentialsForRequest(r, creds))
+			if !ok {
+				if !isPublicRoute(r, public) {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				//let through without the credentials readers need, so only public content may be sent
+				ctx := context.WithValue(r.Context(), "auth", authContext{Username: AuthAnonUsername})
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "publicOnly", true)))
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "auth", auth)))
+		})
+	}
+}
+
 func basicAuthCtx(w http.ResponseWriter, r *http.Request, creds Credentials) (authContext, bool) {
 	var auth authContext
 	auth.Username = AuthAnonUsername
@@ -952,7 +4357,8 @@ func basicAuthCtx(w http.ResponseWriter, r *http.Request, creds Credentials) (au
 		credPass, credUserOk := creds.UserPasswordsClearText[user]
 		log.Trace().Str("credPass", credPass).
 			Bool("credUserOk", credUserOk).Msg("basicAuthCtx")
-		if credUserOk && subtle.ConstantTimeCompare([]byte(pass), []byte(credPass)) == 1 {
+		//writers authenticate too, even when not listed among the readers
+		if credUserOk && subtle.ConstantTimeCompare([]byte(pass), []byte(credPass)) == 1 && (creds.userCanRead(user, true) || creds.userCanWrite(user, true)) {
 			isAuthenticated = true
 			auth.Username = user
 			auth.CanBeAnonymous = false
@@ -971,28 +4377,52 @@ func basicAuthCtx(w http.ResponseWriter, r *http.Request, creds Credentials) (au
 }
 
 func creds(store TiddlerStore, credentialsFile, readers, writers string) (Credentials, error) {
-	var insecureCreds Credentials
-	insecureCreds.UserPasswordsClearText = make(map[string]string)
+	users, err := readCredentialsFile(store, credentialsFile)
+	if err != nil {
+		return Credentials{UserPasswordsClearText: make(map[string]string)}, err
+	}
+	return credentialsFor(users, readers, writers), nil
+}
 
-	if credentialsFile != "" {
-		fileReader, err := store.ReadFile(credentialsFile)
-		if err != nil {
-			return insecureCreds, fmt.Errorf("could not find the credentials file")
-		}
-		reader := csv.NewReader(fileReader)
+//Reads the usernames and passwords of a credentials file, none without a file
+func readCredentialsFile(store TiddlerStore, credentialsFile string) (map[string]string, error) {
+	users := make(map[string]string)
+	if credentialsFile == "" {
+		return users, nil
+	}
+	fileReader, err := store.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not find the credentials file %s: %w", credentialsFile, err)
+	}
+	defer fileReader.Close()
+	reader := csv.NewReader(fileReader)
 
-		records, err := reader.ReadAll()
-		if err != nil {
-			return insecureCreds, fmt.Errorf("could not read credentials file")
-		}
-		for _, r := range records[1:] {
-			insecureCreds.UserPasswordsClearText[r[0]] = r[1]
-			log.Trace().Interface("record", r).Msg("credentials")
-		}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("could not read credentials file %s: %w", credentialsFile, err)
+	}
+	//The first line is a header, e.g. username,password
+	if len(records) < 2 {
+		return nil, fmt.Errorf("credentials file %s needs a header line and at least one username,password line", credentialsFile)
 	}
+	if len(records[0]) < 2 {
+		return nil, fmt.Errorf("credentials file %s needs two columns, the username and the password", credentialsFile)
+	}
+	for _, r := range records[1:] {
+		users[r[0]] = r[1]
+		log.Trace().Interface("record", r).Msg("credentials")
+	}
+	return users, nil
+}
+
+//Returns the credentials of the users with the readers and writers given as to --readers and --writers
+func credentialsFor(users map[string]string, readers, writers string) Credentials {
+	insecureCreds := Credentials{UserPasswordsClearText: users}
 	// Readers
 	if strings.Contains(readers, ",") {
 		insecureCreds.Readers = strings.Split(readers, ",")
+	} else if readers != "" && readers != authTokenAnon && readers != authTokenAuthenticated {
+		insecureCreds.Readers = []string{readers}
 	} else if readers == authTokenAuthenticated {
 		insecureCreds.Readers = make([]string, 0)
 		for k := range insecureCreds.UserPasswordsClearText {
@@ -1002,76 +4432,395 @@ func creds(store TiddlerStore, credentialsFile, readers, writers string) (Creden
 	// Writers
 	if strings.Contains(writers, ",") {
 		insecureCreds.Writers = strings.Split(writers, ",")
+	} else if writers != "" && writers != authTokenAnon && writers != authTokenAuthenticated {
+		insecureCreds.Writers = []string{writers}
 	} else if writers == authTokenAuthenticated {
 		insecureCreds.Writers = make([]string, 0)
 		for k := range insecureCreds.UserPasswordsClearText {
 			insecureCreds.Writers = append(insecureCreds.Writers, k)
 		}
 	}
+	return insecureCreds
+}
+
+//Files in a wiki's folder giving the wiki its own credentials in place of the server's: the users in the format of the
+//credentials file, and the readers and writers as given to --readers and --writers, on one line
+const (
+	wikiCredentialsFile = "credentials.csv"
+	wikiReadersFile     = "readers"
+	wikiWritersFile     = "writers"
+)
+
+//A wiki's own credentials, read from the files in its folder when its handler is created. A setting without its file is the server's.
+type wikiCredentials struct {
+	users            map[string]string //nil for the server's users
+	readers, writers *string           //nil for the server's readers or writers
+}
+
+//Reads the wiki's own credentials from its folder, nil when it has none of their files
+func loadWikiCredentials(store TiddlerStore) (*wikiCredentials, error) {
+	var c wikiCredentials
+	found := false
+	if r, err := store.ReadFile(wikiCredentialsFile); err == nil {
+		r.Close()
+		if c.users, err = readCredentialsFile(store, wikiCredentialsFile); err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	for _, setting := range []struct {
+		file  string
+		value **string
+	}{{wikiReadersFile, &c.readers}, {wikiWritersFile, &c.writers}} {
+		r, err := store.ReadFile(setting.file)
+		if err != nil {
+			continue
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s file: %w", setting.file, err)
+		}
+		value := strings.TrimSpace(string(b))
+		*setting.value = &value
+		found = true
+	}
+	if !found {
+		return nil, nil
+	}
+	return &c, nil
+}
+
+//Returns the wiki's credentials, taking the settings it has no file for from the server
+func (c *wikiCredentials) credentials() Credentials {
+	users, readers, writers := serverCredentials.UserPasswordsClearText, serverReaders, serverWriters
+	if c.users != nil {
+		users = c.users
+	}
+	if c.readers != nil {
+		readers = *c.readers
+	}
+	if c.writers != nil {
+		writers = *c.writers
+	}
+	return credentialsFor(users, readers, writers)
+}
 
-	return insecureCreds, nil
+//Returns the credentials for a request: those of the wiki it is for, when the wiki has its own, or else the server's
+func credentialsForRequest(r *http.Request, server Credentials) Credentials {
+	if handlerSelector == nil {
+		return server
+	}
+	wiki := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	h, err := handlerSelector.getHandlerWithStore(wiki)
+	if err != nil || h.creds == nil {
+		return server
+	}
+	return h.creds.credentials()
 }
 
-func ListenAndServe(addr string, credentialsFile string, readers string, writers string, storeType string, storageLocation string) error {
+func ListenAndServe(addr string, credentialsFile string, readers string, writers string, storeType string, storageLocation string, opts Options) error {
 
-	var store TiddlerStore
 	var err error
 
 	serverHostAndPort = addr
+	serverOptions = opts
+	if opts.MaxFilenameLength > 0 {
+		if opts.MaxFilenameLength < minTiddlerFilenameLength {
+			return fmt.Errorf("max filename length %d is shorter than the %d characters of a hashed filename", opts.MaxFilenameLength, minTiddlerFilenameLength)
+		}
+		maxTiddlerFilenameLength = opts.MaxFilenameLength
+	}
+	caseInsensitiveTitles = opts.CaseInsensitiveTitles
+	preserveEmptyFields = opts.PreserveEmptyFields
+	if opts.DefaultTiddlerType != "" {
+		defaultTiddlerType = opts.DefaultTiddlerType
+	}
+	if opts.RebuildLogInterval != 0 {
+		rebuildLogInterval = opts.RebuildLogInterval
+	}
+	if opts.WikiRetryInterval != 0 {
+		wikiRetryInterval = opts.WikiRetryInterval
+	}
+	storeLimits = opts.StoreLimits
+	numWorkers = defaultStoreWorkers
+	if opts.StoreWorkers > 0 {
+		numWorkers = opts.StoreWorkers
+	}
+	s3Endpoint = opts.S3Endpoint
+	storeLayout = opts.StoreLayout
+	for _, route := range opts.PublicRoutes {
+		if route != PublicFavicon && route != PublicIndex && route != PublicReadyz {
+			return fmt.Errorf("unknown public route %q, expected %s, %s or %s", route, PublicFavicon, PublicIndex, PublicReadyz)
+		}
+	}
+	for _, origin := range opts.AllowedOrigins {
+		if err := checkOrigin(origin); err != nil {
+			return err
+		}
+	}
+	tiddlerWebhook = nil
+	if opts.WebhookURL != "" {
+		if err := checkWebhookURL(opts.WebhookURL); err != nil {
+			return err
+		}
+		tiddlerWebhook = newWebhook(opts.WebhookURL)
+	}
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return fmt.Errorf("TLS needs both a certificate file and a key file")
+	}
+	if opts.HTTPRedirectAddr != "" && opts.TLSCertFile == "" {
+		return fmt.Errorf("redirecting HTTP to HTTPS needs TLS")
+	}
+	switch opts.ConflictStrategy {
+	case "", ConflictClientWins, ConflictServerWins, ConflictReject:
+	default:
+		return fmt.Errorf("unknown conflict strategy %q, expected %s, %s or %s", opts.ConflictStrategy, ConflictClientWins, ConflictServerWins, ConflictReject)
+	}
+	switch opts.SortBy {
+	case "", SortByTitle, SortByModified, SortByCreated:
+	default:
+		return fmt.Errorf("unknown sort order %q, expected %s, %s or %s", opts.SortBy, SortByTitle, SortByModified, SortByCreated)
+	}
+	if opts.MaxIndexBuilds > 0 {
+		maxConcurrentIndexBuilds = opts.MaxIndexBuilds
+	}
+	if err := CheckStorageType(storeType); err != nil {
+		return err
+	}
 	storageType = storeType
 	storagePath = storageLocation
 	trashPath = filepath.Join(storagePath, "trash")         //Trash folder for deleted wikis. Purge after some number of days.
 	templatesPath = filepath.Join(storagePath, "templates") //Templates folder for different "editions" of TiddlyWiki index.html files
 	wikisPath = filepath.Join(storagePath, "wikis")         //Parent folder for all wikis
+	fallbackType, fallbackPath = "", ""
+	if opts.FallbackLocation != "" {
+		location := strings.SplitN(opts.FallbackLocation, "://", 2)
+		if len(location) != 2 {
+			return fmt.Errorf("fallback location %q must be given as <type>://<path>, like the wiki location", opts.FallbackLocation)
+		}
+		fallbackType, fallbackPath = location[0], location[1]
+	}
 	handlerSelector, err = NewHandlerSelector()
 	if err != nil {
-		log.Panic().Str("handler selector", credentialsFile).Err(err).Msg("unable to create handler selector for given storage type and location")
+		return fmt.Errorf("unable to create handler selector for storage type %s and location %s: %w", storeType, storageLocation, err)
 	}
 
 	// Identify credentials, if applicable
-	insecureCreds, err := creds(store, credentialsFile, readers, writers)
+	//The credentials file is read from the store of the wikis, templates and trash folders, relative to its root
+	insecureCreds, err := creds(handlerSelector.store, credentialsFile, readers, writers)
 	if err != nil {
 		log.Panic().Str("credentials file", credentialsFile).Err(err).Msg("unable to process credentials")
 	}
+	serverCredentials = insecureCreds
+	serverReaders, serverWriters = readers, writers
 
 	r := chi.NewRouter()
 	r.Use(zerologger(log.Logger))
-	r.Use(func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			auth, ok := basicAuthCtx(w, r, insecureCreds)
-			if !ok {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-
-			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "auth", auth)))
-		})
-	})
+	r.Use(responseHeaders(opts.ResponseHeaders))  //before authentication, so refusals get them too
+	r.Use(handlerSelector.restrictClientNetworks) //before authentication, so clients of other networks cannot try credentials
+	if len(opts.AllowedOrigins) > 0 {
+		r.Use(cors(opts.AllowedOrigins)) //before authentication, as browsers send preflight requests without credentials
+	}
+	r.Use(requireReader(insecureCreds, opts.PublicRoutes))
+	if opts.AnonSessionMaxAge > 0 {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return fmt.Errorf("could not create the anonymous session key: %w", err)
+		}
+		r.Use(anonymousSessions(opts.AnonSessionMaxAge, key))
+	}
+	if opts.MaxConcurrentPerClient > 0 {
+		r.Use(limitPerClient(opts.MaxConcurrentPerClient))
+	}
+	r.Use(handlerSelector.unavailableWhileDegraded)
 	r.Use(middleware.Compress(5, "text/html", "text/css", "text/javascript"))
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.SetHeader("Connection", "keep-alive"))
 	r.Use(middleware.SetHeader("Keep-Alive", "timeout=5"))
 
-	r.Get("/", serverRootIndex)                              //Load the root index.html page that lists the wikis served by this server and instructs on how to create new ones.
-	r.Get("/addWiki", addWiki)                               //Display a page to enable user to create a new wiki from a template.
-	r.Get("/createNewWiki", createNewWiki)                   //Create the new wiki with name (required) and template (default server edition if omitted).
-	r.Get("/renameWiki", renameWiki)                         //Rename the wiki folder (ie. change the path in the url)
-	r.Get("/deleteWiki", deleteWiki)                         //Delete a wiki. Confirm deletion. Copy to purgatory for some period of time to allow for recovery.
+	r.Get("/readyz", readyz)                                 //Whether the server is up, listing the wikis that are unavailable while their store is rebuilt
+	managementRoutes(r, opts.DisableManagement)              //The landing page, the pages creating, renaming and deleting wikis and their API
 	r.Get("/{wiki}/login-basic", handlerSelector.loginBasic) //Keep this the same for now. Assume single user. After multiple wikis, consider support for multiple users.
 	r.Get("/{wiki}", handlerSelector.index)                  //Use a named parameter to serve the index for the designated wiki. e.g. "/{wikifolder}". Enable create wiki if does not exist.
+	r.Get("/{wiki}/download", handlerSelector.download)      //Download the wiki as a standalone single-file wiki
+	r.Get("/{wiki}/sitemap.xml", handlerSelector.sitemap)    //A sitemap of the wiki's tiddlers for search engines, linking to their permalinks
 	r.Get("/{wiki}/favicon.ico", handlerSelector.favicon)    //Use a named parameter. e.g. "/{wikifolder}/favicon.ico"
+	r.Get("/{wiki}/files/*", handlerSelector.getFile)        //Files in the wiki's files folder (or binary tiddlers), served pre-compressed when stored gzipped
 
 	r.Group(func(r chi.Router) {
 		r.Use(render.SetContentType(render.ContentTypeJSON))
+		r.Use(handlerSelector.logSync) //each wiki's sync requests, while turned on at /{wiki}/debug/sync-log
 
 		r.Get("/{wiki}/status", handlerSelector.status) //Use a named parameter.
 
 		r.Get("/{wiki}/recipes/{recipe}/tiddlers.json", handlerSelector.getSkinnyTiddlerList) //Use a named parameter. e.g. "/{wikifolder}/recipes/{recipe}/tiddlers.json"
 		r.Get("/{wiki}/recipes/{recipe}/tiddlers/*", handlerSelector.getTiddler)              //Use a named parameter.
-		r.Put("/{wiki}/recipes/{recipe}/tiddlers/*", handlerSelector.putTiddler)              //Use a named parameter.
-		r.Delete("/{wiki}/bags/{bag}/tiddlers/*", handlerSelector.deleteTiddler)              //Use a named parameter.
+		r.Get("/{wiki}/search", handlerSelector.searchTiddlers)                               //Full-text search of the titles and text, ?q= for the words and ?limit= to cap the results
+		if opts.Backlinks {
+			r.Get("/{wiki}/backlinks/*", handlerSelector.getBacklinks) //Titles of the tiddlers linking to the tiddler
+		}
+		r.Put("/{wiki}/recipes/{recipe}/tiddlers/*", handlerSelector.putTiddler)                               //Use a named parameter.
+		r.With(requireWriter).Patch("/{wiki}/recipes/{recipe}/tiddlers/*", handlerSelector.patchTiddler)       //Merge fields into an existing tiddler, null removes a field
+		r.Delete("/{wiki}/bags/{bag}/tiddlers/*", handlerSelector.deleteTiddler)                               //Use a named parameter.
+		r.With(requireWriter).Post("/{wiki}/recipes/{recipe}/tiddlers/import", handlerSelector.importTiddlers) //Import a JSON array of tiddlers. ?preserve-timestamps=true keeps created/modified/creator, an Idempotency-Key header makes retries skip what was imported, ?atomic=true imports all or nothing
+		r.With(requireWriter).Post("/{wiki}/recipes/{recipe}/tiddlers/delete", handlerSelector.deleteTiddlers) //Delete a JSON array of titles, reporting the result for each
+		r.With(requireWriter).Post("/{wiki}/recipes/{recipe}/tiddlers", handlerSelector.createTiddler)         //Create a tiddler under a title picked by the server
+		r.With(requireWriter).Post("/{wiki}/tags/rename", handlerSelector.renameTag)                           //Replace a tag on every tiddler carrying it
+		r.With(requireWriter).Get("/{wiki}/debug/files", handlerSelector.debugFiles)                           //The file backing each tiddler, for diagnosing filename collisions
+		r.With(requireWriter).Get("/{wiki}/debug/sync-log", handlerSelector.getSyncLog)                        //Whether the wiki's sync requests are logged, and where
+		r.With(requireWriter).Post("/{wiki}/debug/sync-log", handlerSelector.setSyncLog)                       //Turn the logging of the wiki's sync requests on or off with ?enabled=true or false
+		r.With(requireWriter).Post("/{wiki}/compact", handlerSelector.compact)                                 //Remove empty folders and orphaned .meta files from the tiddlers folder and rebuild the index
+		r.With(requireWriter).Get("/{wiki}/export.tar", handlerSelector.exportTar)                             //The files backing the tiddlers as a tar archive, in their stored .tid and .meta format
+		r.With(requireWriter).Post("/{wiki}/import.tar", handlerSelector.importTar)                            //Write the .tid and .meta files of a tar archive, as export.tar makes, into the tiddlers folder
+	})
+
+	srv := newServer(serverHostAndPort, r, opts)
+	listen := srv.ListenAndServe
+	hooks := []ShutdownHook{}
+	if opts.TLSCertFile != "" {
+		log.Info().Str("addr", addr).Bool("http2", !opts.DisableHTTP2).Msg("starting server with TLS")
+		listen = func() error { return srv.ListenAndServeTLS(opts.TLSCertFile, opts.TLSKeyFile) }
+	} else {
+		log.Info().Str("addr", addr).Bool("h2c", opts.H2C).Msg("starting server")
+	}
+	if opts.HTTPRedirectAddr != "" {
+		redirectSrv := &http.Server{Addr: opts.HTTPRedirectAddr, Handler: httpsRedirect(addr)}
+		log.Info().Str("addr", opts.HTTPRedirectAddr).Msg("redirecting HTTP to HTTPS")
+		listenTLS := listen
+		//either listener failing stops the server, so it is never left answering on one of them only
+		listen = func() error {
+			served := make(chan error, 2)
+			go func() { served <- listenTLS() }()
+			go func() { served <- redirectSrv.ListenAndServe() }()
+			return <-served
+		}
+		hooks = append(hooks, ShutdownHook{Name: "stop HTTPS redirect", Run: redirectSrv.Shutdown})
+	}
+
+	if opts.ReconcileInterval > 0 {
+		stopReconciling := make(chan struct{})
+		go handlerSelector.reconcileStores(opts.ReconcileInterval, stopReconciling)
+		hooks = append(hooks, ShutdownHook{Name: "stop reconciling stores", Run: func(ctx context.Context) error {
+			close(stopReconciling)
+			return nil
+		}})
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	hooks = append(hooks, opts.ShutdownHooks...)
+	if tiddlerWebhook != nil {
+		hooks = append(hooks, ShutdownHook{Name: "wait for webhook deliveries", Run: tiddlerWebhook.wait})
+	}
+	hooks = append(hooks,
+		ShutdownHook{Name: "close sync logs", Run: handlerSelector.closeSyncLogs},
+		ShutdownHook{Name: "close stores", Run: handlerSelector.closeStores})
+	timeout := opts.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return serveUntilStopped(srv, listen, stop, timeout, hooks)
+}
+
+//Pages managing the wikis, at the root of the server
+var managementPages = []string{"/", "/addWiki", "/createNewWiki", "/renameWiki", "/deleteWiki"}
+
+//Registers the landing page, the wiki management pages and the management API. Disabled, the pages answer 404 rather than
+//being taken for the name of a wiki by /{wiki}, and the API is left out.
+func managementRoutes(r chi.Router, disabled bool) {
+	if disabled {
+		for _, page := range managementPages {
+			r.Get(page, http.NotFound)
+		}
+		return
+	}
+	r.Get("/", serverRootIndex)            //Load the root index.html page that lists the wikis served by this server and instructs on how to create new ones.
+	r.Get("/addWiki", addWiki)             //Display a page to enable user to create a new wiki from a template.
+	r.Get("/createNewWiki", createNewWiki) //Create the new wiki with name (required) and template (default server edition if omitted).
+	r.Get("/renameWiki", renameWiki)       //Rename the wiki folder (ie. change the path in the url)
+	r.Get("/deleteWiki", deleteWiki)       //Delete a wiki. Confirm deletion. Copy to purgatory for some period of time to allow for recovery.
+	r.Group(func(r chi.Router) {
+		r.Use(render.SetContentType(render.ContentTypeJSON), requireWriter)
+		r.Get("/api/server", serverInfo) //Storage, access, wikis, templates and trash in one document for a management UI
+		r.Get("/api/trash", listTrash)   //The trash a page at a time, ?limit= and ?offset=
+	})
+}
+
+//Cleanup run on graceful shutdown, once the server has stopped taking requests, such as flushing state kept in memory
+type ShutdownHook struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+const defaultShutdownTimeout = 30 * time.Second
+
+//Serves until listen fails or a signal arrives on stop. On a signal the server finishes the requests in flight, then runs
+//the hooks in order, all within timeout. A hook that fails is logged and the others still run, so each gets its chance
+//to clean up. The first error is returned.
+func serveUntilStopped(srv *http.Server, listen func() error, stop <-chan os.Signal, timeout time.Duration, hooks []ShutdownHook) error {
+	served := make(chan error, 1)
+	go func() { served <- listen() }()
+	select {
+	case err := <-served:
+		return err
+	case sig := <-stop:
+		log.Info().Str("signal", sig.String()).Dur("timeout", timeout).Msg("shutting down")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("could not finish the requests in flight")
+	}
+	for _, hook := range hooks {
+		start := time.Now()
+		if hookErr := hook.Run(ctx); hookErr != nil {
+			log.Error().Err(hookErr).Str("hook", hook.Name).Msg("shutdown hook failed")
+			if err == nil {
+				err = fmt.Errorf("shutdown hook %s: %w", hook.Name, hookErr)
+			}
+			continue
+		}
+		log.Info().Str("hook", hook.Name).Dur("ellapsed", time.Since(start)).Msg("ran shutdown hook")
+	}
+	if served := <-served; !errors.Is(served, http.ErrServerClosed) && err == nil {
+		err = served
+	}
+	return err
+}
+
+//Permanently redirects every request to the same URL over HTTPS on the port of tlsAddr, keeping the method and body of
+//the request, for clients that still reach the server over plain HTTP
+func httpsRedirect(tlsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
 	})
+}
 
-	log.Info().Str("addr", addr).Msg("starting server")
-	return http.ListenAndServe(serverHostAndPort, r)
+//Creates the server with the protocols chosen in opts. With TLS, Go negotiates HTTP/2 unless it is disabled.
+//Without TLS, HTTP/2 is only spoken when H2C is set, for running behind a proxy that talks h2c.
+func newServer(addr string, handler http.Handler, opts Options) *http.Server {
+	tlsEnabled := opts.TLSCertFile != "" || opts.TLSKeyFile != ""
+	if opts.H2C && !tlsEnabled && !opts.DisableHTTP2 {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	srv := &http.Server{Addr: addr, Handler: handler}
+	if opts.DisableHTTP2 {
+		//a non-nil empty map turns off the automatic HTTP/2 upgrade of TLS connections
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv
 }
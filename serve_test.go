@@ -1,30 +1,58 @@
 package tiddlybucket
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"golang.org/x/net/http2"
 )
 
 type dummyTiddlerStore struct {
 	tiddlersByTitle           map[string]Tiddler
+	files                     map[string]string
 	simulateBackingStoreError bool
+	simulateWriteError        bool
+	deletedFolders            []string
+	lastModified              time.Time
+	lastModifiedCalls         int
+	fileModified              map[string]time.Time //of the files, zero when not set
+	reloads                   int
 	// pathToTitle     map[string]string
 }
 
 func (s *dummyTiddlerStore) ReadFile(path string) (io.ReadCloser, error) {
-	// TODO?
-	return nil, nil
+	contents, ok := s.files[path]
+	if !ok {
+		return nil, fmt.Errorf("did not find file %s: %w", path, fs.ErrNotExist)
+	}
+	return io.NopCloser(strings.NewReader(contents)), nil
 }
 
 func (s *dummyTiddlerStore) GetTiddler(title string) (Tiddler, error) {
@@ -47,6 +75,9 @@ func (s *dummyTiddlerStore) GetAllTiddlers() ([]Tiddler, error) {
 }
 
 func (s *dummyTiddlerStore) WriteTiddler(t Tiddler) error {
+	if s.simulateWriteError {
+		return fmt.Errorf("WriteTiddler(): simulated error")
+	}
 	s.tiddlersByTitle[t["title"].(string)] = t
 	// TODO: path?!
 	return nil
@@ -60,451 +91,1751 @@ func (s *dummyTiddlerStore) DeleteTiddler(title string) error {
 	return nil
 }
 
-func Test_handlerWithStore_favicon(t *testing.T) {
-	faviconTid := getTestTiddlerJsonAsTid(t, "favicon.json")
-	faviconTid["text"] = bytes.NewBufferString(faviconTid["text"].(string)).Bytes()
-	store := &dummyTiddlerStore{
-		tiddlersByTitle: map[string]Tiddler{
-			faviconTid["title"].(string): faviconTid,
-		},
+func (s *dummyTiddlerStore) WriteFile(path string, data []byte) error {
+	if s.simulateWriteError {
+		return fmt.Errorf("WriteFile(): simulated error")
 	}
-	type fields struct {
-		Store        TiddlerStore
-		faviconCache *bytes.Buffer
+	if s.files == nil {
+		s.files = make(map[string]string)
+	}
+	s.files[path] = string(data)
+	return nil
+}
+
+func (s *dummyTiddlerStore) DeleteFile(path string) error {
+	if s.simulateWriteError {
+		return fmt.Errorf("DeleteFile(): simulated error")
+	}
+	delete(s.files, path)
+	return nil
+}
+
+func (s *dummyTiddlerStore) FileModified(path string) (time.Time, error) {
+	if _, ok := s.files[path]; !ok {
+		return time.Time{}, fmt.Errorf("did not find file %s: %w", path, fs.ErrNotExist)
+	}
+	return s.fileModified[path], nil
+}
+
+func (s *dummyTiddlerStore) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *dummyTiddlerStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *dummyTiddlerStore) LastModified() (time.Time, error) {
+	s.lastModifiedCalls++
+	return s.lastModified, nil
+}
+
+func (s *dummyTiddlerStore) ListModified() (map[string]time.Time, error) {
+	return map[string]time.Time{}, nil
+}
+
+func (s *dummyTiddlerStore) Reload() error {
+	s.reloads++
+	return nil
+}
+
+func (s *dummyTiddlerStore) ReloadPaths(paths []string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (s *dummyTiddlerStore) TiddlerPaths() map[string]string {
+	paths := make(map[string]string, len(s.tiddlersByTitle))
+	for title := range s.tiddlersByTitle {
+		paths[title] = "tiddlers/" + tiddlerFilename(title)
+	}
+	return paths
+}
+
+func (s *dummyTiddlerStore) ListPaths() ([]string, error) {
+	paths := []string{}
+	for path := range s.files {
+		if strings.HasPrefix(path, "tiddlers/") {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func (s *dummyTiddlerStore) Compact() (CompactReport, error) {
+	return CompactReport{EmptyDirs: []string{}, OrphanedMeta: []string{}}, nil
+}
+
+func (s *dummyTiddlerStore) CreateRequiredFolders(path string) error {
+	return nil
+}
+
+func (s *dummyTiddlerStore) GetWikiList(path string) ([]string, error) {
+	return []string{}, nil
+}
+
+func (s *dummyTiddlerStore) GetWikiTemplateList(path string) ([][]string, error) {
+	return [][]string{}, nil
+}
+
+func (s *dummyTiddlerStore) CreateWikiFolder(wikiPath string, templateFilePath string) error {
+	return nil
+}
+
+func (s *dummyTiddlerStore) CopyFolder(srcPath string, targetPath string) error {
+	return nil
+}
+
+func (s *dummyTiddlerStore) DeleteFolder(path string) error {
+	s.deletedFolders = append(s.deletedFolders, path)
+	return nil
+}
+
+const testIndexHTML = `<html>
+<head>
+<!--~~ Raw markup for the top of the head section ~~-->
+<meta http-equiv="X-UA-Compatible" content="IE=Edge"/>
+</head>
+<body>
+<!--~~ Raw markup for the top of the body section ~~-->
+<!--~~ Static styles ~~-->
+<!--~~ Ordinary tiddlers ~~-->
+<!--~~ Raw markup for the bottom of the body section ~~-->
+</body>
+</html>
+`
+
+// extracts the tiddlers injected into the tiddler store block of a rendered index
+func getIndexStoreTiddlers(t *testing.T, page string) []Tiddler {
+	start := strings.Index(page, `class="tiddlywiki-tiddler-store" type="application/json">`)
+	if start < 0 {
+		t.Fatalf("tiddler store block not found in index")
+	}
+	block := page[start:]
+	block = block[strings.Index(block, ">")+1 : strings.Index(block, "</script>")]
+	var tids []Tiddler
+	if err := json.NewDecoder(strings.NewReader(block)).Decode(&tids); err != nil {
+		t.Fatalf("could not decode tiddler store block: %v", err)
 	}
+	return tids
+}
+
+func Test_handlerWithStore_bag(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
 	tests := []struct {
-		name           string
-		fields         fields
-		want           []byte
-		wantType       string
-		wantStatusCode int
+		name          string
+		serverBag     string
+		configTiddler string
+		want          string
 	}{
-		{"good favicon, in cache",
-			fields{store, bytes.NewBuffer(faviconTid["text"].([]byte))},
-			faviconTid["text"].([]byte), "image/x-icon", http.StatusOK},
-		{"good favicon, not in cache",
-			fields{store, new(bytes.Buffer)},
-			faviconTid["text"].([]byte), "image/x-icon", http.StatusOK},
-		{"missing favicon",
-			fields{&dummyTiddlerStore{}, new(bytes.Buffer)},
-			nil, "text/plain", http.StatusNotFound},
+		{"default", "", "", defaultBag},
+		{"server-wide", "mybag", "", "mybag"},
+		{"wiki config tiddler wins", "mybag", "wikibag", "wikibag"},
+		{"blank config tiddler ignored", "mybag", "  ", "mybag"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &handlerWithStore{
-				Store:        tt.fields.Store,
-				faviconCache: tt.fields.faviconCache,
+			serverOptions.Bag = tt.serverBag
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{
+					"Note": {"title": "Note", "text": "hello"},
+				},
+				files: map[string]string{"index.html": testIndexHTML},
 			}
-			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/favicon.ico", nil)
+			if tt.configTiddler != "" {
+				store.tiddlersByTitle[bagConfigTiddler] = Tiddler{"title": bagConfigTiddler, "text": tt.configTiddler}
+			}
+			h := &handlerWithStore{Store: store}
+
+			// status
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/status", nil)
 			w := httptest.NewRecorder()
-			h.favicon(w, r)
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("favicon() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			h.status(w, r)
+			var status map[string]interface{}
+			if err := json.NewDecoder(w.Result().Body).Decode(&status); err != nil {
+				t.Fatalf("status() could not read server response = %v", err)
 			}
-			if !strings.Contains(resp.Header.Get("Content-Type"), tt.wantType) {
-				t.Errorf("favicon() unexpected Content-Type = %s, want %s", resp.Header.Get("Content-Type"), tt.wantType)
+			if got := status["space"].(map[string]interface{})["recipe"]; got != tt.want {
+				t.Errorf("status() recipe = %v, want %s", got, tt.want)
 			}
-			if resp.StatusCode == http.StatusOK {
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					t.Errorf("favicon() could not read server response = %v", err)
+
+			// putTiddler etag
+			r = httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/x/tiddlers/Other",
+				strings.NewReader(`{"title":"Other","text":"new"}`))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"x", "Other"}}}))
+			w = httptest.NewRecorder()
+			h.putTiddler(w, r)
+			if etag := w.Result().Header.Get("Etag"); !strings.HasPrefix(etag, `"`+tt.want+`/Other/`) {
+				t.Errorf("putTiddler() etag = %s, want bag %s", etag, tt.want)
+			}
+
+			// index bag defaulting
+			r = httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			w = httptest.NewRecorder()
+			h.index(w, r)
+			body, _ := io.ReadAll(w.Result().Body)
+			for _, tid := range getIndexStoreTiddlers(t, string(body)) {
+				if tid["bag"] != tt.want {
+					t.Errorf("index() tiddler %v bag = %v, want %s", tid["title"], tid["bag"], tt.want)
 				}
-				if string(body) != string(tt.want) {
-					t.Errorf("favicon() did not receive expected response = %s, want %s", string(body), tt.want)
+			}
+
+			// delete through the bag the index reported
+			r = httptest.NewRequest(http.MethodDelete, "http://foobar.com/bags/"+tt.want+"/tiddlers/Note", nil)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"bag", "*"}, Values: []string{tt.want, "Note"}}}))
+			w = httptest.NewRecorder()
+			h.deleteTiddler(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Errorf("deleteTiddler() status = %d from bag %s, want %d", w.Code, tt.want, http.StatusNoContent)
+			}
+			if _, ok := store.tiddlersByTitle["Note"]; ok {
+				t.Errorf("deleteTiddler() from bag %s kept the tiddler", tt.want)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_indexExclude(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name          string
+		serverExclude []string
+		configTiddler string
+		wantAbsent    []string
+		wantPresent   []string
+	}{
+		{"everything by default", nil, "", nil, []string{"Note", "$:/plugins/tiddlywiki/markdown", "$:/plugins/other"}},
+		{"server-wide prefix", []string{"$:/plugins/tiddlywiki/"}, "", []string{"$:/plugins/tiddlywiki/markdown"}, []string{"Note", "$:/plugins/other"}},
+		{"wiki config tiddler", nil, "$:/plugins/\n\n", []string{"$:/plugins/tiddlywiki/markdown", "$:/plugins/other"}, []string{"Note"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.IndexExclude = tt.serverExclude
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{
+					"Note":                           {"title": "Note", "text": "hello"},
+					"$:/plugins/tiddlywiki/markdown": {"title": "$:/plugins/tiddlywiki/markdown", "text": "{}"},
+					"$:/plugins/other":               {"title": "$:/plugins/other", "text": "{}"},
+				},
+				files: map[string]string{"index.html": testIndexHTML},
+			}
+			if tt.configTiddler != "" {
+				store.tiddlersByTitle[indexExcludeTiddler] = Tiddler{"title": indexExcludeTiddler, "text": tt.configTiddler}
+			}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			w := httptest.NewRecorder()
+			h.index(w, r)
+			body, _ := io.ReadAll(w.Result().Body)
+			titles := make(map[string]bool)
+			for _, tid := range getIndexStoreTiddlers(t, string(body)) {
+				titles[tid["title"].(string)] = true
+			}
+			for _, title := range tt.wantAbsent {
+				if titles[title] {
+					t.Errorf("index() included excluded tiddler %s", title)
+				}
+			}
+			for _, title := range tt.wantPresent {
+				if !titles[title] {
+					t.Errorf("index() is missing tiddler %s", title)
 				}
 			}
 		})
 	}
 }
 
-func Test_handlerWithStore_loginBasic(t *testing.T) {
+func Test_handlerWithStore_redactFields(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	reader := authContext{Username: "reader"}
+	editor := authContext{Username: "editor", WritingAllowed: true}
 	tests := []struct {
-		name           string
-		auth           authContext
-		wantStatusCode int
+		name      string
+		redact    []string
+		auth      authContext
+		wantField bool
 	}{
-		{"no username",
-			authContext{Username: ""}, http.StatusUnauthorized},
-		{"with username",
-			authContext{Username: "random"}, http.StatusFound},
+		{"reader", []string{"private-notes"}, reader, false},
+		{"editor", []string{"private-notes"}, editor, true},
+		{"reader again, from the cached index", []string{"private-notes"}, reader, false},
+		{"nothing redacted", nil, reader, true},
 	}
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			"Note": {"title": "Note", "text": "hello", "private-notes": "needs a rewrite"},
+		},
+		files: map[string]string{"index.html": testIndexHTML},
+	}
+	// shared so the index cache of one role must not leak into the other
+	h := &handlerWithStore{Store: store}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/login-basic", nil).
-				WithContext(context.WithValue(context.Background(), "auth", tt.auth))
+			serverOptions.RedactFields = tt.redact
+			request := func(target string, keys []string, values []string) *http.Request {
+				r := httptest.NewRequest(http.MethodGet, target, nil)
+				ctx := context.WithValue(r.Context(), "auth", tt.auth)
+				return r.WithContext(context.WithValue(ctx, chi.RouteCtxKey, &chi.Context{URLParams: chi.RouteParams{Keys: keys, Values: values}}))
+			}
+
 			w := httptest.NewRecorder()
-			h := &handlerWithStore{}
-			h.loginBasic(w, r)
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("loginBasic() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			h.getTiddler(w, request("http://foobar.com/recipes/default/tiddlers/Note", []string{"recipe", "*"}, []string{"default", "Note"}))
+			var tid Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&tid); err != nil {
+				t.Fatalf("getTiddler() returned invalid JSON: %v", err)
+			}
+			if _, ok := tid["private-notes"]; ok != tt.wantField {
+				t.Errorf("getTiddler() has private-notes = %v, want %v", ok, tt.wantField)
+			}
+
+			w = httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, request("http://foobar.com/recipes/default/tiddlers.json?filter=%5Bhas%5Bprivate-notes%5D%5D", []string{"recipe"}, []string{"default"}))
+			var skinny []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+				t.Fatalf("getSkinnyTiddlerList() returned invalid JSON: %v", err)
+			}
+			if got := len(skinny) == 1 && skinny[0]["private-notes"] != nil; got != tt.wantField {
+				t.Errorf("getSkinnyTiddlerList() = %v, want private-notes listed and filterable %v", skinny, tt.wantField)
+			}
+
+			w = httptest.NewRecorder()
+			h.index(w, request("http://foobar.com/index", nil, nil))
+			body, _ := io.ReadAll(w.Result().Body)
+			found := false
+			for _, tid := range getIndexStoreTiddlers(t, string(body)) {
+				if _, ok := tid["private-notes"]; ok {
+					found = true
+				}
+			}
+			if found != tt.wantField {
+				t.Errorf("index() has private-notes = %v, want %v", found, tt.wantField)
+			}
+
+			w = httptest.NewRecorder()
+			h.download(w, request("http://foobar.com/download", nil, nil))
+			found = false
+			for _, tid := range getIndexStoreTiddlers(t, w.Body.String()) {
+				if _, ok := tid["private-notes"]; ok {
+					found = true
+				}
+			}
+			if found != tt.wantField {
+				t.Errorf("download() has private-notes = %v, want %v", found, tt.wantField)
 			}
 		})
 	}
+	if _, ok := store.tiddlersByTitle["Note"]["private-notes"]; !ok {
+		t.Errorf("redaction removed the field from the stored tiddler")
+	}
 }
 
-func TestCredentials_userCanWrite(t *testing.T) {
-	type fields struct {
-		UserPasswordsClearText map[string]string
-		Readers                []string
-		Writers                []string
+func Test_handlerWithStore_indexLazy(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name       string
+		lazyIndex  bool
+		wantSkinny map[string]bool
+	}{
+		{"full by default", false, map[string]bool{"Note": false, "$:/core": false, "Empty": false}},
+		{"system tiddlers kept in full", true, map[string]bool{"Note": true, "$:/core": false, "Empty": false}},
 	}
-	type args struct {
-		user            string
-		isAuthenticated bool
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.LazyIndex = tt.lazyIndex
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{
+					"Note":    {"title": "Note", "text": "a very long note"},
+					"$:/core": {"title": "$:/core", "text": "{}"},
+					"Empty":   {"title": "Empty"},
+				},
+				files: map[string]string{"index.html": testIndexHTML},
+			}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			w := httptest.NewRecorder()
+			h.index(w, r)
+			for _, tid := range getIndexStoreTiddlers(t, w.Body.String()) {
+				title := tid.Field("title")
+				_, skinny := tid["_is_skinny"]
+				_, hasText := tid["text"]
+				if skinny != tt.wantSkinny[title] || (skinny && hasText) {
+					t.Errorf("index() %s is_skinny = %v, has text = %v, want skinny %v", title, skinny, hasText, tt.wantSkinny[title])
+				}
+			}
+			if got := store.tiddlersByTitle["Note"]["text"]; got != "a very long note" {
+				t.Errorf("index() changed the stored tiddler's text to %q", got)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_indexStream(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(strings.Replace(testIndexHTML, "<html>", "<html lang=\"en\">", 1)))
+	zw.Close()
+	newStore := func(files map[string]string) *dummyTiddlerStore {
+		return &dummyTiddlerStore{
+			tiddlersByTitle: map[string]Tiddler{
+				"Note":       {"title": "Note", "text": "</script><script>alert(1)</script>"},
+				"$:/boot.js": {"title": "$:/boot.js", "text": "<script>boot()</script>", "tags": "$:/tags/RawMarkupWikified/BottomBody"},
+				"$:/head":    {"title": "$:/head", "text": "<script src=\"head.js\"></script>", "tags": "$:/tags/RawMarkup"},
+			},
+			files: files,
+		}
 	}
+	reNonce := regexp.MustCompile(`script-src 'nonce-([^']+)'`)
 	tests := []struct {
-		name   string
-		fields fields
-		args   args
-		want   bool
+		name       string
+		options    Options
+		files      map[string]string
+		wantStatus int
+		wantHTML   string
 	}{
-		{"valid username, read:anon write:authorized",
-			fields{
-				map[string]string{"bobValid": "dilaVbob"},
-				nil,
-				[]string{"bobValid"}},
-			args{"bobValid", true},
-			true},
-		// TODO: Add test cases.
+		{"same page as cached", Options{}, map[string]string{"index.html": testIndexHTML}, http.StatusOK, "<html>"},
+		{"lazy", Options{LazyIndex: true}, map[string]string{"index.html": testIndexHTML}, http.StatusOK, "<html>"},
+		{"gzipped template", Options{GzipIndex: true}, map[string]string{"index.html": testIndexHTML, indexGzipFile: gz.String()}, http.StatusOK, `<html lang="en">`},
+		{"nonce", Options{CSPNonce: true}, map[string]string{"index.html": testIndexHTML}, http.StatusOK, "<html>"},
+		{"missing template", Options{}, map[string]string{}, http.StatusInternalServerError, ""},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := Credentials{
-				UserPasswordsClearText: tt.fields.UserPasswordsClearText,
-				Readers:                tt.fields.Readers,
-				Writers:                tt.fields.Writers,
+			serverOptions = tt.options
+			cached := &handlerWithStore{Store: newStore(tt.files)}
+			want := httptest.NewRecorder()
+			cached.index(want, httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil))
+
+			serverOptions.StreamIndex = true
+			streamed := &handlerWithStore{Store: newStore(tt.files)}
+			w := httptest.NewRecorder()
+			streamed.index(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("index() status = %d, want %d", w.Code, tt.wantStatus)
 			}
-			if got := c.userCanWrite(tt.args.user, tt.args.isAuthenticated); got != tt.want {
-				t.Errorf("Credentials.userCanWrite() = %v, want %v", got, tt.want)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if streamed.getIndexCache() != "" {
+				t.Errorf("index() cached the streamed page")
+			}
+			got, wantPage := w.Body.String(), want.Body.String()
+			if !strings.HasPrefix(got, tt.wantHTML) {
+				t.Errorf("index() did not stream the template, got %q", got)
+			}
+			if tt.options.CSPNonce {
+				nonce := reNonce.FindStringSubmatch(w.Header().Get("Content-Security-Policy"))
+				if nonce == nil || strings.Count(got, `<script nonce="`+nonce[1]+`"`) != strings.Count(got, "<script") {
+					t.Fatalf("index() script tags without the nonce of %q in %s", w.Header().Get("Content-Security-Policy"), got)
+				}
+				cachedNonce := reNonce.FindStringSubmatch(want.Header().Get("Content-Security-Policy"))
+				got = strings.ReplaceAll(got, nonce[1], "NONCE")
+				wantPage = strings.ReplaceAll(wantPage, cachedNonce[1], "NONCE")
+			}
+			// the store lists its tiddlers in no particular order, so the tiddler store is compared as a set
+			byTitle := func(page string) map[string]Tiddler {
+				tids := map[string]Tiddler{}
+				for _, tid := range getIndexStoreTiddlers(t, page) {
+					tids[tid.Field("title")] = tid
+				}
+				return tids
+			}
+			if !reflect.DeepEqual(byTitle(got), byTitle(wantPage)) {
+				t.Errorf("index() streamed tiddlers %v, want %v", byTitle(got), byTitle(wantPage))
+			}
+			reStore := regexp.MustCompile(`(?m)^\[\{.*$`)
+			if reStore.ReplaceAllString(got, "") != reStore.ReplaceAllString(wantPage, "") {
+				t.Errorf("index() streamed\n%s\nwant the cached page\n%s", got, wantPage)
 			}
 		})
 	}
 }
 
-func Test_basicAuthCtx(t *testing.T) {
-	type args struct {
-		creds                     Credentials
-		username, password, route string
+// discardResponseWriter counts what is sent without keeping it, so benchmarks measure the handler rather than a recorder.
+type discardResponseWriter struct {
+	header http.Header
+	n      int
+}
+
+func (d *discardResponseWriter) Header() http.Header         { return d.header }
+func (d *discardResponseWriter) WriteHeader(statusCode int)  {}
+func (d *discardResponseWriter) Write(b []byte) (int, error) { d.n += len(b); return len(b), nil }
+
+// BenchmarkIndex compares building the page into the cache with streaming it, for a large template and many tiddlers.
+// Run with -benchmem: the cached build holds the template and the page in memory, streaming holds neither.
+func BenchmarkIndex(b *testing.B) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	template := strings.Replace(testIndexHTML, "</head>", strings.Repeat("<script>/* core module */</script>\n", 100000)+"</head>", 1)
+	tiddlers := map[string]Tiddler{}
+	for i := 0; i < 2000; i++ {
+		title := fmt.Sprintf("Note %d", i)
+		tiddlers[title] = Tiddler{"title": title, "text": strings.Repeat("some text ", 100)}
+	}
+	for _, stream := range []bool{false, true} {
+		name := "cached"
+		if stream {
+			name = "streamed"
+		}
+		b.Run(name, func(b *testing.B) {
+			serverOptions = Options{StreamIndex: stream}
+			h := &handlerWithStore{Store: &dummyTiddlerStore{tiddlersByTitle: tiddlers, files: map[string]string{"index.html": template}}}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				h.resetCaches() // every request builds the page, as after a write
+				h.index(&discardResponseWriter{header: http.Header{}}, r)
+			}
+		})
+	}
+}
+
+// BenchmarkPutTiddler saves a tiddler to a 5000 tiddler wiki and lists the tiddlers, as the syncer does after each save.
+func BenchmarkPutTiddler(b *testing.B) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions = Options{}
+	store := NewMemoryStore()
+	for i := 0; i < 5000; i++ {
+		title := fmt.Sprintf("Note %d", i)
+		if err := store.WriteTiddler(Tiddler{"title": title, "text": strings.Repeat("some text ", 100)}); err != nil {
+			b.Fatalf("WriteTiddler() error = %v", err)
+		}
+	}
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	if _, err := h.skinnyTiddlers(); err != nil {
+		b.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := putTiddlerRequest(fmt.Sprintf("Note %d", i%5000), fmt.Sprintf(`{"title":"Note %d","text":"edit %d"}`, i%5000, i))
+		w := httptest.NewRecorder()
+		h.putTiddler(w, r)
+		if w.Code != http.StatusNoContent {
+			b.Fatalf("putTiddler() status = %d", w.Code)
+		}
+		if _, err := h.skinnyTiddlers(); err != nil {
+			b.Fatalf("skinnyTiddlers() error = %v", err)
+		}
 	}
+}
+
+// putTiddlerRequest is a PUT of a tiddler as routed to putTiddler
+func putTiddlerRequest(title, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/default/tiddlers/"+url.PathEscape(title), strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+		&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", title}}}))
+}
+
+func Test_HandlerSelector_restrictClientNetworks(t *testing.T) {
+	note := Tiddler{"title": "Note", "text": "hello"}
+	hr := &HandlerSelector{handlerMap: map[string]*handlerWithStore{
+		"open": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"Note": note}}},
+		"office": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+			"Note":          note,
+			allowIPsTiddler: {"title": allowIPsTiddler, "text": "10.0.0.0/8\n192.168.1.7\nnot a network\n2001:db8::/32"},
+			denyIPsTiddler:  {"title": denyIPsTiddler, "text": "10.6.6.0/24"},
+		}}},
+		"blocked": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+			"Note":         note,
+			denyIPsTiddler: {"title": denyIPsTiddler, "text": "203.0.113.0/24"},
+		}}},
+	}}
+	router := chi.NewRouter()
+	router.Use(hr.restrictClientNetworks)
+	router.Get("/readyz", readyz)
+	router.Get("/{wiki}/recipes/{recipe}/tiddlers/*", hr.getTiddler)
+
 	tests := []struct {
-		name   string
-		args   args
-		want   authContext
-		wantOK bool
+		name       string
+		path       string
+		remoteAddr string
+		wantStatus int
 	}{
-		{"valid username, read:anon write:authorized",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					nil, []string{"bobValid"}},
-				"bobValid", "dilaVbob", ""},
-			authContext{
-				"bobValid", false, true},
-			true},
-		{"missing basic auth, read:anon, write:named",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					nil, []string{"bobValid"}},
-				"", "", ""},
-			authContext{
-				AuthAnonUsername, true, false},
-			true},
-		{"missing basic auth, read:named, write:none",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					[]string{"bobValid"}, nil},
-				"", "", ""},
-			authContext{},
-			false},
-		{"missing username, read:anon write:authorized",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					nil, []string{"bobValid"}},
-				"", "dilaVbob", ""},
-			authContext{
-				AuthAnonUsername, true, false},
-			true},
-		{"missing username, read:authorized write:authorized",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					[]string{"bobValid"}, []string{"bobValid"}},
-				"", "dilaVbob", ""},
-			authContext{},
-			false},
-		{"missing password, read:anon write:authorized",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					nil, []string{"bobValid"}},
-				"bobValid", "", ""},
-			authContext{
-				AuthAnonUsername, true, false},
-			true},
-		{"missing password, read:authorized write:authorized",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					[]string{"bobValid"}, []string{"bobValid"}},
-				"bobValid", "", ""},
-			authContext{},
-			false},
-		{"empty credentials",
-			args{
-				Credentials{},
-				"bobValid", "dilaVbob", ""},
-			authContext{
-				AuthAnonUsername, true, true},
-			true},
-		{"missing basic auth to login-basic, read:authorized write:authorized",
-			args{
-				Credentials{
-					map[string]string{"bobValid": "dilaVbob"},
-					[]string{"bobValid"}, []string{"bobValid"}},
-				"", "", "login-basic"},
-			authContext{
-				AuthAnonUsername, false, false},
-			true},
+		{"wiki without networks", "/open/recipes/default/tiddlers/Note", "203.0.113.9:5000", http.StatusOK},
+		{"allowed network", "/office/recipes/default/tiddlers/Note", "10.1.2.3:5000", http.StatusOK},
+		{"allowed address", "/office/recipes/default/tiddlers/Note", "192.168.1.7:5000", http.StatusOK},
+		{"allowed IPv6 network", "/office/recipes/default/tiddlers/Note", "[2001:db8::1]:5000", http.StatusOK},
+		{"other address", "/office/recipes/default/tiddlers/Note", "192.168.1.8:5000", http.StatusForbidden},
+		{"denied within allowed network", "/office/recipes/default/tiddlers/Note", "10.6.6.6:5000", http.StatusForbidden},
+		{"denied network", "/blocked/recipes/default/tiddlers/Note", "203.0.113.9:5000", http.StatusForbidden},
+		{"outside denied network", "/blocked/recipes/default/tiddlers/Note", "198.51.100.1:5000", http.StatusOK},
+		{"unparseable address", "/office/recipes/default/tiddlers/Note", "somewhere", http.StatusForbidden},
+		{"server route", "/readyz", "192.168.1.8:5000", http.StatusOK},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://foobar.com/%s", tt.args.route), nil)
-			if tt.args.username != "" && tt.args.password != "" {
-				r.SetBasicAuth(tt.args.username, tt.args.password)
-			}
+			defer func(hs *HandlerSelector) { handlerSelector = hs }(handlerSelector)
+			handlerSelector = hr
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com"+tt.path, nil)
+			r.RemoteAddr = tt.remoteAddr
 			w := httptest.NewRecorder()
-			gotCtx, ok := basicAuthCtx(w, r, tt.args.creds)
-			if ok != tt.wantOK {
-				t.Errorf("basicAuthCtx() unexpected ok = %t, want %t", ok, tt.wantOK)
-			}
-			if !reflect.DeepEqual(gotCtx, tt.want) {
-				t.Errorf("basicAuthCtx() unexpected context returned = %v, want %v", gotCtx, tt.want)
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("%s from %s status = %d, want %d", tt.path, tt.remoteAddr, w.Code, tt.wantStatus)
 			}
 		})
 	}
 }
 
-func Test_handlerWithStore_status(t *testing.T) {
+func Test_handlerWithStore_indexTemplates(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	rules, err := ParseIndexTemplates([]string{"iPhone|Mobile=index-mobile.html", "(?i)android=index-android.html"})
+	if err != nil {
+		t.Fatalf("ParseIndexTemplates() error = %v", err)
+	}
+	serverOptions = Options{IndexTemplates: rules}
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{"Note": {"title": "Note", "text": "hello"}},
+		files: map[string]string{
+			"index.html":         testIndexHTML,
+			"index-mobile.html":  strings.Replace(testIndexHTML, "<html>", "<html class=\"mobile\">", 1),
+			"index-android.html": strings.Replace(testIndexHTML, "<html>", "<html class=\"android\">", 1),
+		},
+	}
+	h := &handlerWithStore{Store: store}
 	tests := []struct {
-		name string
-		auth authContext
+		name      string
+		userAgent string
+		wantHTML  string
 	}{
-		{"no username",
-			authContext{"", true, true}},
-		{"with username",
-			authContext{"random", false, true}},
-		{"no authContext",
-			authContext{Username: "TESTDONOTADD"}},
+		{"desktop", "Mozilla/5.0 (X11; Linux x86_64) Firefox/118.0", "<html>"},
+		{"iPhone", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148", `<html class="mobile">`},
+		{"first match wins", "Mozilla/5.0 (Linux; Android 14) Chrome/118.0 Mobile Safari/537.36", `<html class="mobile">`},
+		{"case insensitive pattern", "Mozilla/5.0 (Linux; ANDROID 14) Chrome/118.0 Safari/537.36", `<html class="android">`},
+		{"no user agent", "", "<html>"},
+	}
+	get := func(userAgent string) string {
+		r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+		r.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		h.index(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("index() unexpected status code = %d", w.Code)
+		}
+		return w.Body.String()
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/status", nil)
-			if tt.auth.Username != "TESTDONOTADD" {
-				r = r.WithContext(context.WithValue(context.Background(), "auth", tt.auth))
-			} else {
-				tt.auth.Username = ""
-			}
-			w := httptest.NewRecorder()
-			h := &handlerWithStore{}
-			h.status(w, r)
-			resp := w.Result()
-			var status map[string]interface{}
-			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-				t.Errorf("status() could not read server response = %v", err)
-			}
-			if status["username"] != tt.auth.Username {
-				t.Errorf("status() did not receive expected username = %s, want = %s", status["username"], tt.auth.Username)
-			}
-			if status["anonymous"] != tt.auth.CanBeAnonymous {
-				t.Errorf("status() did not receive expected anonymous value = %t, want = %t", status["anonymous"], tt.auth.CanBeAnonymous)
-			}
-			if status["read_only"] != !tt.auth.WritingAllowed {
-				t.Errorf("status() did not receive expected read_only value = %t, want = %t", status["read_only"], !tt.auth.WritingAllowed)
-			}
-
-			for _, f := range []string{"space", "tiddlywiki_version"} {
-				if _, ok := status[f]; !ok {
-					t.Errorf("status() did not identify '%s' field in response", f)
-				}
+			if got := get(tt.userAgent); !strings.HasPrefix(got, tt.wantHTML) {
+				t.Errorf("index() = %q, want the page starting %s", got, tt.wantHTML)
 			}
 		})
 	}
-}
-
-type chiContextKey struct {
-	name string
-}
-
-func (k *chiContextKey) String() string {
-	return "chi context value " + k.name
-}
 
-func Test_handlerWithStore_getTiddler(t *testing.T) {
-	dummy := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
-	store := &dummyTiddlerStore{
-		tiddlersByTitle: map[string]Tiddler{
-			"TestTiddler": getTestTiddlerJsonAsTid(t, "TestTiddler.json"),
-		},
+	// each template is cached on its own, until a write resets them all
+	delete(store.files, "index-mobile.html")
+	if got := get("iPhone Mobile"); !strings.HasPrefix(got, `<html class="mobile">`) {
+		t.Errorf("index() did not serve the cached mobile page, got %q", got)
 	}
-	type args struct {
-		recipe, tiddlerName string
+	if page, _ := h.cachedIndex(""); !strings.HasPrefix(page, "<html>") {
+		t.Errorf("cachedIndex() of index.html = %q", page)
+	}
+	h.resetCaches()
+	if page, _ := h.cachedIndex("index-android.html"); page != "" {
+		t.Errorf("resetCaches() left the android page cached")
 	}
+}
+
+func Test_handlerWithStore_download(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
 	tests := []struct {
-		name           string
-		args           args
-		store          TiddlerStore
-		want           Tiddler
-		wantStatusCode int
+		name        string
+		keepSync    bool
+		lazyIndex   bool
+		wantAbsent  []string
+		wantPresent []string
 	}{
-		{"existing tiddler",
-			args{"default", "TestTiddler"}, store,
-			dummy, http.StatusOK},
-		{"missing tiddler",
-			args{"default", "NotATiddler"}, store,
-			nil, http.StatusNotFound},
-		{"missing tiddler name in route",
-			args{"default", ""}, store,
-			nil, http.StatusBadRequest},
-		// TODO: add more test cases
+		{"sync config stripped", false, false, []string{"$:/config/tiddlyweb/host", "$:/plugins/tiddlywiki/tiddlyweb"}, []string{"Note", "$:/core"}},
+		{"sync config kept", true, false, nil, []string{"Note", "$:/core", "$:/config/tiddlyweb/host", "$:/plugins/tiddlywiki/tiddlyweb"}},
+		{"full text even with lazy index", false, true, []string{"$:/config/tiddlyweb/host"}, []string{"Note"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &handlerWithStore{
-				Store: tt.store,
+			serverOptions.DownloadSyncConfig = tt.keepSync
+			serverOptions.LazyIndex = tt.lazyIndex
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{
+					"Note":                            {"title": "Note", "text": "hello"},
+					"$:/core":                         {"title": "$:/core", "text": "{}"},
+					"$:/config/tiddlyweb/host":        {"title": "$:/config/tiddlyweb/host", "text": "http://localhost:8080/notes/"},
+					"$:/plugins/tiddlywiki/tiddlyweb": {"title": "$:/plugins/tiddlywiki/tiddlyweb", "text": "{}"},
+				},
+				files: map[string]string{"index.html": testIndexHTML},
 			}
-			r := httptest.NewRequest(http.MethodGet,
-				fmt.Sprintf("http://foobar.com/recipes/%s/tiddlers/%s",
-					tt.args.recipe, tt.args.tiddlerName), nil)
-			r = r.WithContext(context.WithValue(r.Context(),
-				chi.RouteCtxKey,
-				&chi.Context{
-					URLParams: chi.RouteParams{
-						Keys:   []string{"recipe", "*"},
-						Values: []string{tt.args.recipe, tt.args.tiddlerName},
-					},
-				}))
+			h := &handlerWithStore{Store: store, wiki: "notes"}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/download", nil)
 			w := httptest.NewRecorder()
-			h.getTiddler(w, r)
-
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("getTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			h.download(w, r)
+			if got := w.Result().Header.Get("Content-Disposition"); got != `attachment; filename="notes.html"` {
+				t.Errorf("download() Content-Disposition = %s", got)
 			}
-
-			if resp.StatusCode == http.StatusOK {
-				body, err := io.ReadAll(resp.Body)
-				if err != nil {
-					t.Errorf("getTiddler() could not read server response = %v", err)
+			tids := make(map[string]Tiddler)
+			for _, tid := range getIndexStoreTiddlers(t, w.Body.String()) {
+				tids[tid["title"].(string)] = tid
+			}
+			for _, title := range tt.wantAbsent {
+				if _, ok := tids[title]; ok {
+					t.Errorf("download() included sync config tiddler %s", title)
 				}
-				gotTid := convertJsonToTid(t, body)
-				if !areTiddlersEqual(t, tt.want, gotTid) {
-					t.Errorf("getTiddler() returned tiddler does not match expected")
+			}
+			for _, title := range tt.wantPresent {
+				if tid, ok := tids[title]; !ok || tid["text"] == nil {
+					t.Errorf("download() is missing tiddler %s or its text", title)
 				}
 			}
-
+			if _, ok := store.tiddlersByTitle["$:/config/tiddlyweb/host"]; !ok {
+				t.Errorf("download() removed the host tiddler from the store")
+			}
 		})
 	}
 }
 
-func Test_handlerWithStore_putTiddler(t *testing.T) {
-	dummy := getTestTiddlerJson(t, "TestTiddler.json")
-	dummyAsTid := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
-	store := &dummyTiddlerStore{
-		tiddlersByTitle: make(map[string]Tiddler),
-	}
-	type args struct {
-		recipe, tiddlerName string
-		tiddler             []byte
-	}
+func Test_handlerWithStore_sitemap(t *testing.T) {
 	tests := []struct {
-		name           string
-		args           args
-		store          dummyTiddlerStore
-		wantIsUpdated  bool
-		wantStatusCode int
+		name     string
+		host     string
+		wantBase string
 	}{
-		{"standard tiddler",
-			args{"default", dummyAsTid["title"].(string), dummy},
-			*store, false, http.StatusNoContent},
-		// TODO: update existing tiddler
-		// TODO: add more test cases
+		{"configured host", "https://wiki.example.com/notes/", "https://wiki.example.com/notes/"},
+		{"placeholders", "$protocol$//$host$/notes", "http://foobar.com/notes/"},
+		{"no host config", "", "http://foobar.com/notes/"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			jsonTid := convertJsonToTid(t, tt.args.tiddler)
-			_, inStore := tt.store.tiddlersByTitle[jsonTid["title"].(string)]
-			if !tt.wantIsUpdated && inStore {
-				t.Error("found tiddler in store unexpectedly")
+			tids := map[string]Tiddler{
+				"Note":                 {"title": "Note", "text": "hello", "modified": "20230102150405123"},
+				"Two Words & More":     {"title": "Two Words & More", "modified": "20230405"},
+				"Undated":              {"title": "Undated", "modified": "yesterday"},
+				"Draft of 'Note'":      {"title": "Draft of 'Note'", "draft.of": "Note", "modified": "20230102150405123"},
+				"$:/config/Navigation": {"title": "$:/config/Navigation", "modified": "20230102150405123"},
 			}
-			h := &handlerWithStore{
-				Store: &tt.store,
+			if tt.host != "" {
+				tids["$:/config/tiddlyweb/host"] = Tiddler{"title": "$:/config/tiddlyweb/host", "text": tt.host}
 			}
-			r := httptest.NewRequest(http.MethodPut,
-				fmt.Sprintf("http://foobar.com/recipes/%s/tiddlers/%s",
-					tt.args.recipe, tt.args.tiddlerName),
-				bytes.NewReader(tt.args.tiddler))
-			r = r.WithContext(context.WithValue(r.Context(),
-				chi.RouteCtxKey,
-				&chi.Context{
-					URLParams: chi.RouteParams{
-						Keys:   []string{"recipe", "*"},
-						Values: []string{tt.args.recipe, tt.args.tiddlerName},
-					},
-				}))
+			h := &handlerWithStore{Store: &dummyTiddlerStore{tiddlersByTitle: tids}, wiki: "notes"}
 			w := httptest.NewRecorder()
-			h.putTiddler(w, r)
-
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("putTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			h.sitemap(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/sitemap.xml", nil))
+			if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "application/xml") {
+				t.Fatalf("sitemap() = %d %s", w.Code, w.Header().Get("Content-Type"))
 			}
-
-			gotTid, inStore := tt.store.tiddlersByTitle[jsonTid["title"].(string)]
-			if !inStore {
-				t.Errorf("putTiddler() tiddler not found in store with title %s", jsonTid["title"].(string))
+			var got sitemapURLSet
+			if err := xml.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("sitemap() is not valid XML: %v\n%s", err, w.Body.String())
 			}
-			if !areTiddlersEqual(t, jsonTid, gotTid) {
-				t.Errorf("putTiddler() returned tiddler does not match expected")
+			want := []sitemapURL{
+				{Loc: tt.wantBase + "#Note", LastMod: "2023-01-02T15:04:05Z"},
+				{Loc: tt.wantBase + "#Two%20Words%20%26%20More", LastMod: "2023-04-05T00:00:00Z"},
+				{Loc: tt.wantBase + "#Undated"},
+			}
+			if !reflect.DeepEqual(got.URLs, want) {
+				t.Errorf("sitemap() urls = %v, want %v", got.URLs, want)
+			}
+			for _, u := range got.URLs {
+				if _, err := time.Parse(time.RFC3339, u.LastMod); u.LastMod != "" && err != nil {
+					t.Errorf("sitemap() lastmod %q is not a W3C datetime: %v", u.LastMod, err)
+				}
 			}
 		})
 	}
 }
-
-func Test_handlerWithStore_deleteTiddler(t *testing.T) {
-	dummyAsTid := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
-	store := &dummyTiddlerStore{
-		tiddlersByTitle: map[string]Tiddler{
-			dummyAsTid["title"].(string): dummyAsTid,
-		},
-	}
-	type args struct {
-		bag, tiddlerName string
-	}
+func Test_handlerWithStore_indexCSPNonce(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	reNonce := regexp.MustCompile(`script-src 'nonce-([^']+)'`)
 	tests := []struct {
-		name           string
-		args           args
-		store          dummyTiddlerStore
-		wantDeleted    bool
-		wantStatusCode int
+		name      string
+		cspNonce  bool
+		wantNonce bool
 	}{
-		{"delete existing",
-			args{"default", dummyAsTid["title"].(string)},
-			*store, true, http.StatusOK},
-		// TODO: add more test cases
+		{"off by default", false, false},
+		{"nonce per response", true, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &handlerWithStore{
-				Store: &tt.store,
+			serverOptions.CSPNonce = tt.cspNonce
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{
+					"Note":   {"title": "Note", "text": "<script>alert(1)</script>"},
+					"Script": {"title": "Script", "tags": "$:/tags/RawMarkup", "text": "<script>var x = 1;</script>\n"},
+				},
+				files: map[string]string{"index.html": testIndexHTML},
 			}
-			r := httptest.NewRequest(http.MethodDelete,
-				fmt.Sprintf("http://foobar.com/bags/%s/tiddlers/%s",
-					tt.args.bag, tt.args.tiddlerName), nil)
+			h := &handlerWithStore{Store: store}
+			nonces := make(map[string]bool)
+			for i := 0; i < 2; i++ {
+				r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+				w := httptest.NewRecorder()
+				h.index(w, r)
+				body := w.Body.String()
+				csp := w.Result().Header.Get("Content-Security-Policy")
+				if !tt.wantNonce {
+					if csp != "" || strings.Contains(body, "nonce=") {
+						t.Errorf("index() unexpected nonce, csp = %s", csp)
+					}
+					continue
+				}
+				m := reNonce.FindStringSubmatch(csp)
+				if m == nil {
+					t.Fatalf("index() csp = %s, want a script-src nonce", csp)
+				}
+				nonces[m[1]] = true
+				tags := strings.Count(body, "<script")
+				if tagged := strings.Count(body, `<script nonce="`+m[1]+`"`); tags != 2 || tagged != tags {
+					t.Errorf("index() %d of %d script tags carry the nonce, want 2 of 2", tagged, tags)
+				}
+				if tids := getIndexStoreTiddlers(t, body); len(tids) != 2 {
+					t.Errorf("index() store has %d tiddlers, want 2", len(tids))
+				}
+			}
+			if tt.wantNonce && len(nonces) != 2 {
+				t.Errorf("index() reused a nonce across responses")
+			}
+			if strings.Contains(h.getIndexCache(), "nonce=") {
+				t.Errorf("index() cached a page carrying a nonce")
+			}
+		})
+	}
+}
+
+func Test_HandlerSelector_addHandlers(t *testing.T) {
+	tests := []struct {
+		name      string
+		wikis     int
+		maxBuilds int
+	}{
+		{"one at a time", 5, 1},
+		{"bounded", 10, 3},
+		{"more slots than wikis", 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu           sync.Mutex
+				active, peak int
+				wikis        []string
+			)
+			hr := &HandlerSelector{
+				handlerMap: map[string]*handlerWithStore{},
+				storeFunc: func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+					mu.Lock()
+					active++
+					if active > peak {
+						peak = active
+					}
+					mu.Unlock()
+					time.Sleep(10 * time.Millisecond) // stands in for the index build
+					mu.Lock()
+					active--
+					mu.Unlock()
+					return &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}, nil
+				},
+			}
+			for i := 0; i < tt.wikis; i++ {
+				wikis = append(wikis, fmt.Sprintf("wiki%d", i))
+			}
+			if err := hr.addHandlers(wikis, tt.maxBuilds); err != nil {
+				t.Fatalf("addHandlers() error = %v", err)
+			}
+			if peak > tt.maxBuilds {
+				t.Errorf("addHandlers() built %d indexes at once, want at most %d", peak, tt.maxBuilds)
+			}
+			if len(hr.handlerMap) != tt.wikis {
+				t.Errorf("addHandlers() added %d wikis, want %d", len(hr.handlerMap), tt.wikis)
+			}
+		})
+	}
+}
+
+func Test_addHandlers_degradedWiki(t *testing.T) {
+	defer func(hs *HandlerSelector, wp string, ri time.Duration) {
+		handlerSelector, wikisPath, wikiRetryInterval = hs, wp, ri
+	}(handlerSelector, wikisPath, wikiRetryInterval)
+	wikisPath = "wikis"
+	wikiRetryInterval = 10 * time.Millisecond
+
+	var mu sync.Mutex
+	failures := 2 // the flaky wiki's store fails at startup and on the first retry
+	hr := &HandlerSelector{
+		handlerMap: map[string]*handlerWithStore{},
+		storeFunc: func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if path == filepath.Join("wikis", "flaky") && failures > 0 {
+				failures--
+				return nil, errors.New("simulated listing error")
+			}
+			return &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"Note": {"title": "Note", "text": "hello"}}}, nil
+		},
+	}
+	handlerSelector = hr
+	if err := hr.addHandlers([]string{"good", "flaky"}, 2); err != nil {
+		t.Fatalf("addHandlers() error = %v, want the flaky wiki to be degraded", err)
+	}
+
+	router := chi.NewRouter()
+	router.Use(hr.unavailableWhileDegraded)
+	router.Get("/readyz", readyz)
+	router.Get("/{wiki}/status", hr.status)
+	router.Get("/{wiki}/recipes/{recipe}/tiddlers/*", hr.getTiddler)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://foobar.com"+path, nil))
+		return w
+	}
+
+	if w := get("/good/recipes/default/tiddlers/Note"); w.Code != http.StatusOK {
+		t.Errorf("healthy wiki status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("/flaky/recipes/default/tiddlers/Note"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("degraded wiki status = %d, Retry-After = %q, want %d", w.Code, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	if w := get("/flaky/status"); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"degraded":true`) {
+		t.Errorf("degraded wiki /status = %d %s", w.Code, w.Body.String())
+	}
+	if w := get("/readyz"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"flaky"`) {
+		t.Errorf("/readyz = %d %s, want the flaky wiki listed", w.Code, w.Body.String())
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, degraded := hr.degradedState("flaky"); !degraded {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flaky wiki did not recover")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if w := get("/flaky/recipes/default/tiddlers/Note"); w.Code != http.StatusOK {
+		t.Errorf("recovered wiki status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := get("/readyz"); !strings.Contains(w.Body.String(), `"status":"ok"`) {
+		t.Errorf("/readyz after recovery = %s", w.Body.String())
+	}
+}
+
+func Test_addHandlers_recoveryDisabled(t *testing.T) {
+	defer func(ri time.Duration) { wikiRetryInterval = ri }(wikiRetryInterval)
+	wikiRetryInterval = -1
+	hr := &HandlerSelector{
+		handlerMap: map[string]*handlerWithStore{},
+		storeFunc: func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+			return nil, errors.New("simulated listing error")
+		},
+	}
+	if err := hr.addHandlers([]string{"flaky"}, 1); err == nil {
+		t.Errorf("addHandlers() error = nil, want the build error")
+	}
+	if _, degraded := hr.degradedState("flaky"); degraded {
+		t.Errorf("addHandlers() degraded the wiki with recovery turned off")
+	}
+}
+
+func Test_hostTiddlerWriteFailure(t *testing.T) {
+	defer func(hs *HandlerSelector, wp string) { handlerSelector, wikisPath = hs, wp }(handlerSelector, wikisPath)
+	wikisPath = "wikis"
+	tests := []struct {
+		name        string
+		path        string
+		wantDeleted []string
+		wantWikis   []string
+	}{
+		{"create rolls back", "/createNewWiki?name=new&template=empty.html", []string{"wikis/new"}, []string{"old"}},
+		{"rename keeps original", "/renameWiki?currentName=old&newName=renamed", []string{"wikis/renamed"}, []string{"old"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgmtStore := &dummyTiddlerStore{}
+			handlerSelector = &HandlerSelector{
+				handlerMap: map[string]*handlerWithStore{"old": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}}},
+				store:      mgmtStore,
+				storeFunc: func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+					return &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}, simulateWriteError: true}, nil
+				},
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com"+tt.path, nil)
+			w := httptest.NewRecorder()
+			if strings.HasPrefix(tt.path, "/create") {
+				createNewWiki(w, r)
+			} else {
+				renameWiki(w, r)
+			}
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("unexpected status code = %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			if body := w.Body.String(); !strings.Contains(body, "$:/config/tiddlyweb/host") {
+				t.Errorf("response does not explain the failure: %s", body)
+			}
+			if !reflect.DeepEqual(mgmtStore.deletedFolders, tt.wantDeleted) {
+				t.Errorf("deleted folders = %v, want %v", mgmtStore.deletedFolders, tt.wantDeleted)
+			}
+			wikis := make([]string, 0)
+			for name := range handlerSelector.handlerMap {
+				wikis = append(wikis, name)
+			}
+			if !reflect.DeepEqual(wikis, tt.wantWikis) {
+				t.Errorf("wikis = %v, want %v", wikis, tt.wantWikis)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_favicon(t *testing.T) {
+	faviconTid := getTestTiddlerJsonAsTid(t, "favicon.json")
+	faviconTid["text"] = bytes.NewBufferString(faviconTid["text"].(string)).Bytes()
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			faviconTid["title"].(string): faviconTid,
+		},
+	}
+	type fields struct {
+		Store        TiddlerStore
+		faviconCache *bytes.Buffer
+	}
+	tests := []struct {
+		name           string
+		fields         fields
+		want           []byte
+		wantType       string
+		wantStatusCode int
+	}{
+		{"good favicon, in cache",
+			fields{store, bytes.NewBuffer(faviconTid["text"].([]byte))},
+			faviconTid["text"].([]byte), "image/x-icon", http.StatusOK},
+		{"good favicon, not in cache",
+			fields{store, new(bytes.Buffer)},
+			faviconTid["text"].([]byte), "image/x-icon", http.StatusOK},
+		{"missing favicon",
+			fields{&dummyTiddlerStore{}, new(bytes.Buffer)},
+			nil, "text/plain", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{
+				Store:        tt.fields.Store,
+				faviconCache: tt.fields.faviconCache,
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/favicon.ico", nil)
+			w := httptest.NewRecorder()
+			h.favicon(w, r)
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("favicon() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+			if !strings.Contains(resp.Header.Get("Content-Type"), tt.wantType) {
+				t.Errorf("favicon() unexpected Content-Type = %s, want %s", resp.Header.Get("Content-Type"), tt.wantType)
+			}
+			if resp.StatusCode == http.StatusOK {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Errorf("favicon() could not read server response = %v", err)
+				}
+				if string(body) != string(tt.want) {
+					t.Errorf("favicon() did not receive expected response = %s, want %s", string(body), tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_favicon_otherInstance(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name              string
+		checkStoreChanges bool
+		reconcile         bool
+	}{
+		{"reconciled", false, true},
+		{"store changes checked", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.CheckStoreChanges = tt.checkStoreChanges
+			// two instances of the server serving the same bucket
+			newStore := newMemoryStoreFunc()
+			stores := make([]TiddlerStore, 2)
+			for i := range stores {
+				var err error
+				if stores[i], err = newStore("wikis/notes", true, StoreLayout{}); err != nil {
+					t.Fatalf("newStore() error = %v", err)
+				}
+			}
+			if err := stores[0].WriteTiddler(Tiddler{"title": "$:/favicon.ico", "type": "image/x-icon", "text": []byte("old icon")}); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			if err := stores[1].Reload(); err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			other := &handlerWithStore{Store: stores[1], wiki: "notes"}
+			getFavicon := func() string {
+				w := httptest.NewRecorder()
+				other.favicon(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/favicon.ico", nil))
+				return w.Body.String()
+			}
+			if _, err := other.reconcile(); err != nil {
+				t.Fatalf("reconcile() error = %v", err)
+			}
+			if got := getFavicon(); got != "old icon" {
+				t.Fatalf("favicon() = %q, want the old icon", got)
+			}
+
+			// the store's modification times are compared with when the icon was cached
+			time.Sleep(time.Millisecond)
+			if err := stores[0].WriteTiddler(Tiddler{"title": "$:/favicon.ico", "type": "image/x-icon", "text": []byte("new icon")}); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			if !tt.checkStoreChanges {
+				if got := getFavicon(); got != "old icon" {
+					t.Errorf("favicon() = %q before reconciling, want the cached old icon", got)
+				}
+			}
+			if tt.reconcile {
+				if _, err := other.reconcile(); err != nil {
+					t.Fatalf("reconcile() error = %v", err)
+				}
+			}
+			if got := getFavicon(); got != "new icon" {
+				t.Errorf("favicon() = %q, want the icon saved through the other instance", got)
+			}
+		})
+	}
+}
+func Test_handlerWithStore_loginBasic(t *testing.T) {
+	tests := []struct {
+		name           string
+		auth           authContext
+		wantStatusCode int
+	}{
+		{"no username",
+			authContext{Username: ""}, http.StatusUnauthorized},
+		{"with username",
+			authContext{Username: "random"}, http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/login-basic", nil).
+				WithContext(context.WithValue(context.Background(), "auth", tt.auth))
+			w := httptest.NewRecorder()
+			h := &handlerWithStore{}
+			h.loginBasic(w, r)
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("loginBasic() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+		})
+	}
+}
+
+func TestCredentials_userCanWrite(t *testing.T) {
+	type fields struct {
+		UserPasswordsClearText map[string]string
+		Readers                []string
+		Writers                []string
+	}
+	type args struct {
+		user            string
+		isAuthenticated bool
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   bool
+	}{
+		{"valid username, read:anon write:authorized",
+			fields{
+				map[string]string{"bobValid": "dilaVbob"},
+				nil,
+				[]string{"bobValid"}},
+			args{"bobValid", true},
+			true},
+		{"unauthenticated named writer",
+			fields{nil, nil, []string{"bobValid"}},
+			args{"bobValid", false},
+			false},
+		{"domain pattern match",
+			fields{nil, nil, []string{"admin", "*@example.com"}},
+			args{"bob@example.com", true},
+			true},
+		{"domain pattern non-match",
+			fields{nil, nil, []string{"*@example.com"}},
+			args{"bob@example.org", true},
+			false},
+		{"prefix pattern match",
+			fields{nil, nil, []string{"team-*"}},
+			args{"team-blue", true},
+			true},
+		{"prefix pattern non-match",
+			fields{nil, nil, []string{"team-*"}},
+			args{"teamblue", true},
+			false},
+		{"character class pattern",
+			fields{nil, nil, []string{"user[0-9]"}},
+			args{"user7", true},
+			true},
+		{"malformed pattern only matches exactly",
+			fields{nil, nil, []string{"user[0-9"}},
+			args{"user[0-9", true},
+			true},
+		{"authenticated token",
+			fields{nil, nil, []string{"(authenticated)"}},
+			args{"anyone", true},
+			true},
+		// TODO: Add test cases.
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Credentials{
+				UserPasswordsClearText: tt.fields.UserPasswordsClearText,
+				Readers:                tt.fields.Readers,
+				Writers:                tt.fields.Writers,
+			}
+			if got := c.userCanWrite(tt.args.user, tt.args.isAuthenticated); got != tt.want {
+				t.Errorf("Credentials.userCanWrite() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentials_userCanRead(t *testing.T) {
+	tests := []struct {
+		name            string
+		readers         []string
+		user            string
+		isAuthenticated bool
+		want            bool
+	}{
+		{"anyone when no readers", nil, AuthAnonUsername, false, true},
+		{"exact match", []string{"bobValid"}, "bobValid", true, true},
+		{"exact non-match", []string{"bobValid"}, "alice", true, false},
+		{"pattern match", []string{"*@example.com"}, "alice@example.com", true, true},
+		{"pattern non-match", []string{"*@example.com"}, "alice@example.com.evil", true, false},
+		{"pattern needs authentication", []string{"*"}, "alice", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Credentials{Readers: tt.readers}
+			if got := c.userCanRead(tt.user, tt.isAuthenticated); got != tt.want {
+				t.Errorf("Credentials.userCanRead() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_creds(t *testing.T) {
+	tests := []struct {
+		name        string
+		readers     string
+		wantReaders []string
+	}{
+		{"anonymous", "(anon)", nil},
+		{"single pattern", "*@example.com", []string{"*@example.com"}},
+		{"list", "alice,team-*", []string{"alice", "team-*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := creds(nil, "", tt.readers, "(anon)")
+			if err != nil {
+				t.Fatalf("creds() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Readers, tt.wantReaders) {
+				t.Errorf("creds() readers = %v, want %v", got.Readers, tt.wantReaders)
+			}
+			if got.Writers != nil {
+				t.Errorf("creds() writers = %v, want nil", got.Writers)
+			}
+		})
+	}
+}
+
+func Test_creds_file(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		wantUsers map[string]string
+		wantErr   bool
+	}{
+		{"users", "username,password\nalice,secret\nbob,hunter2\n", map[string]string{"alice": "secret", "bob": "hunter2"}, false},
+		{"header only", "username,password\n", nil, true},
+		{"empty", "", nil, true},
+		{"one column", "username\nalice\n", nil, true},
+		{"ragged line", "username,password\nalice\n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if err := store.WriteFile("users.csv", []byte(tt.file)); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+			got, err := creds(store, "users.csv", authTokenAuthenticated, "alice")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("creds() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.UserPasswordsClearText, tt.wantUsers) {
+				t.Errorf("creds() users = %v, want %v", got.UserPasswordsClearText, tt.wantUsers)
+			}
+			sort.Strings(got.Readers)
+			if want := []string{"alice", "bob"}; !reflect.DeepEqual(got.Readers, want) {
+				t.Errorf("creds() readers = %v, want %v", got.Readers, want)
+			}
+		})
+	}
+
+	if _, err := creds(NewMemoryStore(), "missing.csv", "", ""); err == nil {
+		t.Errorf("creds() read a missing credentials file")
+	}
+}
+
+func Test_requireReader_wikiCredentials(t *testing.T) {
+	defer func(hs *HandlerSelector, c Credentials, readers, writers string) {
+		handlerSelector, serverCredentials, serverReaders, serverWriters = hs, c, readers, writers
+	}(handlerSelector, serverCredentials, serverReaders, serverWriters)
+	serverReaders, serverWriters = "alice,bob", "alice"
+	serverCredentials = credentialsFor(map[string]string{"alice": "secret", "bob": "hunter2"}, serverReaders, serverWriters)
+
+	wikiFiles := map[string]map[string]string{
+		"shared":  {},
+		"private": {"readers": "alice\n", "writers": "alice"},
+		"team":    {"credentials.csv": "username,password\ncarol,pw\n", "readers": "(authenticated)"},
+	}
+	handlerSelector = &HandlerSelector{handlerMap: map[string]*handlerWithStore{}}
+	for wiki, files := range wikiFiles {
+		store := NewMemoryStore()
+		for name, content := range files {
+			if err := store.WriteFile(name, []byte(content)); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+		}
+		wikiCreds, err := loadWikiCredentials(store)
+		if err != nil {
+			t.Fatalf("loadWikiCredentials(%s) error = %v", wiki, err)
+		}
+		if (wikiCreds == nil) != (len(files) == 0) {
+			t.Errorf("loadWikiCredentials(%s) = %v with files %v", wiki, wikiCreds, files)
+		}
+		handlerSelector.handlerMap[wiki] = &handlerWithStore{Store: store, wiki: wiki, creds: wikiCreds}
+	}
+	router := chi.NewRouter()
+	router.Use(requireReader(serverCredentials, nil))
+	router.Get("/{wiki}/status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(r.Context().Value("auth"))
+	})
+
+	passwords := map[string]string{"alice": "secret", "bob": "hunter2", "carol": "pw"}
+	tests := []struct {
+		wiki, user string
+		wantStatus int
+		wantWrite  bool
+	}{
+		{"shared", "alice", http.StatusOK, true},
+		{"shared", "bob", http.StatusOK, false},
+		{"shared", "carol", http.StatusUnauthorized, false},
+		{"private", "alice", http.StatusOK, true},
+		{"private", "bob", http.StatusUnauthorized, false},
+		{"team", "carol", http.StatusOK, false},
+		{"team", "alice", http.StatusUnauthorized, false},
+		{"unknown", "bob", http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.wiki+"/"+tt.user, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/"+tt.wiki+"/status", nil)
+			r.SetBasicAuth(tt.user, passwords[tt.user])
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var auth authContext
+			if err := json.NewDecoder(w.Body).Decode(&auth); err != nil {
+				t.Fatalf("could not decode auth context: %v", err)
+			}
+			if auth.Username != tt.user || auth.WritingAllowed != tt.wantWrite {
+				t.Errorf("auth = %+v, want %s writing %v", auth, tt.user, tt.wantWrite)
+			}
+		})
+	}
+
+	store := NewMemoryStore()
+	store.WriteFile("credentials.csv", []byte("username,password\n"))
+	if _, err := loadWikiCredentials(store); err == nil {
+		t.Errorf("loadWikiCredentials() accepted a credentials file without users")
+	}
+}
+
+func Test_basicAuthCtx(t *testing.T) {
+	type args struct {
+		creds                     Credentials
+		username, password, route string
+	}
+	tests := []struct {
+		name   string
+		args   args
+		want   authContext
+		wantOK bool
+	}{
+		{"valid username, read:anon write:authorized",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					nil, []string{"bobValid"}},
+				"bobValid", "dilaVbob", ""},
+			authContext{
+				"bobValid", false, true},
+			true},
+		{"missing basic auth, read:anon, write:named",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					nil, []string{"bobValid"}},
+				"", "", ""},
+			authContext{
+				AuthAnonUsername, true, false},
+			true},
+		{"missing basic auth, read:named, write:none",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					[]string{"bobValid"}, nil},
+				"", "", ""},
+			authContext{},
+			false},
+		{"missing username, read:anon write:authorized",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					nil, []string{"bobValid"}},
+				"", "dilaVbob", ""},
+			authContext{
+				AuthAnonUsername, true, false},
+			true},
+		{"missing username, read:authorized write:authorized",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					[]string{"bobValid"}, []string{"bobValid"}},
+				"", "dilaVbob", ""},
+			authContext{},
+			false},
+		{"missing password, read:anon write:authorized",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					nil, []string{"bobValid"}},
+				"bobValid", "", ""},
+			authContext{
+				AuthAnonUsername, true, false},
+			true},
+		{"missing password, read:authorized write:authorized",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					[]string{"bobValid"}, []string{"bobValid"}},
+				"bobValid", "", ""},
+			authContext{},
+			false},
+		{"valid username not matching readers",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					[]string{"*@example.com"}, []string{"*@example.com"}},
+				"bobValid", "dilaVbob", ""},
+			authContext{},
+			false},
+		{"valid username matching reader and writer patterns",
+			args{
+				Credentials{
+					map[string]string{"bob@example.com": "dilaVbob"},
+					[]string{"*@example.com"}, []string{"*@example.com"}},
+				"bob@example.com", "dilaVbob", ""},
+			authContext{
+				"bob@example.com", false, true},
+			true},
+		{"writer not among the readers",
+			args{
+				Credentials{
+					map[string]string{"alice": "ecila", "bob": "bob"},
+					[]string{"alice"}, []string{"bob"}},
+				"bob", "bob", ""},
+			authContext{
+				"bob", false, true},
+			true},
+		{"reader not among the writers",
+			args{
+				Credentials{
+					map[string]string{"alice": "ecila", "bob": "bob"},
+					[]string{"alice"}, []string{"bob"}},
+				"alice", "ecila", ""},
+			authContext{
+				"alice", false, false},
+			true},
+		{"empty credentials",
+			args{
+				Credentials{},
+				"bobValid", "dilaVbob", ""},
+			authContext{
+				AuthAnonUsername, true, true},
+			true},
+		{"missing basic auth to login-basic, read:authorized write:authorized",
+			args{
+				Credentials{
+					map[string]string{"bobValid": "dilaVbob"},
+					[]string{"bobValid"}, []string{"bobValid"}},
+				"", "", "login-basic"},
+			authContext{
+				AuthAnonUsername, false, false},
+			true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, fmt.Sprintf("http://foobar.com/%s", tt.args.route), nil)
+			if tt.args.username != "" && tt.args.password != "" {
+				r.SetBasicAuth(tt.args.username, tt.args.password)
+			}
+			w := httptest.NewRecorder()
+			gotCtx, ok := basicAuthCtx(w, r, tt.args.creds)
+			if ok != tt.wantOK {
+				t.Errorf("basicAuthCtx() unexpected ok = %t, want %t", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(gotCtx, tt.want) {
+				t.Errorf("basicAuthCtx() unexpected context returned = %v, want %v", gotCtx, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_status(t *testing.T) {
+	tests := []struct {
+		name string
+		auth authContext
+	}{
+		{"no username",
+			authContext{"", true, true}},
+		{"with username",
+			authContext{"random", false, true}},
+		{"no authContext",
+			authContext{Username: "TESTDONOTADD"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/status", nil)
+			if tt.auth.Username != "TESTDONOTADD" {
+				r = r.WithContext(context.WithValue(context.Background(), "auth", tt.auth))
+			} else {
+				tt.auth.Username = ""
+			}
+			w := httptest.NewRecorder()
+			h := &handlerWithStore{}
+			h.status(w, r)
+			resp := w.Result()
+			var status map[string]interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				t.Errorf("status() could not read server response = %v", err)
+			}
+			if status["username"] != tt.auth.Username {
+				t.Errorf("status() did not receive expected username = %s, want = %s", status["username"], tt.auth.Username)
+			}
+			if status["anonymous"] != tt.auth.CanBeAnonymous {
+				t.Errorf("status() did not receive expected anonymous value = %t, want = %t", status["anonymous"], tt.auth.CanBeAnonymous)
+			}
+			if status["read_only"] != !tt.auth.WritingAllowed {
+				t.Errorf("status() did not receive expected read_only value = %t, want = %t", status["read_only"], !tt.auth.WritingAllowed)
+			}
+
+			for _, f := range []string{"space", "tiddlywiki_version"} {
+				if _, ok := status[f]; !ok {
+					t.Errorf("status() did not identify '%s' field in response", f)
+				}
+			}
+		})
+	}
+}
+
+type chiContextKey struct {
+	name string
+}
+
+func (k *chiContextKey) String() string {
+	return "chi context value " + k.name
+}
+
+func Test_handlerWithStore_getTiddler(t *testing.T) {
+	dummy := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			"TestTiddler": getTestTiddlerJsonAsTid(t, "TestTiddler.json"),
+		},
+	}
+	type args struct {
+		recipe, tiddlerName string
+	}
+	tests := []struct {
+		name           string
+		args           args
+		store          TiddlerStore
+		want           Tiddler
+		wantStatusCode int
+	}{
+		{"existing tiddler",
+			args{"default", "TestTiddler"}, store,
+			dummy, http.StatusOK},
+		{"missing tiddler",
+			args{"default", "NotATiddler"}, store,
+			nil, http.StatusNotFound},
+		{"missing tiddler name in route",
+			args{"default", ""}, store,
+			nil, http.StatusBadRequest},
+		// TODO: add more test cases
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{
+				Store: tt.store,
+			}
+			r := httptest.NewRequest(http.MethodGet,
+				fmt.Sprintf("http://foobar.com/recipes/%s/tiddlers/%s",
+					tt.args.recipe, tt.args.tiddlerName), nil)
+			r = r.WithContext(context.WithValue(r.Context(),
+				chi.RouteCtxKey,
+				&chi.Context{
+					URLParams: chi.RouteParams{
+						Keys:   []string{"recipe", "*"},
+						Values: []string{tt.args.recipe, tt.args.tiddlerName},
+					},
+				}))
+			w := httptest.NewRecorder()
+			h.getTiddler(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("getTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+
+			if resp.StatusCode == http.StatusOK {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Errorf("getTiddler() could not read server response = %v", err)
+				}
+				gotTid := convertJsonToTid(t, body)
+				if !areTiddlersEqual(t, tt.want, gotTid) {
+					t.Errorf("getTiddler() returned tiddler does not match expected")
+				}
+			}
+
+		})
+	}
+}
+
+func Test_handlerWithStore_putTiddler(t *testing.T) {
+	dummy := getTestTiddlerJson(t, "TestTiddler.json")
+	dummyAsTid := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: make(map[string]Tiddler),
+	}
+	type args struct {
+		recipe, tiddlerName string
+		tiddler             []byte
+	}
+	tests := []struct {
+		name           string
+		args           args
+		store          dummyTiddlerStore
+		wantIsUpdated  bool
+		wantStatusCode int
+	}{
+		{"standard tiddler",
+			args{"default", dummyAsTid["title"].(string), dummy},
+			*store, false, http.StatusNoContent},
+		// TODO: update existing tiddler
+		// TODO: add more test cases
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jsonTid := convertJsonToTid(t, tt.args.tiddler)
+			_, inStore := tt.store.tiddlersByTitle[jsonTid["title"].(string)]
+			if !tt.wantIsUpdated && inStore {
+				t.Error("found tiddler in store unexpectedly")
+			}
+			h := &handlerWithStore{
+				Store: &tt.store,
+			}
+			r := httptest.NewRequest(http.MethodPut,
+				fmt.Sprintf("http://foobar.com/recipes/%s/tiddlers/%s",
+					tt.args.recipe, tt.args.tiddlerName),
+				bytes.NewReader(tt.args.tiddler))
+			r = r.WithContext(context.WithValue(r.Context(),
+				chi.RouteCtxKey,
+				&chi.Context{
+					URLParams: chi.RouteParams{
+						Keys:   []string{"recipe", "*"},
+						Values: []string{tt.args.recipe, tt.args.tiddlerName},
+					},
+				}))
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("putTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+
+			gotTid, inStore := tt.store.tiddlersByTitle[jsonTid["title"].(string)]
+			if !inStore {
+				t.Errorf("putTiddler() tiddler not found in store with title %s", jsonTid["title"].(string))
+			}
+			if !areTiddlersEqual(t, jsonTid, gotTid) {
+				t.Errorf("putTiddler() returned tiddler does not match expected")
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_deleteTiddler(t *testing.T) {
+	dummyAsTid := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			dummyAsTid["title"].(string): dummyAsTid,
+		},
+	}
+	type args struct {
+		bag, tiddlerName string
+	}
+	tests := []struct {
+		name           string
+		args           args
+		store          dummyTiddlerStore
+		wantDeleted    bool
+		wantStatusCode int
+	}{
+		{"delete existing",
+			args{"default", dummyAsTid["title"].(string)},
+			*store, true, http.StatusNoContent},
+		{"delete missing",
+			args{"default", "Missing"},
+			*store, false, http.StatusInternalServerError},
+		{"invalid escape",
+			args{"default", "Bad%zzTitle"},
+			*store, false, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// each case deletes from its own copy of the tiddlers
+			tiddlers := make(map[string]Tiddler)
+			for title, tid := range tt.store.tiddlersByTitle {
+				tiddlers[title] = tid
+			}
+			tt.store.tiddlersByTitle = tiddlers
+			h := &handlerWithStore{
+				Store: &tt.store,
+			}
+			r := httptest.NewRequest(http.MethodDelete,
+				fmt.Sprintf("http://foobar.com/bags/%s/tiddlers/%s",
+					tt.args.bag, url.PathEscape(tt.args.tiddlerName)), nil)
 			r = r.WithContext(context.WithValue(r.Context(),
 				chi.RouteCtxKey,
 				&chi.Context{
@@ -514,269 +1845,3613 @@ func Test_handlerWithStore_deleteTiddler(t *testing.T) {
 					},
 				}))
 			w := httptest.NewRecorder()
-			h.deleteTiddler(w, r)
+			h.deleteTiddler(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("deleteTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+
+			if _, gotNotDeleted := tt.store.tiddlersByTitle[tt.args.tiddlerName]; tt.wantDeleted && gotNotDeleted {
+				t.Errorf("deleteTiddler() tiddler unexpectedly found still in the store")
+			}
+			if _, err := tt.store.GetTiddler(tt.args.tiddlerName); tt.wantDeleted && err == nil {
+				t.Errorf("deleteTiddler() tiddler unexpectedly returned by the store")
+			}
+			if !tt.wantDeleted && len(tt.store.tiddlersByTitle) != 1 {
+				t.Errorf("deleteTiddler() changed the store on failure: %v", tt.store.tiddlersByTitle)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getSkinnyTiddlerList(t *testing.T) {
+	stripText := func(tid Tiddler) Tiddler {
+		skinnyTid := make(Tiddler)
+		for k, v := range tid {
+			if k == "text" {
+				continue
+			}
+			skinnyTid[k] = v
+		}
+		return skinnyTid
+	}
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			"TestTiddler":    getTestTiddlerJsonAsTid(t, "TestTiddler.json"),
+			"$:/favicon.ico": getTestTiddlerJsonAsTid(t, "favicon.json"),
+			"another":        getTestTiddlerJsonAsTid(t, "another.json"),
+		},
+	}
+	cache := []Tiddler{
+		stripText(store.tiddlersByTitle["TestTiddler.json"]),
+		// stripText(store.tiddlersByTitle["favicon.json"]),
+		stripText(store.tiddlersByTitle["another.json"]),
+	}
+	emptyStore := &dummyTiddlerStore{tiddlersByTitle: make(map[string]Tiddler)}
+	type fields struct {
+		store           dummyTiddlerStore
+		skinnyListCache []Tiddler
+	}
+	type args struct {
+		recipe string
+	}
+	tests := []struct {
+		name           string
+		fields         fields
+		args           args
+		want           []Tiddler
+		wantStatusCode int
+	}{
+		{"use cache",
+			fields{*emptyStore, cache},
+			args{"default"},
+			cache, http.StatusOK},
+		{"build cache",
+			fields{*store, nil},
+			args{"default"},
+			cache, http.StatusOK},
+		{"empty store",
+			fields{*emptyStore, nil},
+			args{"default"},
+			[]Tiddler{}, http.StatusOK},
+		{"nil store",
+			fields{dummyTiddlerStore{simulateBackingStoreError: true}, nil},
+			args{"default"},
+			nil, http.StatusInternalServerError},
+		// TODO: add more test cases
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{
+				Store:           &tt.fields.store,
+				skinnyListCache: tt.fields.skinnyListCache,
+			}
+			r := httptest.NewRequest(http.MethodGet,
+				fmt.Sprintf("http://foobar.com/recipes/%s/tiddlers.json",
+					tt.args.recipe), nil)
+			r = r.WithContext(context.WithValue(r.Context(),
+				chi.RouteCtxKey,
+				&chi.Context{
+					URLParams: chi.RouteParams{
+						Keys:   []string{"recipe"},
+						Values: []string{tt.args.recipe},
+					},
+				}))
+			w := httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("getSkinnyTiddlerList() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+			if resp.StatusCode == http.StatusOK {
+				var got []Tiddler
+				if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+					t.Errorf("getSkinnyTiddlerList() could not read server response = %v", err)
+				}
+				if !areTiddlerSlicesEqual(t, tt.want, got) {
+					t.Errorf("getSkinnyTiddlerList(): returned tiddler slice does not match expected")
+				}
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_index(t *testing.T) {
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			"TestTiddler":    getTestTiddlerJsonAsTid(t, "TestTiddler.json"),
+			"loading-splash": getTestTiddlerJsonAsTid(t, "loading-splash.json"),
+			// "$:/favicon.ico": getTestTiddlerJsonAsTid(t, "favicon.json"),
+			// "another":        getTestTiddlerJsonAsTid(t, "another.json"),
+		},
+	}
+	type fields struct {
+		Store      dummyTiddlerStore
+		indexCache *bytes.Buffer
+	}
+	tests := []struct {
+		name           string
+		fields         fields
+		wantStatusCode int
+	}{
+		{"build the cache",
+			fields{*store, nil}, http.StatusOK},
+		// TODO: add more test cases
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{
+				Store: &tt.fields.Store,
+				// indexCache: tt.fields.indexCache,
+			}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			w := httptest.NewRecorder()
+			h.index(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Errorf("getSkinnyTiddlerList() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+			if resp.StatusCode == http.StatusOK {
+				reader := bufio.NewReader(resp.Body)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil && err != io.EOF {
+						t.Logf("index line: %s", line)
+						t.Fatalf("could not read line in index file: %v", err)
+					}
+					// t.Logf("line: %s", line)
+					if strings.Contains(line, "<!--~~ Ordinary tiddlers ~~-->") {
+						for {
+							scriptLine, err := reader.ReadString('\n')
+							if err == io.EOF {
+								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
+							}
+							if strings.Contains(scriptLine, "</script>") {
+								break
+							}
+							if strings.Contains(scriptLine, `<script class="tiddlywiki-tiddler-store"`) {
+								continue
+							}
+							// t.Logf("script thingy:\n%s", strings.TrimSpace(scriptLine))
+							var stored []Tiddler
+							if err := json.NewDecoder(strings.NewReader(scriptLine)).Decode(&stored); err != nil {
+								t.Errorf("index() could not read server response = %v", err)
+							}
+							want := make([]Tiddler, 0)
+							for _, t := range tt.fields.Store.tiddlersByTitle {
+								want = append(want, t)
+							}
+							if !areTiddlerSlicesEqual(t, want, stored) {
+								t.Errorf("index(): returned tiddler slice does not match expected")
+							}
+						}
+					} else if strings.Contains(line, "<!--~~ Raw markup for the top of the head section ~~-->") {
+						var markup bytes.Buffer
+						for {
+							markupLine, err := reader.ReadString('\n')
+							if err == io.EOF {
+								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
+							}
+							if strings.Contains(markupLine, `<meta http-equiv="X-UA-Compatible" content="IE=Edge"/>`) {
+								break
+							}
+							markup.WriteString(markupLine)
+						}
+						// TODO: check that this is correct
+						t.Logf("head markup:\n%s", markup.String())
+					} else if strings.Contains(line, "<!--~~ Raw markup for the top of the body section ~~-->") {
+						var markup bytes.Buffer
+						for {
+							markupLine, err := reader.ReadString('\n')
+							if err == io.EOF {
+								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
+							}
+							if strings.Contains(markupLine, "<!--~~ Static styles ~~-->") {
+								break
+							}
+							markup.WriteString(markupLine)
+						}
+						// TODO: check that this is correct
+						t.Logf("body-top markup:\n%s", markup.String())
+					} else if strings.Contains(line, "<!--~~ Raw markup for the bottom of the body section ~~-->") {
+						var markup bytes.Buffer
+						for {
+							markupLine, err := reader.ReadString('\n')
+							if err == io.EOF {
+								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
+							}
+							if strings.Contains(markupLine, `</body>`) {
+								break
+							}
+							markup.WriteString(markupLine)
+						}
+						// TODO: check that this is correct
+						t.Logf("body-bottom markup:\n%s", markup.String())
+					}
+					if err == io.EOF {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_resetCaches(t *testing.T) {
+	type fields struct {
+		indexCache      *bytes.Buffer
+		faviconCache    *bytes.Buffer
+		skinnyListCache []Tiddler
+	}
+	tests := []struct {
+		name   string
+		fields fields
+	}{
+		{"basic test", fields{
+			bytes.NewBufferString("this is dummy text"),
+			bytes.NewBufferString("my favorite icon"),
+			[]Tiddler{getTestTiddlerJsonAsTid(t, "TestTiddler.json")}}},
+		{"missing caches", fields{nil, nil, nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{
+				indexCache:      tt.fields.indexCache,
+				faviconCache:    tt.fields.faviconCache,
+				skinnyListCache: tt.fields.skinnyListCache,
+			}
+			h.resetCaches()
+
+			if h.indexCache != nil && h.indexCache.Len() > 0 {
+				t.Errorf("handlerWithStore.resetCaches() unexpectedly found indexCache not empty %d", h.indexCache.Len())
+			}
+			if h.faviconCache != nil && h.faviconCache.Len() > 0 {
+				t.Errorf("handlerWithStore.resetCaches() unexpectedly found faviconCache not empty %d", h.faviconCache.Len())
+			}
+			if len(h.skinnyListCache) > 0 {
+				t.Errorf("handlerWithStore.resetCaches() unexpectedly found skinnyListCache not empty %d", len(h.skinnyListCache))
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getFile(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"><circle r="5"/></svg>`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(svg))
+	zw.Close()
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			"pixel.png": {"title": "pixel.png", "type": "image/png", "text": []byte{0x89, 'P', 'N', 'G'}},
+			"icon.svg":  {"title": "icon.svg", "type": "image/svg+xml", "text": svg, gzippedContentField: gz.Bytes()},
+		},
+		files: map[string]string{
+			"files/logo.svg.gz": gz.String(),
+			"files/plain.css":   "body {}",
+			"files/README":      "just some text",
+		},
+	}
+	tests := []struct {
+		name           string
+		file           string
+		acceptEncoding string
+		want           string
+		wantType       string
+		wantEncoding   string
+		wantStatusCode int
+	}{
+		{"gzip stored svg, gzip client", "logo.svg", "gzip, deflate", gz.String(), "image/svg+xml", "gzip", http.StatusOK},
+		{"gzip stored svg, identity client", "logo.svg", "", svg, "image/svg+xml", "", http.StatusOK},
+		{"gzip stored svg, gzip refused", "logo.svg", "gzip;q=0", svg, "image/svg+xml", "", http.StatusOK},
+		{"plain file", "plain.css", "gzip", "body {}", "text/css", "", http.StatusOK},
+		{"binary tiddler", "pixel.png", "gzip", "\x89PNG", "image/png", "", http.StatusOK},
+		{"gzip stored tiddler, gzip client", "icon.svg", "gzip", gz.String(), "image/svg+xml", "gzip", http.StatusOK},
+		{"gzip stored tiddler, identity client", "icon.svg", "", svg, "image/svg+xml", "", http.StatusOK},
+		{"no extension, sniffed", "README", "", "just some text", "text/plain", "", http.StatusOK},
+		{"missing", "nothing.svg", "gzip", "", "", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/files/"+tt.file, nil)
+			if tt.acceptEncoding != "" {
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"*"}, Values: []string{tt.file}}}))
+			w := httptest.NewRecorder()
+			h.getFile(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatusCode {
+				t.Fatalf("getFile() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			}
+			if resp.StatusCode != http.StatusOK {
+				return
+			}
+			if got := resp.Header.Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("getFile() Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if got := resp.Header.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("getFile() Vary = %q, want Accept-Encoding", got)
+			}
+			if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Errorf("getFile() Content-Type = %q, want %q", got, tt.wantType)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("getFile() body = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getFile_binaryETag(t *testing.T) {
+	defer func(o Options, hash func([]byte) string) { serverOptions, binaryContentHash = o, hash }(serverOptions, binaryContentHash)
+	hashes := 0
+	hash := binaryContentHash
+	binaryContentHash = func(content []byte) string {
+		hashes++
+		return hash(content)
+	}
+	content := []byte("\x89PNG\r\n\x1a\nnot really an image")
+	store := NewMemoryStore()
+	if err := store.WriteTiddler(Tiddler{"title": "photo.png", "type": "image/png", "text": content}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	// read back from the .meta file, as after a restart
+	if err := store.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	h := &handlerWithStore{Store: store}
+	get := func(header, value string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://foobar.com/mywiki/files/photo.png", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+			&chi.Context{URLParams: chi.RouteParams{Keys: []string{"*"}, Values: []string{"photo.png"}}}))
+		w := httptest.NewRecorder()
+		h.getFile(w, r)
+		return w
+	}
+	strong := fmt.Sprintf(`"%x"`, sha256.Sum256(content))
+
+	tests := []struct {
+		name       string
+		header     string
+		value      string
+		wantStatus int
+		wantEtag   string
+		wantBody   string
+	}{
+		{"full content", "", "", http.StatusOK, strong, string(content)},
+		{"again", "", "", http.StatusOK, strong, string(content)},
+		{"not modified", "If-None-Match", strong, http.StatusNotModified, strong, ""},
+		{"modified", "If-None-Match", `"stale"`, http.StatusOK, strong, string(content)},
+		{"range", "Range", "bytes=0-3", http.StatusPartialContent, strong, string(content[:4])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := get(tt.header, tt.value)
+			if w.Code != tt.wantStatus {
+				t.Errorf("getFile() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if etag := w.Header().Get("Etag"); etag != tt.wantEtag {
+				t.Errorf("getFile() Etag = %s, want %s", etag, tt.wantEtag)
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("getFile() body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+	if hashes != 1 {
+		t.Errorf("content hashed %d times, want once when written", hashes)
+	}
+
+	// the hash is not sent to clients, nor kept when sent back on a text tiddler
+	r := httptest.NewRequest(http.MethodGet, "http://foobar.com/mywiki/recipes/default/tiddlers/photo.png", nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+		&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", "photo.png"}}}))
+	w := httptest.NewRecorder()
+	h.getTiddler(w, r)
+	var sent Tiddler
+	if err := json.NewDecoder(w.Body).Decode(&sent); err != nil {
+		t.Fatalf("getTiddler() did not send JSON: %v", err)
+	}
+	if _, ok := sent[binaryHashField]; ok || sent.Field("title") != "photo.png" {
+		t.Errorf("getTiddler() sent %v, want the tiddler without %s", sent, binaryHashField)
+	}
+	sentBack := Tiddler{"title": "Note", "text": "hello", binaryHashField: "abc"}
+	if err := flattenTiddlyWebFormat(sentBack); err != nil || sentBack[binaryHashField] != nil {
+		t.Errorf("flattenTiddlyWebFormat() = %v, %v, want %s dropped", sentBack, err, binaryHashField)
+	}
+}
+
+func Test_contentTypeFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content []byte
+		want    string
+	}{
+		{"css", "site.css", []byte("body {}"), "text/css; charset=utf-8"},
+		{"upper case extension", "LOGO.PNG", nil, "image/png"},
+		{"svg", "logo.svg", []byte("<svg/>"), "image/svg+xml"},
+		{"woff2 font", "font.woff2", []byte("wOF2"), "font/woff2"},
+		{"icon", "favicon.ico", nil, "image/x-icon"},
+		{"extension wins over content", "data.json", []byte("<html>"), "application/json"},
+		{"unknown extension sniffed", "photo.unknown", []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+		{"no extension sniffed", "", []byte("GIF89a"), "image/gif"},
+		{"nothing to go by", "archive", nil, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := contentTypeFor(tt.file, tt.content); got != tt.want {
+				t.Errorf("contentTypeFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_importTiddlers(t *testing.T) {
+	payload := `[
+		{"title":"Old Note","text":"from 2015","created":"20150102030405000","modified":"20150607080910000","creator":"alice","tags":["one","two words"]},
+		{"text":"no title"},
+		{"title":"Existing","text":"imported over"},
+		{"title":"Bad Fields","fields":"x"}
+	]`
+	tests := []struct {
+		name          string
+		query         string
+		wantPreserved bool
+	}{
+		{"preserve timestamps", "?preserve-timestamps=true", true},
+		{"restamp by default", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"Existing": {"title": "Existing", "text": "stored", "revision": "4"}}}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodPost, "http://foobar.com/recipes/default/tiddlers/import"+tt.query,
+				strings.NewReader(payload))
+			w := httptest.NewRecorder()
+			h.importTiddlers(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("importTiddlers() unexpected status code = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			var result struct {
+				Imported []string
+				Failed   map[string]string
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatalf("importTiddlers() could not read server response = %v", err)
+			}
+			if len(result.Imported) != 2 || len(result.Failed) != 2 || result.Failed["Bad Fields"] == "" {
+				t.Errorf("importTiddlers() imported = %v, failed = %v", result.Imported, result.Failed)
+			}
+			// the next revision, so that syncing clients fetch the tiddler imported over theirs
+			if existing := store.tiddlersByTitle["Existing"]; existing["text"] != "imported over" || existing["revision"] != "5" {
+				t.Errorf("importTiddlers() wrote %v over revision 4, want revision 5", existing)
+			}
+			got, ok := store.tiddlersByTitle["Old Note"]
+			if !ok {
+				t.Fatal("importTiddlers() tiddler not found in store")
+			}
+			if got["tags"] != "one [[two words]]" {
+				t.Errorf("importTiddlers() tags = %v", got["tags"])
+			}
+			if got["creator"] != "alice" {
+				t.Errorf("importTiddlers() creator = %v, want alice", got["creator"])
+			}
+			if preserved := got["created"] == "20150102030405000" && got["modified"] == "20150607080910000"; preserved != tt.wantPreserved {
+				t.Errorf("importTiddlers() created = %v, modified = %v, want preserved %t", got["created"], got["modified"], tt.wantPreserved)
+			}
+		})
+	}
+}
+
+// listingWriteStore lists the tiddlers through the handler while one title is written, as a GET arriving mid-import would
+type listingWriteStore struct {
+	TiddlerStore
+	h         *handlerWithStore
+	listTitle string
+}
+
+func (s *listingWriteStore) WriteTiddler(t Tiddler) error {
+	if t["title"] == s.listTitle {
+		s.h.skinnyTiddlers()
+	}
+	return s.TiddlerStore.WriteTiddler(t)
+}
+
+func Test_handlerWithStore_importTiddlers_caches(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.MaxRevisions = 2
+	mem := NewMemoryStore()
+	if err := mem.WriteTiddler(Tiddler{"title": "Existing", "text": "original", "revision": "4"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	store := &listingWriteStore{TiddlerStore: mem, listTitle: "Second"}
+	h := &handlerWithStore{Store: store}
+	store.h = h
+	if _, err := h.skinnyTiddlers(); err != nil {
+		t.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "http://foobar.com/recipes/default/tiddlers/import",
+		strings.NewReader(`[{"title":"First","text":"1"},{"title":"Second","text":"2"},{"title":"Third","text":"3"},{"title":"Existing","text":"imported"}]`))
+	w := httptest.NewRecorder()
+	h.importTiddlers(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("importTiddlers() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// the list built while the import was being written is not kept
+	skinny, err := h.skinnyTiddlers()
+	if err != nil {
+		t.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+	titles := []string{}
+	for _, tid := range skinny {
+		titles = append(titles, tid.Field("title"))
+	}
+	if want := []string{"Existing", "First", "Second", "Third"}; !reflect.DeepEqual(titles, want) {
+		t.Errorf("skinnyTiddlers() after import = %v, want %v", titles, want)
+	}
+	// the tiddler imported over is kept in the history, as putTiddler keeps it
+	if old, err := h.readRevision("Existing", 4); err != nil || old.Field("text") != "original" {
+		t.Errorf("readRevision(Existing, 4) = %v, %v, want the original", old, err)
+	}
+}
+
+func Test_handlerWithStore_importTiddlers_idempotencyKey(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: make(map[string]Tiddler)}
+	h := &handlerWithStore{Store: store}
+	tests := []struct {
+		name         string
+		key          string
+		payload      string
+		wantImported []string
+		wantSkipped  []string
+		wantDone     int
+	}{
+		{"first attempt", "batch-1", `[{"title":"One","text":"1"},{"title":"Two","text":"2"}]`, []string{"One", "Two"}, []string{}, 2},
+		{"retry skips what was imported", "batch-1", `[{"title":"One","text":"1"},{"title":"Two","text":"2"},{"title":"Three","text":"3"}]`, []string{"Three"}, []string{"One", "Two"}, 3},
+		{"other key imports again", "batch-2", `[{"title":"One","text":"1"}]`, []string{"One"}, []string{}, 1},
+		{"no key", "", `[{"title":"One","text":"1"}]`, []string{"One"}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// changed since the first attempt, so a skipped tiddler that was rewritten would show
+			if tid, ok := store.tiddlersByTitle["One"]; ok {
+				tid["text"] = "edited"
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://foobar.com/recipes/default/tiddlers/import", strings.NewReader(tt.payload))
+			if tt.key != "" {
+				r.Header.Set("Idempotency-Key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			h.importTiddlers(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("importTiddlers() status = %d, want %d", w.Code, http.StatusOK)
+			}
+			var result struct {
+				Imported []string
+				Skipped  []string
+				Progress map[string]int
+			}
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("importTiddlers() could not read server response = %v", err)
+			}
+			if !reflect.DeepEqual(result.Imported, tt.wantImported) || !reflect.DeepEqual(result.Skipped, tt.wantSkipped) {
+				t.Errorf("importTiddlers() imported = %v, skipped = %v, want %v, %v", result.Imported, result.Skipped, tt.wantImported, tt.wantSkipped)
+			}
+			if result.Progress["done"] != tt.wantDone {
+				t.Errorf("importTiddlers() progress = %v, want %d done", result.Progress, tt.wantDone)
+			}
+			if len(tt.wantSkipped) > 0 && store.tiddlersByTitle["One"]["text"] != "edited" {
+				t.Errorf("importTiddlers() rewrote skipped tiddler One")
+			}
+		})
+	}
+	if len(store.files) != 2 {
+		t.Errorf("importTiddlers() wrote %d progress markers, want 2: %v", len(store.files), store.files)
+	}
+}
+
+// countingWriteStore counts the writes of each title, taking a while over each so that concurrent requests overlap
+type countingWriteStore struct {
+	TiddlerStore
+	mu     sync.Mutex
+	writes map[string]int
+}
+
+func (s *countingWriteStore) WriteTiddler(t Tiddler) error {
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	s.writes[t.Field("title")]++
+	s.mu.Unlock()
+	return s.TiddlerStore.WriteTiddler(t)
+}
+
+func Test_handlerWithStore_importTiddlers_concurrentRetry(t *testing.T) {
+	for _, query := range []string{"", "?atomic=true"} {
+		t.Run("query "+query, func(t *testing.T) {
+			store := &countingWriteStore{TiddlerStore: NewMemoryStore(), writes: map[string]int{}}
+			h := &handlerWithStore{Store: store}
+			var wg sync.WaitGroup
+			for i := 0; i < 2; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := httptest.NewRequest(http.MethodPost, "http://foobar.com/recipes/default/tiddlers/import"+query,
+						strings.NewReader(`[{"title":"One","text":"1"},{"title":"Two","text":"2"}]`))
+					r.Header.Set("Idempotency-Key", "batch")
+					w := httptest.NewRecorder()
+					h.importTiddlers(w, r)
+					if w.Code != http.StatusOK {
+						t.Errorf("importTiddlers() status = %d, want %d", w.Code, http.StatusOK)
+					}
+				}()
+			}
+			wg.Wait()
+			// the retry waits for the attempt under way and skips what it imported
+			if want := map[string]int{"One": 1, "Two": 1}; !reflect.DeepEqual(store.writes, want) {
+				t.Errorf("importTiddlers() writes = %v, want %v", store.writes, want)
+			}
+		})
+	}
+}
+
+// failingWriteStore fails the writes of one title, as a bucket can part way through a batch
+type failingWriteStore struct {
+	TiddlerStore
+	failTitle string
+}
+
+func (s *failingWriteStore) WriteTiddler(t Tiddler) error {
+	if t["title"] == s.failTitle {
+		return errors.New("simulated write error")
+	}
+	return s.TiddlerStore.WriteTiddler(t)
+}
+
+func Test_handlerWithStore_importTiddlers_atomic(t *testing.T) {
+	tests := []struct {
+		name       string
+		payload    string
+		failTitle  string
+		wantStatus int
+		wantFailed []string
+	}{
+		{"all imported", `[{"title":"New","text":"new"},{"title":"Existing","text":"imported"}]`, "", http.StatusOK, []string{}},
+		{"bad tiddler aborts the batch", `[{"title":"New","text":"new"},{"title":"Existing","text":"imported"},{"title":"Bad","caption":"two\nlines"}]`, "", http.StatusUnprocessableEntity, []string{"Bad"}},
+		{"missing title aborts the batch", `[{"title":"New","text":"new"},{"text":"no title"}]`, "", http.StatusUnprocessableEntity, []string{"#1"}},
+		{"failed write rolls back", `[{"title":"New","text":"new"},{"title":"Existing","text":"imported"},{"title":"New","text":"again"},{"title":"Unwritable","text":"x"}]`, "Unwritable", http.StatusInternalServerError, []string{"Unwritable"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := NewMemoryStore()
+			if err := mem.WriteTiddler(Tiddler{"title": "Existing", "text": "original", "revision": "4"}); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			h := &handlerWithStore{Store: &failingWriteStore{TiddlerStore: mem, failTitle: tt.failTitle}}
+			if _, err := h.skinnyTiddlers(); err != nil {
+				t.Fatalf("skinnyTiddlers() error = %v", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "http://foobar.com/recipes/default/tiddlers/import?atomic=true", strings.NewReader(tt.payload))
+			w := httptest.NewRecorder()
+			h.importTiddlers(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("importTiddlers() status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			// the listing is that of the store once the batch committed or rolled back
+			skinny, err := h.skinnyTiddlers()
+			if err != nil {
+				t.Fatalf("skinnyTiddlers() error = %v", err)
+			}
+			if listed := len(skinny) == 2; listed != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("skinnyTiddlers() after import = %v", skinny)
+			}
+			var result struct {
+				Imported      []string
+				Failed        map[string]string
+				NotRolledBack map[string]string `json:"not_rolled_back"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+				t.Fatalf("importTiddlers() could not read server response = %v", err)
+			}
+			failed := []string{}
+			for title := range result.Failed {
+				failed = append(failed, title)
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) || len(result.NotRolledBack) > 0 {
+				t.Errorf("importTiddlers() failed = %v, not rolled back = %v, want failed %v", result.Failed, result.NotRolledBack, tt.wantFailed)
+			}
+
+			existing, err := mem.GetTiddler("Existing")
+			if err != nil {
+				t.Fatalf("GetTiddler() error = %v", err)
+			}
+			_, newErr := mem.GetTiddler("New")
+			if tt.wantStatus == http.StatusOK {
+				if !reflect.DeepEqual(result.Imported, []string{"New", "Existing"}) || existing.Field("text") != "imported" || newErr != nil {
+					t.Errorf("importTiddlers() imported = %v, Existing = %v, New error = %v", result.Imported, existing, newErr)
+				}
+				return
+			}
+			// nothing of the batch is left in the store
+			if len(result.Imported) != 0 || existing.Field("text") != "original" || existing.Field("revision") != "4" || newErr == nil {
+				t.Errorf("importTiddlers() imported = %v, Existing = %v, New error = %v, want the store as before", result.Imported, existing, newErr)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_deleteTiddlers(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"One":  {"title": "One"},
+		"Two":  {"title": "Two"},
+		"Keep": {"title": "Keep"},
+	}}
+	h := &handlerWithStore{Store: store}
+	h.setIndexCache([]byte("cached"), time.Now())
+
+	handler := requireWriter(http.HandlerFunc(h.deleteTiddlers))
+	tests := []struct {
+		name        string
+		auth        authContext
+		wantStatus  int
+		wantDeleted []string
+		wantFailed  []string
+	}{
+		{"reader is refused", authContext{Username: "reader"}, http.StatusForbidden, nil, nil},
+		{"writer deletes", authContext{Username: "writer", WritingAllowed: true}, http.StatusOK, []string{"One", "Two"}, []string{"Missing"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "http://foobar.com/recipes/default/tiddlers/delete",
+				strings.NewReader(`["One","Missing","Two"]`))
+			r = r.WithContext(context.WithValue(r.Context(), "auth", tt.auth))
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("deleteTiddlers() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(store.tiddlersByTitle) != 3 {
+					t.Errorf("deleteTiddlers() deleted tiddlers for a refused request")
+				}
+				return
+			}
+			var result struct {
+				Deleted []string
+				Failed  map[string]string
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				t.Fatalf("deleteTiddlers() could not read server response = %v", err)
+			}
+			if !reflect.DeepEqual(result.Deleted, tt.wantDeleted) {
+				t.Errorf("deleteTiddlers() deleted = %v, want %v", result.Deleted, tt.wantDeleted)
+			}
+			for _, title := range tt.wantFailed {
+				if _, ok := result.Failed[title]; !ok {
+					t.Errorf("deleteTiddlers() failed = %v, want %s reported", result.Failed, title)
+				}
+			}
+			if _, ok := store.tiddlersByTitle["Keep"]; !ok || len(store.tiddlersByTitle) != 1 {
+				t.Errorf("deleteTiddlers() left %v in the store", store.tiddlersByTitle)
+			}
+			if page, _ := h.cachedIndex(""); page != "" {
+				t.Errorf("deleteTiddlers() did not reset the index cache")
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_putTiddler_conflictStrategy(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name       string
+		strategy   string
+		ifMatch    string
+		wantStatus int
+		wantText   string
+		wantEtag   string
+	}{
+		{"no etag always writes", ConflictReject, "", http.StatusNoContent, "client", `"default/Note/4:`},
+		{"matching revision writes", ConflictReject, `"default/Note/3:abc"`, http.StatusNoContent, "client", `"default/Note/4:`},
+		{"client wins by default", "", `"default/Note/1:abc"`, http.StatusNoContent, "client", `"default/Note/4:`},
+		{"client wins", ConflictClientWins, `"default/Note/1:abc"`, http.StatusNoContent, "client", `"default/Note/4:`},
+		{"server wins", ConflictServerWins, `"default/Note/1:abc"`, http.StatusOK, "server", `"default/Note/3:`},
+		{"reject", ConflictReject, `"default/Note/1:abc"`, http.StatusPreconditionFailed, "server", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.ConflictStrategy = tt.strategy
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+				"Note": {"title": "Note", "text": "server", "revision": "3"},
+			}}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/default/tiddlers/Note",
+				strings.NewReader(`{"title":"Note","text":"client"}`))
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", "Note"}}}))
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+
+			resp := w.Result()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("putTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			stored := store.tiddlersByTitle["Note"]
+			if got := stored.Field("text"); got != tt.wantText {
+				t.Errorf("putTiddler() stored text = %s, want %s", got, tt.wantText)
+			}
+			if etag := resp.Header.Get("Etag"); !strings.HasPrefix(etag, tt.wantEtag) || (tt.wantEtag == "") != (etag == "") {
+				t.Errorf("putTiddler() etag = %s, want prefix %s", etag, tt.wantEtag)
+			}
+			if tt.wantStatus == http.StatusOK {
+				var sent Tiddler
+				if err := json.NewDecoder(resp.Body).Decode(&sent); err != nil || sent.Field("text") != "server" {
+					t.Errorf("putTiddler() did not send back the stored tiddler: %v, %v", sent, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_putTiddler_created(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      Tiddler
+		body        string
+		wantCreated string // empty for a stamp of the time of the request
+	}{
+		{"new tiddler is stamped", nil, `{"title":"Note","text":"new"}`, ""},
+		{"client created kept on a new tiddler", nil, `{"title":"Note","created":"20200101000000000"}`, "20200101000000000"},
+		{"stored created kept on update", Tiddler{"title": "Note", "created": "20190101000000000", "revision": "1"}, `{"title":"Note","text":"updated"}`, "20190101000000000"},
+		{"client created wins on update", Tiddler{"title": "Note", "created": "20190101000000000", "revision": "1"}, `{"title":"Note","created":"20210101000000000"}`, "20210101000000000"},
+		{"update of a tiddler without created", Tiddler{"title": "Note", "revision": "1"}, `{"title":"Note","text":"updated"}`, "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+			if tt.stored != nil {
+				store.tiddlersByTitle["Note"] = tt.stored
+			}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/default/tiddlers/Note", strings.NewReader(tt.body))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", "Note"}}}))
+			before := time.Now().Add(-time.Second)
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("putTiddler() unexpected status code = %d", w.Code)
+			}
+
+			stored := store.tiddlersByTitle["Note"]
+			created, hasCreated := stored["created"]
+			switch tt.wantCreated {
+			case "-":
+				if hasCreated {
+					t.Errorf("putTiddler() added created = %v to an existing tiddler", created)
+				}
+			case "":
+				stamp, err := parseTiddlerTime(stored.Field("created"))
+				if err != nil || stamp.Before(before) || stamp.After(time.Now()) {
+					t.Errorf("putTiddler() created = %v, want the time of the request", created)
+				}
+			default:
+				if created != tt.wantCreated {
+					t.Errorf("putTiddler() created = %v, want %s", created, tt.wantCreated)
+				}
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_putTiddler_normalizeTitles(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name       string
+		normalize  bool
+		stored     Tiddler
+		title      string
+		wantStatus int
+		wantTitle  string
+		wantOrig   string
+	}{
+		{"padded title", true, nil, " Home ", http.StatusNoContent, "Home", " Home "},
+		{"internal runs", true, nil, "My \t Note\n", http.StatusNoContent, "My Note", "My \t Note\n"},
+		{"clean title untouched", true, nil, "Home", http.StatusNoContent, "Home", ""},
+		{"disabled", false, nil, " Home ", http.StatusNoContent, " Home ", ""},
+		{"update of a normalized tiddler", true, Tiddler{"title": "Home", "original-title": " Home ", "revision": "1"}, " Home ", http.StatusNoContent, "Home", " Home "},
+		{"distinct tiddler not merged", true, Tiddler{"title": "Home", "revision": "1"}, " Home ", http.StatusConflict, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.NormalizeTitles = tt.normalize
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+			if tt.stored != nil {
+				store.tiddlersByTitle[tt.stored.Field("title")] = tt.stored
+			}
+			h := &handlerWithStore{Store: store}
+			body, _ := json.Marshal(map[string]string{"title": tt.title, "text": "welcome"})
+			r := httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/default/tiddlers/"+url.PathEscape(tt.title), bytes.NewReader(body))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", url.PathEscape(tt.title)}}}))
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("putTiddler() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusNoContent {
+				if got := store.tiddlersByTitle["Home"]; got.Field("text") != "" {
+					t.Errorf("putTiddler() overwrote the distinct tiddler = %v", got)
+				}
+				return
+			}
+			if len(store.tiddlersByTitle) != 1 {
+				t.Errorf("putTiddler() stored %d tiddlers, want 1: %v", len(store.tiddlersByTitle), store.tiddlersByTitle)
+			}
+			got, ok := store.tiddlersByTitle[tt.wantTitle]
+			if !ok {
+				t.Fatalf("putTiddler() did not store %q: %v", tt.wantTitle, store.tiddlersByTitle)
+			}
+			if got.Field("title") != tt.wantTitle || got.Field("original-title") != tt.wantOrig {
+				t.Errorf("putTiddler() title = %q, original-title = %q, want %q and %q", got.Field("title"), got.Field("original-title"), tt.wantTitle, tt.wantOrig)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_revisions(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.MaxRevisions = 2
+	store := NewMemoryStore()
+	h := &handlerWithStore{Store: store}
+	request := func(method, target string, body io.Reader) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://foobar.com/mywiki/recipes/default/tiddlers/"+target, body)
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+			&chi.Context{URLParams: chi.RouteParams{Keys: []string{"wiki", "recipe", "*"}, Values: []string{"mywiki", "default", strings.Split(target, "?")[0]}}}))
+		w := httptest.NewRecorder()
+		if method == http.MethodPut {
+			h.putTiddler(w, r)
+		} else {
+			h.getTiddler(w, r)
+		}
+		return w
+	}
+	for i := 0; i < 4; i++ {
+		body, _ := json.Marshal(map[string]string{"title": "My Note", "text": fmt.Sprintf("v%d", i)})
+		if w := request(http.MethodPut, url.PathEscape("My Note"), bytes.NewReader(body)); w.Code != http.StatusNoContent {
+			t.Fatalf("putTiddler() unexpected status code = %d", w.Code)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantText   string
+	}{
+		{"current", "", http.StatusOK, "v3"},
+		{"current revision", "?revision=3", http.StatusOK, "v3"},
+		{"earlier revision", "?revision=2", http.StatusOK, "v2"},
+		{"oldest kept", "?revision=1", http.StatusOK, "v1"},
+		{"dropped beyond max", "?revision=0", http.StatusNotFound, ""},
+		{"never written", "?revision=9", http.StatusNotFound, ""},
+		{"invalid", "?revision=x", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := request(http.MethodGet, url.PathEscape("My Note")+tt.query, nil)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("getTiddler() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("getTiddler() returned invalid JSON: %v", err)
+			}
+			if got.Field("text") != tt.wantText {
+				t.Errorf("getTiddler() text = %q, want %q", got.Field("text"), tt.wantText)
+			}
+		})
+	}
+
+	// the history is not listed as tiddlers
+	tids, err := store.GetAllTiddlers()
+	if err != nil {
+		t.Fatalf("GetAllTiddlers() error = %v", err)
+	}
+	if len(tids) != 1 {
+		t.Errorf("GetAllTiddlers() = %v, want only My Note", tids)
+	}
+}
+
+func Test_handlerWithStore_revisions_otherWrites(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.MaxRevisions = 5
+	store := NewMemoryStore()
+	h := &handlerWithStore{Store: store}
+	post := func(handler http.HandlerFunc, target, body string) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, "http://foobar.com/mywiki/"+target, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status = %d: %s", target, w.Code, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.putTiddler(w, putTiddlerRequest("Note", `{"title":"Note","text":"v0","tags":"a"}`))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("putTiddler() status = %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodPatch, "http://foobar.com/recipes/default/tiddlers/Note", strings.NewReader(`{"text":"v1"}`))
+	w = httptest.NewRecorder()
+	h.patchTiddler(w, r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+		&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", "Note"}}})))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("patchTiddler() status = %d", w.Code)
+	}
+	post(h.importTiddlers, "recipes/default/tiddlers/import?atomic=true", `[{"title":"Note","text":"v2","tags":"a"}]`)
+	post(h.importTiddlers, "recipes/default/tiddlers/import", `[{"title":"Note","text":"v3","tags":"a"}]`)
+	post(h.renameTag, "tags/rename", `{"old":"a","new":"b"}`)
+
+	// each write bumping the revision kept the one it replaced
+	for revision, want := range []string{"v0", "v1", "v2", "v3"} {
+		if got, err := h.readRevision("Note", revision); err != nil || got.Field("text") != want {
+			t.Errorf("readRevision(Note, %d) = %v, %v, want text %s", revision, got, err, want)
+		}
+	}
+	if current, _ := store.GetTiddler("Note"); current.Field("revision") != "4" || current.Field("tags") != "b" {
+		t.Errorf("Note = %v, want revision 4 tagged b", current)
+	}
+}
+
+func Test_handlerWithStore_putTiddler_attachment(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.AttachmentThreshold = 64
+	large := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 32)
+	tests := []struct {
+		name    string
+		title   string
+		tidType string
+		content []byte
+		wantExt string //of the attachment, "" to stay inline
+	}{
+		{"large image", "My Photo", "image/png", large, ".png"},
+		{"keeps extension in title", "logo.png", "image/png", large, ".png"},
+		{"small image stays inline", "Icon", "image/png", large[:16], ""},
+		{"svg stays inline", "Drawing", "image/svg+xml", large, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+			h := &handlerWithStore{Store: store}
+			body, _ := json.Marshal(map[string]string{"title": tt.title, "type": tt.tidType, "text": base64.StdEncoding.EncodeToString(tt.content)})
+			r := httptest.NewRequest(http.MethodPut, "http://foobar.com/mywiki/recipes/default/tiddlers/"+url.PathEscape(tt.title), bytes.NewReader(body))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"wiki", "recipe", "*"}, Values: []string{"mywiki", "default", url.PathEscape(tt.title)}}}))
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("putTiddler() unexpected status code = %d, want %d", w.Code, http.StatusNoContent)
+			}
+			stored := store.tiddlersByTitle[tt.title]
+			if tt.wantExt == "" {
+				if _, ok := stored["_canonical_uri"]; ok || len(store.files) != 0 {
+					t.Errorf("putTiddler() moved %s out of the tiddler", tt.title)
+				}
+				return
+			}
+			wantFile := "files/" + attachmentFilename(tt.title, tt.tidType, tt.content)
+			if filepath.Ext(wantFile) != tt.wantExt {
+				t.Errorf("putTiddler() attachment %s, want extension %s", wantFile, tt.wantExt)
+			}
+			if got := store.files[wantFile]; got != string(tt.content) {
+				t.Errorf("putTiddler() attachment %s = %q, want the decoded content", wantFile, got)
+			}
+			if _, ok := stored["text"]; ok {
+				t.Errorf("putTiddler() kept the text of an attachment tiddler")
+			}
+			wantURI := "/mywiki/" + wantFile
+			if uri := stored.Field("_canonical_uri"); uri != wantURI {
+				t.Errorf("putTiddler() _canonical_uri = %s, want %s", uri, wantURI)
+			}
+
+			// the reference resolves through the files route
+			name := strings.TrimPrefix(stored.Field("_canonical_uri"), "/mywiki/files/")
+			r = httptest.NewRequest(http.MethodGet, "http://foobar.com"+stored.Field("_canonical_uri"), nil)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"wiki", "*"}, Values: []string{"mywiki", name}}}))
+			w = httptest.NewRecorder()
+			h.getFile(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != string(tt.content) {
+				t.Errorf("getFile() status = %d, served %d bytes", w.Code, w.Body.Len())
+			}
+			if ct := w.Result().Header.Get("Content-Type"); ct != "image/png" {
+				t.Errorf("getFile() Content-Type = %s, want image/png", ct)
+			}
+		})
+	}
+}
+
+// Fails every tiddler write, but not the writes of other files
+type tiddlerWriteFailingStore struct {
+	*dummyTiddlerStore
+}
+
+func (s tiddlerWriteFailingStore) WriteTiddler(t Tiddler) error {
+	return fmt.Errorf("WriteTiddler(): simulated error")
+}
+
+func Test_handlerWithStore_attachmentFiles(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.AttachmentThreshold = 64
+	large := bytes.Repeat([]byte{0x89, 'P', 'N', 'G'}, 32)
+	withParams := func(r *http.Request, keys, values []string) *http.Request {
+		return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, &chi.Context{URLParams: chi.RouteParams{Keys: keys, Values: values}}))
+	}
+	put := func(h *handlerWithStore, title string, content []byte) int {
+		body, _ := json.Marshal(map[string]string{"title": title, "type": "image/png", "text": base64.StdEncoding.EncodeToString(content)})
+		r := withParams(httptest.NewRequest(http.MethodPut, "http://foobar.com/mywiki/recipes/default/tiddlers/"+url.PathEscape(title), bytes.NewReader(body)),
+			[]string{"wiki", "recipe", "*"}, []string{"mywiki", "default", url.PathEscape(title)})
+		w := httptest.NewRecorder()
+		h.putTiddler(w, r)
+		return w.Code
+	}
+	attachment := func(title string, content []byte) string {
+		return "files/" + attachmentFilename(title, "image/png", content)
+	}
+
+	// titles made the same by binaryFilename get files of their own
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+	h := &handlerWithStore{Store: store}
+	for _, title := range []string{"a/b", "a:b"} {
+		if code := put(h, title, append([]byte(title), large...)); code != http.StatusNoContent {
+			t.Fatalf("putTiddler(%s) status = %d", title, code)
+		}
+	}
+	for _, title := range []string{"a/b", "a:b"} {
+		if got := store.files[attachment(title, append([]byte(title), large...))]; got != title+string(large) {
+			t.Errorf("attachment of %s = %q, overwritten by the other title", title, got)
+		}
+	}
+
+	// a file the server did not write is not overwritten
+	ownFile := attachment("Photo", large)
+	store = &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}, files: map[string]string{ownFile: "the operator's"}}
+	h = &handlerWithStore{Store: store}
+	if code := put(h, "Photo", large); code != http.StatusConflict {
+		t.Errorf("putTiddler() over another file status = %d, want %d", code, http.StatusConflict)
+	}
+	if got := store.files[ownFile]; got != "the operator's" {
+		t.Errorf("putTiddler() overwrote %s with %q", ownFile, got)
+	}
+
+	// saving the same content again keeps the attachment, new content replaces it
+	store = &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+	h = &handlerWithStore{Store: store}
+	changed := append([]byte{0}, large...)
+	for _, content := range [][]byte{large, large, changed} {
+		if code := put(h, "Photo", content); code != http.StatusNoContent {
+			t.Fatalf("putTiddler() status = %d", code)
+		}
+	}
+	if _, ok := store.files[attachment("Photo", large)]; ok {
+		t.Errorf("putTiddler() kept the attachment of the replaced content")
+	}
+	if _, ok := store.files[attachment("Photo", changed)]; !ok {
+		t.Errorf("putTiddler() did not store the attachment of the new content")
+	}
+
+	// deleting the tiddler deletes its attachment, but not a file it only refers to
+	store.files["files/shared.png"] = string(large)
+	store.tiddlersByTitle["Linked"] = Tiddler{"title": "Linked", "type": "image/png", "_canonical_uri": "/mywiki/files/shared.png"}
+	for _, title := range []string{"Photo", "Linked"} {
+		w := httptest.NewRecorder()
+		h.deleteTiddler(w, withParams(httptest.NewRequest(http.MethodDelete, "http://foobar.com/mywiki/bags/default/tiddlers/"+title, nil),
+			[]string{"wiki", "bag", "*"}, []string{"mywiki", "default", title}))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("deleteTiddler(%s) status = %d", title, w.Code)
+		}
+	}
+	if _, ok := store.files[attachment("Photo", changed)]; ok {
+		t.Errorf("deleteTiddler() kept the attachment of the deleted tiddler")
+	}
+	if _, ok := store.files["files/shared.png"]; !ok {
+		t.Errorf("deleteTiddler() deleted a file the server did not write")
+	}
+
+	// the attachment of a tiddler that could not be written is removed
+	store = &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+	h = &handlerWithStore{Store: tiddlerWriteFailingStore{store}}
+	if code := put(h, "Photo", large); code != http.StatusInternalServerError {
+		t.Errorf("putTiddler() status = %d, want %d", code, http.StatusInternalServerError)
+	}
+	if len(store.files) != 0 {
+		t.Errorf("putTiddler() left %v after failing to write the tiddler", store.files)
+	}
+}
+
+func Test_handlerWithStore_putTiddler_binary(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n', 0x00, 0xff, 0x10}
+	tests := []struct {
+		name      string
+		title     string
+		tidType   string
+		previous  Tiddler
+		wantFile  string
+		wantGone  string
+		wantBytes bool
+	}{
+		{"png", "Logo", "image/png", nil, "tiddlers/Logo.png", "", true},
+		{"keeps extension in title", "logo.png", "image/png", nil, "tiddlers/logo.png", "", true},
+		{"replaces a base64 .tid", "Logo", "image/png", Tiddler{"title": "Logo", "type": "image/png", "text": "AAAA"}, "tiddlers/Logo.png", "tiddlers/Logo.tid", true},
+		{"svg stays text", "Drawing", "image/svg+xml", nil, "tiddlers/Drawing.tid", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			if tt.previous != nil {
+				if err := store.WriteTiddler(tt.previous); err != nil {
+					t.Fatalf("WriteTiddler() error = %v", err)
+				}
+			}
+			h := &handlerWithStore{Store: store}
+			body, _ := json.Marshal(map[string]string{"title": tt.title, "type": tt.tidType, "text": base64.StdEncoding.EncodeToString(png)})
+			r := httptest.NewRequest(http.MethodPut, "http://foobar.com/mywiki/recipes/default/tiddlers/"+url.PathEscape(tt.title), bytes.NewReader(body))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"wiki", "recipe", "*"}, Values: []string{"mywiki", "default", url.PathEscape(tt.title)}}}))
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("putTiddler() unexpected status code = %d", w.Code)
+			}
+
+			f, err := store.ReadFile(tt.wantFile)
+			if err != nil {
+				t.Fatalf("putTiddler() did not write %s: %v", tt.wantFile, err)
+			}
+			data, _ := io.ReadAll(f)
+			f.Close()
+			if got := bytes.Equal(data, png); got != tt.wantBytes {
+				t.Errorf("putTiddler() wrote the content as is = %v, want %v", got, tt.wantBytes)
+			}
+			if tt.wantGone != "" {
+				if _, err := store.ReadFile(tt.wantGone); err == nil {
+					t.Errorf("putTiddler() left the previous file %s", tt.wantGone)
+				}
+			}
+
+			// read back from the files, as after a restart
+			if err := store.Reload(); err != nil {
+				t.Fatalf("Reload() error = %v", err)
+			}
+			tids, _ := store.GetAllTiddlers()
+			if len(tids) != 1 {
+				t.Errorf("GetAllTiddlers() = %d tiddlers, want 1", len(tids))
+			}
+			w = httptest.NewRecorder()
+			r = httptest.NewRequest(http.MethodGet, "http://foobar.com/mywiki/recipes/default/tiddlers/"+url.PathEscape(tt.title), nil)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"wiki", "recipe", "*"}, Values: []string{"mywiki", "default", url.PathEscape(tt.title)}}}))
+			h.getTiddler(w, r)
+			var got map[string]interface{}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("getTiddler() returned invalid JSON: %v", err)
+			}
+			if got["text"] != base64.StdEncoding.EncodeToString(png) || got["type"] != tt.tidType {
+				t.Errorf("getTiddler() = %v, want the uploaded %s", got, tt.tidType)
+			}
+		})
+	}
+}
+func Test_handlerWithStore_createTiddler(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+	h := &handlerWithStore{Store: store}
+	const numTiddlers = 5
+	titles := make(map[string]bool)
+	for i := 0; i < numTiddlers; i++ {
+		r := httptest.NewRequest(http.MethodPost, "http://foobar.com/mywiki/recipes/default/tiddlers",
+			strings.NewReader(fmt.Sprintf(`{"text":"note %d","tags":["inbox"]}`, i)))
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+			&chi.Context{URLParams: chi.RouteParams{Keys: []string{"wiki", "recipe"}, Values: []string{"mywiki", "default"}}}))
+		w := httptest.NewRecorder()
+		h.createTiddler(w, r)
+
+		resp := w.Result()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("createTiddler() unexpected status code = %d, want %d", resp.StatusCode, http.StatusCreated)
+		}
+		var result struct{ Title string }
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("createTiddler() could not read server response = %v", err)
+		}
+		if titles[result.Title] {
+			t.Errorf("createTiddler() reused title %s", result.Title)
+		}
+		titles[result.Title] = true
+		if loc := resp.Header.Get("Location"); loc != "/mywiki/recipes/default/tiddlers/"+url.PathEscape(result.Title) {
+			t.Errorf("createTiddler() Location = %s", loc)
+		}
+		if etag := resp.Header.Get("Etag"); !strings.HasPrefix(etag, `"default/`+url.QueryEscape(result.Title)+`/`) {
+			t.Errorf("createTiddler() Etag = %s", etag)
+		}
+		stored, ok := store.tiddlersByTitle[result.Title]
+		if !ok {
+			t.Fatalf("createTiddler() tiddler %s not found in store", result.Title)
+		}
+		if stored.Field("text") != fmt.Sprintf("note %d", i) || stored.Field("tags") != "inbox" || stored.Field("created") == "" {
+			t.Errorf("createTiddler() stored %v", stored)
+		}
+	}
+	if len(store.tiddlersByTitle) != numTiddlers {
+		t.Errorf("createTiddler() store has %d tiddlers, want %d", len(store.tiddlersByTitle), numTiddlers)
+	}
+}
+
+func Test_handlerWithStore_indexCheckStoreChanges(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name        string
+		check       bool
+		modified    time.Duration //when the store changes, relative to the first index build
+		wantReloads int
+		wantText    string
+	}{
+		{"unchanged store keeps cache", true, -time.Hour, 0, "before"},
+		{"changed store rebuilds", true, time.Hour, 1, "after"},
+		{"check disabled keeps cache", false, time.Hour, 0, "before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.CheckStoreChanges = tt.check
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{"Note": {"title": "Note", "text": "before"}},
+				files:           map[string]string{"index.html": testIndexHTML},
+			}
+			h := &handlerWithStore{Store: store}
+			get := func() []Tiddler {
+				r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+				w := httptest.NewRecorder()
+				h.index(w, r)
+				return getIndexStoreTiddlers(t, w.Body.String())
+			}
+			get()
+
+			// an external edit the server did not see
+			store.tiddlersByTitle["Note"] = Tiddler{"title": "Note", "text": "after"}
+			store.lastModified = time.Now().Add(tt.modified)
+
+			tids := get()
+			if store.reloads != tt.wantReloads {
+				t.Errorf("index() reloaded the store %d times, want %d", store.reloads, tt.wantReloads)
+			}
+			if len(tids) != 1 || tids[0].Field("text") != tt.wantText {
+				t.Errorf("index() served %v, want text %s", tids, tt.wantText)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getSkinnyTiddlerList_malformed(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"Good":    {"title": "Good", "tags": "one [[two words]]", "text": "x"},
+		"42":      {"title": float64(42), "text": "numeric title"},
+		"Odd":     {"title": "Odd", "tags": map[string]interface{}{"a": "b"}, "text": "odd tags"},
+		"Mixed":   {"title": "Mixed", "tags": []interface{}{"ok", float64(1)}},
+		"List":    {"title": "List", "tags": []interface{}{"$:/tags/Macro"}, "text": "\\define m() x"},
+		"NoTitle": {"title": map[string]interface{}{}, "text": "unusable"},
+	}}
+	h := &handlerWithStore{Store: store}
+	r := httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json", nil)
+	w := httptest.NewRecorder()
+	h.getSkinnyTiddlerList(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("getSkinnyTiddlerList() unexpected status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	var skinny []Tiddler
+	if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+		t.Fatalf("getSkinnyTiddlerList() could not read server response = %v", err)
+	}
+	byTitle := make(map[string]Tiddler)
+	for _, tid := range skinny {
+		byTitle[tid["title"].(string)] = tid
+	}
+	if len(byTitle) != 5 {
+		t.Errorf("getSkinnyTiddlerList() returned %d tiddlers, want 5 (all but the unusable title)", len(byTitle))
+	}
+	if _, ok := byTitle["42"]; !ok {
+		t.Errorf("getSkinnyTiddlerList() did not coerce the numeric title")
+	}
+	for _, title := range []string{"Odd", "Mixed"} {
+		if _, ok := byTitle[title]["tags"]; ok {
+			t.Errorf("getSkinnyTiddlerList() kept malformed tags of %s", title)
+		}
+	}
+	if byTitle["Good"]["tags"] != "one [[two words]]" {
+		t.Errorf("getSkinnyTiddlerList() tags of Good = %v", byTitle["Good"]["tags"])
+	}
+	if _, ok := byTitle["List"]["text"]; !ok {
+		t.Errorf("getSkinnyTiddlerList() dropped the text of a macro tiddler")
+	}
+	if _, ok := byTitle["Good"]["text"]; ok {
+		t.Errorf("getSkinnyTiddlerList() kept the text of an ordinary tiddler")
+	}
+}
+
+func Test_handlerWithStore_getSkinnyTiddlerList_paged(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"Echo":        {"title": "Echo"},
+		"Alpha":       {"title": "Alpha"},
+		"Delta":       {"title": "Delta"},
+		"Charlie":     {"title": "Charlie"},
+		"Bravo":       {"title": "Bravo"},
+		"$:/SiteName": {"title": "$:/SiteName", "text": "left out"},
+	}}
+	h := &handlerWithStore{Store: store}
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTitles []string
+		wantNext   string
+		wantTotal  string
+	}{
+		{"everything by default", "", http.StatusOK, []string{"Alpha", "Bravo", "Charlie", "Delta", "Echo"}, "", ""},
+		{"first page", "?limit=2", http.StatusOK, []string{"Alpha", "Bravo"}, "</recipes/default/tiddlers.json?limit=2&offset=2>; rel=\"next\"", "5"},
+		{"middle page", "?limit=2&offset=2", http.StatusOK, []string{"Charlie", "Delta"}, "</recipes/default/tiddlers.json?limit=2&offset=4>; rel=\"next\"", "5"},
+		{"last page", "?limit=2&offset=4", http.StatusOK, []string{"Echo"}, "", "5"},
+		{"exactly the rest", "?limit=3&offset=2", http.StatusOK, []string{"Charlie", "Delta", "Echo"}, "", "5"},
+		{"offset only", "?offset=3", http.StatusOK, []string{"Delta", "Echo"}, "", "5"},
+		{"past the end", "?offset=9", http.StatusOK, []string{}, "", "5"},
+		{"other parameters kept", "?filter=%5Ball%5Btiddlers%5D%5D&limit=1", http.StatusOK, []string{"Alpha"}, "</recipes/default/tiddlers.json?filter=%5Ball%5Btiddlers%5D%5D&limit=1&offset=1>; rel=\"next\"", "5"},
+		{"bad limit", "?limit=0", http.StatusBadRequest, nil, "", ""},
+		{"bad offset", "?offset=-1", http.StatusBadRequest, nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json"+tt.query, nil)
+			w := httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("getSkinnyTiddlerList() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var skinny []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+				t.Fatalf("getSkinnyTiddlerList() could not read server response = %v", err)
+			}
+			titles := []string{}
+			for _, tid := range skinny {
+				titles = append(titles, tid.Field("title"))
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("getSkinnyTiddlerList() titles = %v, want %v", titles, tt.wantTitles)
+			}
+			if got := w.Header().Get("Link"); got != tt.wantNext {
+				t.Errorf("getSkinnyTiddlerList() Link = %q, want %q", got, tt.wantNext)
+			}
+			if got := w.Header().Get("X-Total-Count"); got != tt.wantTotal {
+				t.Errorf("getSkinnyTiddlerList() X-Total-Count = %q, want %q", got, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getSkinnyTiddlerList_oversized(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"Echo":        {"title": "Echo"},
+		"Alpha":       {"title": "Alpha"},
+		"Delta":       {"title": "Delta"},
+		"Charlie":     {"title": "Charlie"},
+		"Bravo":       {"title": "Bravo"},
+		"$:/SiteName": {"title": "$:/SiteName", "text": "counted but not listed"},
+	}}
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	tests := []struct {
+		name            string
+		maxSkinnyList   int
+		maxWikiTiddlers int
+		query           string
+		wantStatus      int
+		wantTiddlers    int
+		wantTotal       string
+	}{
+		{"no caps", 0, 0, "", http.StatusOK, 5, ""},
+		{"list at the cap", 5, 0, "", http.StatusOK, 5, ""},
+		{"list over the cap", 4, 0, "", http.StatusRequestEntityTooLarge, 0, "5"},
+		{"paged over the cap", 4, 0, "?limit=4", http.StatusOK, 4, "5"},
+		{"filtered under the cap", 4, 0, "?filter=%5B%5BAlpha%5D%5D", http.StatusOK, 1, ""},
+		{"wiki at the threshold", 0, 6, "", http.StatusOK, 5, ""},
+		{"wiki over the threshold", 0, 5, "", http.StatusInsufficientStorage, 0, ""},
+		{"wiki over the threshold paged", 0, 5, "?limit=1", http.StatusInsufficientStorage, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.MaxSkinnyList, serverOptions.MaxWikiTiddlers = tt.maxSkinnyList, tt.maxWikiTiddlers
+			w := httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("getSkinnyTiddlerList() status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if got := w.Header().Get("X-Total-Count"); got != tt.wantTotal {
+				t.Errorf("getSkinnyTiddlerList() X-Total-Count = %q, want %q", got, tt.wantTotal)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if !strings.Contains(w.Body.String(), "max_wiki_tiddlers") && !strings.Contains(w.Body.String(), "?limit=") {
+					t.Errorf("getSkinnyTiddlerList() body = %q, want guidance", w.Body.String())
+				}
+				return
+			}
+			var skinny []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+				t.Fatalf("getSkinnyTiddlerList() could not read server response = %v", err)
+			}
+			if len(skinny) != tt.wantTiddlers {
+				t.Errorf("getSkinnyTiddlerList() sent %d tiddlers, want %d", len(skinny), tt.wantTiddlers)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_sortBy(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tids := map[string]Tiddler{
+		"Bravo":   {"title": "Bravo", "created": "20200101000000000", "modified": "20230301000000000"},
+		"Alpha":   {"title": "Alpha", "created": "20210101000000000", "modified": "20230101000000000"},
+		"Delta":   {"title": "Delta", "created": "20210101000000000", "modified": "20230301000000000"},
+		"Charlie": {"title": "Charlie", "created": "not a date"},
+	}
+	tests := []struct {
+		sortBy     string
+		wantTitles []string
+	}{
+		{"", []string{"Alpha", "Bravo", "Charlie", "Delta"}},
+		{SortByTitle, []string{"Alpha", "Bravo", "Charlie", "Delta"}},
+		{SortByModified, []string{"Bravo", "Delta", "Alpha", "Charlie"}},
+		{SortByCreated, []string{"Alpha", "Delta", "Bravo", "Charlie"}},
+	}
+	for _, tt := range tests {
+		t.Run("sorted by "+tt.sortBy, func(t *testing.T) {
+			serverOptions.SortBy = tt.sortBy
+			h := &handlerWithStore{Store: &dummyTiddlerStore{tiddlersByTitle: tids, files: map[string]string{"index.html": testIndexHTML}}}
+
+			w := httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json", nil))
+			var skinny []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+				t.Fatalf("getSkinnyTiddlerList() could not read server response = %v", err)
+			}
+			titles := []string{}
+			for _, tid := range skinny {
+				titles = append(titles, tid.Field("title"))
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("getSkinnyTiddlerList() titles = %v, want %v", titles, tt.wantTitles)
+			}
+
+			all, _ := h.Store.GetAllTiddlers()
+			page, err := h.renderIndexPage("", all, false)
+			if err != nil {
+				t.Fatalf("renderIndexPage() error = %v", err)
+			}
+			titles = []string{}
+			for _, tid := range getIndexStoreTiddlers(t, page) {
+				titles = append(titles, tid.Field("title"))
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("renderIndexPage() titles = %v, want %v", titles, tt.wantTitles)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_getSkinnyTiddlerList_modified(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"Monday":     {"title": "Monday", "modified": "20230102000000000"},
+		"Midweek":    {"title": "Midweek", "modified": "20230104120000000"},
+		"Sunday":     {"title": "Sunday", "modified": "20230108235959999"},
+		"NextMonday": {"title": "NextMonday", "modified": "20230109000000000"},
+		"Short":      {"title": "Short", "modified": "20230105"},
+		"Malformed":  {"title": "Malformed", "modified": "last tuesday"},
+		"Undated":    {"title": "Undated"},
+	}}
+	h := &handlerWithStore{Store: store}
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTitles []string
+	}{
+		{"no range", "", http.StatusOK, []string{"Malformed", "Midweek", "Monday", "NextMonday", "Short", "Sunday", "Undated"}},
+		{"week, after inclusive and before exclusive", "?modifiedAfter=20230102&modifiedBefore=20230109", http.StatusOK, []string{"Midweek", "Monday", "Short", "Sunday"}},
+		{"next week", "?modifiedAfter=20230109&modifiedBefore=20230116", http.StatusOK, []string{"NextMonday"}},
+		{"open start", "?modifiedBefore=20230104120000000", http.StatusOK, []string{"Monday"}},
+		{"open end", "?modifiedAfter=20230104120000000", http.StatusOK, []string{"Midweek", "NextMonday", "Short", "Sunday"}},
+		{"empty range", "?modifiedAfter=20230105&modifiedBefore=20230105", http.StatusOK, []string{}},
+		{"with paging", "?modifiedAfter=20230102&limit=2&offset=1", http.StatusOK, []string{"Monday", "NextMonday"}},
+		{"with filter", "?modifiedAfter=20230102&filter=" + url.QueryEscape("[prefix[M]]"), http.StatusOK, []string{"Midweek", "Monday"}},
+		{"unsupported filter lists everything", "?modifiedAfter=20230109&filter=" + url.QueryEscape("[prefix<x>]"), http.StatusOK, []string{"NextMonday"}},
+		{"bad start", "?modifiedAfter=yesterday", http.StatusBadRequest, nil},
+		{"bad end", "?modifiedBefore=2023", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json"+tt.query, nil)
+			w := httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("getSkinnyTiddlerList() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var skinny []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+				t.Fatalf("getSkinnyTiddlerList() could not read server response = %v", err)
+			}
+			titles := []string{}
+			for _, tid := range skinny {
+				titles = append(titles, tid.Field("title"))
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("getSkinnyTiddlerList() titles = %v, want %v", titles, tt.wantTitles)
+			}
+		})
+	}
+	// the range filters a copy, leaving the cached list whole
+	if got := len(h.getSkinnyListCache()); got != 7 {
+		t.Errorf("getSkinnyListCache() has %d tiddlers after filtered requests, want 7", got)
+	}
+}
+
+func Test_handlerWithStore_searchTiddlers(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"Apple Pie":       {"title": "Apple Pie", "text": "Bake the apples with cinnamon. Apples, apples, apples."},
+		"Apple Crumble":   {"title": "Apple Crumble", "text": "A crumble of apples and oats."},
+		"Cinnamon":        {"title": "Cinnamon", "text": "A spice for apple dishes."},
+		"Oats":            {"title": "Oats", "text": "Rolled OATS."},
+		"$:/config/Apple": {"title": "$:/config/Apple", "text": "apple apple apple apple apple apple"},
+	}}
+	h := &handlerWithStore{Store: store}
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTitles []string
+		wantTotal  string
+	}{
+		{"single term ranked by frequency", "?q=apple", http.StatusOK, []string{"Apple Pie", "Apple Crumble", "Cinnamon"}, "3"},
+		{"case insensitive", "?q=OATS", http.StatusOK, []string{"Oats", "Apple Crumble"}, "2"},
+		{"every term must match", "?q=apple+cinnamon", http.StatusOK, []string{"Apple Pie", "Cinnamon"}, "2"},
+		{"terms in title and text", "?q=crumble+oats", http.StatusOK, []string{"Apple Crumble"}, "1"},
+		{"system tiddlers excluded", "?q=config", http.StatusOK, []string{}, "0"},
+		{"limit", "?q=apple&limit=1", http.StatusOK, []string{"Apple Pie"}, "3"},
+		{"no query", "?q=+", http.StatusBadRequest, nil, ""},
+		{"bad limit", "?q=apple&limit=0", http.StatusBadRequest, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/default/search"+tt.query, nil)
+			w := httptest.NewRecorder()
+			h.searchTiddlers(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("searchTiddlers() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var results []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&results); err != nil {
+				t.Fatalf("searchTiddlers() could not read server response = %v", err)
+			}
+			titles := []string{}
+			for _, tid := range results {
+				if _, ok := tid["text"]; ok {
+					t.Errorf("searchTiddlers() result %q has its text", tid.Field("title"))
+				}
+				titles = append(titles, tid.Field("title"))
+			}
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("searchTiddlers() titles = %v, want %v", titles, tt.wantTitles)
+			}
+			if got := w.Header().Get("X-Total-Count"); got != tt.wantTotal {
+				t.Errorf("searchTiddlers() X-Total-Count = %q, want %q", got, tt.wantTotal)
+			}
+		})
+	}
+	// the results are copies, leaving the stored text in place
+	if store.tiddlersByTitle["Oats"]["text"] != "Rolled OATS." {
+		t.Errorf("searchTiddlers() changed the stored tiddler = %v", store.tiddlersByTitle["Oats"])
+	}
+}
+
+func Test_handlerWithStore_getSkinnyTiddlerList_revision(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name     string
+		withHash bool
+	}{
+		{"revision only", false},
+		{"with content hash", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.SkinnyHash = tt.withHash
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+				"New":     {"title": "New", "text": "never saved through the server"},
+				"Saved":   {"title": "Saved", "text": "saved", "revision": "7"},
+				"Blank":   {"title": "Blank", "text": "blank", "revision": ""},
+				"Similar": {"title": "Similar", "text": "saved", "revision": "1"},
+			}}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json", nil)
+			w := httptest.NewRecorder()
+			h.getSkinnyTiddlerList(w, r)
+			var skinny []Tiddler
+			if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil {
+				t.Fatalf("getSkinnyTiddlerList() could not read server response = %v", err)
+			}
+			want := map[string]string{"New": "0", "Saved": "7", "Blank": "0", "Similar": "1"}
+			hashes := make(map[string]bool)
+			for _, tid := range skinny {
+				title := tid.Field("title")
+				if got := tid["revision"]; got != want[title] {
+					t.Errorf("getSkinnyTiddlerList() revision of %s = %v, want %s", title, got, want[title])
+				}
+				hash, ok := tid["hash"]
+				if ok != tt.withHash {
+					t.Errorf("getSkinnyTiddlerList() hash of %s present = %t, want %t", title, ok, tt.withHash)
+				}
+				if ok {
+					hashes[hash.(string)] = true
+				}
+			}
+			if tt.withHash && len(hashes) != len(skinny) {
+				t.Errorf("getSkinnyTiddlerList() hashes are not distinct per tiddler: %v", hashes)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_bagRules(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	tests := []struct {
+		name          string
+		serverRules   []string
+		configTiddler string
+		want          map[string]string
+	}{
+		{"single bag by default", nil, "",
+			map[string]string{"$:/SiteTitle": defaultBag, "Note": defaultBag}},
+		{"server-wide system bag", []string{"$:/=system"}, "",
+			map[string]string{"$:/SiteTitle": "system", "Note": defaultBag}},
+		{"longest prefix wins", []string{"$:/=system", "$:/plugins/=plugins"}, "",
+			map[string]string{"$:/SiteTitle": "system", "$:/plugins/x": "plugins", "Note": defaultBag}},
+		{"wiki config tiddler", nil, "$:/=system\nnot a rule\n",
+			map[string]string{"$:/SiteTitle": "system", "Note": defaultBag}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseBagRules(tt.serverRules)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverOptions.BagRules = rules
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{},
+				files:           map[string]string{"index.html": testIndexHTML},
+			}
+			for title := range tt.want {
+				store.tiddlersByTitle[title] = Tiddler{"title": title, "text": "x"}
+			}
+			if tt.configTiddler != "" {
+				store.tiddlersByTitle[bagRulesTiddler] = Tiddler{"title": bagRulesTiddler, "text": tt.configTiddler}
+			}
+			h := &handlerWithStore{Store: store}
+
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			w := httptest.NewRecorder()
+			h.index(w, r)
+			for _, tid := range getIndexStoreTiddlers(t, w.Body.String()) {
+				title := tid["title"].(string)
+				if want, ok := tt.want[title]; ok && tid["bag"] != want {
+					t.Errorf("index() bag of %s = %v, want %s", title, tid["bag"], want)
+				}
+			}
+
+			for title, want := range tt.want {
+				r := httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/default/tiddlers/"+url.PathEscape(title),
+					strings.NewReader(fmt.Sprintf(`{"title":%q,"text":"y"}`, title)))
+				r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+					&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", url.PathEscape(title)}}}))
+				w := httptest.NewRecorder()
+				h.putTiddler(w, r)
+				if etag := w.Result().Header.Get("Etag"); !strings.HasPrefix(etag, `"`+want+`/`) {
+					t.Errorf("putTiddler() etag of %s = %s, want bag %s", title, etag, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBagRules(t *testing.T) {
+	if _, err := ParseBagRules([]string{"$:/"}); err == nil {
+		t.Errorf("ParseBagRules() accepted a rule without a bag")
+	}
+	got, err := ParseBagRules([]string{"a=b=c"})
+	if err != nil || !reflect.DeepEqual(got, []BagRule{{Prefix: "a=b", Bag: "c"}}) {
+		t.Errorf("ParseBagRules() = %v, %v", got, err)
+	}
+}
+
+func Test_handlerWithStore_tiddlerChanged(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions = Options{}
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"A":              {"title": "A", "text": "first", "revision": "1"},
+		"B":              {"title": "B", "text": "second"},
+		"$:/favicon.ico": {"title": "$:/favicon.ico", "type": "image/x-icon", "text": []byte("icon")},
+	}}
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	if _, err := h.skinnyTiddlers(); err != nil {
+		t.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+	h.setIndexCache([]byte("<html>cached</html>"), time.Now())
+	h.setFaviconCache([]byte("icon"), time.Now())
+	// the list the handler would build from the store
+	wantSkinny := func() []Tiddler {
+		fresh := &handlerWithStore{Store: store}
+		skinny, err := fresh.skinnyTiddlers()
+		if err != nil {
+			t.Fatalf("skinnyTiddlers() error = %v", err)
+		}
+		return skinny
+	}
+
+	tests := []struct {
+		name        string
+		do          func() int
+		wantStatus  int
+		wantFavicon bool
+	}{
+		{"add", func() int {
+			w := httptest.NewRecorder()
+			h.putTiddler(w, putTiddlerRequest("C", `{"title":"C","text":"third","tags":"$:/tags/Macro"}`))
+			return w.Code
+		}, http.StatusNoContent, true},
+		{"update", func() int {
+			w := httptest.NewRecorder()
+			h.putTiddler(w, putTiddlerRequest("A", `{"title":"A","text":"edited"}`))
+			return w.Code
+		}, http.StatusNoContent, true},
+		{"delete", func() int {
+			r := httptest.NewRequest(http.MethodDelete, "http://foobar.com/bags/default/tiddlers/B", nil)
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"bag", "*"}, Values: []string{"default", "B"}}}))
+			w := httptest.NewRecorder()
+			h.deleteTiddler(w, r)
+			return w.Code
+		}, http.StatusNoContent, true},
+		{"favicon", func() int {
+			w := httptest.NewRecorder()
+			h.putTiddler(w, putTiddlerRequest("$:/favicon.ico", `{"title":"$:/favicon.ico","type":"image/x-icon","text":"bmV3IGljb24="}`))
+			return w.Code
+		}, http.StatusNoContent, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.setIndexCache([]byte("<html>cached</html>"), time.Now())
+			if status := tt.do(); status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if got, want := h.getSkinnyListCache(), wantSkinny(); !reflect.DeepEqual(got, want) {
+				t.Errorf("skinny list cache = %v, want %v", got, want)
+			}
+			if page, _ := h.cachedIndex(""); page != "" {
+				t.Errorf("cachedIndex() = %q after a write, want it stale", page)
+			}
+			if h.getIndexCache() == "" {
+				t.Errorf("the stale index was discarded before being rebuilt")
+			}
+			if icon, _ := h.getFaviconCache(); (len(icon) > 0) != tt.wantFavicon {
+				t.Errorf("favicon cache = %q, want it kept %v", icon, tt.wantFavicon)
+			}
+		})
+	}
+	if got := h.skinnyListRebuilds.count(); got != 1 {
+		t.Errorf("skinny list built %d times, want only once", got)
+	}
+
+	// a list built from tiddlers read before a write is not cached
+	builtAt := time.Now()
+	h.tiddlerChanged("A", store.tiddlersByTitle["A"])
+	h.setSkinnyListCache([]Tiddler{{"title": "outdated"}}, builtAt)
+	if got := h.getSkinnyListCache(); len(got) == 1 {
+		t.Errorf("setSkinnyListCache() cached the list built before a write")
+	}
+	h.setIndexCache([]byte("<html>outdated</html>"), builtAt)
+	if page, _ := h.cachedIndex(""); page != "" {
+		t.Errorf("cachedIndex() = %q, want the page built before a write stale", page)
+	}
+}
+
+func Test_handlerWithStore_tiddlerChanged_concurrent(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions = Options{}
+	store := NewMemoryStore()
+	for i := 0; i < 20; i++ {
+		if err := store.WriteTiddler(Tiddler{"title": fmt.Sprintf("Note %d", i), "text": "start"}); err != nil {
+			t.Fatalf("WriteTiddler() error = %v", err)
+		}
+	}
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				w := httptest.NewRecorder()
+				h.putTiddler(w, putTiddlerRequest(fmt.Sprintf("Note %d", (i*20+j)%25), fmt.Sprintf(`{"title":"Note %d","text":"writer %d"}`, (i*20+j)%25, i)))
+				if w.Code != http.StatusNoContent {
+					t.Errorf("putTiddler() status = %d", w.Code)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := h.skinnyTiddlers(); err != nil {
+					t.Errorf("skinnyTiddlers() error = %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	got, err := h.skinnyTiddlers()
+	if err != nil {
+		t.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+	want, err := (&handlerWithStore{Store: store}).skinnyTiddlers()
+	if err != nil {
+		t.Fatalf("skinnyTiddlers() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("skinny list after concurrent writes = %v, want %v", got, want)
+	}
+}
+
+func Test_handlerWithStore_renameTag(t *testing.T) {
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+		"A": {"title": "A", "tags": "project-x [[other tag]]", "revision": "2"},
+		"B": {"title": "B", "tags": "[[project-x]]"},
+		"C": {"title": "C", "tags": "project-x project-y"},
+		"D": {"title": "D", "tags": "project-xy"},
+		"E": {"title": "E", "text": "untagged"},
+	}}
+	h := &handlerWithStore{Store: store}
+	h.setSkinnyListCache([]Tiddler{{"title": "cached"}}, time.Now())
+	r := httptest.NewRequest(http.MethodPost, "http://foobar.com/mywiki/tags/rename",
+		strings.NewReader(`{"old":"project-x","new":"project-y"}`))
+	w := httptest.NewRecorder()
+	h.renameTag(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("renameTag() unexpected status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	var result struct {
+		Changed int
+		Failed  map[string]string
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("renameTag() could not read server response = %v", err)
+	}
+	if result.Changed != 3 || len(result.Failed) != 0 {
+		t.Errorf("renameTag() changed = %d, failed = %v, want 3 changed", result.Changed, result.Failed)
+	}
+	want := map[string]string{
+		"A": "project-y [[other tag]]",
+		"B": "project-y",
+		"C": "project-y",
+		"D": "project-xy",
+	}
+	for title, tags := range want {
+		if got := store.tiddlersByTitle[title]["tags"]; got != tags {
+			t.Errorf("renameTag() tags of %s = %v, want %s", title, got, tags)
+		}
+	}
+	if rev := store.tiddlersByTitle["A"]["revision"]; rev != "3" {
+		t.Errorf("renameTag() revision of A = %v, want 3", rev)
+	}
+	if len(h.getSkinnyListCache()) != 0 {
+		t.Errorf("renameTag() did not reset the caches")
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "http://foobar.com/mywiki/tags/rename", strings.NewReader(`{"old":"project-x"}`))
+	w = httptest.NewRecorder()
+	h.renameTag(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("renameTag() without a new tag status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// savingDuringListStore starts a save of a tiddler through the handler once all tiddlers were read, giving it a moment to finish
+type savingDuringListStore struct {
+	TiddlerStore
+	save  func()
+	saved chan struct{}
+}
+
+func (s *savingDuringListStore) GetAllTiddlers() ([]Tiddler, error) {
+	tids, err := s.TiddlerStore.GetAllTiddlers()
+	go func() {
+		s.save()
+		close(s.saved)
+	}()
+	select {
+	case <-s.saved:
+	case <-time.After(50 * time.Millisecond):
+	}
+	return tids, err
+}
+
+func Test_handlerWithStore_renameTag_concurrentSave(t *testing.T) {
+	mem := NewMemoryStore()
+	if err := mem.WriteTiddler(Tiddler{"title": "A", "text": "first", "tags": "project-x"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	h := &handlerWithStore{}
+	store := &savingDuringListStore{TiddlerStore: mem, saved: make(chan struct{})}
+	store.save = func() {
+		w := httptest.NewRecorder()
+		h.putTiddler(w, putTiddlerRequest("A", `{"title":"A","text":"edited","tags":"project-x"}`))
+		if w.Code != http.StatusNoContent {
+			t.Errorf("putTiddler() status = %d", w.Code)
+		}
+	}
+	h.Store = store
+
+	r := httptest.NewRequest(http.MethodPost, "http://foobar.com/mywiki/tags/rename", strings.NewReader(`{"old":"project-x","new":"project-y"}`))
+	w := httptest.NewRecorder()
+	h.renameTag(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("renameTag() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	<-store.saved
+	// the save waited for the rename rather than being overwritten by it
+	if tid, err := mem.GetTiddler("A"); err != nil || tid.Field("text") != "edited" {
+		t.Errorf("tiddler A after rename and save = %v, %v, want the saved text", tid, err)
+	}
+}
+
+func Test_handlerWithStore_patchTiddler(t *testing.T) {
+	tests := []struct {
+		name       string
+		title      string
+		patch      string
+		wantStatus int
+		wantFields map[string]interface{} // nil value means the field must be absent
+	}{
+		{"add a field", "Task", `{"priority":"high"}`, http.StatusNoContent,
+			map[string]interface{}{"priority": "high", "text": "do it", "status": "open", "revision": "3"}},
+		{"change a field", "Task", `{"status":"done","title":"Ignored"}`, http.StatusNoContent,
+			map[string]interface{}{"status": "done", "text": "do it", "title": "Task", "revision": "3"}},
+		{"remove a field", "Task", `{"status":null}`, http.StatusNoContent,
+			map[string]interface{}{"status": nil, "text": "do it", "revision": "3"}},
+		{"number is stored as a string", "Task", `{"priority":2}`, http.StatusNoContent,
+			map[string]interface{}{"priority": "2"}},
+		{"missing tiddler", "Nope", `{"status":"done"}`, http.StatusNotFound, nil},
+		{"unusable value", "Task", `{"status":{"a":"b"}}`, http.StatusBadRequest,
+			map[string]interface{}{"status": "open", "revision": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+				"Task": {"title": "Task", "text": "do it", "status": "open", "revision": "2"},
+			}}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodPatch, "http://foobar.com/recipes/default/tiddlers/"+tt.title, strings.NewReader(tt.patch))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", tt.title}}}))
+			w := httptest.NewRecorder()
+			h.patchTiddler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("patchTiddler() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNoContent {
+				if etag := w.Result().Header.Get("Etag"); !strings.HasPrefix(etag, `"default/Task/3:`) {
+					t.Errorf("patchTiddler() etag = %s, want revision 3", etag)
+				}
+			}
+			stored := store.tiddlersByTitle["Task"]
+			for field, want := range tt.wantFields {
+				got, ok := stored[field]
+				if want == nil && ok {
+					t.Errorf("patchTiddler() kept field %s = %v", field, got)
+				} else if want != nil && got != want {
+					t.Errorf("patchTiddler() field %s = %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_limitPerClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		clients    []string //usernames of concurrent requests, "" for anonymous from the same IP
+		sessions   bool     //anonymous sessions are issued, but the requests send no cookie back
+		wantStatus []int
+	}{
+		{"under the limit", 2, []string{"alice", "alice"}, false, []int{http.StatusOK, http.StatusOK}},
+		{"over the limit", 1, []string{"alice", "alice"}, false, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{"limited per user", 1, []string{"alice", "bob"}, false, []int{http.StatusOK, http.StatusOK}},
+		{"anonymous by IP", 1, []string{"", ""}, false, []int{http.StatusOK, http.StatusTooManyRequests}},
+		{"anonymous dropping the session cookie by IP", 1, []string{"", ""}, true, []int{http.StatusOK, http.StatusTooManyRequests}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			entered := make(chan struct{}, len(tt.clients))
+			limited := limitPerClient(tt.max)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				entered <- struct{}{}
+				<-release
+			}))
+			if tt.sessions {
+				limited = anonymousSessions(time.Hour, []byte("test key"))(limited)
+			}
+			recorders := make([]*httptest.ResponseRecorder, len(tt.clients))
+			var wg sync.WaitGroup
+			for i, username := range tt.clients {
+				r := httptest.NewRequest(http.MethodGet, "http://foobar.com/", nil)
+				r.RemoteAddr = "192.0.2.1:1234"
+				if username == "" {
+					username = AuthAnonUsername
+				}
+				r = r.WithContext(context.WithValue(r.Context(), "auth", authContext{Username: username}))
+				recorders[i] = httptest.NewRecorder()
+				wg.Add(1)
+				go func(w *httptest.ResponseRecorder, r *http.Request) {
+					defer wg.Done()
+					limited.ServeHTTP(w, r)
+				}(recorders[i], r)
+				//let each request either enter the handler or be rejected before sending the next
+				select {
+				case <-entered:
+				case <-time.After(100 * time.Millisecond):
+				}
+			}
+			close(release)
+			wg.Wait()
+			for i, w := range recorders {
+				if w.Code != tt.wantStatus[i] {
+					t.Errorf("request %d unexpected status code = %d, want %d", i, w.Code, tt.wantStatus[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_compact(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "tiddlers", "empty"), 0700)
+	store, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "tiddlers", "gone.png.meta"), []byte("title: gone.png\ntype: image/png\n"), 0644)
+
+	h := &handlerWithStore{Store: store}
+	r := httptest.NewRequest(http.MethodPost, "http://foobar.com/notes/compact", nil)
+	w := httptest.NewRecorder()
+	h.compact(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("compact() unexpected status code = %d", w.Code)
+	}
+	var got CompactReport
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("compact() returned invalid JSON: %v", err)
+	}
+	want := CompactReport{EmptyDirs: []string{"empty"}, OrphanedMeta: []string{"gone.png.meta"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("compact() = %+v, want %+v", got, want)
+	}
+}
+
+func Test_handlerWithStore_exportTar(t *testing.T) {
+	src := t.TempDir()
+	png := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0xff}
+	os.MkdirAll(filepath.Join(src, "tiddlers", "sub"), 0700)
+	os.WriteFile(filepath.Join(src, "tiddlers", "pic.png"), png, 0644)
+	os.WriteFile(filepath.Join(src, "tiddlers", "pic.png.meta"), []byte("title: pic.png\ntype: image/png\n"), 0644)
+	os.WriteFile(filepath.Join(src, "tiddlers", "sub", "Nested.tid"), []byte("title: Nested\ntags: [[a tag]]\n\nin a folder"), 0644)
+	store, err := NewFileStore(src, true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	if err := store.WriteTiddler(Tiddler{"title": "Note", "text": "hello\nworld", "modified": "20230101000000000"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	r := httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/export.tar", nil)
+	w := httptest.NewRecorder()
+	h.exportTar(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("exportTar() unexpected status code = %d", w.Code)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="notes.tar"` {
+		t.Errorf("exportTar() Content-Disposition = %q", got)
+	}
+
+	// unpacking the archive into another wiki folder imports the same tiddlers
+	dst := t.TempDir()
+	names := []string{}
+	tr := tar.NewReader(w.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("exportTar() returned an invalid archive: %v", err)
+		}
+		names = append(names, hdr.Name)
+		path := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		os.MkdirAll(filepath.Dir(path), 0700)
+		b, _ := io.ReadAll(tr)
+		os.WriteFile(path, b, 0644)
+	}
+	wantNames := []string{"tiddlers/Note.tid", "tiddlers/pic.png", "tiddlers/pic.png.meta", "tiddlers/sub/Nested.tid"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("exportTar() entries = %v, want %v", names, wantNames)
+	}
+	imported, err := NewFileStore(dst, true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() of the unpacked archive error = %v", err)
+	}
+	for _, title := range []string{"Note", "Nested", "pic.png"} {
+		want, _ := store.GetTiddler(title)
+		got, err := imported.GetTiddler(title)
+		if err != nil {
+			t.Errorf("GetTiddler(%q) of the unpacked archive error = %v", title, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("GetTiddler(%q) of the unpacked archive = %v, want %v", title, got, want)
+		}
+	}
+	if b, _ := os.ReadFile(filepath.Join(dst, "tiddlers", "pic.png")); !bytes.Equal(b, png) {
+		t.Errorf("exportTar() changed the binary file, got %v", b)
+	}
+}
+
+func Test_handlerWithStore_importTar(t *testing.T) {
+	defer func(n int64) { maxImportTarEntrySize = n }(maxImportTarEntrySize)
+	maxImportTarEntrySize = 100
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "tiddlers", "sub"), 0700)
+	os.WriteFile(filepath.Join(src, "tiddlers", "pic.png"), []byte("\x89PNG\r\n\x1a\n\x00\xff"), 0644)
+	os.WriteFile(filepath.Join(src, "tiddlers", "pic.png.meta"), []byte("title: pic.png\ntype: image/png\n"), 0644)
+	os.WriteFile(filepath.Join(src, "tiddlers", "sub", "Nested.tid"), []byte("title: Nested\ntags: [[a tag]]\n\nin a folder"), 0644)
+	os.WriteFile(filepath.Join(src, "tiddlers", "Note.tid"), []byte("title: Note\nmodified: 20230101000000000\n\nhello"), 0644)
+	exported, err := NewFileStore(src, true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	w := httptest.NewRecorder()
+	(&handlerWithStore{Store: exported, wiki: "notes"}).exportTar(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/export.tar", nil))
+	archive := w.Body.Bytes()
+
+	// entries export.tar would not make: relative to the tiddlers folder, broken or outside the wiki
+	var extra bytes.Buffer
+	tw := tar.NewWriter(&extra)
+	for _, f := range []struct{ name, body string }{
+		{"Loose.tid", "title: Loose\n\nno folder"},
+		{"tiddlers/Untitled.tid", "type: text/plain\n\nno title"},
+		{"tiddlers/orphan.jpg", "\xff\xd8"},
+		{"tiddlers/gone.png.meta", "title: gone.png\ntype: image/png\n"},
+		{"../escape.tid", "title: Escape\n"},
+		{".history/Note/3.tid", "title: Note\nrevision: 3\n\nforged"},
+		{"tiddlers/.drafts/Draft.tid", "title: Draft\n"},
+		{"tiddlers/.history/Note/pic.png", "\x89PNG"},
+		{"tiddlers/Big.tid", "title: Big\n\n" + strings.Repeat("x", 100)},
+	} {
+		tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body))})
+		tw.Write([]byte(f.body))
+	}
+	tw.Close()
+
+	store := NewMemoryStore()
+	store.WriteTiddler(Tiddler{"title": "Note", "text": "older"})
+	h := &handlerWithStore{Store: store, wiki: "copy"}
+	for _, body := range [][]byte{archive, extra.Bytes()} {
+		r := httptest.NewRequest(http.MethodPost, "http://foobar.com/copy/import.tar", bytes.NewReader(body))
+		w := httptest.NewRecorder()
+		h.importTar(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("importTar() unexpected status code = %d: %s", w.Code, w.Body.String())
+		}
+		var got struct {
+			Imported []string          `json:"imported"`
+			Files    int               `json:"files"`
+			Failed   map[string]string `json:"failed"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+			t.Fatalf("importTar() returned invalid JSON: %v", err)
+		}
+		if bytes.Equal(body, archive) {
+			if !reflect.DeepEqual(got.Imported, []string{"Nested", "Note", "pic.png"}) || got.Files != 4 || len(got.Failed) != 0 {
+				t.Errorf("importTar() of the export = %+v", got)
+			}
+			continue
+		}
+		wantFailed := []string{"../escape.tid", ".history/Note/3.tid", "Untitled.tid", "gone.png.meta", "orphan.jpg", "tiddlers/.drafts/Draft.tid", "tiddlers/.history/Note/pic.png", "tiddlers/Big.tid"}
+		failed := []string{}
+		for name := range got.Failed {
+			failed = append(failed, name)
+		}
+		sort.Strings(failed)
+		if !reflect.DeepEqual(got.Imported, []string{"Loose"}) || !reflect.DeepEqual(failed, wantFailed) {
+			t.Errorf("importTar() of broken entries = %+v, want failed %v", got, wantFailed)
+		}
+	}
+
+	for _, title := range []string{"Note", "Nested", "pic.png", "Loose"} {
+		got, err := store.GetTiddler(title)
+		if err != nil {
+			t.Errorf("GetTiddler(%q) after importTar() error = %v", title, err)
+			continue
+		}
+		if want, err := exported.GetTiddler(title); err == nil && !reflect.DeepEqual(got, want) {
+			t.Errorf("GetTiddler(%q) after importTar() = %v, want %v", title, got, want)
+		}
+	}
+	if paths := store.TiddlerPaths(); len(paths) != 4 {
+		t.Errorf("importTar() left the files %v, want one for each title", paths)
+	}
+	if _, err := store.ReadFile(".history/Note/3.tid"); err == nil {
+		t.Errorf("importTar() wrote a revision into the history")
+	}
+
+	defer func(n int64) { maxImportTarSize = n }(maxImportTarSize)
+	maxImportTarSize = int64(len(archive) / 2)
+	w = httptest.NewRecorder()
+	h.importTar(w, httptest.NewRequest(http.MethodPost, "http://foobar.com/copy/import.tar", bytes.NewReader(archive)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("importTar() of an archive over the limit status code = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func Test_handlerWithStore_debugFiles(t *testing.T) {
+	tests := []struct {
+		name               string
+		titles             []string
+		wantSharedFiles    [][]string
+		wantCaseCollisions [][]string
+	}{
+		{"distinct files", []string{"Alpha", "Beta"}, [][]string{}, [][]string{}},
+		{"lossy filenames", []string{"a/b", "a:b", "Beta"}, [][]string{{"a/b", "a:b"}}, [][]string{}},
+		{"case variants", []string{"Note", "note"}, [][]string{}, [][]string{{"Note", "note"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}
+			for _, title := range tt.titles {
+				store.tiddlersByTitle[title] = Tiddler{"title": title}
+			}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/debug/files", nil)
+			w := httptest.NewRecorder()
+			h.debugFiles(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("debugFiles() unexpected status code = %d", w.Code)
+			}
+			var got struct {
+				Files          map[string]string `json:"files"`
+				SharedFiles    [][]string        `json:"shared_files"`
+				CaseCollisions [][]string        `json:"case_collisions"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("debugFiles() returned invalid JSON: %v", err)
+			}
+			if len(got.Files) != len(tt.titles) {
+				t.Errorf("debugFiles() files = %v, want %d titles", got.Files, len(tt.titles))
+			}
+			if !reflect.DeepEqual(got.SharedFiles, tt.wantSharedFiles) {
+				t.Errorf("debugFiles() shared_files = %v, want %v", got.SharedFiles, tt.wantSharedFiles)
+			}
+			if !reflect.DeepEqual(got.CaseCollisions, tt.wantCaseCollisions) {
+				t.Errorf("debugFiles() case_collisions = %v, want %v", got.CaseCollisions, tt.wantCaseCollisions)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_indexGzip(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	gzipped := func(s string) string {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(s))
+		zw.Close()
+		return b.String()
+	}
+	tests := []struct {
+		name         string
+		gzipIndex    bool
+		files        map[string]string
+		wantStatus   int
+		wantGzipFile bool
+		modified     map[string]time.Time
+	}{
+		{"reads gzipped index", true, map[string]string{"index.html.gz": gzipped(testIndexHTML)}, http.StatusOK, true, nil},
+		{"prefers gzipped index", true, map[string]string{"index.html": "stale", "index.html.gz": gzipped(testIndexHTML)}, http.StatusOK, true, nil},
+		{"writes gzipped index", true, map[string]string{"index.html": testIndexHTML}, http.StatusOK, true, nil},
+		{"corrupt gzipped index", true, map[string]string{"index.html": testIndexHTML, "index.html.gz": "not gzip"}, http.StatusInternalServerError, true, nil},
+		{"disabled ignores gzipped index", false, map[string]string{"index.html": testIndexHTML, "index.html.gz": "not gzip"}, http.StatusOK, true, nil},
+		{"rewrites outdated gzipped index", true, map[string]string{"index.html": testIndexHTML, "index.html.gz": gzipped("outdated")}, http.StatusOK, true,
+			map[string]time.Time{"index.html": time.Now(), "index.html.gz": time.Now().Add(-time.Minute)}},
+		{"disabled writes nothing", false, map[string]string{"index.html": testIndexHTML}, http.StatusOK, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverOptions.GzipIndex = tt.gzipIndex
+			store := &dummyTiddlerStore{
+				tiddlersByTitle: map[string]Tiddler{"Note": {"title": "Note", "text": "hello"}},
+				files:           tt.files,
+				fileModified:    tt.modified,
+			}
+			h := &handlerWithStore{Store: store}
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
+			w := httptest.NewRecorder()
+			h.index(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("index() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if tids := getIndexStoreTiddlers(t, w.Body.String()); len(tids) != 1 || tids[0].Field("text") != "hello" {
+					t.Errorf("index() served %v", tids)
+				}
+			}
+			gz, ok := store.files["index.html.gz"]
+			if ok != tt.wantGzipFile {
+				t.Fatalf("index() left index.html.gz present = %v, want %v", ok, tt.wantGzipFile)
+			}
+			if ok && tt.gzipIndex && tt.wantStatus == http.StatusOK {
+				zr, err := gzip.NewReader(strings.NewReader(gz))
+				if err != nil {
+					t.Fatalf("index.html.gz is not gzipped: %v", err)
+				}
+				if b, _ := io.ReadAll(zr); string(b) != testIndexHTML {
+					t.Errorf("index.html.gz = %q, want the index template", b)
+				}
+			}
+		})
+	}
+}
+
+func Test_managementRoutes_disabled(t *testing.T) {
+	router := chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "auth", authContext{Username: "admin", WritingAllowed: true})))
+		})
+	})
+	managementRoutes(router, true)
+	router.Get("/{wiki}", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(chi.URLParam(r, "wiki"))) })
+	router.Get("/{wiki}/recipes/{recipe}/tiddlers.json", func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{"landing page", "/", http.StatusNotFound},
+		{"add wiki", "/addWiki", http.StatusNotFound},
+		{"create wiki", "/createNewWiki?name=notes", http.StatusNotFound},
+		{"rename wiki", "/renameWiki?oldName=notes&newName=journal", http.StatusNotFound},
+		{"delete wiki", "/deleteWiki?name=notes", http.StatusNotFound},
+		{"server api", "/api/server", http.StatusNotFound},
+		{"trash api", "/api/trash", http.StatusNotFound},
+		{"wiki", "/notes", http.StatusOK},
+		{"sync", "/notes/recipes/default/tiddlers.json", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://foobar.com"+tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("GET %s status = %d, want %d", tt.path, w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_serverInfo(t *testing.T) {
+	defer func(hs *HandlerSelector, st, sp, tp, trp string, c Credentials, sw string) {
+		handlerSelector, storageType, storagePath, templatesPath, trashPath, serverCredentials, serverWriters = hs, st, sp, tp, trp, c, sw
+	}(handlerSelector, storageType, storagePath, templatesPath, trashPath, serverCredentials, serverWriters)
+
+	dir := t.TempDir()
+	rootStore, err := NewFileStore(dir, false, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	rootStore.CreateRequiredFolders(dir)
+	os.WriteFile(filepath.Join(dir, "templates", "empty.html"), []byte(testIndexHTML), 0644)
+	os.WriteFile(filepath.Join(dir, "templates", "empty.txt"), []byte("An empty wiki"), 0644)
+	os.Mkdir(filepath.Join(dir, "trash", "old"), 0700)
+
+	storageType, storagePath = "file", dir
+	templatesPath, trashPath = filepath.Join(dir, "templates"), filepath.Join(dir, "trash")
+	serverCredentials, serverWriters = Credentials{Writers: []string{"alice"}}, "alice"
+	notesReaders := "bob,carol"
+	handlerSelector = &HandlerSelector{
+		store: rootStore,
+		handlerMap: map[string]*handlerWithStore{
+			"notes": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+				"$:/SiteDescription": {"title": "$:/SiteDescription", "text": "My notes"},
+				"Note":               {"title": "Note"},
+			}}, creds: &wikiCredentials{readers: &notesReaders}},
+			"empty": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{}}},
+		},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "http://foobar.com/api/server", nil)
+	w := httptest.NewRecorder()
+	serverInfo(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("serverInfo() unexpected status code = %d", w.Code)
+	}
+	var got struct {
+		Storage map[string]string   `json:"storage"`
+		Access  map[string][]string `json:"access"`
+		Wikis   []struct {
+			Name        string   `json:"name"`
+			Description string   `json:"description"`
+			Tiddlers    int      `json:"tiddlers"`
+			Readers     []string `json:"readers"`
+			Writers     []string `json:"writers"`
+		} `json:"wikis"`
+		Templates []map[string]string `json:"templates"`
+		Trash     []string            `json:"trash"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("serverInfo() returned invalid JSON: %v", err)
+	}
+	if got.Storage["type"] != "file" || got.Storage["location"] != dir {
+		t.Errorf("serverInfo() storage = %v", got.Storage)
+	}
+	if !reflect.DeepEqual(got.Access, map[string][]string{"readers": {}, "writers": {"alice"}}) {
+		t.Errorf("serverInfo() access = %v", got.Access)
+	}
+	if len(got.Wikis) != 2 || got.Wikis[1].Name != "notes" || got.Wikis[1].Description != "My notes" || got.Wikis[1].Tiddlers != 2 || got.Wikis[0].Tiddlers != 0 {
+		t.Errorf("serverInfo() wikis = %+v", got.Wikis)
+	}
+	if len(got.Wikis) == 2 {
+		//notes sets its own readers and takes its writers from the server, empty sets nothing
+		if !reflect.DeepEqual(got.Wikis[1].Readers, []string{"bob", "carol"}) || !reflect.DeepEqual(got.Wikis[1].Writers, []string{"alice"}) {
+			t.Errorf("serverInfo() access of notes = %v, %v", got.Wikis[1].Readers, got.Wikis[1].Writers)
+		}
+		if !reflect.DeepEqual(got.Wikis[0].Readers, []string{}) || !reflect.DeepEqual(got.Wikis[0].Writers, []string{"alice"}) {
+			t.Errorf("serverInfo() access of empty = %v, %v", got.Wikis[0].Readers, got.Wikis[0].Writers)
+		}
+	}
+	if len(got.Templates) != 1 || got.Templates[0]["name"] != "empty" || got.Templates[0]["file"] != "empty.html" || got.Templates[0]["description"] != "An empty wiki" {
+		t.Errorf("serverInfo() templates = %v", got.Templates)
+	}
+	if !reflect.DeepEqual(got.Trash, []string{"old"}) {
+		t.Errorf("serverInfo() trash = %v", got.Trash)
+	}
+}
+
+func Test_listTrash(t *testing.T) {
+	defer func(hs *HandlerSelector, trp string) {
+		handlerSelector, trashPath = hs, trp
+	}(handlerSelector, trashPath)
+
+	dir := t.TempDir()
+	rootStore, err := NewFileStore(dir, false, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	rootStore.CreateRequiredFolders(dir)
+	//c and e were trashed before deletion times were recorded
+	records := map[string]string{
+		"a": `{"name":"a","deleted":"2024-03-03T00:00:00Z","size":10}`,
+		"b": `{"name":"b","deleted":"2024-03-01T00:00:00Z","size":5}`,
+		"d": `{"name":"d","deleted":"2024-03-02T00:00:00Z","size":20}`,
+	}
+	for _, name := range []string{"c", "a", "e", "b", "d"} {
+		os.Mkdir(filepath.Join(dir, "trash", name), 0700)
+		if record, ok := records[name]; ok {
+			os.WriteFile(filepath.Join(dir, "trash", name, trashRecordFile), []byte(record), 0644)
+		}
+	}
+	trashPath = filepath.Join(dir, "trash")
+	handlerSelector = &HandlerSelector{store: rootStore, storeFunc: NewFileStore}
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantTrash  []string
+		wantLimit  int
+		wantOffset int
+	}{
+		{"default page", "", http.StatusOK, []string{"a", "d", "b", "c", "e"}, trashPageSize, 0},
+		{"first page", "?limit=2", http.StatusOK, []string{"a", "d"}, 2, 0},
+		{"middle page", "?limit=2&offset=2", http.StatusOK, []string{"b", "c"}, 2, 2},
+		{"last partial page", "?limit=2&offset=4", http.StatusOK, []string{"e"}, 2, 4},
+		{"offset at end", "?limit=2&offset=5", http.StatusOK, []string{}, 2, 5},
+		{"offset past end", "?offset=100", http.StatusOK, []string{}, trashPageSize, 100},
+		{"limit capped", "?limit=100000", http.StatusOK, []string{"a", "d", "b", "c", "e"}, trashMaxPageSize, 0},
+		{"zero limit", "?limit=0", http.StatusBadRequest, nil, 0, 0},
+		{"negative offset", "?offset=-1", http.StatusBadRequest, nil, 0, 0},
+		{"bad limit", "?limit=ten", http.StatusBadRequest, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/api/trash"+tt.query, nil)
+			w := httptest.NewRecorder()
+			listTrash(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("listTrash() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got struct {
+				Trash  []trashEntry `json:"trash"`
+				Total  int          `json:"total"`
+				Size   int64        `json:"size"`
+				Limit  int          `json:"limit"`
+				Offset int          `json:"offset"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatalf("listTrash() returned invalid JSON: %v", err)
+			}
+			names := []string{}
+			for _, entry := range got.Trash {
+				names = append(names, entry.Name)
+				if _, ok := records[entry.Name]; ok != (entry.Deleted != nil && entry.Size != nil) {
+					t.Errorf("listTrash() entry %+v, want a deletion time and size only when recorded", entry)
+				}
+			}
+			if !reflect.DeepEqual(names, tt.wantTrash) || got.Total != 5 || got.Size != 35 || got.Limit != tt.wantLimit || got.Offset != tt.wantOffset {
+				t.Errorf("listTrash() = %+v, want trash %v, total 5, size 35, limit %d, offset %d", got, tt.wantTrash, tt.wantLimit, tt.wantOffset)
+			}
+		})
+	}
+}
+
+func Test_deleteWiki_recordsTrash(t *testing.T) {
+	defer func(hs *HandlerSelector, wp, trp string) {
+		handlerSelector, wikisPath, trashPath = hs, wp, trp
+	}(handlerSelector, wikisPath, trashPath)
+
+	dir := t.TempDir()
+	rootStore, err := NewFileStore(dir, false, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	rootStore.CreateRequiredFolders(dir)
+	wikisPath, trashPath = filepath.Join(dir, "wikis"), filepath.Join(dir, "trash")
+	os.MkdirAll(filepath.Join(wikisPath, "notes", "tiddlers"), 0700)
+	os.WriteFile(filepath.Join(wikisPath, "notes", "index.html"), []byte(testIndexHTML), 0644)
+	os.WriteFile(filepath.Join(wikisPath, "notes", "tiddlers", "Note.tid"), []byte("title: Note\n\nhello"), 0644)
+	store, err := NewFileStore(filepath.Join(wikisPath, "notes"), true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+	handlerSelector = &HandlerSelector{
+		store:      rootStore,
+		storeFunc:  NewFileStore,
+		handlerMap: map[string]*handlerWithStore{"notes": {Store: store}},
+	}
+
+	before := time.Now()
+	w := httptest.NewRecorder()
+	deleteWiki(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/deleteWiki?name=notes", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("deleteWiki() unexpected status code = %d: %s", w.Code, w.Body.String())
+	}
+	got := readTrashEntry("notes")
+	wantSize := int64(len(testIndexHTML) + len("title: Note\n\nhello"))
+	if got.Deleted == nil || got.Deleted.Before(before.Truncate(time.Second)) || got.Size == nil || *got.Size != wantSize {
+		t.Errorf("deleteWiki() recorded %+v, want deleted after %v and size %d", got, before, wantSize)
+	}
+}
+
+func Test_requireReader_publicRoutes(t *testing.T) {
+	creds := Credentials{map[string]string{"alice": "secret"}, []string{"alice"}, []string{"alice"}}
+	store := &dummyTiddlerStore{
+		tiddlersByTitle: map[string]Tiddler{
+			"Note":                     {"title": "Note", "text": "private"},
+			"$:/favicon.ico":           {"title": "$:/favicon.ico", "type": "image/x-icon", "text": []byte("\x00\x00\x01\x00")},
+			"$:/config/tiddlyweb/host": {"title": "$:/config/tiddlyweb/host", "text": "$protocol$//$host$/notes/"},
+		},
+		files: map[string]string{"index.html": testIndexHTML},
+	}
+	h := &handlerWithStore{Store: store}
+	defer func(hs *HandlerSelector) { handlerSelector = hs }(handlerSelector)
+	handlerSelector = &HandlerSelector{handlerMap: map[string]*handlerWithStore{"notes": h}}
+	tests := []struct {
+		name       string
+		public     []string
+		method     string
+		path       string
+		user       string
+		wantStatus int
+		wantNote   bool
+	}{
+		{"favicon needs credentials by default", nil, "", "/notes/favicon.ico", "", http.StatusUnauthorized, false},
+		{"public favicon", []string{PublicFavicon}, "", "/notes/favicon.ico", "", http.StatusOK, false},
+		{"tiddlers stay protected", []string{PublicFavicon, PublicIndex}, "", "/notes/recipes/default/tiddlers/Note", "", http.StatusUnauthorized, false},
+		{"index needs credentials by default", []string{PublicFavicon}, "", "/notes", "", http.StatusUnauthorized, false},
+		{"public index is an empty shell", []string{PublicIndex}, "", "/notes", "", http.StatusOK, false},
+		{"readers get the full index", []string{PublicIndex}, "", "/notes", "alice", http.StatusOK, true},
+		{"public readyz", []string{PublicReadyz}, "", "/readyz", "", http.StatusOK, false},
+		{"management pages stay protected", []string{PublicIndex}, "", "/deleteWiki?wiki=x", "", http.StatusUnauthorized, false},
+		{"landing page stays protected", []string{PublicIndex}, "", "/", "", http.StatusUnauthorized, false},
+		{"unknown wiki stays protected", []string{PublicIndex, PublicFavicon}, "", "/other", "", http.StatusUnauthorized, false},
+		{"public index only read", []string{PublicIndex}, http.MethodPost, "/notes", "", http.StatusUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.resetCaches()
+			router := chi.NewRouter()
+			router.Use(requireReader(creds, tt.public))
+			router.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {})
+			managementRoutes(router, false)
+			router.Get("/{wiki}", h.index)
+			router.Post("/{wiki}", h.index)
+			router.Get("/{wiki}/favicon.ico", h.favicon)
+			router.Get("/{wiki}/recipes/{recipe}/tiddlers/*", h.getTiddler)
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r := httptest.NewRequest(method, "http://foobar.com"+tt.path, nil)
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, creds.UserPasswordsClearText[tt.user])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.path != "/notes" || w.Code != http.StatusOK {
+				return
+			}
+			titles := make(map[string]bool)
+			for _, tid := range getIndexStoreTiddlers(t, w.Body.String()) {
+				titles[tid.Field("title")] = true
+			}
+			if titles["Note"] != tt.wantNote || !titles["$:/config/tiddlyweb/host"] {
+				t.Errorf("index tiddlers = %v, want Note included %v and the host config", titles, tt.wantNote)
+			}
+		})
+	}
+}
+
+func Test_anonymousSessions(t *testing.T) {
+	key := []byte("test key")
+	now := time.Now()
+	tests := []struct {
+		name        string
+		username    string
+		cookie      string
+		wantIssued  bool
+		wantSession string
+	}{
+		{"issued to anonymous user", AuthAnonUsername, "", true, ""},
+		{"kept while valid", AuthAnonUsername, signAnonSession("abc", now.Add(time.Minute), key), false, "abc"},
+		{"reissued when expired", AuthAnonUsername, signAnonSession("abc", now.Add(-time.Second), key), true, ""},
+		{"reissued when tampered", AuthAnonUsername, signAnonSession("abc", now.Add(time.Minute), []byte("other key")), true, ""},
+		{"reissued when malformed", AuthAnonUsername, "abc", true, ""},
+		{"not issued to named user", "bobValid", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotSession string
+			h := anonymousSessions(time.Hour, key)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotSession, _ = r.Context().Value("anonSession").(string)
+			}))
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), "auth", authContext{Username: tt.username}))
+			if tt.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: anonSessionCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			var issued *http.Cookie
+			for _, c := range w.Result().Cookies() {
+				if c.Name == anonSessionCookie {
+					issued = c
+				}
+			}
+			if (issued != nil) != tt.wantIssued {
+				t.Fatalf("anonymousSessions() issued cookie = %v, want issued %v", issued, tt.wantIssued)
+			}
+			if issued != nil {
+				if issued.MaxAge != 3600 || !issued.HttpOnly {
+					t.Errorf("anonymousSessions() cookie = %+v, want an hour long HttpOnly cookie", issued)
+				}
+				if _, ok := verifyAnonSession(issued.Value, key, now); !ok {
+					t.Errorf("anonymousSessions() issued invalid session %s", issued.Value)
+				}
+				// grouped by IP address until the cookie is sent back
+				if gotSession != "" {
+					t.Errorf("anonymousSessions() request session = %q for a newly issued session, want none", gotSession)
+				}
+				if _, ok := verifyAnonSession(issued.Value, key, now.Add(2*time.Hour)); ok {
+					t.Errorf("anonymousSessions() issued a session still valid after its max age")
+				}
+			} else if gotSession != tt.wantSession {
+				t.Errorf("anonymousSessions() request session = %q, want %q", gotSession, tt.wantSession)
+			}
+		})
+	}
+}
+
+func Test_clientKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    authContext
+		session string
+		want    string
+	}{
+		{"named user", authContext{Username: "bobValid"}, "abc", "user:bobValid"},
+		{"anonymous session", authContext{Username: AuthAnonUsername}, "abc", "session:abc"},
+		{"anonymous without session", authContext{Username: AuthAnonUsername}, "", "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			ctx := context.WithValue(r.Context(), "auth", tt.auth)
+			if tt.session != "" {
+				ctx = context.WithValue(ctx, "anonSession", tt.session)
+			}
+			if got := clientKey(r.WithContext(ctx)); got != tt.want {
+				t.Errorf("clientKey() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_handlerWithStore_prettyJSON(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		skinny     bool
+		wantIndent bool
+	}{
+		{"tiddler compact by default", "", false, false},
+		{"tiddler pretty", "?pretty=1", false, true},
+		{"tiddler pretty=false", "?pretty=false", false, false},
+		{"skinny list compact by default", "", true, false},
+		{"skinny list pretty", "?pretty=true", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &handlerWithStore{Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{
+				"Note": {"title": "Note", "text": "hello", "revision": "1"},
+			}}}
+			w := httptest.NewRecorder()
+			if tt.skinny {
+				r := httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers.json"+tt.query, nil)
+				h.getSkinnyTiddlerList(w, r)
+			} else {
+				r := httptest.NewRequest(http.MethodGet, "http://foobar.com/recipes/default/tiddlers/Note"+tt.query, nil)
+				r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+					&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", "Note"}}}))
+				h.getTiddler(w, r)
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("unexpected status code = %d", w.Code)
+			}
+			body := w.Body.Bytes()
+			if !json.Valid(body) {
+				t.Fatalf("response is not valid JSON: %s", body)
+			}
+			if got := bytes.Contains(body, []byte("\n  ")); got != tt.wantIndent {
+				t.Errorf("response indented = %v, want %v: %s", got, tt.wantIndent, body)
+			}
+			if ct := w.Result().Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("response Content-Type = %s", ct)
+			}
+		})
+	}
+}
+
+func Test_sortWikiList(t *testing.T) {
+	now := time.Now()
+	wikis := []wikiInfo{
+		{Name: "alpha", Tiddlers: 5, Modified: now.Add(-time.Hour)},
+		{Name: "beta", Tiddlers: 1, Modified: now},
+		{Name: "gamma", Tiddlers: 5, Modified: now.Add(-2 * time.Hour)},
+		{Name: "team-notes", Tiddlers: 3, Modified: now.Add(-time.Minute)},
+	}
+	tests := []struct {
+		name                string
+		prefix, sort, order string
+		want                []string
+		wantErr             bool
+	}{
+		{"default by name", "", "", "", []string{"alpha", "beta", "gamma", "team-notes"}, false},
+		{"name desc", "", "name", "desc", []string{"team-notes", "gamma", "beta", "alpha"}, false},
+		{"modified", "", "modified", "asc", []string{"gamma", "alpha", "team-notes", "beta"}, false},
+		{"modified desc", "", "modified", "desc", []string{"beta", "team-notes", "alpha", "gamma"}, false},
+		{"count ties by name", "", "count", "", []string{"beta", "team-notes", "alpha", "gamma"}, false},
+		{"count desc ties by name", "", "count", "desc", []string{"alpha", "gamma", "team-notes", "beta"}, false},
+		{"prefix", "team-", "", "", []string{"team-notes"}, false},
+		{"prefix without matches", "zeta", "", "", []string{}, false},
+		{"unknown sort", "", "size", "", nil, true},
+		{"unknown order", "", "name", "up", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sortWikiList(wikis, tt.prefix, tt.sort, tt.order)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sortWikiList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			names := []string{}
+			for _, wiki := range got {
+				names = append(names, wiki.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("sortWikiList() = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func Test_serverRootIndex_sort(t *testing.T) {
+	defer func(hs *HandlerSelector) { handlerSelector = hs }(handlerSelector)
+	small := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"a": {"title": "a"}}, lastModified: time.Now()}
+	large := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"a": {"title": "a"}, "b": {"title": "b"}}, lastModified: time.Now().Add(-time.Hour)}
+	handlerSelector = &HandlerSelector{handlerMap: map[string]*handlerWithStore{
+		"small": {Store: small},
+		"large": {Store: large},
+	}}
+	tests := []struct {
+		name         string
+		query        string
+		wantStatus   int
+		wantFirst    string
+		wantListings int //of each store, to find when it was last modified
+	}{
+		{"by name", "", http.StatusOK, "large", 0},
+		{"by count desc", "?sort=count&order=desc", http.StatusOK, "large", 0},
+		{"by count", "?sort=count", http.StatusOK, "small", 0},
+		{"by modified desc", "?sort=modified&order=desc", http.StatusOK, "small", 1},
+		{"filtered", "?prefix=sm", http.StatusOK, "small", 0},
+		{"unknown sort", "?sort=size", http.StatusBadRequest, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			small.lastModifiedCalls, large.lastModifiedCalls = 0, 0
+			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/"+tt.query, nil)
+			w := httptest.NewRecorder()
+			serverRootIndex(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("serverRootIndex() unexpected status code = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if small.lastModifiedCalls != tt.wantListings || large.lastModifiedCalls != tt.wantListings {
+				t.Errorf("serverRootIndex() listed the stores %d and %d times, want %d", small.lastModifiedCalls, large.lastModifiedCalls, tt.wantListings)
+			}
+			if tt.wantFirst == "" {
+				return
+			}
+			page := w.Body.String()
+			first := strings.Index(page, "<a href='"+tt.wantFirst+"'")
+			if first < 0 {
+				t.Fatalf("serverRootIndex() did not list %s", tt.wantFirst)
+			}
+			for name := range handlerSelector.handlerMap {
+				if i := strings.Index(page, "<a href='"+name+"'"); i >= 0 && i < first {
+					t.Errorf("serverRootIndex() listed %s before %s", name, tt.wantFirst)
+				}
+			}
+			if tt.query == "?prefix=sm" && strings.Contains(page, "<a href='large'") {
+				t.Errorf("serverRootIndex() listed a wiki not matching the prefix")
+			}
+		})
+	}
+}
+
+// a store holding a client, which is closed on shutdown
+type closingTiddlerStore struct {
+	dummyTiddlerStore
+	closed int
+}
+
+func (s *closingTiddlerStore) Close() error {
+	s.closed++
+	return nil
+}
+
+func Test_serveUntilStopped(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	started, release := make(chan bool), make(chan bool)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		io.WriteString(w, "done")
+	})}
+
+	wikiStore, rootStore := &closingTiddlerStore{}, &closingTiddlerStore{}
+	hr := &HandlerSelector{store: rootStore, handlerMap: map[string]*handlerWithStore{
+		"notes": {Store: wikiStore},
+		"plain": {Store: &dummyTiddlerStore{}},
+	}}
+	ran := []string{}
+	hooks := []ShutdownHook{
+		{"flush", func(ctx context.Context) error { ran = append(ran, "flush"); return ctx.Err() }},
+		{"broken", func(ctx context.Context) error { ran = append(ran, "broken"); return errors.New("simulated error") }},
+		{"close stores", func(ctx context.Context) error { ran = append(ran, "close stores"); return hr.closeStores(ctx) }},
+	}
+	stop := make(chan os.Signal, 1)
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- serveUntilStopped(srv, func() error { return srv.Serve(ln) }, stop, 5*time.Second, hooks)
+	}()
+
+	// a request in flight when the signal arrives is finished before the hooks run
+	response := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			response <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		response <- string(b)
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+	time.Sleep(50 * time.Millisecond)
+	if len(ran) != 0 {
+		t.Errorf("shutdown hooks %v ran before the request in flight finished", ran)
+	}
+	close(release)
+	if got := <-response; got != "done" {
+		t.Errorf("request in flight got %q, want it finished", got)
+	}
+
+	err = <-stopped
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("serveUntilStopped() error = %v, want the broken hook's error", err)
+	}
+	if !reflect.DeepEqual(ran, []string{"flush", "broken", "close stores"}) {
+		t.Errorf("shutdown hooks ran = %v", ran)
+	}
+	if wikiStore.closed != 1 || rootStore.closed != 1 {
+		t.Errorf("closeStores() closed the wiki store %d times and the server's store %d times, want once each", wikiStore.closed, rootStore.closed)
+	}
+}
+
+func Test_serveUntilStopped_listenError(t *testing.T) {
+	srv := &http.Server{}
+	err := serveUntilStopped(srv, func() error { return errors.New("address in use") }, make(chan os.Signal), time.Second, []ShutdownHook{
+		{"unexpected", func(ctx context.Context) error {
+			t.Errorf("shutdown hook ran although the server never started")
+			return nil
+		}},
+	})
+	if err == nil || err.Error() != "address in use" {
+		t.Errorf("serveUntilStopped() error = %v, want the listen error", err)
+	}
+}
+
+func TestParseIndexTemplates(t *testing.T) {
+	tests := []struct {
+		name         string
+		rules        []string
+		wantTemplate []string
+		wantErr      bool
+	}{
+		{"none", nil, []string{}, false},
+		{"rules in order", []string{"Mobile=index-mobile.html", "Kindle= index-eink.html "}, []string{"index-mobile.html", "index-eink.html"}, false},
+		{"pattern with equals sign", []string{"rv=11=index-old.html"}, []string{"index-old.html"}, false},
+		{"no template", []string{"Mobile="}, nil, true},
+		{"no pattern", []string{"=index-mobile.html"}, nil, true},
+		{"bad pattern", []string{"Mobile(=index-mobile.html"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIndexTemplates(tt.rules)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseIndexTemplates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			templates := []string{}
+			for _, rule := range got {
+				templates = append(templates, rule.Template)
+			}
+			if !reflect.DeepEqual(templates, tt.wantTemplate) {
+				t.Errorf("ParseIndexTemplates() templates = %v, want %v", templates, tt.wantTemplate)
+			}
+		})
+	}
+}
+
+func TestParseResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"none", []string{}, map[string]string{}, false},
+		{"canonical names", []string{"x-frame-options=DENY"}, map[string]string{"X-Frame-Options": "DENY"}, false},
+		{"value with =", []string{"Strict-Transport-Security=max-age=31536000; includeSubDomains"}, map[string]string{"Strict-Transport-Security": "max-age=31536000; includeSubDomains"}, false},
+		{"empty value", []string{"X-Content-Type-Options="}, map[string]string{"X-Content-Type-Options": ""}, false},
+		{"missing name", []string{"=DENY"}, nil, true},
+		{"missing =", []string{"X-Frame-Options"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseResponseHeaders(tt.headers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseResponseHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseResponseHeaders() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_responseHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured map[string]string
+		want       map[string]string
+	}{
+		{"defaults", nil, map[string]string{"X-Content-Type-Options": "nosniff"}},
+		{"added", map[string]string{"X-Frame-Options": "SAMEORIGIN"}, map[string]string{"X-Content-Type-Options": "nosniff", "X-Frame-Options": "SAMEORIGIN"}},
+		{"default dropped", map[string]string{"x-content-type-options": ""}, map[string]string{"X-Content-Type-Options": ""}},
+		{"default overridden", map[string]string{"X-Content-Type-Options": "other"}, map[string]string{"X-Content-Type-Options": "other"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := responseHeaders(tt.configured)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/", nil))
+			for name, want := range tt.want {
+				if got := w.Result().Header.Get(name); got != want {
+					t.Errorf("responseHeaders() %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_cors(t *testing.T) {
+	tests := []struct {
+		name            string
+		allowed         []string
+		method          string
+		origin          string
+		wantCode        int
+		wantOrigin      string
+		wantCredentials string
+		wantMethods     string
+	}{
+		{"same origin", []string{"https://tools.example.com"}, http.MethodGet, "", http.StatusUnauthorized, "", "", ""},
+		{"allowed origin", []string{"https://tools.example.com/"}, http.MethodGet, "https://tools.example.com", http.StatusUnauthorized, "https://tools.example.com", "true", ""},
+		{"other origin", []string{"https://tools.example.com"}, http.MethodGet, "https://evil.example.com", http.StatusUnauthorized, "", "", ""},
+		{"preflight", []string{"https://tools.example.com"}, http.MethodOptions, "https://tools.example.com", http.StatusNoContent, "https://tools.example.com", "true", corsAllowMethods},
+		{"preflight of other origin", []string{"https://tools.example.com"}, http.MethodOptions, "https://evil.example.com", http.StatusUnauthorized, "", "", ""},
+		{"any origin", []string{"*"}, http.MethodPut, "https://evil.example.com", http.StatusUnauthorized, "*", "", ""},
+		{"any origin preflight", []string{"*"}, http.MethodOptions, "https://evil.example.com", http.StatusNoContent, "*", "", corsAllowMethods},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// stands in for the authentication that follows, which preflight requests must not reach
+			h := cors(tt.allowed)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+			r := httptest.NewRequest(tt.method, "http://foobar.com/notes/recipes/default/tiddlers/Note", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.method == http.MethodOptions {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			header := w.Result().Header
+			if w.Code != tt.wantCode ||
+				header.Get("Access-Control-Allow-Origin") != tt.wantOrigin ||
+				header.Get("Access-Control-Allow-Credentials") != tt.wantCredentials ||
+				header.Get("Access-Control-Allow-Methods") != tt.wantMethods {
+				t.Errorf("cors() = %d %v", w.Code, header)
+			}
+			if header.Get("Vary") != "Origin" {
+				t.Errorf("cors() Vary = %q, want Origin", header.Get("Vary"))
+			}
+		})
+	}
+}
+
+func Test_checkOrigin(t *testing.T) {
+	tests := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{"*", false},
+		{"https://tools.example.com", false},
+		{"http://localhost:8080/", false},
+		{"tools.example.com", true},
+		{"https://tools.example.com/path", true},
+		{"ftp://tools.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if err := checkOrigin(tt.origin); (err != nil) != tt.wantErr {
+				t.Errorf("checkOrigin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// run with -race: wikis are created and deleted while requests look them up and list them
+func TestHandlerSelector_concurrentWikis(t *testing.T) {
+	defer func(wp string) { wikisPath = wp }(wikisPath)
+	wikisPath = "wikis"
+	hr := &HandlerSelector{
+		handlerMap: map[string]*handlerWithStore{},
+		storeFunc: func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+			return NewMemoryStore(), nil
+		},
+	}
+	if err := hr.addHandler("home"); err != nil {
+		t.Fatalf("addHandler() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wiki := fmt.Sprintf("wiki%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := hr.addHandler(wiki); err != nil {
+					t.Errorf("addHandler() error = %v", err)
+					return
+				}
+				hr.removeHandler(wiki)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if h, err := hr.getHandlerWithStore("home"); err != nil || h.wiki != "home" {
+					t.Errorf("getHandlerWithStore(home) = %v, %v", h, err)
+				}
+				hr.getHandlerWithStore(wiki)
+				hr.getWikiList(false)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if wikis := hr.getWikiList(false); len(wikis) != 1 || wikis[0].Name != "home" {
+		t.Errorf("getWikiList() = %v, want only home", wikis)
+	}
+}
 
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("deleteTiddler() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
-			}
+func TestNewHandlerSelector_missingWikisFolder(t *testing.T) {
+	defer func(hs *HandlerSelector, st, sp, wp string) {
+		handlerSelector, storageType, storagePath, wikisPath = hs, st, sp, wp
+	}(handlerSelector, storageType, storagePath, wikisPath)
+	dir := t.TempDir()
+	storageType, storagePath = "file", dir
+	wikisPath = filepath.Join(dir, "misconfigured", "wikis")
 
-			if _, gotNotDeleted := tt.store.tiddlersByTitle[tt.args.tiddlerName]; tt.wantDeleted && gotNotDeleted {
-				t.Errorf("deleteTiddler() tiddler unexpectedly found still in the store")
-			}
-		})
+	hs, err := NewHandlerSelector()
+	if err != nil {
+		t.Fatalf("NewHandlerSelector() error = %v", err)
+	}
+	if len(hs.handlerMap) != 0 {
+		t.Errorf("NewHandlerSelector() found wikis %v", hs.handlerMap)
+	}
+
+	handlerSelector = hs
+	w := httptest.NewRecorder()
+	serverRootIndex(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "No wikis yet") {
+		t.Errorf("serverRootIndex() = %d %s, want the no wikis yet page", w.Code, w.Body.String())
 	}
 }
 
-func Test_handlerWithStore_getSkinnyTiddlerList(t *testing.T) {
-	stripText := func(tid Tiddler) Tiddler {
-		skinnyTid := make(Tiddler)
-		for k, v := range tid {
-			if k == "text" {
-				continue
+func TestCheckStorageType(t *testing.T) {
+	for _, storeType := range StorageTypes {
+		if err := CheckStorageType(storeType); err != nil {
+			t.Errorf("CheckStorageType(%q) error = %v", storeType, err)
+		}
+	}
+	for _, storeType := range []string{"ftp", "", "File", "gcs"} {
+		err := CheckStorageType(storeType)
+		if err == nil {
+			t.Errorf("CheckStorageType(%q) accepted an unknown storage type", storeType)
+			continue
+		}
+		for _, supported := range StorageTypes {
+			if !strings.Contains(err.Error(), supported) {
+				t.Errorf("CheckStorageType(%q) error = %q, want it to list %s", storeType, err, supported)
 			}
-			skinnyTid[k] = v
 		}
-		return skinnyTid
 	}
-	store := &dummyTiddlerStore{
-		tiddlersByTitle: map[string]Tiddler{
-			"TestTiddler":    getTestTiddlerJsonAsTid(t, "TestTiddler.json"),
-			"$:/favicon.ico": getTestTiddlerJsonAsTid(t, "favicon.json"),
-			"another":        getTestTiddlerJsonAsTid(t, "another.json"),
-		},
+}
+
+func TestNewHandlerSelector_unknownStorageType(t *testing.T) {
+	defer func(hs *HandlerSelector, st, sp, wp string) {
+		handlerSelector, storageType, storagePath, wikisPath = hs, st, sp, wp
+	}(handlerSelector, storageType, storagePath, wikisPath)
+	storageType, storagePath = "ftp", "example.com/wikis"
+	wikisPath = filepath.Join(storagePath, "wikis")
+
+	if hs, err := NewHandlerSelector(); err == nil || !strings.Contains(err.Error(), `"ftp" not supported`) {
+		t.Errorf("NewHandlerSelector() = %v, %v, want the unsupported storage type error", hs, err)
 	}
-	cache := []Tiddler{
-		stripText(store.tiddlersByTitle["TestTiddler.json"]),
-		// stripText(store.tiddlersByTitle["favicon.json"]),
-		stripText(store.tiddlersByTitle["another.json"]),
+}
+
+func TestNewHandlerSelector_proxy(t *testing.T) {
+	defer func(hs *HandlerSelector, st, sp, wp string) {
+		handlerSelector, storageType, storagePath, wikisPath = hs, st, sp, wp
+	}(handlerSelector, storageType, storagePath, wikisPath)
+	upstream := &upstreamWiki{
+		tiddlers:  map[string]Tiddler{"Home": {"title": "Home", "text": "welcome", "revision": "1"}},
+		fetches:   map[string]int{},
+		basicAuth: ":", // no credentials
 	}
-	emptyStore := &dummyTiddlerStore{tiddlersByTitle: make(map[string]Tiddler)}
-	type fields struct {
-		store           dummyTiddlerStore
-		skinnyListCache []Tiddler
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	storageType, storagePath = "proxy", srv.URL+"/notes"
+	wikisPath = filepath.Join(storagePath, "wikis")
+
+	hs, err := NewHandlerSelector()
+	if err != nil {
+		t.Fatalf("NewHandlerSelector() error = %v", err)
 	}
-	type args struct {
-		recipe string
+	h, ok := hs.handlerMap["notes"]
+	if !ok {
+		t.Fatalf("NewHandlerSelector() wikis = %v, want the mirrored notes", hs.handlerMap)
+	}
+
+	w := httptest.NewRecorder()
+	h.getSkinnyTiddlerList(w, httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/recipes/default/tiddlers.json", nil))
+	var skinny []Tiddler
+	if err := json.NewDecoder(w.Body).Decode(&skinny); err != nil || len(skinny) != 1 || skinny[0].Field("title") != "Home" {
+		t.Errorf("getSkinnyTiddlerList() = %v, %v, want the mirrored Home", skinny, err)
+	}
+	if err := h.Store.WriteTiddler(Tiddler{"title": "Home", "text": "defaced"}); !errors.Is(err, ErrReadOnlyStore) {
+		t.Errorf("WriteTiddler() error = %v, want ErrReadOnlyStore", err)
 	}
+}
+
+func Test_cacheRebuilds_record(t *testing.T) {
+	defer func(i time.Duration) { rebuildLogInterval = i }(rebuildLogInterval)
 	tests := []struct {
-		name           string
-		fields         fields
-		args           args
-		want           []Tiddler
-		wantStatusCode int
+		name         string
+		interval     time.Duration
+		builds       int
+		wantUnlogged int64
 	}{
-		{"use cache",
-			fields{*emptyStore, cache},
-			args{"default"},
-			cache, http.StatusOK},
-		{"build cache",
-			fields{*store, nil},
-			args{"default"},
-			cache, http.StatusOK},
-		{"empty store",
-			fields{*emptyStore, nil},
-			args{"default"},
-			[]Tiddler{}, http.StatusOK},
-		{"nil store",
-			fields{dummyTiddlerStore{simulateBackingStoreError: true}, nil},
-			args{"default"},
-			nil, http.StatusInternalServerError},
-		// TODO: add more test cases
+		{"rate limited", time.Hour, 3, 2},
+		{"every rebuild", -1, 3, 0},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &handlerWithStore{
-				Store:           &tt.fields.store,
-				skinnyListCache: tt.fields.skinnyListCache,
+			rebuildLogInterval = tt.interval
+			var c cacheRebuilds
+			for i := 0; i < tt.builds; i++ {
+				c.record("notes", "index", 10, time.Millisecond)
 			}
-			r := httptest.NewRequest(http.MethodGet,
-				fmt.Sprintf("http://foobar.com/recipes/%s/tiddlers.json",
-					tt.args.recipe), nil)
-			r = r.WithContext(context.WithValue(r.Context(),
-				chi.RouteCtxKey,
-				&chi.Context{
-					URLParams: chi.RouteParams{
-						Keys:   []string{"recipe"},
-						Values: []string{tt.args.recipe},
-					},
-				}))
-			w := httptest.NewRecorder()
-			h.getSkinnyTiddlerList(w, r)
-
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("getSkinnyTiddlerList() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			if c.count() != int64(tt.builds) {
+				t.Errorf("count() = %d, want %d", c.count(), tt.builds)
 			}
-			if resp.StatusCode == http.StatusOK {
-				var got []Tiddler
-				if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
-					t.Errorf("getSkinnyTiddlerList() could not read server response = %v", err)
-				}
-				if !areTiddlerSlicesEqual(t, tt.want, got) {
-					t.Errorf("getSkinnyTiddlerList(): returned tiddler slice does not match expected")
-				}
+			if c.unlogged != tt.wantUnlogged || c.unloggedTook != time.Duration(tt.wantUnlogged)*time.Millisecond {
+				t.Errorf("record() left %d rebuilds taking %v unlogged, want %d", c.unlogged, c.unloggedTook, tt.wantUnlogged)
 			}
 		})
 	}
 }
 
-func Test_handlerWithStore_index(t *testing.T) {
+func Test_handlerWithStore_cacheRebuilds(t *testing.T) {
 	store := &dummyTiddlerStore{
-		tiddlersByTitle: map[string]Tiddler{
-			"TestTiddler":    getTestTiddlerJsonAsTid(t, "TestTiddler.json"),
-			"loading-splash": getTestTiddlerJsonAsTid(t, "loading-splash.json"),
-			// "$:/favicon.ico": getTestTiddlerJsonAsTid(t, "favicon.json"),
-			// "another":        getTestTiddlerJsonAsTid(t, "another.json"),
-		},
+		tiddlersByTitle: map[string]Tiddler{"Note": {"title": "Note", "text": "hello"}},
+		files:           map[string]string{"index.html": testIndexHTML},
 	}
-	type fields struct {
-		Store      dummyTiddlerStore
-		indexCache *bytes.Buffer
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	load := func() {
+		h.index(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://foobar.com/notes", nil))
+		h.getSkinnyTiddlerList(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://foobar.com/notes/recipes/default/tiddlers.json", nil))
+	}
+	load()
+	load() // served from the caches
+	if got := h.indexRebuilds.count(); got != 1 {
+		t.Errorf("index rebuilds = %d, want 1", got)
+	}
+	h.resetCaches()
+	load()
+	if got := h.indexRebuilds.count(); got != 2 {
+		t.Errorf("index rebuilds after reset = %d, want 2", got)
 	}
+	if got := h.skinnyListRebuilds.count(); got != 2 {
+		t.Errorf("skinny list rebuilds after reset = %d, want 2", got)
+	}
+}
+
+func Test_newServer_TLS(t *testing.T) {
+	// only used for its certificate and a client that trusts it
+	ts := httptest.NewUnstartedServer(http.NotFoundHandler())
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
 	tests := []struct {
-		name           string
-		fields         fields
-		wantStatusCode int
+		name      string
+		opts      Options
+		wantProto string
 	}{
-		{"build the cache",
-			fields{*store, nil}, http.StatusOK},
-		// TODO: add more test cases
+		{"http2 negotiated", Options{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem"}, "HTTP/2.0"},
+		{"http2 disabled", Options{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", DisableHTTP2: true}, "HTTP/1.1"},
+		{"h2c ignored with TLS", Options{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", H2C: true}, "HTTP/2.0"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &handlerWithStore{
-				Store: &tt.fields.Store,
-				// indexCache: tt.fields.indexCache,
+			srv := newServer("127.0.0.1:0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}), tt.opts)
+			srv.TLSConfig = &tls.Config{Certificates: ts.TLS.Certificates}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
 			}
-			r := httptest.NewRequest(http.MethodGet, "http://foobar.com/index", nil)
-			w := httptest.NewRecorder()
-			h.index(w, r)
+			go srv.ServeTLS(ln, "", "")
+			defer srv.Close()
 
-			resp := w.Result()
-			if resp.StatusCode != tt.wantStatusCode {
-				t.Errorf("getSkinnyTiddlerList() unexpected status code = %d, want %d", resp.StatusCode, tt.wantStatusCode)
+			resp, err := ts.Client().Get("https://" + ln.Addr().String() + "/")
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
 			}
-			if resp.StatusCode == http.StatusOK {
-				reader := bufio.NewReader(resp.Body)
-				for {
-					line, err := reader.ReadString('\n')
-					if err != nil && err != io.EOF {
-						t.Logf("index line: %s", line)
-						t.Fatalf("could not read line in index file: %v", err)
-					}
-					// t.Logf("line: %s", line)
-					if strings.Contains(line, "<!--~~ Ordinary tiddlers ~~-->") {
-						for {
-							scriptLine, err := reader.ReadString('\n')
-							if err == io.EOF {
-								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
-							}
-							if strings.Contains(scriptLine, "</script>") {
-								break
-							}
-							if strings.Contains(scriptLine, `<script class="tiddlywiki-tiddler-store"`) {
-								continue
-							}
-							// t.Logf("script thingy:\n%s", strings.TrimSpace(scriptLine))
-							var stored []Tiddler
-							if err := json.NewDecoder(strings.NewReader(scriptLine)).Decode(&stored); err != nil {
-								t.Errorf("index() could not read server response = %v", err)
-							}
-							want := make([]Tiddler, 0)
-							for _, t := range tt.fields.Store.tiddlersByTitle {
-								want = append(want, t)
-							}
-							if !areTiddlerSlicesEqual(t, want, stored) {
-								t.Errorf("index(): returned tiddler slice does not match expected")
-							}
-						}
-					} else if strings.Contains(line, "<!--~~ Raw markup for the top of the head section ~~-->") {
-						var markup bytes.Buffer
-						for {
-							markupLine, err := reader.ReadString('\n')
-							if err == io.EOF {
-								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
-							}
-							if strings.Contains(markupLine, `<meta http-equiv="X-UA-Compatible" content="IE=Edge"/>`) {
-								break
-							}
-							markup.WriteString(markupLine)
-						}
-						// TODO: check that this is correct
-						t.Logf("head markup:\n%s", markup.String())
-					} else if strings.Contains(line, "<!--~~ Raw markup for the top of the body section ~~-->") {
-						var markup bytes.Buffer
-						for {
-							markupLine, err := reader.ReadString('\n')
-							if err == io.EOF {
-								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
-							}
-							if strings.Contains(markupLine, "<!--~~ Static styles ~~-->") {
-								break
-							}
-							markup.WriteString(markupLine)
-						}
-						// TODO: check that this is correct
-						t.Logf("body-top markup:\n%s", markup.String())
-					} else if strings.Contains(line, "<!--~~ Raw markup for the bottom of the body section ~~-->") {
-						var markup bytes.Buffer
-						for {
-							markupLine, err := reader.ReadString('\n')
-							if err == io.EOF {
-								t.Fatalf("unexpectedly found EOF while trying to read tiddlers")
-							}
-							if strings.Contains(markupLine, `</body>`) {
-								break
-							}
-							markup.WriteString(markupLine)
-						}
-						// TODO: check that this is correct
-						t.Logf("body-bottom markup:\n%s", markup.String())
-					}
-					if err == io.EOF {
-						break
-					}
-				}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.Proto != tt.wantProto || string(body) != tt.wantProto {
+				t.Errorf("negotiated %s, server saw %s, want %s", resp.Proto, body, tt.wantProto)
 			}
 		})
 	}
 }
 
-func Test_handlerWithStore_resetCaches(t *testing.T) {
-	type fields struct {
-		indexCache      *bytes.Buffer
-		faviconCache    *bytes.Buffer
-		skinnyListCache []Tiddler
-	}
+func Test_httpsRedirect(t *testing.T) {
 	tests := []struct {
-		name   string
-		fields fields
+		name    string
+		tlsAddr string
+		target  string
+		want    string
 	}{
-		{"basic test", fields{
-			bytes.NewBufferString("this is dummy text"),
-			bytes.NewBufferString("my favorite icon"),
-			[]Tiddler{getTestTiddlerJsonAsTid(t, "TestTiddler.json")}}},
-		{"missing caches", fields{nil, nil, nil}},
+		{"default port", ":443", "http://wiki.example.com/notes/recipes/default/tiddlers/A%20B?x=1", "https://wiki.example.com/notes/recipes/default/tiddlers/A%20B?x=1"},
+		{"other port", "0.0.0.0:8443", "http://wiki.example.com:8080/notes", "https://wiki.example.com:8443/notes"},
+		{"ipv6 host", ":443", "http://[::1]:80/", "https://[::1]/"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &handlerWithStore{
-				indexCache:      tt.fields.indexCache,
-				faviconCache:    tt.fields.faviconCache,
-				skinnyListCache: tt.fields.skinnyListCache,
+			w := httptest.NewRecorder()
+			httpsRedirect(tt.tlsAddr).ServeHTTP(w, httptest.NewRequest(http.MethodPut, tt.target, nil))
+			if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+				t.Errorf("httpsRedirect() = %d %q, want %d %q", w.Code, w.Header().Get("Location"), http.StatusPermanentRedirect, tt.want)
 			}
-			h.resetCaches()
+		})
+	}
+}
 
-			if h.indexCache != nil && h.indexCache.Len() > 0 {
-				t.Errorf("handlerWithStore.resetCaches() unexpectedly found indexCache not empty %d", h.indexCache.Len())
+func Test_newServer_h2c(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantErr bool
+	}{
+		{"h2c enabled", Options{H2C: true}, false},
+		{"h2c off by default", Options{}, true},
+		{"h2c with http2 disabled", Options{H2C: true, DisableHTTP2: true}, true},
+	}
+	// speaks HTTP/2 with prior knowledge over plain TCP, as a proxy using h2c does
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer("", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.WriteString(w, r.Proto)
+			}), tt.opts)
+			ts := httptest.NewServer(srv.Handler)
+			defer ts.Close()
+
+			resp, err := client.Get(ts.URL + "/")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
 			}
-			if h.faviconCache != nil && h.faviconCache.Len() > 0 {
-				t.Errorf("handlerWithStore.resetCaches() unexpectedly found faviconCache not empty %d", h.faviconCache.Len())
+			if err != nil {
+				return
 			}
-			if len(h.skinnyListCache) > 0 {
-				t.Errorf("handlerWithStore.resetCaches() unexpectedly found skinnyListCache not empty %d", len(h.skinnyListCache))
+			defer resp.Body.Close()
+			if body, _ := io.ReadAll(resp.Body); resp.Proto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+				t.Errorf("negotiated %s, server saw %s, want HTTP/2.0", resp.Proto, body)
+			}
+
+			// plain HTTP/1.1 clients keep working
+			resp, err = http.Get(ts.URL + "/")
+			if err != nil {
+				t.Fatalf("HTTP/1.1 Get() error = %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.Proto != "HTTP/1.1" {
+				t.Errorf("HTTP/1.1 client negotiated %s", resp.Proto)
 			}
 		})
 	}
 }
+
+func TestListenAndServe_maxFilenameLength(t *testing.T) {
+	defer func(o Options, addr string, n int) {
+		serverOptions, serverHostAndPort, maxTiddlerFilenameLength = o, addr, n
+	}(serverOptions, serverHostAndPort, maxTiddlerFilenameLength)
+
+	for _, n := range []int{1, minTiddlerFilenameLength - 1} {
+		err := ListenAndServe("localhost:0", "", "", "", "memory", "", Options{MaxFilenameLength: n})
+		if err == nil || !strings.Contains(err.Error(), "max filename length") {
+			t.Errorf("ListenAndServe() with max filename length %d error = %v, want it refused", n, err)
+		}
+		if maxTiddlerFilenameLength != 255 {
+			t.Errorf("ListenAndServe() set max filename length %d", maxTiddlerFilenameLength)
+		}
+	}
+}
@@ -3,34 +3,116 @@ package tiddlybucket
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"mime"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/api/iterator"
 )
 
-const numWorkers = 15
+//How many objects or files a store reads, copies or deletes at once, e.g. when building its index. Set from Options.StoreWorkers
+var numWorkers = defaultStoreWorkers
+
+const defaultStoreWorkers = 15
+
+//Longest tiddler filename written as-is. Longer ones are truncated and suffixed with a hash of the title. Most filesystems cap names at 255 bytes.
+var maxTiddlerFilenameLength = 255
+
+//Length of the hash suffix of a truncated filename, the shortest limit a filename can be kept to
+const minTiddlerFilenameLength = len("_") + 2*sha1.Size + len(".tid")
+
+//Timeout and retry count for one kind of object store request. A zero Timeout waits indefinitely and zero Retries tries once.
+type OperationLimits struct {
+	Timeout time.Duration
+	Retries int
+}
+
+//Limits for each kind of object store request, since listing all tiddlers takes far longer than reading or writing a single one
+type StoreLimits struct {
+	Read  OperationLimits //reading a single object
+	Write OperationLimits //writing or deleting a single object
+	List  OperationLimits //listing the tiddlers, when building the index or checking for changes
+}
+
+type storeOperation int
+
+const (
+	opRead storeOperation = iota
+	opWrite
+	opList
+)
+
+func (op storeOperation) String() string {
+	return [...]string{"read", "write", "list"}[op]
+}
+
+//Limits applied by the object stores, set from the server options
+var storeLimits StoreLimits
+
+func (l StoreLimits) forOperation(op storeOperation) OperationLimits {
+	switch op {
+	case opWrite:
+		return l.Write
+	case opList:
+		return l.List
+	default:
+		return l.Read
+	}
+}
+
+//Runs an object store request with the timeout of its kind of operation, retrying failures up to its retry count.
+//The request must be done with the context by the time it returns, so results are read in full within it.
+func runStoreOperation(parent context.Context, op storeOperation, path string, request func(ctx context.Context) error) error {
+	limits := storeLimits.forOperation(op)
+	var err error
+	for attempt := 0; attempt <= limits.Retries; attempt++ {
+		ctx, cancel := parent, context.CancelFunc(func() {})
+		if limits.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(parent, limits.Timeout)
+		}
+		err = request(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		log.Warn().Str("operation", op.String()).Str("path", path).Int("attempt", attempt+1).Err(err).Msg("store request failed")
+	}
+	return err
+}
 
 var (
 	reTiddlerFilename = regexp.MustCompile(`[/:"]`)
 	reBinaryType      = regexp.MustCompile(`/(pdf|gif|jpeg|png|x-icon)$`)
+	reAttachmentName  = regexp.MustCompile(`^[0-9a-f]{40}(\.[^/]*)?$`)
 )
 
 type TiddlerStore interface {
@@ -39,6 +121,18 @@ type TiddlerStore interface {
 	GetAllTiddlers() ([]Tiddler, error)
 	WriteTiddler(t Tiddler) error
 	DeleteTiddler(title string) error
+	WriteFile(path string, data []byte) error      //writes a file relative to the store's base directory, e.g. an attachment under files/
+	DeleteFile(path string) error                  //removes a file relative to the store's base directory. A file that is already gone is not an error
+	FileModified(path string) (time.Time, error)   //when a file relative to the store's base directory was last changed
+	WriteTiddlerFile(path string, t Tiddler) error //writes a tiddler as a .tid file relative to the store's base directory, outside the index, e.g. a revision kept in the history
+	ReadTiddlerFile(path string) (Tiddler, error)  //reads a tiddler written with WriteTiddlerFile
+	LastModified() (time.Time, error)              //when the tiddlers were last changed in the backing store, found with a single listing
+	ListModified() (map[string]time.Time, error)   //the tiddler files in the backing store, listed afresh, keyed by their paths in TiddlerPaths with when each last changed
+	Reload() error                                 //rebuilds the index and cache from the backing store, picking up changes made outside the server
+	ReloadPaths(paths []string) ([]string, error)  //re-reads the tiddler files at some paths of ListModified into the index and cache, returning the titles added, changed or dropped
+	TiddlerPaths() map[string]string               //a copy of the index of tiddler titles to the files backing them
+	ListPaths() ([]string, error)                  //the files backing the tiddlers, .meta companions included, relative to the store's base directory for ReadFile
+	Compact() (CompactReport, error)               //removes what deleted and renamed tiddlers left behind and rebuilds the index
 	//Added below functions to support creation and management of multiple wikis
 	CreateRequiredFolders(path string) error
 	GetWikiList(path string) ([]string, error)
@@ -48,14 +142,357 @@ type TiddlerStore interface {
 	DeleteFolder(path string) error
 }
 
+//What a compaction of a store removed, relative to the tiddlers folder
+type CompactReport struct {
+	EmptyDirs    []string `json:"empty_dirs"`    //folders left empty under the tiddlers folder
+	OrphanedMeta []string `json:"orphaned_meta"` //.meta files whose companion file is gone
+}
+
+//Where a wiki keeps its index template and its tiddlers, relative to the wiki's folder (or bucket prefix).
+//Separate folders let object store lifecycle rules treat the index and the tiddlers differently.
+type StoreLayout struct {
+	IndexDir    string //folder of index.html and index.html.gz, the wiki's folder itself by default
+	TiddlersDir string //folder of the tiddler files, tiddlers by default
+}
+
+//Returns the layout with the default folders filled in
+func (l StoreLayout) withDefaults() StoreLayout {
+	if l.TiddlersDir == "" {
+		l.TiddlersDir = "tiddlers"
+	}
+	return l
+}
+
+//Returns the full path of a file read or written through ReadFile and WriteFile, placing the index template in IndexDir
+func (l StoreLayout) filePath(baseDir, path string) string {
+	if path == "index.html" || path == indexGzipFile {
+		return filepath.Join(baseDir, l.IndexDir, path)
+	}
+	return filepath.Join(baseDir, path)
+}
+
 func tiddlerFilename(title string) string {
-	return fmt.Sprintf("%s.tid", reTiddlerFilename.ReplaceAllString(title, "_"))
+	filename := fmt.Sprintf("%s.tid", reTiddlerFilename.ReplaceAllString(title, "_"))
+	if maxTiddlerFilenameLength <= 0 || len(filename) <= maxTiddlerFilenameLength {
+		return filename
+	}
+	// The title is read back from the file itself, so a deterministic hash keeps the name unique without needing to be reversible
+	sum := sha1.Sum([]byte(title))
+	suffix := "_" + hex.EncodeToString(sum[:]) + ".tid"
+	prefixLen := maxTiddlerFilenameLength - len(suffix)
+	if prefixLen < 0 {
+		prefixLen = 0
+	}
+	for prefixLen > 0 && !utf8.RuneStart(filename[prefixLen]) {
+		prefixLen--
+	}
+	hashed := filename[:prefixLen] + suffix
+	log.Debug().Str("title", title).Str("filename", hashed).Msg("tiddler filename too long, using hashed filename")
+	return hashed
+}
+
+//When true, titles that differ only by case are treated as the same tiddler, matching how case-insensitive filesystems (macOS, Windows) store them
+var caseInsensitiveTitles = false
+
+//Indexed titles by their lower case, kept next to a store's title to file index so that resolveTitle does not scan the index
+type foldedTitles map[string]string
+
+func newFoldedTitles(index map[string]string) foldedTitles {
+	folded := make(foldedTitles, len(index))
+	for title := range index {
+		folded.add(title)
+	}
+	return folded
+}
+
+func (f foldedTitles) add(title string) {
+	f[strings.ToLower(title)] = title
+}
+
+//Removes the title, unless another spelling of it was indexed since
+func (f foldedTitles) remove(title string) {
+	if f[strings.ToLower(title)] == title {
+		delete(f, strings.ToLower(title))
+	}
+}
+
+//Returns the indexed title to use for the given title. With caseInsensitiveTitles set, an existing title differing only by case is returned instead of the one given.
+func resolveTitle(index map[string]string, folded foldedTitles, title string) string {
+	if _, ok := index[title]; ok || !caseInsensitiveTitles {
+		return title
+	}
+	if indexed, ok := folded[strings.ToLower(title)]; ok {
+		return indexed
+	}
+	return title
+}
+
+//Writes a tiddler as a .tid file through the store's WriteFile, for the stores' WriteTiddlerFile
+func writeTiddlerFile(store TiddlerStore, path string, t Tiddler) error {
+	var buf bytes.Buffer
+	tfile := TiddlerFile{t}
+	if err := tfile.Write(&buf); err != nil {
+		return err
+	}
+	return store.WriteFile(path, buf.Bytes())
+}
+
+//Copies the title to file index, so it can be handed out without holding the store's lock
+func copyTiddlerPaths(index map[string]string) map[string]string {
+	paths := make(map[string]string, len(index))
+	for title, path := range index {
+		paths[title] = path
+	}
+	return paths
+}
+
+//Returns the files in the index relative to baseDir, sorted, adding the companion file of each .meta file
+func listIndexedPaths(index map[string]string, baseDir string) ([]string, error) {
+	seen := make(map[string]bool, len(index))
+	paths := make([]string, 0, len(index))
+	for _, path := range index {
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, p := range []string{rel, strings.TrimSuffix(rel, ".meta")} {
+			if !seen[p] {
+				seen[p] = true
+				paths = append(paths, p)
+			}
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+//Keeps the tiddler files of a listing of the files under tiddlersDir, giving a .meta file the later time of itself and
+//the file it describes, so a binary tiddler whose content alone was replaced shows as changed
+func tiddlerFileModTimes(files map[string]time.Time, tiddlersDir string) map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for path, modified := range files {
+		if !strings.HasPrefix(path, tiddlersDir) || !isTiddlerFile(strings.TrimPrefix(path, tiddlersDir)) {
+			continue
+		}
+		if content, ok := files[strings.TrimSuffix(path, ".meta")]; ok && content.After(modified) {
+			modified = content
+		}
+		modTimes[path] = modified
+	}
+	return modTimes
+}
+
+//Closes a store that holds a client or connection, such as a bucket store's client. Stores that hold none are left as they are.
+func closeStore(store TiddlerStore) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+//Groups indexed titles that differ only by case. Each group and the groups themselves are sorted.
+func findCaseCollisions(index map[string]string) [][]string {
+	byFolded := make(map[string][]string)
+	for title := range index {
+		folded := strings.ToLower(title)
+		byFolded[folded] = append(byFolded[folded], title)
+	}
+	collisions := make([][]string, 0)
+	for _, titles := range byFolded {
+		if len(titles) > 1 {
+			sort.Strings(titles)
+			collisions = append(collisions, titles)
+		}
+	}
+	sort.Slice(collisions, func(i, j int) bool { return collisions[i][0] < collisions[j][0] })
+	return collisions
+}
+
+//Reads the whole file at the given path (relative to the store's base directory).
+func readAllFromStore(store TiddlerStore, path string) ([]byte, error) {
+	r, err := store.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+//Returns the object key prefix of a folder of a bucket, ending in a slash. The folder's path may start with the bucket name,
+//as the storage location does (bucket/folder).
+func bucketFolderPrefix(bucket, path string) string {
+	key := bucketObjectKey(bucket, path)
+	if key == "" || key == bucket {
+		return ""
+	}
+	return strings.TrimSuffix(key, "/") + "/"
+}
+
+//Splits a bucket location into the bucket and the folder within it. The location is either a URI (s3://bucket/folder)
+//or, as the server builds the paths of the wikis from the storage location, bucket/folder.
+func parseBucketLocation(location string) (bucket, baseDir string, err error) {
+	if strings.Contains(location, "://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return "", "", fmt.Errorf("could not parse the uri: %s", err)
+		}
+		return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+	}
+	bucket, baseDir, _ = strings.Cut(filepath.ToSlash(location), "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("no bucket in location %q", location)
+	}
+	return bucket, baseDir, nil
+}
+
+//Returns the object key of a path that may start with the bucket name
+func bucketObjectKey(bucket, path string) string {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+	return strings.TrimPrefix(path, bucket+"/")
+}
+
+//Creates a wiki in an object store, which has no folders: the template is copied to the wiki's index.html and an empty
+//object named like a folder (ending in a slash) stands for the tiddlers folder, as bucket consoles do, unless putObject is nil.
+//A missing template is reported by copyObject rather than leaving a wiki without an index.
+func createBucketWikiFolder(wikiKey, templateKey string, layout StoreLayout, copyObject func(dst, src string) error, putObject func(key string, data []byte) error) error {
+	indexKey := filepath.ToSlash(layout.filePath(wikiKey, "index.html"))
+	if err := copyObject(indexKey, templateKey); err != nil {
+		return fmt.Errorf("could not copy template %s to %s: %w", templateKey, indexKey, err)
+	}
+	if putObject == nil {
+		return nil
+	}
+	tiddlersKey := filepath.ToSlash(filepath.Join(wikiKey, layout.TiddlersDir)) + "/"
+	if err := putObject(tiddlersKey, nil); err != nil {
+		return fmt.Errorf("could not create %s: %w", tiddlersKey, err)
+	}
+	return nil
+}
+
+//Reports the objects of a folder that an operation failed on, one "key: reason" each, or nil when none failed
+func objectErrors(operation string, failed []string, total int) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("could not %s %d of %d objects: %s", operation, len(failed), total, strings.Join(failed, "; "))
+}
+
+//Calls f for each key with numWorkers workers, so folders of many objects are not one round trip at a time.
+//No more keys are handed out once a call fails, and the first error is returned.
+func forEachKey(keys []string, f func(key string) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	work := make(chan string, numWorkers)
+	for w := 1; w <= numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				if err := f(key); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, key := range keys {
+		if failed() {
+			break
+		}
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+//Returns the templates among the keys listed under prefix, as the file store does: the name, the .html file and the
+//description read from the .txt object of the same name, if any, sorted by name. Objects in subfolders and hidden objects
+//(such as the probe written by probeBucket) are not templates.
+func bucketTemplateList(prefix string, keys []string, read func(key string) (io.ReadCloser, error)) ([][]string, error) {
+	listed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		listed[key] = true
+	}
+	templates := [][]string{}
+	for _, key := range keys {
+		file := strings.TrimPrefix(key, prefix)
+		if strings.Contains(file, "/") || strings.HasPrefix(file, ".") || !strings.HasSuffix(file, ".html") {
+			continue
+		}
+		name := strings.TrimSuffix(file, ".html")
+		description := ""
+		if descriptionKey := prefix + name + ".txt"; listed[descriptionKey] {
+			r, err := read(descriptionKey)
+			if err != nil {
+				return nil, err
+			}
+			b, err := io.ReadAll(r)
+			r.Close()
+			if err != nil {
+				return nil, fmt.Errorf("could not read '%s': %s", descriptionKey, err.Error())
+			}
+			description = string(b)
+		}
+		templates = append(templates, []string{name, file, description})
+	}
+	//Sort by template name
+	sort.SliceStable(templates, func(i, j int) bool {
+		return templates[i][0] < templates[j][0]
+	})
+	return templates, nil
+}
+
+//Name of the object written and deleted under the templates folder to check that a bucket is writable
+const bucketProbeName = ".tiddlyverse-probe"
+
+//Writes a small object under prefix and deletes it again, to check that the bucket exists and the credentials may write to it
+func probeBucket(prefix string, putObject func(key string, data []byte) error, deleteObject func(key string) error) error {
+	key := prefix + bucketProbeName
+	if err := putObject(key, []byte("probe")); err != nil {
+		return fmt.Errorf("bucket is not writable, could not write %s: %w", key, err)
+	}
+	if err := deleteObject(key); err != nil {
+		return fmt.Errorf("bucket is not writable, could not delete %s: %w", key, err)
+	}
+	return nil
+}
+
+//Returns the name of a folder listed under prefix, given as its own prefix (e.g. wikis/notes/ under wikis/ is notes).
+//Objects directly under prefix have no folder prefix, so their name is empty.
+func subfolderName(prefix, folderPrefix string) string {
+	if !strings.HasPrefix(folderPrefix, prefix) {
+		return ""
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(folderPrefix, prefix), "/")
 }
 
+//Folder of the tiddlers folder keeping the earlier revisions of the tiddlers, which are not tiddlers of the wiki themselves
+const historyDir = ".history"
+
+//Reports whether a path, relative to the tiddlers folder, is a .tid or .meta file of a tiddler. Hidden files and the files in
+//hidden folders, such as the revisions in historyDir, are not.
 func isTiddlerFile(path string) bool {
-	if strings.HasPrefix(path, ".") || (!strings.HasSuffix(path, ".tid") && !strings.HasSuffix(path, ".meta")) {
+	if !strings.HasSuffix(path, ".tid") && !strings.HasSuffix(path, ".meta") {
 		return false
 	}
+	for _, segment := range strings.Split(filepath.ToSlash(path), "/") {
+		if strings.HasPrefix(segment, ".") && segment != "." && segment != ".." {
+			return false
+		}
+	}
 
 	if strings.HasSuffix(path, "$__plugins_tobibeer_rate_styles_imgfix.tid") {
 		// FIXME: fuck you in particular
@@ -64,24 +501,119 @@ func isTiddlerFile(path string) bool {
 	return true
 }
 
-func writeTiddlerToWriter(t Tiddler, tiddlersDir string, index *map[string]string, cache *map[string]Tiddler, writer func(path string) (io.WriteCloser, error)) error {
+//Returns the name of the file holding the content of a binary tiddler, adding the extension of its type when the title has none
+func binaryFilename(title, contentType string) string {
+	name := reTiddlerFilename.ReplaceAllString(title, "_")
+	if filepath.Ext(name) == "" {
+		if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+//Returns the name of the file an attachment of a tiddler is stored in: a hash of the title and content, which does not collide
+//between titles that binaryFilename would make the same and changes with the content, followed by the extension binaryFilename uses
+func attachmentFilename(title, contentType string, data []byte) string {
+	h := sha1.New()
+	h.Write([]byte(title))
+	h.Write([]byte{0})
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)) + filepath.Ext(binaryFilename(title, contentType))
+}
+
+//Writes a tiddler to a .tid file, or a tiddler with binary ([]byte) text to its content file and a .meta file of its other fields,
+//as TiddlyWiki does. The file of the tiddler written before under another name, such as a .tid file of what is now a binary tiddler,
+//is removed so that it does not come back on a reload.
+func writeTiddlerToWriter(t Tiddler, tiddlersDir string, index *map[string]string, folded *foldedTitles, cache *map[string]Tiddler, writer func(path string) (io.WriteCloser, error), remove func(path string) error) error {
 	title := t.Field("title") // TODO: remove?
+	content, binary := t["text"].([]byte)
 	path := filepath.Join(tiddlersDir, tiddlerFilename(title))
+	if binary {
+		path = filepath.Join(tiddlersDir, binaryFilename(title, t.Field("type"))+".meta")
+	}
+	// overwrite the file of a title differing only by case rather than leaving two index entries for what may be the same file
+	existing := resolveTitle(*index, *folded, title)
+	previous := (*index)[existing]
+	if existing != title && filepath.Ext(previous) == filepath.Ext(path) {
+		path = previous
+	}
 	log.Trace().Str("title", title).Str("path", path).Msg("writeTiddlerToWriter")
 
-	w, err := writer(path)
-	if err != nil {
+	// the content goes first, so the .meta file never points at a missing one
+	if binary {
+		if err := writeAndClose(writer, strings.TrimSuffix(path, ".meta"), content); err != nil {
+			return err
+		}
+		fields := make(Tiddler, len(t)+1)
+		for k, v := range t {
+			if k != "text" {
+				fields[k] = v
+			}
+		}
+		//hashed once here rather than on every read of the content
+		fields[binaryHashField] = binaryContentHash(content)
+		t = fields
+	}
+	var buf bytes.Buffer
+	tfile := TiddlerFile{t}
+	if err := tfile.Write(&buf); err != nil {
+		return err
+	}
+	if err := writeAndClose(writer, path, buf.Bytes()); err != nil {
 		return err
 	}
-	defer w.Close()
 
-	tfile := TiddlerFile{t}
-	if err := tfile.Write(w); err == nil {
-		(*index)[title] = path
-		(*cache)[title] = t
+	if previous != "" && previous != path {
+		stale := []string{previous}
+		if strings.HasSuffix(previous, ".meta") {
+			stale = append(stale, strings.TrimSuffix(previous, ".meta"))
+		}
+		for _, p := range stale {
+			if p == strings.TrimSuffix(path, ".meta") {
+				continue
+			}
+			if err := remove(p); err != nil {
+				log.Warn().Str("title", title).Str("path", p).Err(err).Msg("could not remove the previous file of a rewritten tiddler")
+			}
+		}
+	}
+	if existing != title {
+		delete(*index, existing)
+		delete(*cache, existing)
+		folded.remove(existing)
 	}
-	// log.Trace().Interface("tfile", tfile).Msg("writeTiddlerToWriter")
+	(*index)[title] = path
+	folded.add(title)
+	if binary {
+		t["text"] = content
+	}
+	(*cache)[title] = t
+
+	return nil
+}
+
+//Field of the .meta file of a binary tiddler holding the hash of its content, written with the content and served as its ETag
+const binaryHashField = "_content_hash"
+
+//Field of a tiddler read from content kept gzipped at rest, holding the content as stored. It is never written to a file.
+const gzippedContentField = "_gzipped_content"
 
+//Hashes the content of a binary tiddler for binaryHashField
+var binaryContentHash = func(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+//Writes data through a writer from writeTiddlerToWriter. Object store writers upload on Close, so its error decides whether the write happened.
+func writeAndClose(writer func(path string) (io.WriteCloser, error), path string, data []byte) error {
+	w, err := writer(path)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
 	return err
 }
 
@@ -90,7 +622,7 @@ func readTiddlerFileWithReadCloser(path string, reader func(path string) (io.Rea
 	log.Trace().Str("path", path).Msg("readTiddlerFileWithReadCloser()")
 	f, err := reader(path)
 	if err != nil {
-		return nil, fmt.Errorf("could not open file '%s': %s", path, err.Error())
+		return nil, fmt.Errorf("could not open file '%s': %w", path, err)
 	}
 	defer f.Close()
 
@@ -124,19 +656,46 @@ func readTiddlerFileWithReadCloser(path string, reader func(path string) (io.Rea
 			return nil, fmt.Errorf("could not read file contents '%s': %s", nonMetaFilename, err.Error())
 		}
 
-		log.Trace().Str("type", tfile.tid["type"].(string)).Msg("check type")
-		if reBinaryType.MatchString(tfile.tid["type"].(string)) {
+		//content kept gzipped at rest (e.g. logo.svg.gz described by logo.svg.gz.meta) is inflated, keeping what was stored
+		//to be served as it is to the clients that accept gzip
+		contentName := nonMetaFilename
+		if strings.HasSuffix(nonMetaFilename, ".gz") && tfile.tid.Field("type") != "application/gzip" {
+			zr, err := gzip.NewReader(bytes.NewReader(b))
+			var inflated []byte
+			if err == nil {
+				inflated, err = io.ReadAll(zr)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("could not inflate file contents '%s': %s", nonMetaFilename, err.Error())
+			}
+			tfile.tid[gzippedContentField] = b
+			b = inflated
+			contentName = strings.TrimSuffix(nonMetaFilename, ".gz")
+		}
+
+		contentType := tfile.tid.Field("type")
+		if contentType == "" {
+			//a .meta file written by hand may leave the type out, which the file it describes then tells
+			contentType, _, _ = mime.ParseMediaType(contentTypeFor(contentName, b))
+			tfile.tid["type"] = contentType
+		}
+		log.Trace().Str("type", contentType).Msg("check type")
+		if reBinaryType.MatchString(contentType) {
 			tfile.tid["text"] = b
 		} else {
 			tfile.tid["text"] = string(b)
 		}
 	}
+	if _, ok := tfile.tid["type"]; !ok {
+		tfile.tid["type"] = defaultTiddlerType
+	}
 
 	return tfile.Tiddler(), nil
 }
 
-func getTiddlerFileFromStore(title, tiddlersDir string, index map[string]string, cache map[string]Tiddler, reader func(string) (io.ReadCloser, error)) (Tiddler, error) {
+func getTiddlerFileFromStore(title, tiddlersDir string, index map[string]string, folded foldedTitles, cache map[string]Tiddler, reader func(string) (io.ReadCloser, error)) (Tiddler, error) {
 	log.Debug().Str("title", title).Msg("get file from store")
+	title = resolveTitle(index, folded, title)
 	filename, ok := index[title]
 	if !ok {
 		filename = filepath.Join(tiddlersDir, tiddlerFilename(title))
@@ -252,6 +811,27 @@ func buildCacheAndIndex(walker func(f func(path string) error) error,
 	}
 
 	wg.Wait()
+	for _, titles := range findCaseCollisions(index) {
+		log.Warn().Strs("titles", titles).Bool("case_insensitive_titles", caseInsensitiveTitles).
+			Msg("tiddler titles differ only by case")
+		if !caseInsensitiveTitles {
+			continue
+		}
+		//keep the most recently modified tiddler and drop the others from the index
+		keep := titles[0]
+		for _, title := range titles[1:] {
+			tiddler, kept := cache[title], cache[keep]
+			if tiddlerTimeAfter(tiddler.Field("modified"), kept.Field("modified")) {
+				keep = title
+			}
+		}
+		for _, title := range titles {
+			if title != keep {
+				delete(index, title)
+				delete(cache, title)
+			}
+		}
+	}
 	log.Info().
 		Int("num_tiddlers", len(index)).
 		Dur("ellapsed", time.Since(start)).
@@ -261,16 +841,69 @@ func buildCacheAndIndex(walker func(f func(path string) error) error,
 	return index, cache, nil
 }
 
+//Re-reads the tiddler files at the given paths into an index and cache built by buildCacheAndIndex, so that a few files changed
+//outside the server are picked up without reading them all. The tiddler of a path that is gone is dropped, a file that cannot
+//be read is left as it was, and a file of a title already kept in another file stays out of the index, as after a reload.
+//Returns the titles added, changed or dropped.
+func reloadTiddlerPaths(paths []string, reader func(path string) (io.ReadCloser, error), mu sync.Locker,
+	index *map[string]string, folded *foldedTitles, cache *map[string]Tiddler) []string {
+	read := make(map[string]Tiddler, len(paths))
+	for _, path := range paths {
+		tiddler, err := readTiddlerFileWithReadCloser(path, reader)
+		if err != nil && !isNotFound(err) {
+			log.Error().Str("path", path).Err(err).Msg("could not get tiddler as file")
+			continue
+		}
+		read[path] = tiddler //nil for a file that is gone
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	titleAt := make(map[string]string, len(*index))
+	for title, path := range *index {
+		titleAt[path] = title
+	}
+	changed := []string{}
+	for _, path := range paths {
+		tiddler, ok := read[path]
+		if !ok {
+			continue
+		}
+		title, _ := fieldAsString(tiddler["title"])
+		if previous, ok := titleAt[path]; ok && previous != title {
+			delete(*index, previous)
+			delete(*cache, previous)
+			folded.remove(previous)
+			changed = append(changed, previous)
+		}
+		if title == "" {
+			continue
+		}
+		if other, ok := (*index)[title]; ok && other != path {
+			log.Warn().Str("title", title).Str("path", path).Str("indexed_path", other).Msg("tiddler title already kept in another file")
+			continue
+		}
+		(*index)[title] = path
+		(*cache)[title] = tiddler
+		folded.add(title)
+		changed = append(changed, title)
+	}
+	return changed
+}
+
 type fileStore struct {
 	baseDir, tiddlersDir string
+	layout               StoreLayout
 	tiddlerToFile        map[string]string
+	foldedTitles         foldedTitles
 	tiddlerCache         map[string]Tiddler
+	mu                   sync.RWMutex //guards tiddlerToFile, foldedTitles, tiddlerCache and the tiddler files against concurrent writes
 }
 
 func (s *fileStore) newReader(filename string) (io.ReadCloser, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, fmt.Errorf("could not open file '%s': %s", filename, err.Error())
+		return nil, fmt.Errorf("could not open file '%s': %w", filename, err)
 	}
 	return f, nil
 }
@@ -307,79 +940,256 @@ func (s *fileStore) walk(f func(path string) error) error {
 }
 
 func (s *fileStore) ReadFile(path string) (io.ReadCloser, error) {
-	return s.newReader(filepath.Join(s.baseDir, path))
+	return s.newReader(s.layout.filePath(s.baseDir, path))
 }
 
 func (s *fileStore) GetTiddler(title string) (Tiddler, error) {
-	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.tiddlerCache, s.newReader)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.foldedTitles, s.tiddlerCache, s.newReader)
 }
 
 func (s *fileStore) GetAllTiddlers() ([]Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return getAllTiddlerFilesFromStore(s.tiddlerCache, s.newReader, s.walk)
 }
 
 func (s *fileStore) WriteTiddler(t Tiddler) error {
-	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.foldedTitles), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
 		w, err := os.Create(path)
 		if err != nil {
 			return nil, err
 		}
 		return w, nil
-	})
+	}, removeFile)
 }
 
 func (s *fileStore) DeleteTiddler(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title = resolveTitle(s.tiddlerToFile, s.foldedTitles, title)
 	log.Trace().Str("title", title).Str("filename", s.tiddlerToFile[title]).
 		Msg("fileStore.Delete")
 	if err := os.Remove(s.tiddlerToFile[title]); err != nil {
 		return err
 	}
 	delete(s.tiddlerToFile, title)
+	s.foldedTitles.remove(title)
 	delete(s.tiddlerCache, title)
 	return nil
 }
 
-func (s *fileStore) CreateRequiredFolders(path string) error {
-	//Create wikis, templates and trash folders in the indicated storage location if they do not exist
-	var err error
-	wikisDirExists := false
-	templatesDirExists := false
-	trashDirExists := false
+func (s *fileStore) WriteFile(path string, data []byte) error {
+	fullPath := s.layout.filePath(s.baseDir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(fullPath, data, 0644)
+}
 
-	files, err := os.ReadDir(path)
-	if err != nil {
+func (s *fileStore) DeleteFile(path string) error {
+	return removeFile(s.layout.filePath(s.baseDir, path))
+}
+
+//Removes a file, which is not an error when it is already gone
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
+	return nil
+}
 
-	for _, file := range files {
-		if file.IsDir() {
-			if file.Name() == "wikis" {
-				wikisDirExists = true
-			} else if file.Name() == "templates" {
-				templatesDirExists = true
-			} else if file.Name() == "trash" {
-				trashDirExists = true
-			}
-		}
+func (s *fileStore) FileModified(path string) (time.Time, error) {
+	info, err := os.Stat(s.layout.filePath(s.baseDir, path))
+	if err != nil {
+		return time.Time{}, err
 	}
-	if !wikisDirExists {
-		err = os.Mkdir(filepath.Join(path, "wikis"), 0700)
+	return info.ModTime(), nil
+}
+
+func (s *fileStore) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *fileStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *fileStore) LastModified() (time.Time, error) {
+	var last time.Time
+	//Directories are included since removing a file changes the modification time of its folder only
+	err := filepath.WalkDir(s.tiddlersDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-	}
-	if !templatesDirExists {
-		err = os.Mkdir(filepath.Join(path, "templates"), 0700)
-		if err != nil {
-			return err
+		if !d.IsDir() && !isTiddlerFile(strings.TrimPrefix(path, s.tiddlersDir)) {
+			return nil
 		}
-	}
-	if !trashDirExists {
-		err = os.Mkdir(filepath.Join(path, "trash"), 0700)
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-	}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+		return nil
+	})
+	return last, err
+}
+
+func (s *fileStore) ListModified() (map[string]time.Time, error) {
+	files := make(map[string]time.Time)
+	err := filepath.WalkDir(s.tiddlersDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files[path] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlerFileModTimes(files, s.tiddlersDir), nil
+}
+
+func (s *fileStore) Reload() error {
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return nil
+}
+
+func (s *fileStore) ReloadPaths(paths []string) ([]string, error) {
+	return reloadTiddlerPaths(paths, s.newReader, &s.mu, &s.tiddlerToFile, &s.foldedTitles, &s.tiddlerCache), nil
+}
+
+func (s *fileStore) TiddlerPaths() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyTiddlerPaths(s.tiddlerToFile)
+}
+
+func (s *fileStore) ListPaths() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listIndexedPaths(s.tiddlerToFile, s.baseDir)
+}
+
+//Removes the .meta files whose companion file is gone and the folders left empty under the tiddlers folder, then rebuilds
+//the index and cache. Writes wait until it is done, so it is safe on a wiki being served.
+func (s *fileStore) Compact() (CompactReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := CompactReport{EmptyDirs: []string{}, OrphanedMeta: []string{}}
+	dirs := []string{}
+	err := filepath.WalkDir(s.tiddlersDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != s.tiddlersDir {
+				dirs = append(dirs, path)
+			}
+			return nil
+		}
+		if !strings.HasSuffix(path, ".meta") {
+			return nil
+		}
+		if _, err := os.Stat(strings.TrimSuffix(path, ".meta")); !errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(s.tiddlersDir, path)
+		report.OrphanedMeta = append(report.OrphanedMeta, rel)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	//Folders are walked parents first, so going backwards empties the subfolders before their parent is checked
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(dirs[i])
+		if err != nil {
+			return report, err
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := os.Remove(dirs[i]); err != nil {
+			return report, err
+		}
+		rel, _ := filepath.Rel(s.tiddlersDir, dirs[i])
+		report.EmptyDirs = append(report.EmptyDirs, rel)
+	}
+
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return report, err
+	}
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return report, nil
+}
+
+func (s *fileStore) CreateRequiredFolders(path string) error {
+	//Create wikis, templates and trash folders in the indicated storage location if they do not exist
+	var err error
+	wikisDirExists := false
+	templatesDirExists := false
+	trashDirExists := false
+
+	files, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			if file.Name() == "wikis" {
+				wikisDirExists = true
+			} else if file.Name() == "templates" {
+				templatesDirExists = true
+			} else if file.Name() == "trash" {
+				trashDirExists = true
+			}
+		}
+	}
+	if !wikisDirExists {
+		err = os.Mkdir(filepath.Join(path, "wikis"), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	if !templatesDirExists {
+		err = os.Mkdir(filepath.Join(path, "templates"), 0700)
+		if err != nil {
+			return err
+		}
+	}
+	if !trashDirExists {
+		err = os.Mkdir(filepath.Join(path, "trash"), 0700)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -387,8 +1197,13 @@ func (s *fileStore) GetWikiList(path string) ([]string, error) {
 	wikiFolders := []string{}
 
 	files, err := os.ReadDir(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// a new server has no wikis folder until CreateRequiredFolders runs
+		log.Warn().Str("path", path).Msg("wikis folder does not exist, so there are no wikis yet")
+		return wikiFolders, nil
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	for _, file := range files {
@@ -475,13 +1290,17 @@ func (s *fileStore) CreateWikiFolder(wikiPath string, templateFilePath string) e
 	if err != nil {
 		return err
 	}
-	destinationFile := filepath.Join(wikiPath, "index.html")
+	destinationFile := s.layout.filePath(wikiPath, "index.html")
+	err = os.MkdirAll(filepath.Dir(destinationFile), 0700)
+	if err != nil {
+		return err
+	}
 	err = os.WriteFile(destinationFile, input, 0644)
 	if err != nil {
 		return err
 	}
 	//Create a tiddlers folder in the new directory
-	err = os.Mkdir(filepath.Join(wikiPath, "tiddlers"), 0700)
+	err = os.MkdirAll(filepath.Join(wikiPath, s.layout.TiddlersDir), 0700)
 	if err != nil {
 		return err
 	}
@@ -505,12 +1324,13 @@ func (s *fileStore) DeleteFolder(path string) error {
 	return nil
 }
 
-func NewFileStore(dir string, requireIndex bool) (TiddlerStore, error) {
+func NewFileStore(dir string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
 	log.Info().Str("dir", dir).Msg("creating 'local filesystem' TiddlerStore")
 
 	s := new(fileStore)
 	s.baseDir = dir
-	s.tiddlersDir = filepath.Join(s.baseDir, "tiddlers")
+	s.layout = layout.withDefaults()
+	s.tiddlersDir = filepath.Join(s.baseDir, s.layout.TiddlersDir)
 
 	if requireIndex { //Index for tiddlers and wiki index.html file not needed for handler that will solely manage wikis, templates and trash folders
 		// build the index
@@ -520,6 +1340,7 @@ func NewFileStore(dir string, requireIndex bool) (TiddlerStore, error) {
 			return nil, err
 		}
 		s.tiddlerToFile = index
+		s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
 		s.tiddlerCache = cache
 	}
 
@@ -529,41 +1350,89 @@ func NewFileStore(dir string, requireIndex bool) (TiddlerStore, error) {
 // https://pkg.go.dev/google.golang.org/cloud/storage#hdr-Creating_a_Client
 type googleBucketStore struct {
 	uri, bucket, baseDir, tiddlersDir string
+	layout                            StoreLayout
 	tiddlerToFile                     map[string]string
+	foldedTitles                      foldedTitles
 	tiddlerCache                      map[string]Tiddler
+	mu                                sync.RWMutex //guards tiddlerToFile, foldedTitles, tiddlerCache and the tiddler objects against concurrent writes
 	client                            *storage.Client
 	ctx                               context.Context
 	bucketHandle                      *storage.BucketHandle
 }
 
 func (s *googleBucketStore) newReader(path string) (io.ReadCloser, error) {
-	r, err := s.bucketHandle.Object(path).NewReader(s.ctx)
+	var data []byte
+	err := runStoreOperation(s.ctx, opRead, path, func(ctx context.Context) error {
+		r, err := s.bucketHandle.Object(path).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err = io.ReadAll(r)
+		return err
+	})
 	if err != nil {
 		log.Warn().Str("path", path).Err(err).Msg("could not create tiddler reader")
-		return nil, fmt.Errorf("could not open object '%s': %s", path, err.Error())
+		return nil, fmt.Errorf("could not open object '%s': %w", path, err)
 	}
-	return r, nil
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+//Collects a tiddler file written by writeTiddlerToWriter and uploads it in one request on Close
+type bufferedObjectWriter struct {
+	bytes.Buffer
+	put func(data []byte) error
+}
+
+func (w *bufferedObjectWriter) Close() error {
+	return w.put(w.Bytes())
+}
+
+//Uploads an object within the write limits. GCS writers only upload on Close, so a failed attempt can be retried from the start.
+func (s *googleBucketStore) putObject(path string, data []byte) error {
+	return runStoreOperation(s.ctx, opWrite, path, func(ctx context.Context) error {
+		w := s.bucketHandle.Object(path).NewWriter(ctx)
+		if _, err := w.Write(data); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
 }
 
 func (s *googleBucketStore) walk(f func(filename string) error) error {
 	errors := make([]error, 0)
-	it := s.bucketHandle.Objects(s.ctx, &storage.Query{Prefix: s.tiddlersDir})
-	p := iterator.NewPager(it, 100, "")
-	var wg sync.WaitGroup
-	for {
-		var objects []*storage.ObjectAttrs
-		log.Trace().Msg("calling p.NextPage()")
-		pageToken, err := p.NextPage(&objects)
-		if err != nil {
-			log.Panic().Err(err).Msg("error reading gcp bucket page")
-			// TODO: Handle error.
+	// list every page first, so a listing that times out can be retried without visiting objects twice
+	var pages [][]*storage.ObjectAttrs
+	err := runStoreOperation(s.ctx, opList, s.tiddlersDir, func(ctx context.Context) error {
+		pages = nil
+		it := s.bucketHandle.Objects(ctx, &storage.Query{Prefix: s.tiddlersDir})
+		p := iterator.NewPager(it, 100, "")
+		for {
+			var objects []*storage.ObjectAttrs
+			log.Trace().Msg("calling p.NextPage()")
+			pageToken, err := p.NextPage(&objects)
+			if err != nil {
+				return err
+			}
+			log.Trace().Int("len(objects)", len(objects)).Str("pageToken", pageToken).Msg("have objects")
+			pages = append(pages, objects)
+			if pageToken == "" {
+				return nil
+			}
 		}
-		log.Trace().Int("len(objects)", len(objects)).Str("pageToken", pageToken).Msg("have objects")
+	})
+	if err != nil {
+		log.Panic().Err(err).Msg("error reading gcp bucket page")
+		// TODO: Handle error.
+	}
+	var wg sync.WaitGroup
+	for _, objects := range pages {
 		wg.Add(1)
 		go func(entries []*storage.ObjectAttrs) {
 			defer wg.Done()
 			for _, entry := range entries {
-				if strings.HasPrefix(entry.Name, s.tiddlersDir) && isTiddlerFile(entry.Name) {
+				if strings.HasPrefix(entry.Name, s.tiddlersDir) && isTiddlerFile(strings.TrimPrefix(entry.Name, s.tiddlersDir)) {
 					log.Trace().Str("name", entry.Name).Msg("found a valid tiddler")
 					if err := f(entry.Name); err != nil {
 						errors = append(errors, err)
@@ -571,11 +1440,8 @@ func (s *googleBucketStore) walk(f func(filename string) error) error {
 				}
 			}
 		}(objects)
-		if pageToken == "" {
-			wg.Wait()
-			break
-		}
 	}
+	wg.Wait()
 
 	for _, err := range errors {
 		log.Error().Err(err).Msg("walk error")
@@ -585,79 +1451,318 @@ func (s *googleBucketStore) walk(f func(filename string) error) error {
 }
 
 func (s *googleBucketStore) ReadFile(path string) (io.ReadCloser, error) {
-	return s.newReader(filepath.Join(s.baseDir, path))
+	return s.newReader(s.layout.filePath(s.baseDir, path))
 }
 
 func (s *googleBucketStore) GetTiddler(title string) (Tiddler, error) {
-	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.tiddlerCache, s.newReader)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.foldedTitles, s.tiddlerCache, s.newReader)
 }
 
 func (s *googleBucketStore) GetAllTiddlers() ([]Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return getAllTiddlerFilesFromStore(s.tiddlerCache, s.newReader, s.walk)
 }
 
 func (s *googleBucketStore) WriteTiddler(t Tiddler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	log.Trace().Str("title", t["title"].(string)).Msg("googleBucketStore.WriteTiddler")
-	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
-		return s.bucketHandle.Object(path).NewWriter(s.ctx), nil
-	})
+	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.foldedTitles), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
+		return &bufferedObjectWriter{put: func(data []byte) error { return s.putObject(path, data) }}, nil
+	}, s.deleteObject)
 }
 
 func (s *googleBucketStore) DeleteTiddler(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title = resolveTitle(s.tiddlerToFile, s.foldedTitles, title)
 	log.Trace().Str("title", title).Str("filename", s.tiddlerToFile[title]).
 		Msg("googleBucketStore.Delete")
-	if err := s.bucketHandle.Object(s.tiddlerToFile[title]).Delete(s.ctx); err != nil {
+	err := runStoreOperation(s.ctx, opWrite, s.tiddlerToFile[title], func(ctx context.Context) error {
+		return s.bucketHandle.Object(s.tiddlerToFile[title]).Delete(ctx)
+	})
+	if err != nil {
 		return err
 	}
 	delete(s.tiddlerToFile, title)
+	s.foldedTitles.remove(title)
 	delete(s.tiddlerCache, title)
 	return nil
 }
 
+func (s *googleBucketStore) WriteFile(path string, data []byte) error {
+	return s.putObject(s.layout.filePath(s.baseDir, path), data)
+}
+
+func (s *googleBucketStore) DeleteFile(path string) error {
+	return s.deleteObject(s.layout.filePath(s.baseDir, path))
+}
+
+//Deletes an object within the write limits. An object that is already gone is not an error.
+func (s *googleBucketStore) deleteObject(key string) error {
+	return runStoreOperation(s.ctx, opWrite, key, func(ctx context.Context) error {
+		if err := s.bucketHandle.Object(key).Delete(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *googleBucketStore) FileModified(path string) (time.Time, error) {
+	var modified time.Time
+	key := s.layout.filePath(s.baseDir, path)
+	err := runStoreOperation(s.ctx, opRead, key, func(ctx context.Context) error {
+		attrs, err := s.bucketHandle.Object(key).Attrs(ctx)
+		if err != nil {
+			return err
+		}
+		modified = attrs.Updated
+		return nil
+	})
+	return modified, err
+}
+
+func (s *googleBucketStore) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *googleBucketStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *googleBucketStore) LastModified() (time.Time, error) {
+	var last time.Time
+	err := runStoreOperation(s.ctx, opList, s.tiddlersDir, func(ctx context.Context) error {
+		last = time.Time{}
+		it := s.bucketHandle.Objects(ctx, &storage.Query{Prefix: s.tiddlersDir})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if isTiddlerFile(strings.TrimPrefix(attrs.Name, s.tiddlersDir)) && attrs.Updated.After(last) {
+				last = attrs.Updated
+			}
+		}
+	})
+	return last, err
+}
+
+func (s *googleBucketStore) ListModified() (map[string]time.Time, error) {
+	var files map[string]time.Time
+	err := runStoreOperation(s.ctx, opList, s.tiddlersDir, func(ctx context.Context) error {
+		files = make(map[string]time.Time)
+		it := s.bucketHandle.Objects(ctx, &storage.Query{Prefix: s.tiddlersDir})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			files[attrs.Name] = attrs.Updated
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlerFileModTimes(files, s.tiddlersDir), nil
+}
+
+func (s *googleBucketStore) Reload() error {
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return nil
+}
+
+func (s *googleBucketStore) ReloadPaths(paths []string) ([]string, error) {
+	return reloadTiddlerPaths(paths, s.newReader, &s.mu, &s.tiddlerToFile, &s.foldedTitles, &s.tiddlerCache), nil
+}
+
+func (s *googleBucketStore) TiddlerPaths() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyTiddlerPaths(s.tiddlerToFile)
+}
+
+func (s *googleBucketStore) ListPaths() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listIndexedPaths(s.tiddlerToFile, s.baseDir)
+}
+
+//Closes the storage client, which the store cannot be used after
+func (s *googleBucketStore) Close() error {
+	return s.client.Close()
+}
+
+//Object stores have no folders to leave empty
+func (s *googleBucketStore) Compact() (CompactReport, error) {
+	return CompactReport{}, errors.New("Not yet implemented!")
+}
+
 //Creates wikis, templates and trash folders at the specified wiki_location if not existing.
+//Buckets have no folders to create, so this checks instead that the bucket can be written, for bad credentials or a wrong
+//bucket to stop the server at startup rather than fail its first write.
 func (s *googleBucketStore) CreateRequiredFolders(path string) error {
-	return errors.New("not yet implemented")
+	return probeBucket(bucketFolderPrefix(s.bucket, filepath.Join(path, "templates")), s.putObject, func(key string) error {
+		return runStoreOperation(s.ctx, opWrite, key, func(ctx context.Context) error {
+			return s.bucketHandle.Object(key).Delete(ctx)
+		})
+	})
 }
 
-//Returns the list of existing wikis
+//Returns the list of existing wikis, the folders directly under path. With a delimiter, each folder is listed once
+//as an object with only its Prefix set.
 func (s *googleBucketStore) GetWikiList(path string) ([]string, error) {
-	return nil, errors.New("not yet implemented")
+	prefix := bucketFolderPrefix(s.bucket, path)
+	wikiFolders := []string{}
+	err := runStoreOperation(s.ctx, opList, prefix, func(ctx context.Context) error {
+		wikiFolders = wikiFolders[:0]
+		it := s.bucketHandle.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if name := subfolderName(prefix, attrs.Prefix); name != "" {
+				wikiFolders = append(wikiFolders, name)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wikiFolders, nil
 }
 
-//Returns the list of existing wiki templates
+//Returns the list of existing wiki templates, each <name>.html object directly under path with the description in <name>.txt
 func (s *googleBucketStore) GetWikiTemplateList(path string) ([][]string, error) {
-	return nil, errors.New("not yet implemented")
+	prefix := bucketFolderPrefix(s.bucket, path)
+	keys, err := s.listKeys(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s: %w", prefix, err)
+	}
+	return bucketTemplateList(prefix, keys, s.newReader)
 }
 
 //Creates the wiki folder, tiddlers folder and copies the relevant template wiki file to the wiki folder
 func (s *googleBucketStore) CreateWikiFolder(wikiPath string, templateFilePath string) error {
-	return errors.New("not yet implemented")
+	return createBucketWikiFolder(bucketObjectKey(s.bucket, wikiPath), bucketObjectKey(s.bucket, templateFilePath), s.layout,
+		func(dst, src string) error {
+			return runStoreOperation(s.ctx, opWrite, dst, func(ctx context.Context) error {
+				_, err := s.bucketHandle.Object(dst).CopierFrom(s.bucketHandle.Object(src)).Run(ctx)
+				if errors.Is(err, storage.ErrObjectNotExist) {
+					return fmt.Errorf("template does not exist: %w", err)
+				}
+				return err
+			})
+		},
+		s.putObject)
 }
 
-//Recursively copies a folder. Used to move a wiki and its tiddlers to the trash folder
+//Returns the names of all the objects under prefix
+func (s *googleBucketStore) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := runStoreOperation(s.ctx, opList, prefix, func(ctx context.Context) error {
+		keys = keys[:0]
+		it := s.bucketHandle.Objects(ctx, &storage.Query{Prefix: prefix})
+		for {
+			attrs, err := it.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			keys = append(keys, attrs.Name)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+//Recursively copies a folder. Used to move a wiki and its tiddlers to the trash folder.
+//Each object under the source prefix is copied to the same name under the target prefix, numWorkers at a time.
 func (s *googleBucketStore) CopyFolder(srcPath string, targetPath string) error {
-	return errors.New("not yet implemented")
+	srcPrefix, targetPrefix := bucketFolderPrefix(s.bucket, srcPath), bucketFolderPrefix(s.bucket, targetPath)
+	if srcPrefix == "" || targetPrefix == "" {
+		return fmt.Errorf("will not copy %s to %s: not a folder of bucket %s", srcPath, targetPath, s.bucket)
+	}
+	keys, err := s.listKeys(srcPrefix)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %w", srcPrefix, err)
+	}
+	return forEachKey(keys, func(key string) error {
+		dst := targetPrefix + strings.TrimPrefix(key, srcPrefix)
+		err := runStoreOperation(s.ctx, opWrite, dst, func(ctx context.Context) error {
+			_, err := s.bucketHandle.Object(dst).CopierFrom(s.bucketHandle.Object(key)).Run(ctx)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("could not copy %s to %s: %w", key, dst, err)
+		}
+		return nil
+	})
 }
 
 //Recursively deletes a folder and its contents. Used to remove a wiki folder from wikis after copying to trash.
+//The objects are deleted numWorkers at a time. An object already gone, e.g. deleted by a retried request, is not an error.
 func (s *googleBucketStore) DeleteFolder(path string) error {
-	return errors.New("not yet implemented")
+	prefix := bucketFolderPrefix(s.bucket, path)
+	if prefix == "" {
+		return fmt.Errorf("will not delete %s: not a folder of bucket %s", path, s.bucket)
+	}
+	keys, err := s.listKeys(prefix)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %w", prefix, err)
+	}
+	return forEachKey(keys, func(key string) error {
+		err := runStoreOperation(s.ctx, opWrite, key, func(ctx context.Context) error {
+			if err := s.bucketHandle.Object(key).Delete(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("could not delete %s: %w", key, err)
+		}
+		return nil
+	})
 }
 
-func NewGoogleBucketStore(uri string, requireIndex bool) (TiddlerStore, error) {
+func NewGoogleBucketStore(uri string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
 	log.Info().Str("uri", uri).Msg("creating 'Google Cloud Storage' TiddlerStore")
 
 	var err error
 
 	s := new(googleBucketStore)
 	s.uri = uri
-	u, err := url.Parse(s.uri)
+	s.bucket, s.baseDir, err = parseBucketLocation(s.uri)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse the uri: %s", err)
+		return nil, err
 	}
-	s.bucket = u.Host
-	s.baseDir = u.Path[1:]
-	s.tiddlersDir = filepath.Join(s.baseDir, "tiddlers")
+	s.layout = layout.withDefaults()
+	s.tiddlersDir = filepath.Join(s.baseDir, s.layout.TiddlersDir)
 	log.Trace().Str("bucket", s.bucket).Str("tiddlersDir", s.tiddlersDir).Msg("parsed the uri")
 
 	s.ctx = context.Background()
@@ -675,6 +1780,7 @@ func NewGoogleBucketStore(uri string, requireIndex bool) (TiddlerStore, error) {
 			return nil, err
 		}
 		s.tiddlerToFile = index
+		s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
 		s.tiddlerCache = cache
 	}
 	return s, nil
@@ -683,15 +1789,27 @@ func NewGoogleBucketStore(uri string, requireIndex bool) (TiddlerStore, error) {
 // https://docs.aws.amazon.com/sdk-for-go/api/service/s3/
 type awsS3Store struct {
 	uri, bucket, baseDir, tiddlersDir string
+	layout                            StoreLayout
 	tiddlerToFile                     map[string]string
+	foldedTitles                      foldedTitles
 	tiddlerCache                      map[string]Tiddler
-	s3svc                             *s3.S3
+	mu                                sync.RWMutex //guards tiddlerToFile, foldedTitles, tiddlerCache and the tiddler objects against concurrent writes
+	s3svc                             s3iface.S3API
 }
 
 func (s *awsS3Store) newReader(path string) (io.ReadCloser, error) {
-	result, err := s.s3svc.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(path)})
+	var data []byte
+	err := runStoreOperation(context.Background(), opRead, path, func(ctx context.Context) error {
+		result, err := s.s3svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(path)})
+		if err != nil {
+			return err
+		}
+		defer result.Body.Close()
+		data, err = io.ReadAll(result.Body)
+		return err
+	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
@@ -709,17 +1827,22 @@ func (s *awsS3Store) newReader(path string) (io.ReadCloser, error) {
 		}
 
 		log.Warn().Str("path", path).Err(err).Msg("could not create tiddler reader")
-		return nil, fmt.Errorf("could not open object '%s': %s", path, err.Error())
+		return nil, fmt.Errorf("could not open object '%s': %w", path, err)
 	}
 
-	return result.Body, nil
+	return io.NopCloser(bytes.NewReader(data)), nil
 }
 
 func (s *awsS3Store) walk(f func(filename string) error) error {
 	errors := make([]error, 0)
-	result, err := s.s3svc.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(s.bucket)})
-	// Prefix: s.tiddlersDir})
+	var result *s3.ListObjectsV2Output
+	err := runStoreOperation(context.Background(), opList, s.tiddlersDir, func(ctx context.Context) error {
+		var err error
+		result, err = s.s3svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket)})
+		// Prefix: s.tiddlersDir})
+		return err
+	})
 	if err != nil {
 		// errors = append(errors, err)
 		log.Panic().Err(err).Msg("error reading s3 bucket objects")
@@ -728,7 +1851,7 @@ func (s *awsS3Store) walk(f func(filename string) error) error {
 	}
 
 	for _, obj := range result.Contents {
-		if strings.HasPrefix(*obj.Key, s.tiddlersDir) && isTiddlerFile(*obj.Key) {
+		if strings.HasPrefix(*obj.Key, s.tiddlersDir) && isTiddlerFile(strings.TrimPrefix(*obj.Key, s.tiddlersDir)) {
 			if err := f(*obj.Key); err != nil {
 				// errors = append(errors, err)
 				return nil
@@ -769,27 +1892,34 @@ func (s *awsS3Store) walk(f func(filename string) error) error {
 }
 
 func (s *awsS3Store) ReadFile(path string) (io.ReadCloser, error) {
-	return s.newReader(filepath.Join(s.baseDir, path))
+	return s.newReader(s.layout.filePath(s.baseDir, path))
 }
 
 func (s *awsS3Store) GetTiddler(title string) (Tiddler, error) {
-	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.tiddlerCache, s.newReader)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.foldedTitles, s.tiddlerCache, s.newReader)
 }
 
 func (s *awsS3Store) GetAllTiddlers() ([]Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return getAllTiddlerFilesFromStore(s.tiddlerCache, s.newReader, s.walk)
 }
 
 type s3ObjectWriteCloser struct {
 	bucket, key string
-	s3svc       *s3.S3
+	s3svc       s3iface.S3API
 }
 
 func (s s3ObjectWriteCloser) Write(p []byte) (int, error) {
-	_, err := s.s3svc.PutObject(&s3.PutObjectInput{
-		Body:   aws.ReadSeekCloser(bytes.NewReader(p)),
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.key),
+	err := runStoreOperation(context.Background(), opWrite, s.key, func(ctx context.Context) error {
+		_, err := s.s3svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Body:   aws.ReadSeekCloser(bytes.NewReader(p)),
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.key),
+		})
+		return err
 	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -808,19 +1938,27 @@ func (s s3ObjectWriteCloser) Close() error {
 }
 
 func (s *awsS3Store) WriteTiddler(t Tiddler) error {
-	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.foldedTitles), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
 		return s3ObjectWriteCloser{
 			bucket: s.bucket,
 			key:    path,
 			s3svc:  s.s3svc,
 		}, nil
-	})
+	}, s.deleteObject)
 }
 
 func (s *awsS3Store) DeleteTiddler(title string) error {
-	_, err := s.s3svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.tiddlerToFile[title]),
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title = resolveTitle(s.tiddlerToFile, s.foldedTitles, title)
+	err := runStoreOperation(context.Background(), opWrite, s.tiddlerToFile[title], func(ctx context.Context) error {
+		_, err := s.s3svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.tiddlerToFile[title]),
+		})
+		return err
 	})
 	if err != nil {
 		if aerr, ok := err.(awserr.Error); ok {
@@ -832,57 +1970,352 @@ func (s *awsS3Store) DeleteTiddler(title string) error {
 		return err
 	}
 	delete(s.tiddlerToFile, title)
+	s.foldedTitles.remove(title)
 	delete(s.tiddlerCache, title)
 	return nil
 }
 
-//Creates wikis, templates and trash folders at the specified wiki_location if not existing.
-func (s *awsS3Store) CreateRequiredFolders(path string) error {
-	return errors.New("Not yet implemented!")
+func (s *awsS3Store) WriteFile(path string, data []byte) error {
+	_, err := s3ObjectWriteCloser{
+		bucket: s.bucket,
+		key:    s.layout.filePath(s.baseDir, path),
+		s3svc:  s.s3svc,
+	}.Write(data)
+	return err
 }
 
-//Returns the list of existing wikis
-func (s *awsS3Store) GetWikiList(path string) ([]string, error) {
-	return nil, errors.New("Not yet implemented!")
+func (s *awsS3Store) DeleteFile(path string) error {
+	return s.deleteObject(s.layout.filePath(s.baseDir, path))
 }
 
-//Returns the list of existing wiki templates
-func (s *awsS3Store) GetWikiTemplateList(path string) ([][]string, error) {
-	return nil, errors.New("Not yet implemented!")
+//Deletes an object within the write limits. S3 does not fail for a key that is already gone.
+func (s *awsS3Store) deleteObject(key string) error {
+	return runStoreOperation(context.Background(), opWrite, key, func(ctx context.Context) error {
+		_, err := s.s3svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	})
 }
 
-//Creates the wiki folder, tiddlers folder and copies the relevant template wiki file to the wiki folder
-func (s *awsS3Store) CreateWikiFolder(wikiPath string, templateFilePath string) error {
-	return errors.New("Not yet implemented!")
+func (s *awsS3Store) FileModified(path string) (time.Time, error) {
+	var modified time.Time
+	key := s.layout.filePath(s.baseDir, path)
+	err := runStoreOperation(context.Background(), opRead, key, func(ctx context.Context) error {
+		result, err := s.s3svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key)})
+		if err != nil {
+			return err
+		}
+		modified = aws.TimeValue(result.LastModified)
+		return nil
+	})
+	//a HEAD request has no body to tell NoSuchKey, only its status
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+		return modified, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return modified, err
 }
 
-//Recursively copies a folder. Used to move a wiki and its tiddlers to the trash folder
+func (s *awsS3Store) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *awsS3Store) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *awsS3Store) LastModified() (time.Time, error) {
+	var last time.Time
+	err := runStoreOperation(context.Background(), opList, s.tiddlersDir, func(ctx context.Context) error {
+		last = time.Time{}
+		return s.s3svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.tiddlersDir),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				if isTiddlerFile(strings.TrimPrefix(aws.StringValue(obj.Key), s.tiddlersDir)) && obj.LastModified != nil && obj.LastModified.After(last) {
+					last = *obj.LastModified
+				}
+			}
+			return true
+		})
+	})
+	return last, err
+}
+
+func (s *awsS3Store) ListModified() (map[string]time.Time, error) {
+	var files map[string]time.Time
+	err := runStoreOperation(context.Background(), opList, s.tiddlersDir, func(ctx context.Context) error {
+		files = make(map[string]time.Time)
+		return s.s3svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(s.tiddlersDir),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				files[aws.StringValue(obj.Key)] = aws.TimeValue(obj.LastModified)
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlerFileModTimes(files, s.tiddlersDir), nil
+}
+
+func (s *awsS3Store) Reload() error {
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return nil
+}
+
+func (s *awsS3Store) ReloadPaths(paths []string) ([]string, error) {
+	return reloadTiddlerPaths(paths, s.newReader, &s.mu, &s.tiddlerToFile, &s.foldedTitles, &s.tiddlerCache), nil
+}
+
+func (s *awsS3Store) TiddlerPaths() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyTiddlerPaths(s.tiddlerToFile)
+}
+
+func (s *awsS3Store) ListPaths() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listIndexedPaths(s.tiddlerToFile, s.baseDir)
+}
+
+//Object stores have no folders to leave empty
+func (s *awsS3Store) Compact() (CompactReport, error) {
+	return CompactReport{}, errors.New("Not yet implemented!")
+}
+
+//Creates wikis, templates and trash folders at the specified wiki_location if not existing.
+//S3 has no folders to create, so this checks instead that the bucket can be written, for bad credentials or a wrong
+//bucket to stop the server at startup rather than fail its first write.
+func (s *awsS3Store) CreateRequiredFolders(path string) error {
+	putObject := func(key string, data []byte) error {
+		_, err := s3ObjectWriteCloser{bucket: s.bucket, key: key, s3svc: s.s3svc}.Write(data)
+		return err
+	}
+	return probeBucket(bucketFolderPrefix(s.bucket, filepath.Join(path, "templates")), putObject, func(key string) error {
+		return runStoreOperation(context.Background(), opWrite, key, func(ctx context.Context) error {
+			_, err := s.s3svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    aws.String(key),
+			})
+			return err
+		})
+	})
+}
+
+//Returns the list of existing wikis, the folders directly under path. Listing with a delimiter returns each folder once
+//as a common prefix, however many objects it holds.
+func (s *awsS3Store) GetWikiList(path string) ([]string, error) {
+	prefix := bucketFolderPrefix(s.bucket, path)
+	wikiFolders := []string{}
+	err := runStoreOperation(context.Background(), opList, prefix, func(ctx context.Context) error {
+		wikiFolders = wikiFolders[:0]
+		return s.s3svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:    aws.String(s.bucket),
+			Prefix:    aws.String(prefix),
+			Delimiter: aws.String("/"),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, p := range page.CommonPrefixes {
+				if name := subfolderName(prefix, aws.StringValue(p.Prefix)); name != "" {
+					wikiFolders = append(wikiFolders, name)
+				}
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wikiFolders, nil
+}
+
+//Returns the list of existing wiki templates, each <name>.html object directly under path with the description in <name>.txt
+func (s *awsS3Store) GetWikiTemplateList(path string) ([][]string, error) {
+	prefix := bucketFolderPrefix(s.bucket, path)
+	keys, err := s.listKeys(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s: %w", prefix, err)
+	}
+	return bucketTemplateList(prefix, keys, s.newReader)
+}
+
+//Copies the relevant template wiki file to the wiki folder. S3 has no folders, so nothing is created for the tiddlers:
+//the wiki's store writes them under its tiddlers prefix, which exists once the first one is written.
+func (s *awsS3Store) CreateWikiFolder(wikiPath string, templateFilePath string) error {
+	templateKey := bucketObjectKey(s.bucket, templateFilePath)
+	return createBucketWikiFolder(bucketObjectKey(s.bucket, wikiPath), templateKey, s.layout,
+		func(dst, src string) error {
+			return runStoreOperation(context.Background(), opWrite, dst, func(ctx context.Context) error {
+				_, err := s.s3svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+					Bucket:     aws.String(s.bucket),
+					CopySource: aws.String(url.PathEscape(s.bucket + "/" + src)),
+					Key:        aws.String(dst),
+				})
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+					return fmt.Errorf("template does not exist: %w", err)
+				}
+				return err
+			})
+		},
+		nil)
+}
+
+//Most keys S3 deletes in one DeleteObjects request
+const s3DeleteBatchSize = 1000
+
+//Returns the keys of all the objects under prefix, however many pages they are listed in
+func (s *awsS3Store) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := runStoreOperation(context.Background(), opList, prefix, func(ctx context.Context) error {
+		keys = keys[:0]
+		return s.s3svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(s.bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, obj := range page.Contents {
+				keys = append(keys, aws.StringValue(obj.Key))
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+//Recursively copies a folder. Used to move a wiki and its tiddlers to the trash folder.
+//S3 has no folders, so each object under the source prefix is copied to the same key under the target prefix.
 func (s *awsS3Store) CopyFolder(srcPath string, targetPath string) error {
-	return errors.New("Not yet implemented!")
+	srcPrefix, targetPrefix := bucketFolderPrefix(s.bucket, srcPath), bucketFolderPrefix(s.bucket, targetPath)
+	if srcPrefix == "" || targetPrefix == "" {
+		return fmt.Errorf("will not copy %s to %s: not a folder of bucket %s", srcPath, targetPath, s.bucket)
+	}
+	keys, err := s.listKeys(srcPrefix)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %w", srcPrefix, err)
+	}
+	failed := []string{}
+	for _, key := range keys {
+		dst := targetPrefix + strings.TrimPrefix(key, srcPrefix)
+		err := runStoreOperation(context.Background(), opWrite, dst, func(ctx context.Context) error {
+			_, err := s.s3svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+				Bucket:     aws.String(s.bucket),
+				CopySource: aws.String(url.PathEscape(s.bucket + "/" + key)),
+				Key:        aws.String(dst),
+			})
+			return err
+		})
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+	return objectErrors("copy", failed, len(keys))
 }
 
 //Recursively deletes a folder and its contents. Used to remove a wiki folder from wikis after copying to trash.
+//The objects are deleted in batches, and the objects S3 reports it could not delete are returned in the error.
 func (s *awsS3Store) DeleteFolder(path string) error {
-	return errors.New("Not yet implemented!")
+	prefix := bucketFolderPrefix(s.bucket, path)
+	if prefix == "" {
+		return fmt.Errorf("will not delete %s: not a folder of bucket %s", path, s.bucket)
+	}
+	keys, err := s.listKeys(prefix)
+	if err != nil {
+		return fmt.Errorf("could not list %s: %w", prefix, err)
+	}
+	failed := []string{}
+	for start := 0; start < len(keys); start += s3DeleteBatchSize {
+		end := start + s3DeleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		var result *s3.DeleteObjectsOutput
+		err := runStoreOperation(context.Background(), opWrite, prefix, func(ctx context.Context) error {
+			var err error
+			result, err = s.s3svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+				Bucket: aws.String(s.bucket),
+				Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+			})
+			return err
+		})
+		if err != nil {
+			for _, key := range keys[start:end] {
+				failed = append(failed, fmt.Sprintf("%s: %s", key, err))
+			}
+			continue
+		}
+		for _, e := range result.Errors {
+			failed = append(failed, fmt.Sprintf("%s: %s", aws.StringValue(e.Key), aws.StringValue(e.Message)))
+		}
+	}
+	return objectErrors("delete", failed, len(keys))
+}
+
+//Where an S3-compatible object store such as MinIO, Wasabi or Cloudflare R2 is reached instead of AWS
+type S3Endpoint struct {
+	URL            string //e.g. http://localhost:9000 for MinIO. Empty uses AWS
+	Region         string //overrides the region of the AWS configuration, which other providers need set (R2 uses auto)
+	ForcePathStyle bool   //address buckets as <endpoint>/<bucket> rather than <bucket>.<endpoint>, as MinIO needs
+}
+
+//The endpoint the S3 store uses, set from the server options
+var s3Endpoint S3Endpoint
+
+//Returns the session configuration for the endpoint, which leaves the AWS defaults (e.g. AWS_REGION) in place when it is the zero value
+func (e S3Endpoint) awsConfig() *aws.Config {
+	cfg := aws.NewConfig()
+	if e.URL != "" {
+		cfg = cfg.WithEndpoint(e.URL)
+	}
+	if e.Region != "" {
+		cfg = cfg.WithRegion(e.Region)
+	}
+	if e.ForcePathStyle {
+		cfg = cfg.WithS3ForcePathStyle(true)
+	}
+	return cfg
 }
 
-func NewAwsS3Store(uri string, requireIndex bool) (TiddlerStore, error) {
+func NewAwsS3Store(uri string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
 	log.Info().Str("uri", uri).Msg("creating 'AWS S3' TiddlerStore")
 
 	var err error
 
 	s := new(awsS3Store)
 	s.uri = uri
-	u, err := url.Parse(s.uri)
+	s.bucket, s.baseDir, err = parseBucketLocation(s.uri)
 	if err != nil {
-		return nil, fmt.Errorf("could not parse the uri: %s", err)
+		return nil, err
 	}
-	s.bucket = u.Host
-	s.baseDir = u.Path[1:]
-	s.tiddlersDir = filepath.Join(s.baseDir, "tiddlers")
+	s.layout = layout.withDefaults()
+	s.tiddlersDir = filepath.Join(s.baseDir, s.layout.TiddlersDir)
 	log.Trace().Str("bucket", s.bucket).Str("tiddlersDir", s.tiddlersDir).Msg("parsed the uri")
 
-	sess := session.Must(session.NewSession())
+	sess, err := session.NewSession(s3Endpoint.awsConfig())
+	if err != nil {
+		return nil, err
+	}
 	s.s3svc = s3.New(sess)
 
 	if requireIndex { //Index not required for Store that will solely manage wikis, templates and trash folders
@@ -892,7 +2325,1238 @@ func NewAwsS3Store(uri string, requireIndex bool) (TiddlerStore, error) {
 			return nil, err
 		}
 		s.tiddlerToFile = index
+		s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
 		s.tiddlerCache = cache
 	}
 	return s, nil
 }
+
+//An object listed in an Azure container: a blob, or a virtual folder when listing with a delimiter
+type azureBlobItem struct {
+	Name         string
+	LastModified time.Time
+	IsPrefix     bool
+}
+
+//The blob operations the Azure store uses, so it can be tested without an Azure account
+type azureBlobAPI interface {
+	Download(ctx context.Context, key string) ([]byte, error)
+	Upload(ctx context.Context, key string, data []byte) error
+	Delete(ctx context.Context, key string) error
+	List(ctx context.Context, prefix string, delimiter string, f func(item azureBlobItem)) error
+}
+
+//azureBlobAPI on a container of the Azure SDK's client
+type azureContainer struct {
+	client    *azblob.Client
+	container string
+}
+
+func (c azureContainer) Download(ctx context.Context, key string) ([]byte, error) {
+	resp, err := c.client.DownloadStream(ctx, c.container, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (c azureContainer) Upload(ctx context.Context, key string, data []byte) error {
+	_, err := c.client.UploadBuffer(ctx, c.container, key, data, nil)
+	return err
+}
+
+func (c azureContainer) Delete(ctx context.Context, key string) error {
+	_, err := c.client.DeleteBlob(ctx, c.container, key, nil)
+	return err
+}
+
+//Lists every blob under prefix or, with a delimiter, the blobs and virtual folders directly under it
+func (c azureContainer) List(ctx context.Context, prefix string, delimiter string, f func(item azureBlobItem)) error {
+	visit := func(blobs []*container.BlobItem) {
+		for _, blob := range blobs {
+			item := azureBlobItem{Name: *blob.Name}
+			if blob.Properties != nil && blob.Properties.LastModified != nil {
+				item.LastModified = *blob.Properties.LastModified
+			}
+			f(item)
+		}
+	}
+	if delimiter == "" {
+		pager := c.client.NewListBlobsFlatPager(c.container, &azblob.ListBlobsFlatOptions{Prefix: &prefix})
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			if err != nil {
+				return err
+			}
+			visit(page.Segment.BlobItems)
+		}
+		return nil
+	}
+	pager := c.client.ServiceClient().NewContainerClient(c.container).NewListBlobsHierarchyPager(delimiter, &container.ListBlobsHierarchyOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range page.Segment.BlobPrefixes {
+			f(azureBlobItem{Name: *p.Name, IsPrefix: true})
+		}
+		visit(page.Segment.BlobItems)
+	}
+	return nil
+}
+
+// https://learn.microsoft.com/en-us/azure/storage/blobs/storage-quickstart-blobs-go
+type azureBlobStore struct {
+	uri, container, baseDir, tiddlersDir string
+	layout                               StoreLayout
+	tiddlerToFile                        map[string]string
+	foldedTitles                         foldedTitles
+	tiddlerCache                         map[string]Tiddler
+	mu                                   sync.RWMutex //guards tiddlerToFile, foldedTitles, tiddlerCache and the tiddler blobs against concurrent writes
+	blobs                                azureBlobAPI
+}
+
+func (s *azureBlobStore) newReader(path string) (io.ReadCloser, error) {
+	var data []byte
+	err := runStoreOperation(context.Background(), opRead, path, func(ctx context.Context) error {
+		var err error
+		data, err = s.blobs.Download(ctx, path)
+		return err
+	})
+	if err != nil {
+		log.Warn().Str("path", path).Err(err).Msg("could not create tiddler reader")
+		return nil, fmt.Errorf("could not open blob '%s': %w", path, err)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+//Uploads a blob within the write limits
+func (s *azureBlobStore) putObject(path string, data []byte) error {
+	return runStoreOperation(context.Background(), opWrite, path, func(ctx context.Context) error {
+		return s.blobs.Upload(ctx, path, data)
+	})
+}
+
+//Returns the names of all the blobs under prefix
+func (s *azureBlobStore) listKeys(prefix string) ([]string, error) {
+	keys := []string{}
+	err := runStoreOperation(context.Background(), opList, prefix, func(ctx context.Context) error {
+		keys = keys[:0]
+		return s.blobs.List(ctx, prefix, "", func(item azureBlobItem) {
+			keys = append(keys, item.Name)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *azureBlobStore) walk(f func(filename string) error) error {
+	keys, err := s.listKeys(s.tiddlersDir + "/")
+	if err != nil {
+		log.Error().Err(err).Msg("error listing azure blobs")
+		return err
+	}
+	for _, key := range keys {
+		if !isTiddlerFile(strings.TrimPrefix(key, s.tiddlersDir)) {
+			continue
+		}
+		if err := f(key); err != nil {
+			log.Error().Err(err).Str("key", key).Msg("walk error")
+		}
+	}
+	return nil
+}
+
+func (s *azureBlobStore) ReadFile(path string) (io.ReadCloser, error) {
+	return s.newReader(filepath.ToSlash(s.layout.filePath(s.baseDir, path)))
+}
+
+func (s *azureBlobStore) GetTiddler(title string) (Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.foldedTitles, s.tiddlerCache, s.newReader)
+}
+
+func (s *azureBlobStore) GetAllTiddlers() ([]Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getAllTiddlerFilesFromStore(s.tiddlerCache, s.newReader, s.walk)
+}
+
+func (s *azureBlobStore) WriteTiddler(t Tiddler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.foldedTitles), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
+		return &bufferedObjectWriter{put: func(data []byte) error {
+			return s.putObject(filepath.ToSlash(path), data)
+		}}, nil
+	}, func(path string) error {
+		return s.deleteObject(filepath.ToSlash(path))
+	})
+}
+
+func (s *azureBlobStore) DeleteTiddler(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title = resolveTitle(s.tiddlerToFile, s.foldedTitles, title)
+	err := runStoreOperation(context.Background(), opWrite, s.tiddlerToFile[title], func(ctx context.Context) error {
+		err := s.blobs.Delete(ctx, s.tiddlerToFile[title])
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return nil //already deleted by an earlier attempt
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	delete(s.tiddlerToFile, title)
+	s.foldedTitles.remove(title)
+	delete(s.tiddlerCache, title)
+	return nil
+}
+
+func (s *azureBlobStore) WriteFile(path string, data []byte) error {
+	return s.putObject(filepath.ToSlash(s.layout.filePath(s.baseDir, path)), data)
+}
+
+func (s *azureBlobStore) DeleteFile(path string) error {
+	return s.deleteObject(filepath.ToSlash(s.layout.filePath(s.baseDir, path)))
+}
+
+//Deletes a blob within the write limits. A blob that is already gone is not an error.
+func (s *azureBlobStore) deleteObject(key string) error {
+	return runStoreOperation(context.Background(), opWrite, key, func(ctx context.Context) error {
+		if err := s.blobs.Delete(ctx, key); !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *azureBlobStore) FileModified(path string) (time.Time, error) {
+	var (
+		modified time.Time
+		found    bool
+	)
+	key := filepath.ToSlash(s.layout.filePath(s.baseDir, path))
+	err := runStoreOperation(context.Background(), opRead, key, func(ctx context.Context) error {
+		return s.blobs.List(ctx, key, "", func(item azureBlobItem) {
+			if item.Name == key {
+				modified, found = item.LastModified, true
+			}
+		})
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return modified, err
+}
+
+func (s *azureBlobStore) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *azureBlobStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *azureBlobStore) LastModified() (time.Time, error) {
+	var last time.Time
+	err := runStoreOperation(context.Background(), opList, s.tiddlersDir, func(ctx context.Context) error {
+		last = time.Time{}
+		return s.blobs.List(ctx, s.tiddlersDir+"/", "", func(item azureBlobItem) {
+			if isTiddlerFile(strings.TrimPrefix(item.Name, s.tiddlersDir)) && item.LastModified.After(last) {
+				last = item.LastModified
+			}
+		})
+	})
+	return last, err
+}
+
+func (s *azureBlobStore) ListModified() (map[string]time.Time, error) {
+	var files map[string]time.Time
+	err := runStoreOperation(context.Background(), opList, s.tiddlersDir, func(ctx context.Context) error {
+		files = make(map[string]time.Time)
+		return s.blobs.List(ctx, s.tiddlersDir+"/", "", func(item azureBlobItem) {
+			files[item.Name] = item.LastModified
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiddlerFileModTimes(files, s.tiddlersDir), nil
+}
+
+func (s *azureBlobStore) Reload() error {
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return nil
+}
+
+func (s *azureBlobStore) ReloadPaths(paths []string) ([]string, error) {
+	return reloadTiddlerPaths(paths, s.newReader, &s.mu, &s.tiddlerToFile, &s.foldedTitles, &s.tiddlerCache), nil
+}
+
+func (s *azureBlobStore) TiddlerPaths() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyTiddlerPaths(s.tiddlerToFile)
+}
+
+func (s *azureBlobStore) ListPaths() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listIndexedPaths(s.tiddlerToFile, s.baseDir)
+}
+
+//Object stores have no folders to leave empty
+func (s *azureBlobStore) Compact() (CompactReport, error) {
+	return CompactReport{}, errors.New("Not yet implemented!")
+}
+
+//Containers have no folders to create, so this checks instead that the container can be written, for bad credentials or a
+//wrong container to stop the server at startup rather than fail its first write.
+func (s *azureBlobStore) CreateRequiredFolders(path string) error {
+	return probeBucket(bucketFolderPrefix(s.container, filepath.Join(path, "templates")), s.putObject, func(key string) error {
+		return runStoreOperation(context.Background(), opWrite, key, func(ctx context.Context) error {
+			return s.blobs.Delete(ctx, key)
+		})
+	})
+}
+
+//Returns the list of existing wikis, the virtual folders directly under path
+func (s *azureBlobStore) GetWikiList(path string) ([]string, error) {
+	prefix := bucketFolderPrefix(s.container, path)
+	wikiFolders := []string{}
+	err := runStoreOperation(context.Background(), opList, prefix, func(ctx context.Context) error {
+		wikiFolders = wikiFolders[:0]
+		return s.blobs.List(ctx, prefix, "/", func(item azureBlobItem) {
+			if name := subfolderName(prefix, item.Name); item.IsPrefix && name != "" {
+				wikiFolders = append(wikiFolders, name)
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wikiFolders, nil
+}
+
+//Returns the list of existing wiki templates, each <name>.html blob directly under path with the description in <name>.txt
+func (s *azureBlobStore) GetWikiTemplateList(path string) ([][]string, error) {
+	prefix := bucketFolderPrefix(s.container, path)
+	keys, err := s.listKeys(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list %s: %w", prefix, err)
+	}
+	return bucketTemplateList(prefix, keys, s.newReader)
+}
+
+//Creates the wiki folder, tiddlers folder and copies the relevant template wiki file to the wiki folder
+func (s *azureBlobStore) CreateWikiFolder(wikiPath string, templateFilePath string) error {
+	return errors.New("Not yet implemented!")
+}
+
+//Recursively copies a folder. Used to move a wiki and its tiddlers to the trash folder
+func (s *azureBlobStore) CopyFolder(srcPath string, targetPath string) error {
+	return errors.New("Not yet implemented!")
+}
+
+//Recursively deletes a folder and its contents. Used to remove a wiki folder from wikis after copying to trash.
+func (s *azureBlobStore) DeleteFolder(path string) error {
+	return errors.New("Not yet implemented!")
+}
+
+//Creates a client for the storage account from the standard Azure environment variables: AZURE_STORAGE_CONNECTION_STRING,
+//or AZURE_STORAGE_ACCOUNT with its key in AZURE_STORAGE_KEY.
+func newAzureClientFromEnv() (*azblob.Client, error) {
+	if connectionString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connectionString != "" {
+		return azblob.NewClientFromConnectionString(connectionString, nil)
+	}
+	account, key := os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY")
+	if account == "" || key == "" {
+		return nil, errors.New("set AZURE_STORAGE_CONNECTION_STRING, or AZURE_STORAGE_ACCOUNT and AZURE_STORAGE_KEY, to use Azure Blob Storage")
+	}
+	cred, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, err
+	}
+	return azblob.NewClientWithSharedKeyCredential(fmt.Sprintf("https://%s.blob.core.windows.net/", account), cred, nil)
+}
+
+func NewAzureBlobStore(uri string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+	log.Info().Str("uri", uri).Msg("creating 'Azure Blob Storage' TiddlerStore")
+
+	var err error
+
+	s := new(azureBlobStore)
+	s.uri = uri
+	s.container, s.baseDir, err = parseBucketLocation(s.uri)
+	if err != nil {
+		return nil, err
+	}
+	s.layout = layout.withDefaults()
+	s.tiddlersDir = filepath.ToSlash(filepath.Join(s.baseDir, s.layout.TiddlersDir))
+	log.Trace().Str("container", s.container).Str("tiddlersDir", s.tiddlersDir).Msg("parsed the uri")
+
+	client, err := newAzureClientFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s.blobs = azureContainer{client: client, container: s.container}
+
+	if requireIndex { //Index not required for Store that will solely manage wikis, templates and trash folders
+		index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+		if err != nil {
+			return nil, err
+		}
+		s.tiddlerToFile = index
+		s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+		s.tiddlerCache = cache
+	}
+	return s, nil
+}
+
+//A file of an in-memory store, holding the bytes a file store would write to disk
+type memoryFile struct {
+	data     []byte
+	modified time.Time
+}
+
+//A folder of an in-memory store. Modified changes when a file or folder directly in it is added or removed, as a directory's
+//modification time does.
+type memoryFolder struct {
+	folders  map[string]*memoryFolder
+	files    map[string]memoryFile
+	modified time.Time
+}
+
+func newMemoryFolder() *memoryFolder {
+	return &memoryFolder{folders: map[string]*memoryFolder{}, files: map[string]memoryFile{}, modified: time.Now()}
+}
+
+//Copies the folder and everything in it
+func (f *memoryFolder) clone() *memoryFolder {
+	c := newMemoryFolder()
+	for name, file := range f.files {
+		c.files[name] = file
+	}
+	for name, folder := range f.folders {
+		c.folders[name] = folder.clone()
+	}
+	return c
+}
+
+//The folders of an in-memory server. The server's store and the store of each wiki share one tree, so a wiki created by
+//the server's store can be opened by the store of the wiki.
+type memoryTree struct {
+	mu   sync.RWMutex
+	root *memoryFolder
+}
+
+func newMemoryTree() *memoryTree {
+	return &memoryTree{root: newMemoryFolder()}
+}
+
+//Splits a path into the names of its folders and file. An empty path, . and / are the root.
+func memoryPathNames(p string) []string {
+	p = strings.Trim(path.Clean(filepath.ToSlash(p)), "/")
+	if p == "" || p == "." {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+//Returns the folder at the path, creating missing folders when create is true. It is nil when a folder is missing and create is false.
+func (t *memoryTree) folder(names []string, create bool) *memoryFolder {
+	f := t.root
+	for _, name := range names {
+		next, ok := f.folders[name]
+		if !ok {
+			if !create {
+				return nil
+			}
+			next = newMemoryFolder()
+			f.folders[name] = next
+			f.modified = time.Now()
+		}
+		f = next
+	}
+	return f
+}
+
+func (t *memoryTree) readFile(p string) ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := memoryPathNames(p)
+	if len(names) > 0 {
+		if f := t.folder(names[:len(names)-1], false); f != nil {
+			if file, ok := f.files[names[len(names)-1]]; ok {
+				return file.data, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+}
+
+//Writes a file, creating the folders it is in
+func (t *memoryTree) fileModified(p string) (time.Time, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := memoryPathNames(p)
+	if len(names) > 0 {
+		if f := t.folder(names[:len(names)-1], false); f != nil {
+			if file, ok := f.files[names[len(names)-1]]; ok {
+				return file.modified, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+}
+
+func (t *memoryTree) writeFile(p string, data []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := memoryPathNames(p)
+	if len(names) == 0 {
+		return fmt.Errorf("%s is a folder", p)
+	}
+	f := t.folder(names[:len(names)-1], true)
+	name := names[len(names)-1]
+	if _, ok := f.folders[name]; ok {
+		return fmt.Errorf("%s is a folder", p)
+	}
+	now := time.Now()
+	if _, ok := f.files[name]; !ok {
+		f.modified = now
+	}
+	f.files[name] = memoryFile{data: append([]byte(nil), data...), modified: now}
+	return nil
+}
+
+//Removes a file
+func (t *memoryTree) remove(p string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := memoryPathNames(p)
+	if len(names) > 0 {
+		if f := t.folder(names[:len(names)-1], false); f != nil {
+			if _, ok := f.files[names[len(names)-1]]; ok {
+				delete(f.files, names[len(names)-1])
+				f.modified = time.Now()
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+}
+
+//Removes a file or a folder and everything in it. A missing path is not an error, as with os.RemoveAll.
+func (t *memoryTree) removeAll(p string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := memoryPathNames(p)
+	if len(names) == 0 {
+		t.root = newMemoryFolder()
+		return nil
+	}
+	f := t.folder(names[:len(names)-1], false)
+	if f == nil {
+		return nil
+	}
+	delete(f.files, names[len(names)-1])
+	delete(f.folders, names[len(names)-1])
+	f.modified = time.Now()
+	return nil
+}
+
+//Creates a folder and the folders it is in, failing if it exists already as os.Mkdir does
+func (t *memoryTree) mkdir(p string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.folder(memoryPathNames(p), false) != nil {
+		return fmt.Errorf("%s: %w", p, fs.ErrExist)
+	}
+	t.folder(memoryPathNames(p), true)
+	return nil
+}
+
+//Copies the folder at src to dst, adding to what is in dst already
+func (t *memoryTree) copyFolder(src, dst string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	from := t.folder(memoryPathNames(src), false)
+	if from == nil {
+		return fmt.Errorf("%s: %w", src, fs.ErrNotExist)
+	}
+	from = from.clone()
+	to := t.folder(memoryPathNames(dst), true)
+	for name, file := range from.files {
+		to.files[name] = file
+	}
+	for name, folder := range from.folders {
+		to.folders[name] = folder
+	}
+	to.modified = time.Now()
+	return nil
+}
+
+//Returns the names of the folders and files directly in a folder, sorted. A missing folder is an error wrapping fs.ErrNotExist.
+func (t *memoryTree) list(p string) (folders []string, files []string, err error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	f := t.folder(memoryPathNames(p), false)
+	if f == nil {
+		return nil, nil, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+	}
+	folders, files = []string{}, []string{}
+	for name := range f.folders {
+		folders = append(folders, name)
+	}
+	for name := range f.files {
+		files = append(files, name)
+	}
+	sort.Strings(folders)
+	sort.Strings(files)
+	return folders, files, nil
+}
+
+//Calls f with the path of each file under a folder and its subfolders, and with each of the folders, in no particular order
+func (t *memoryTree) walk(p string, f func(path string, folder *memoryFolder, file *memoryFile)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var visit func(dir string, folder *memoryFolder)
+	visit = func(dir string, folder *memoryFolder) {
+		f(dir, folder, nil)
+		for name, file := range folder.files {
+			file := file
+			f(path.Join(dir, name), nil, &file)
+		}
+		for name, sub := range folder.folders {
+			visit(path.Join(dir, name), sub)
+		}
+	}
+	if folder := t.folder(memoryPathNames(p), false); folder != nil {
+		visit(path.Clean(filepath.ToSlash(p)), folder)
+	}
+}
+
+//A store kept in memory, for demos and for tests that want the real handlers without touching disk. Tiddlers are kept as the
+//.tid and .meta files a file store would write, so exports, folder copies and the trash work as they do on disk.
+type memoryStore struct {
+	baseDir, tiddlersDir string
+	layout               StoreLayout
+	tiddlerToFile        map[string]string
+	foldedTitles         foldedTitles
+	tiddlerCache         map[string]Tiddler
+	mu                   sync.RWMutex //guards tiddlerToFile, foldedTitles and tiddlerCache against concurrent writes
+	tree                 *memoryTree
+}
+
+func (s *memoryStore) newReader(path string) (io.ReadCloser, error) {
+	data, err := s.tree.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStore) walk(f func(filename string) error) error {
+	paths := []string{}
+	s.tree.walk(s.tiddlersDir, func(p string, folder *memoryFolder, file *memoryFile) {
+		if file != nil && isTiddlerFile(strings.TrimPrefix(p, filepath.ToSlash(s.tiddlersDir))) {
+			paths = append(paths, p)
+		}
+	})
+	for _, p := range paths {
+		if err := f(p); err != nil {
+			log.Error().Err(err).Str("path", p).Msg("walk error")
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) ReadFile(path string) (io.ReadCloser, error) {
+	return s.newReader(s.layout.filePath(s.baseDir, path))
+}
+
+func (s *memoryStore) GetTiddler(title string) (Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getTiddlerFileFromStore(title, s.tiddlersDir, s.tiddlerToFile, s.foldedTitles, s.tiddlerCache, s.newReader)
+}
+
+func (s *memoryStore) GetAllTiddlers() ([]Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return getAllTiddlerFilesFromStore(s.tiddlerCache, s.newReader, s.walk)
+}
+
+func (s *memoryStore) WriteTiddler(t Tiddler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return writeTiddlerToWriter(t, s.tiddlersDir, &(s.tiddlerToFile), &(s.foldedTitles), &(s.tiddlerCache), func(path string) (io.WriteCloser, error) {
+		return &bufferedObjectWriter{put: func(data []byte) error {
+			return s.tree.writeFile(path, data)
+		}}, nil
+	}, s.removeFile)
+}
+
+func (s *memoryStore) DeleteTiddler(title string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	title = resolveTitle(s.tiddlerToFile, s.foldedTitles, title)
+	if err := s.tree.remove(s.tiddlerToFile[title]); err != nil {
+		return err
+	}
+	delete(s.tiddlerToFile, title)
+	s.foldedTitles.remove(title)
+	delete(s.tiddlerCache, title)
+	return nil
+}
+
+func (s *memoryStore) WriteFile(path string, data []byte) error {
+	return s.tree.writeFile(s.layout.filePath(s.baseDir, path), data)
+}
+
+func (s *memoryStore) DeleteFile(path string) error {
+	return s.removeFile(s.layout.filePath(s.baseDir, path))
+}
+
+//Removes a file from the tree, which is not an error when it is already gone
+func (s *memoryStore) removeFile(path string) error {
+	if err := s.tree.remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) FileModified(path string) (time.Time, error) {
+	return s.tree.fileModified(s.layout.filePath(s.baseDir, path))
+}
+
+func (s *memoryStore) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *memoryStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *memoryStore) LastModified() (time.Time, error) {
+	var last time.Time
+	s.tree.walk(s.tiddlersDir, func(p string, folder *memoryFolder, file *memoryFile) {
+		if folder != nil && folder.modified.After(last) {
+			last = folder.modified
+		}
+		if file != nil && isTiddlerFile(strings.TrimPrefix(p, filepath.ToSlash(s.tiddlersDir))) && file.modified.After(last) {
+			last = file.modified
+		}
+	})
+	return last, nil
+}
+
+func (s *memoryStore) ListModified() (map[string]time.Time, error) {
+	files := make(map[string]time.Time)
+	s.tree.walk(s.tiddlersDir, func(p string, folder *memoryFolder, file *memoryFile) {
+		if file != nil {
+			files[p] = file.modified
+		}
+	})
+	return tiddlerFileModTimes(files, filepath.ToSlash(s.tiddlersDir)), nil
+}
+
+func (s *memoryStore) Reload() error {
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return nil
+}
+
+func (s *memoryStore) ReloadPaths(paths []string) ([]string, error) {
+	return reloadTiddlerPaths(paths, s.newReader, &s.mu, &s.tiddlerToFile, &s.foldedTitles, &s.tiddlerCache), nil
+}
+
+func (s *memoryStore) TiddlerPaths() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyTiddlerPaths(s.tiddlerToFile)
+}
+
+func (s *memoryStore) ListPaths() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listIndexedPaths(s.tiddlerToFile, s.baseDir)
+}
+
+//Removes the .meta files whose companion file is gone and the folders left empty under the tiddlers folder, then rebuilds
+//the index and cache, as the file store does
+func (s *memoryStore) Compact() (CompactReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := CompactReport{EmptyDirs: []string{}, OrphanedMeta: []string{}}
+	rel := func(p string) string {
+		r, _ := filepath.Rel(s.tiddlersDir, p)
+		return r
+	}
+	s.tree.mu.Lock()
+	var compact func(dir string, folder *memoryFolder)
+	compact = func(dir string, folder *memoryFolder) {
+		for name := range folder.files {
+			if strings.HasSuffix(name, ".meta") {
+				if _, ok := folder.files[strings.TrimSuffix(name, ".meta")]; !ok {
+					delete(folder.files, name)
+					folder.modified = time.Now()
+					report.OrphanedMeta = append(report.OrphanedMeta, rel(path.Join(dir, name)))
+				}
+			}
+		}
+		for name, sub := range folder.folders {
+			compact(path.Join(dir, name), sub)
+			if len(sub.files) == 0 && len(sub.folders) == 0 {
+				delete(folder.folders, name)
+				folder.modified = time.Now()
+				report.EmptyDirs = append(report.EmptyDirs, rel(path.Join(dir, name)))
+			}
+		}
+	}
+	if folder := s.tree.folder(memoryPathNames(s.tiddlersDir), false); folder != nil {
+		compact(path.Clean(s.tiddlersDir), folder)
+	}
+	s.tree.mu.Unlock()
+	sort.Strings(report.EmptyDirs)
+	sort.Strings(report.OrphanedMeta)
+
+	index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+	if err != nil {
+		return report, err
+	}
+	s.tiddlerToFile = index
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = cache
+	return report, nil
+}
+
+//Create wikis, templates and trash folders in the indicated storage location if they do not exist
+func (s *memoryStore) CreateRequiredFolders(path string) error {
+	for _, name := range []string{"wikis", "templates", "trash"} {
+		if err := s.tree.mkdir(filepath.Join(path, name)); err != nil && !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) GetWikiList(path string) ([]string, error) {
+	folders, _, err := s.tree.list(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []string{}, nil
+	}
+	return folders, err
+}
+
+//Returns the list of existing wiki templates, each <name>.html file directly in path with the description in <name>.txt
+func (s *memoryStore) GetWikiTemplateList(path string) ([][]string, error) {
+	_, files, err := s.tree.list(path)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Join(memoryPathNames(path), "/") + "/"
+	keys := make([]string, len(files))
+	for i, file := range files {
+		keys[i] = prefix + file
+	}
+	return bucketTemplateList(prefix, keys, s.newReader)
+}
+
+//Creates the wiki folder, tiddlers folder and copies the relevant template wiki file to the wiki folder
+func (s *memoryStore) CreateWikiFolder(wikiPath string, templateFilePath string) error {
+	if err := s.tree.mkdir(wikiPath); err != nil {
+		return err
+	}
+	template, err := s.tree.readFile(templateFilePath)
+	if err != nil {
+		return err
+	}
+	if err := s.tree.writeFile(s.layout.filePath(wikiPath, "index.html"), template); err != nil {
+		return err
+	}
+	s.tree.mu.Lock()
+	defer s.tree.mu.Unlock()
+	s.tree.folder(memoryPathNames(filepath.Join(wikiPath, s.layout.TiddlersDir)), true)
+	return nil
+}
+
+func (s *memoryStore) CopyFolder(srcPath string, targetPath string) error {
+	return s.tree.copyFolder(srcPath, targetPath)
+}
+
+func (s *memoryStore) DeleteFolder(path string) error {
+	return s.tree.removeAll(path)
+}
+
+//Returns a store of one wiki kept in memory, with the tiddlers folder at its root, for tests that need a real store
+func NewMemoryStore() TiddlerStore {
+	s, _ := newMemoryStoreIn(newMemoryTree(), "", true, StoreLayout{})
+	return s
+}
+
+//Returns a function creating stores in a tree of folders they share, as NewHandlerSelector creates the store of each wiki
+func newMemoryStoreFunc() func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+	tree := newMemoryTree()
+	return func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+		return newMemoryStoreIn(tree, path, requireIndex, layout)
+	}
+}
+
+func newMemoryStoreIn(tree *memoryTree, dir string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+	log.Info().Str("dir", dir).Msg("creating 'memory' TiddlerStore")
+
+	s := new(memoryStore)
+	s.tree = tree
+	s.baseDir = dir
+	s.layout = layout.withDefaults()
+	s.tiddlersDir = filepath.Join(s.baseDir, s.layout.TiddlersDir)
+	s.tiddlerToFile = map[string]string{}
+	s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+	s.tiddlerCache = map[string]Tiddler{}
+
+	if requireIndex { //Index not required for Store that will solely manage wikis, templates and trash folders
+		index, cache, err := buildCacheAndIndex(s.walk, s.newReader)
+		if err != nil {
+			return nil, err
+		}
+		s.tiddlerToFile = index
+		s.foldedTitles = newFoldedTitles(s.tiddlerToFile)
+		s.tiddlerCache = cache
+	}
+	return s, nil
+}
+
+//Returned by the store operations a kind of store cannot do
+var errNotImplemented = errors.New("Not yet implemented!")
+
+//Returned by the writes of a store that mirrors another server
+var ErrReadOnlyStore = errors.New("store is read-only")
+
+//The title of the config tiddler telling TiddlyWiki where to sync, which a mirror points at itself
+const tiddlyWebHostTiddler = "$:/config/tiddlyweb/host"
+
+//A read-only mirror of a wiki served by another tiddlybucket or TiddlyWeb server. Its tiddlers are fetched through the
+//TiddlyWeb API, listed from recipes/default/tiddlers.json and read from recipes/default/tiddlers/<title>, and kept in
+//memory. Reload fetches again only those whose revision changed. Every write fails with ErrReadOnlyStore.
+type proxyStore struct {
+	upstream     string        //root of the wiki on the upstream server, e.g. https://wiki.example.com/notes
+	auth         *url.Userinfo //credentials of the upstream server, from the location
+	wiki         string        //name the wiki is served under, the last segment of the upstream's path
+	client       *http.Client
+	tiddlerCache map[string]Tiddler
+	foldedTitles foldedTitles
+	mu           sync.RWMutex //guards tiddlerCache and foldedTitles, which Reload replaces
+}
+
+//Returns a function creating the store of the one wiki mirrored from location, the http(s) URL of its root on the upstream
+//server. User info in the URL is sent to the upstream as basic authentication.
+func newProxyStoreFunc(location string) func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+	return func(path string, requireIndex bool, layout StoreLayout) (TiddlerStore, error) {
+		return newProxyStore(location, path, requireIndex)
+	}
+}
+
+func newProxyStore(location string, dir string, requireIndex bool) (*proxyStore, error) {
+	log.Info().Str("dir", dir).Msg("creating 'proxy' TiddlerStore")
+	upstream, err := url.Parse(strings.TrimSuffix(location, "/"))
+	if err != nil || (upstream.Scheme != "http" && upstream.Scheme != "https") || upstream.Host == "" {
+		return nil, fmt.Errorf("proxy location %q must be the http(s) URL of the upstream wiki", location)
+	}
+	s := &proxyStore{auth: upstream.User, client: &http.Client{}, tiddlerCache: map[string]Tiddler{}}
+	upstream.User = nil
+	s.upstream = upstream.String()
+	s.wiki = path.Base(upstream.Path)
+	if s.wiki == "." || s.wiki == "/" {
+		s.wiki = "wiki"
+	}
+
+	if requireIndex { //Index not required for Store that will solely manage wikis, templates and trash folders
+		if filepath.Base(dir) != s.wiki {
+			return nil, fmt.Errorf("%s only mirrors wiki %s", s.upstream, s.wiki)
+		}
+		if err := s.Reload(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+//Fetches a path under the upstream wiki's root. A path the upstream does not have is an error wrapping fs.ErrNotExist.
+func (s *proxyStore) fetch(p string) ([]byte, error) {
+	target := s.upstream + "/" + p
+	var data []byte
+	err := runStoreOperation(context.Background(), opRead, target, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+		if err != nil {
+			return err
+		}
+		if s.auth != nil {
+			password, _ := s.auth.Password()
+			req.SetBasicAuth(s.auth.Username(), password)
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return fmt.Errorf("%s: %w", target, fs.ErrNotExist)
+		case resp.StatusCode != http.StatusOK:
+			return fmt.Errorf("%s: %s", target, resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+		return err
+	})
+	return data, err
+}
+
+func (s *proxyStore) fetchSkinnyList() ([]Tiddler, error) {
+	data, err := s.fetch("recipes/default/tiddlers.json")
+	if err != nil {
+		return nil, err
+	}
+	var skinny []Tiddler
+	if err := json.Unmarshal(data, &skinny); err != nil {
+		return nil, fmt.Errorf("could not read the tiddler list of %s: %w", s.upstream, err)
+	}
+	return skinny, nil
+}
+
+//Reads the upstream's page as the index template, leaving out the tiddlers a tiddlybucket upstream injected into it so they
+//are not sent twice. Other files are read from the same path under the upstream wiki's root.
+func (s *proxyStore) ReadFile(p string) (io.ReadCloser, error) {
+	if p != "index.html" {
+		if strings.HasSuffix(p, ".gz") {
+			return nil, fmt.Errorf("%s: %w", p, fs.ErrNotExist)
+		}
+		segments := strings.Split(filepath.ToSlash(p), "/")
+		for i := range segments {
+			segments[i] = url.PathEscape(segments[i])
+		}
+		data, err := s.fetch(strings.Join(segments, "/"))
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	page, err := s.fetch("")
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(stripInjectedTiddlers(page))), nil
+}
+
+//Removes the tiddler store that tiddlybucket writes on its own lines right after the ordinary tiddlers marker, leaving the
+//template's own stores, which start their JSON on the line of the script tag
+func stripInjectedTiddlers(page []byte) []byte {
+	marker := []byte("<!--~~ Ordinary tiddlers ~~-->\n")
+	injected := []byte(`<script class="tiddlywiki-tiddler-store" type="application/json">` + "\n")
+	i := bytes.Index(page, marker)
+	if i < 0 || !bytes.HasPrefix(page[i+len(marker):], injected) {
+		return page
+	}
+	start := i + len(marker)
+	end := bytes.Index(page[start:], []byte("</script>\n"))
+	if end < 0 {
+		return page
+	}
+	return append(append([]byte{}, page[:start]...), page[start+end+len("</script>\n"):]...)
+}
+
+func (s *proxyStore) GetTiddler(title string) (Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if tid, ok := s.tiddlerCache[title]; ok {
+		return tid, nil
+	}
+	if caseInsensitiveTitles {
+		if tid, ok := s.tiddlerCache[s.foldedTitles[strings.ToLower(title)]]; ok {
+			return tid, nil
+		}
+	}
+	return nil, fmt.Errorf("tiddler %s: %w", title, fs.ErrNotExist)
+}
+
+func (s *proxyStore) GetAllTiddlers() ([]Tiddler, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tids := make([]Tiddler, 0, len(s.tiddlerCache))
+	for _, t := range s.tiddlerCache {
+		tids = append(tids, t)
+	}
+	return tids, nil
+}
+
+func (s *proxyStore) WriteTiddler(t Tiddler) error {
+	return ErrReadOnlyStore
+}
+
+func (s *proxyStore) DeleteTiddler(title string) error {
+	return ErrReadOnlyStore
+}
+
+func (s *proxyStore) WriteFile(path string, data []byte) error {
+	return ErrReadOnlyStore
+}
+
+func (s *proxyStore) DeleteFile(path string) error {
+	return ErrReadOnlyStore
+}
+
+//Returns the latest modified date in the upstream's tiddler list, fetching it again
+func (s *proxyStore) FileModified(path string) (time.Time, error) {
+	return time.Time{}, errNotImplemented
+}
+
+func (s *proxyStore) WriteTiddlerFile(path string, t Tiddler) error {
+	return writeTiddlerFile(s, path, t)
+}
+
+func (s *proxyStore) ReadTiddlerFile(path string) (Tiddler, error) {
+	return readTiddlerFileWithReadCloser(path, s.ReadFile)
+}
+
+func (s *proxyStore) LastModified() (time.Time, error) {
+	skinny, err := s.fetchSkinnyList()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var last time.Time
+	for _, tid := range skinny {
+		if modified, err := parseTiddlerTime(tid.Field("modified")); err == nil && modified.After(last) {
+			last = modified
+		}
+	}
+	return last, nil
+}
+
+//A mirror has no files to list, Reload fetches what changed upstream
+func (s *proxyStore) ListModified() (map[string]time.Time, error) {
+	return nil, errNotImplemented
+}
+
+func (s *proxyStore) ReloadPaths(paths []string) ([]string, error) {
+	return nil, errNotImplemented
+}
+
+//Fetches the upstream's tiddler list, then the tiddlers that are new or whose revision changed since they were last fetched
+func (s *proxyStore) Reload() error {
+	skinny, err := s.fetchSkinnyList()
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	previous := s.tiddlerCache
+	s.mu.RUnlock()
+
+	cache := make(map[string]Tiddler, len(skinny))
+	fetched := 0
+	for _, listed := range skinny {
+		title := listed.Field("title")
+		if title == "" {
+			continue
+		}
+		if tid, ok := previous[title]; ok && listed.Field("revision") != "" && tid.Field("revision") == listed.Field("revision") {
+			cache[title] = tid
+			continue
+		}
+		data, err := s.fetch("recipes/default/tiddlers/" + url.PathEscape(title))
+		if err != nil {
+			return fmt.Errorf("could not fetch tiddler %s from %s: %w", title, s.upstream, err)
+		}
+		tid := make(Tiddler)
+		if err := json.Unmarshal(data, &tid); err != nil {
+			return fmt.Errorf("could not read tiddler %s from %s: %w", title, s.upstream, err)
+		}
+		flattenTiddlyWebFormat(tid)
+		cache[title] = tid
+		fetched++
+	}
+	// the upstream's own sync config would send the mirror's visitors to the upstream
+	cache[tiddlyWebHostTiddler] = Tiddler{"title": tiddlyWebHostTiddler, "text": "$protocol$//$host$/" + s.wiki + "/"}
+	folded := make(foldedTitles, len(cache))
+	for title := range cache {
+		folded.add(title)
+	}
+
+	s.mu.Lock()
+	s.tiddlerCache = cache
+	s.foldedTitles = folded
+	s.mu.Unlock()
+	log.Info().Str("upstream", s.upstream).Int("tiddlers", len(cache)).Int("fetched", fetched).Msg("mirrored tiddlers")
+	return nil
+}
+
+//The tiddlers' paths on the upstream server
+func (s *proxyStore) TiddlerPaths() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	paths := make(map[string]string, len(s.tiddlerCache))
+	for title := range s.tiddlerCache {
+		paths[title] = "recipes/default/tiddlers/" + url.PathEscape(title)
+	}
+	return paths
+}
+
+func (s *proxyStore) ListPaths() ([]string, error) {
+	return nil, errors.New("Not yet implemented!")
+}
+
+func (s *proxyStore) Compact() (CompactReport, error) {
+	return CompactReport{}, ErrReadOnlyStore
+}
+
+//There is nothing to create for a mirror
+func (s *proxyStore) CreateRequiredFolders(path string) error {
+	return nil
+}
+
+//Lists the mirrored wiki as the only wiki. The templates and trash of a mirror are empty.
+func (s *proxyStore) GetWikiList(path string) ([]string, error) {
+	if filepath.Base(path) == "wikis" {
+		return []string{s.wiki}, nil
+	}
+	return []string{}, nil
+}
+
+func (s *proxyStore) GetWikiTemplateList(path string) ([][]string, error) {
+	return [][]string{}, nil
+}
+
+func (s *proxyStore) CreateWikiFolder(wikiPath string, templateFilePath string) error {
+	return ErrReadOnlyStore
+}
+
+func (s *proxyStore) CopyFolder(srcPath string, targetPath string) error {
+	return ErrReadOnlyStore
+}
+
+func (s *proxyStore) DeleteFolder(path string) error {
+	return ErrReadOnlyStore
+}
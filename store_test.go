@@ -2,13 +2,32 @@ package tiddlybucket
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/go-chi/chi/v5"
 )
 
 type closingBuffer struct {
@@ -38,13 +57,14 @@ func Test_writeTiddlerToWriter(t *testing.T) {
 			title := tt.args.t["title"].(string)
 			wantPath := filepath.Join(tt.args.tiddlersDir, tiddlerFilename(title))
 			gotFile := new(closingBuffer)
-			err := writeTiddlerToWriter(tt.args.t, tt.args.tiddlersDir, &tt.args.index, &tt.args.cache,
+			folded := newFoldedTitles(tt.args.index)
+			err := writeTiddlerToWriter(tt.args.t, tt.args.tiddlersDir, &tt.args.index, &folded, &tt.args.cache,
 				func(path string) (io.WriteCloser, error) {
 					if wantPath != path {
 						t.Errorf("writeTiddlerToWriter() path does not match expected = %s, want %s", wantPath, path)
 					}
 					return gotFile, nil
-				})
+				}, func(path string) error { return nil })
 			if (err != nil) != tt.wantErr {
 				t.Errorf("writeTiddlerToWriter() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -103,6 +123,97 @@ func Test_readTiddlerFileWithReadCloser(t *testing.T) {
 	}
 }
 
+func Test_readTiddlerFileWithReadCloser_missingType(t *testing.T) {
+	defer func(typ string) { defaultTiddlerType = typ }(defaultTiddlerType)
+	png := []byte("\x89PNG\r\n\x1a\n")
+	files := map[string][]byte{
+		"tiddlers/Logo.png.meta":  []byte("title: Logo\n"),
+		"tiddlers/Logo.png":       png,
+		"tiddlers/Notes.meta":     []byte("title: Notes\n"),
+		"tiddlers/Notes":          []byte("plain text"),
+		"tiddlers/Typed.png.meta": []byte("title: Typed\ntype: image/png\n"),
+		"tiddlers/Typed.png":      png,
+		"tiddlers/Untyped.tid":    []byte("title: Untyped\n\nhello"),
+		"tiddlers/Markdown.tid":   []byte("title: Markdown\ntype: text/x-markdown\n\nhello"),
+	}
+	reader := func(path string) (io.ReadCloser, error) {
+		b, ok := files[path]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	tests := []struct {
+		name        string
+		path        string
+		defaultType string
+		wantType    string
+		wantBinary  bool
+	}{
+		{"meta without type takes its content's", "tiddlers/Logo.png.meta", "", "image/png", true},
+		{"meta without type or extension", "tiddlers/Notes.meta", "", "text/plain", false},
+		{"meta with type", "tiddlers/Typed.png.meta", "", "image/png", true},
+		{"tid without type", "tiddlers/Untyped.tid", "", "text/vnd.tiddlywiki", false},
+		{"tid without type, configured", "tiddlers/Untyped.tid", "text/x-markdown", "text/x-markdown", false},
+		{"tid with type", "tiddlers/Markdown.tid", "text/plain", "text/x-markdown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defaultTiddlerType = "text/vnd.tiddlywiki"
+			if tt.defaultType != "" {
+				defaultTiddlerType = tt.defaultType
+			}
+			got, err := readTiddlerFileWithReadCloser(tt.path, reader)
+			if err != nil {
+				t.Fatalf("readTiddlerFileWithReadCloser() error = %v", err)
+			}
+			if got["type"] != tt.wantType {
+				t.Errorf("readTiddlerFileWithReadCloser() type = %v, want %s", got["type"], tt.wantType)
+			}
+			if _, binary := got["text"].([]byte); binary != tt.wantBinary {
+				t.Errorf("readTiddlerFileWithReadCloser() text = %T, want binary %v", got["text"], tt.wantBinary)
+			}
+		})
+	}
+}
+
+func Test_readTiddlerFileWithReadCloser_gzipped(t *testing.T) {
+	svg := `<svg xmlns="http://www.w3.org/2000/svg"/>`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(svg))
+	zw.Close()
+	files := map[string][]byte{
+		"tiddlers/icon.svg.gz.meta":   []byte("title: icon.svg\n"),
+		"tiddlers/icon.svg.gz":        gz.Bytes(),
+		"tiddlers/broken.svg.gz.meta": []byte("title: broken.svg\ntype: image/svg+xml\n"),
+		"tiddlers/broken.svg.gz":      []byte(svg),
+	}
+	reader := func(path string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(files[path])), nil
+	}
+
+	got, err := readTiddlerFileWithReadCloser("tiddlers/icon.svg.gz.meta", reader)
+	if err != nil {
+		t.Fatalf("readTiddlerFileWithReadCloser() error = %v", err)
+	}
+	if got["text"] != svg || got["type"] != "image/svg+xml" {
+		t.Errorf("readTiddlerFileWithReadCloser() text = %v, type = %v, want the inflated svg", got["text"], got["type"])
+	}
+	if stored, _ := got[gzippedContentField].([]byte); !bytes.Equal(stored, gz.Bytes()) {
+		t.Errorf("readTiddlerFileWithReadCloser() did not keep the gzipped content")
+	}
+	// the gzipped content is never written back
+	var buf bytes.Buffer
+	if err := (&TiddlerFile{got}).Write(&buf); err != nil || strings.Contains(buf.String(), gzippedContentField) {
+		t.Errorf("TiddlerFile.Write() = %q, %v, want no %s field", buf.String(), err, gzippedContentField)
+	}
+
+	if _, err := readTiddlerFileWithReadCloser("tiddlers/broken.svg.gz.meta", reader); err == nil {
+		t.Errorf("readTiddlerFileWithReadCloser() read content that is not gzipped")
+	}
+}
+
 // focused on testing that it reads from the cache when available
 func Test_getTiddlerFileFromStore(t *testing.T) {
 	dummyAsTid := getTestTiddlerJsonAsTid(t, "TestTiddler.json")
@@ -136,7 +247,7 @@ func Test_getTiddlerFileFromStore(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			wantPath := filepath.Join(tt.args.tiddlersDir, tiddlerFilename(tt.args.title))
-			gotTid, err := getTiddlerFileFromStore(tt.args.title, tt.args.tiddlersDir, tt.args.index, tt.args.cache,
+			gotTid, err := getTiddlerFileFromStore(tt.args.title, tt.args.tiddlersDir, tt.args.index, newFoldedTitles(tt.args.index), tt.args.cache,
 				func(path string) (io.ReadCloser, error) {
 					if wantPath != path {
 						t.Errorf("getTiddlerFileFromStore() path does not match expected = %s, want %s", wantPath, path)
@@ -259,3 +370,1471 @@ func Test_buildCacheAndIndex(t *testing.T) {
 		})
 	}
 }
+
+// run with -race to catch unsynchronized access to the store's index and cache
+func Test_fileStore_concurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tiddlers"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handlerWithStore{Store: store}
+
+	const numTiddlers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < numTiddlers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			title := fmt.Sprintf("Concurrent %d", i)
+			r := httptest.NewRequest(http.MethodPut, "http://foobar.com/recipes/default/tiddlers/"+url.PathEscape(title),
+				strings.NewReader(fmt.Sprintf(`{"title":%q,"text":"text %d"}`, title, i)))
+			r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey,
+				&chi.Context{URLParams: chi.RouteParams{Keys: []string{"recipe", "*"}, Values: []string{"default", url.PathEscape(title)}}}))
+			w := httptest.NewRecorder()
+			h.putTiddler(w, r)
+			if w.Code != http.StatusNoContent {
+				t.Errorf("putTiddler() unexpected status code = %d, want %d", w.Code, http.StatusNoContent)
+			}
+			if _, err := store.GetAllTiddlers(); err != nil {
+				t.Errorf("GetAllTiddlers() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	tids, err := store.GetAllTiddlers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tids) != numTiddlers {
+		t.Errorf("store has %d tiddlers, want %d", len(tids), numTiddlers)
+	}
+	for i := 0; i < numTiddlers; i++ {
+		title := fmt.Sprintf("Concurrent %d", i)
+		tid, err := store.GetTiddler(title)
+		if err != nil {
+			t.Errorf("GetTiddler(%s) error = %v", title, err)
+			continue
+		}
+		if tid.Field("text") != fmt.Sprintf("text %d", i) {
+			t.Errorf("GetTiddler(%s) text = %s", title, tid.Field("text"))
+		}
+	}
+	reread, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tids, _ := reread.GetAllTiddlers(); len(tids) != numTiddlers {
+		t.Errorf("tiddler files on disk = %d, want %d", len(tids), numTiddlers)
+	}
+}
+
+func Test_fileStore_longTitle(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "tiddlers"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	title := strings.Repeat("A very long title ", 25)
+	if filename := tiddlerFilename(title); len(filename) > maxTiddlerFilenameLength {
+		t.Fatalf("tiddlerFilename() length = %d, want at most %d", len(filename), maxTiddlerFilenameLength)
+	}
+	if tiddlerFilename(title) == tiddlerFilename(title+"!") {
+		t.Errorf("tiddlerFilename() should differ for titles sharing a long prefix")
+	}
+	func() {
+		defer func(n int) { maxTiddlerFilenameLength = n }(maxTiddlerFilenameLength)
+		maxTiddlerFilenameLength = minTiddlerFilenameLength
+		if filename := tiddlerFilename(title); len(filename) != minTiddlerFilenameLength {
+			t.Errorf("tiddlerFilename() length = %d at the shortest limit, want %d", len(filename), minTiddlerFilenameLength)
+		}
+	}()
+	if err := store.WriteTiddler(Tiddler{"title": title, "text": "long"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	tid, err := store.GetTiddler(title)
+	if err != nil {
+		t.Fatalf("GetTiddler() error = %v", err)
+	}
+	if tid.Field("text") != "long" {
+		t.Errorf("GetTiddler() text = %s, want long", tid.Field("text"))
+	}
+	reread, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tid, err := reread.GetTiddler(title); err != nil || tid.Field("text") != "long" {
+		t.Errorf("GetTiddler() after reload = %v, %v", tid, err)
+	}
+}
+
+func Test_buildCacheAndIndex_caseCollisions(t *testing.T) {
+	// simulates a case-insensitive filesystem that has ended up holding both spellings
+	files := map[string]string{
+		"tiddlers/MyNote.tid": "title: MyNote\nmodified: 20230101000000000\n\nolder",
+		"tiddlers/mynote.tid": "title: mynote\nmodified: 20230201000000000\n\nnewer",
+		"tiddlers/Other.tid":  "title: Other\n\nother",
+	}
+	reader := func(path string) (io.ReadCloser, error) {
+		content, ok := files[path]
+		if !ok {
+			return nil, fmt.Errorf("no such file: %s", path)
+		}
+		return io.NopCloser(strings.NewReader(content)), nil
+	}
+	walker := func(f func(path string) error) error {
+		for path := range files {
+			if err := f(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		wantTitles      []string
+		lookup          string
+		wantText        string
+	}{
+		{"case sensitive keeps both", false, []string{"MyNote", "Other", "mynote"}, "MyNote", "older"},
+		{"case insensitive keeps newest", true, []string{"Other", "mynote"}, "MYNOTE", "newer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caseInsensitiveTitles = tt.caseInsensitive
+			defer func() { caseInsensitiveTitles = false }()
+
+			index, cache, err := buildCacheAndIndex(walker, reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			titles := make([]string, 0, len(index))
+			for title := range index {
+				titles = append(titles, title)
+			}
+			sort.Strings(titles)
+			if !reflect.DeepEqual(titles, tt.wantTitles) {
+				t.Errorf("buildCacheAndIndex() titles = %v, want %v", titles, tt.wantTitles)
+			}
+			tid, err := getTiddlerFileFromStore(tt.lookup, "tiddlers", index, newFoldedTitles(index), cache, reader)
+			if err != nil {
+				t.Fatalf("getTiddlerFileFromStore(%s) error = %v", tt.lookup, err)
+			}
+			if tid.Field("text") != tt.wantText {
+				t.Errorf("getTiddlerFileFromStore(%s) text = %s, want %s", tt.lookup, tid.Field("text"), tt.wantText)
+			}
+		})
+	}
+}
+
+func Test_findCaseCollisions(t *testing.T) {
+	index := map[string]string{"MyNote": "a", "mynote": "b", "MYNOTE": "c", "Other": "d", "other2": "e"}
+	want := [][]string{{"MYNOTE", "MyNote", "mynote"}}
+	if got := findCaseCollisions(index); !reflect.DeepEqual(got, want) {
+		t.Errorf("findCaseCollisions() = %v, want %v", got, want)
+	}
+}
+
+func Test_writeTiddlerToWriter_caseInsensitive(t *testing.T) {
+	caseInsensitiveTitles = true
+	defer func() { caseInsensitiveTitles = false }()
+
+	index := map[string]string{"MyNote": "tiddlers/MyNote.tid"}
+	cache := map[string]Tiddler{"MyNote": {"title": "MyNote"}}
+	folded := newFoldedTitles(index)
+	var gotPath string
+	err := writeTiddlerToWriter(Tiddler{"title": "mynote", "text": "x"}, "tiddlers", &index, &folded, &cache, func(path string) (io.WriteCloser, error) {
+		gotPath = path
+		return &closingBuffer{}, nil
+	}, func(path string) error {
+		t.Errorf("writeTiddlerToWriter() removed %s", path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotPath != "tiddlers/MyNote.tid" {
+		t.Errorf("writeTiddlerToWriter() wrote to %s, want the existing file tiddlers/MyNote.tid", gotPath)
+	}
+	if _, ok := index["MyNote"]; ok {
+		t.Errorf("writeTiddlerToWriter() left the old spelling in the index")
+	}
+	if index["mynote"] != "tiddlers/MyNote.tid" {
+		t.Errorf("writeTiddlerToWriter() index = %v", index)
+	}
+	if want := (foldedTitles{"mynote": "mynote"}); !reflect.DeepEqual(folded, want) {
+		t.Errorf("writeTiddlerToWriter() folded titles = %v, want %v", folded, want)
+	}
+}
+
+func Test_resolveTitle(t *testing.T) {
+	index := map[string]string{"MyNote": "tiddlers/MyNote.tid", "Other": "tiddlers/Other.tid"}
+	folded := newFoldedTitles(index)
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		title           string
+		want            string
+	}{
+		{"indexed", true, "MyNote", "MyNote"},
+		{"differing by case", true, "MYNOTE", "MyNote"},
+		{"not indexed", true, "Missing", "Missing"},
+		{"case sensitive", false, "MYNOTE", "MYNOTE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caseInsensitiveTitles = tt.caseInsensitive
+			defer func() { caseInsensitiveTitles = false }()
+			if got := resolveTitle(index, folded, tt.title); got != tt.want {
+				t.Errorf("resolveTitle(%s) = %s, want %s", tt.title, got, tt.want)
+			}
+		})
+	}
+
+	folded.remove("Other")
+	folded.add("mynote")
+	folded.remove("MyNote")
+	if want := (foldedTitles{"mynote": "mynote"}); !reflect.DeepEqual(folded, want) {
+		t.Errorf("folded titles = %v, want %v", folded, want)
+	}
+}
+
+func Test_fileStore_LastModifiedAndReload(t *testing.T) {
+	dir := t.TempDir()
+	tiddlersDir := filepath.Join(dir, "tiddlers")
+	if err := os.Mkdir(tiddlersDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteTiddler(Tiddler{"title": "Note", "text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	before, err := store.LastModified()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.IsZero() {
+		t.Fatalf("LastModified() is zero after a write")
+	}
+
+	// another program adds a tiddler
+	external := filepath.Join(tiddlersDir, "External.tid")
+	if err := os.WriteFile(external, []byte("title: External\n\nfrom outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := before.Add(time.Minute)
+	if err := os.Chtimes(external, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if after, err := store.LastModified(); err != nil || !after.Equal(later) {
+		t.Errorf("LastModified() = %v, %v, want %v", after, err, later)
+	}
+	if modified, err := store.FileModified("tiddlers/External.tid"); err != nil || !modified.Equal(later) {
+		t.Errorf("FileModified() = %v, %v, want %v", modified, err, later)
+	}
+	if _, err := store.FileModified("index.html"); !isNotFound(err) {
+		t.Errorf("FileModified() of a missing file error = %v, want not found", err)
+	}
+	if tids, _ := store.GetAllTiddlers(); len(tids) != 1 {
+		t.Fatalf("GetAllTiddlers() = %d tiddlers before Reload(), want the 1 cached", len(tids))
+	}
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if tids, _ := store.GetAllTiddlers(); len(tids) != 2 {
+		t.Errorf("GetAllTiddlers() = %d tiddlers after Reload(), want 2", len(tids))
+	}
+	if tid, err := store.GetTiddler("External"); err != nil || tid.Field("text") != "from outside" {
+		t.Errorf("GetTiddler() after Reload() = %v, %v", tid, err)
+	}
+}
+
+func Test_runStoreOperation(t *testing.T) {
+	defer func(l StoreLimits) { storeLimits = l }(storeLimits)
+	storeLimits = StoreLimits{
+		Read:  OperationLimits{Timeout: time.Second, Retries: 0},
+		Write: OperationLimits{Timeout: 2 * time.Second, Retries: 1},
+		List:  OperationLimits{Timeout: time.Minute, Retries: 2},
+	}
+	tests := []struct {
+		name         string
+		op           storeOperation
+		failures     int
+		wantTimeout  time.Duration
+		wantAttempts int
+		wantErr      bool
+	}{
+		{"read", opRead, 0, time.Second, 1, false},
+		{"read not retried", opRead, 1, time.Second, 1, true},
+		{"write retried", opWrite, 1, 2 * time.Second, 2, false},
+		{"write gives up", opWrite, 2, 2 * time.Second, 2, true},
+		{"list", opList, 2, time.Minute, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := runStoreOperation(context.Background(), tt.op, "tiddlers/a.tid", func(ctx context.Context) error {
+				attempts++
+				deadline, ok := ctx.Deadline()
+				if !ok {
+					t.Fatalf("runStoreOperation() gave no deadline")
+				}
+				if timeout := time.Until(deadline); timeout > tt.wantTimeout || timeout < tt.wantTimeout-time.Second/2 {
+					t.Errorf("runStoreOperation() timeout = %v, want %v", timeout, tt.wantTimeout)
+				}
+				if attempts <= tt.failures {
+					return fmt.Errorf("simulated failure")
+				}
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("runStoreOperation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("runStoreOperation() attempts = %d, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func Test_runStoreOperation_noTimeout(t *testing.T) {
+	defer func(l StoreLimits) { storeLimits = l }(storeLimits)
+	storeLimits = StoreLimits{}
+	runStoreOperation(context.Background(), opList, "tiddlers", func(ctx context.Context) error {
+		if _, ok := ctx.Deadline(); ok {
+			t.Errorf("runStoreOperation() set a deadline without a timeout")
+		}
+		return nil
+	})
+}
+
+func Test_writeTiddlerToWriter_closeError(t *testing.T) {
+	index, folded, cache := map[string]string{}, foldedTitles{}, map[string]Tiddler{}
+	err := writeTiddlerToWriter(Tiddler{"title": "Note", "text": "hi"}, "tiddlers", &index, &folded, &cache, func(path string) (io.WriteCloser, error) {
+		return &bufferedObjectWriter{put: func(data []byte) error { return fmt.Errorf("upload failed") }}, nil
+	}, removeFile)
+	if err == nil {
+		t.Errorf("writeTiddlerToWriter() ignored the failed upload")
+	}
+	if _, ok := index["Note"]; ok {
+		t.Errorf("writeTiddlerToWriter() indexed a tiddler that was not written")
+	}
+}
+
+func Test_fileStore_GetWikiList(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "wikis", "notes"), 0700)
+	os.WriteFile(filepath.Join(dir, "wikis", "stray.txt"), []byte("not a wiki"), 0644)
+	tests := []struct {
+		name string
+		path string
+		want []string
+	}{
+		{"wikis folder", filepath.Join(dir, "wikis"), []string{"notes"}},
+		{"missing wikis folder", filepath.Join(dir, "missing"), []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewFileStore(dir, false, StoreLayout{})
+			if err != nil {
+				t.Fatalf("NewFileStore() error = %v", err)
+			}
+			got, err := s.GetWikiList(tt.path)
+			if err != nil {
+				t.Fatalf("GetWikiList() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetWikiList() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Serves ListObjectsV2 pages from memory, the way the SDK's paginator hands them to the callback
+type mockS3 struct {
+	s3iface.S3API
+	pages   []*s3.ListObjectsV2Output
+	err     error
+	inputs  []*s3.ListObjectsV2Input
+	objects map[string]bool //keys of the objects in the bucket, listed a page at a time when there are no pages
+	copies  []*s3.CopyObjectInput
+	batches []int           //number of keys in each DeleteObjects request
+	locked  map[string]bool //keys DeleteObjects reports it could not delete
+	puts    []string        //keys of every PutObject request, even those since deleted
+	putErr  error
+	bodies  map[string]string //contents of the objects read with GetObject
+}
+
+func (m *mockS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	body, ok := m.bodies[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func (m *mockS3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	delete(m.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (m *mockS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	m.batches = append(m.batches, len(input.Delete.Objects))
+	out := &s3.DeleteObjectsOutput{}
+	for _, obj := range input.Delete.Objects {
+		key := aws.StringValue(obj.Key)
+		if m.locked[key] {
+			out.Errors = append(out.Errors, &s3.Error{Key: obj.Key, Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+			continue
+		}
+		delete(m.objects, key)
+	}
+	return out, nil
+}
+
+func (m *mockS3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	m.copies = append(m.copies, input)
+	source, _ := url.PathUnescape(aws.StringValue(input.CopySource))
+	if !m.objects[strings.TrimPrefix(source, aws.StringValue(input.Bucket)+"/")] {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	m.objects[aws.StringValue(input.Key)] = true
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	m.puts = append(m.puts, aws.StringValue(input.Key))
+	if m.putErr != nil {
+		return nil, m.putErr
+	}
+	m.objects[aws.StringValue(input.Key)] = true
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (m *mockS3) ListObjectsV2PagesWithContext(ctx aws.Context, input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool, opts ...request.Option) error {
+	m.inputs = append(m.inputs, input)
+	if m.err != nil {
+		return m.err
+	}
+	pages := m.pages
+	if pages == nil {
+		pages = m.objectPages(aws.StringValue(input.Prefix))
+	}
+	for i, page := range pages {
+		if !fn(page, i == len(pages)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+// objectPages lists the objects under prefix in pages of at most 1000 keys, as S3 does.
+func (m *mockS3) objectPages(prefix string) []*s3.ListObjectsV2Output {
+	keys := []string{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	pages := []*s3.ListObjectsV2Output{{}}
+	for _, key := range keys {
+		if len(pages[len(pages)-1].Contents) == 1000 {
+			pages = append(pages, &s3.ListObjectsV2Output{})
+		}
+		page := pages[len(pages)-1]
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	return pages
+}
+
+func commonPrefixes(prefixes ...string) *s3.ListObjectsV2Output {
+	page := &s3.ListObjectsV2Output{}
+	for _, p := range prefixes {
+		page.CommonPrefixes = append(page.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+	}
+	return page
+}
+
+func Test_awsS3Store_GetWikiList(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		pages      []*s3.ListObjectsV2Output
+		err        error
+		wantPrefix string
+		want       []string
+		wantErr    bool
+	}{
+		{"several wikis over two pages", "my-bucket/site/wikis",
+			[]*s3.ListObjectsV2Output{commonPrefixes("site/wikis/notes/", "site/wikis/recipes/"), commonPrefixes("site/wikis/work/")},
+			nil, "site/wikis/", []string{"notes", "recipes", "work"}, false},
+		{"path without bucket", "wikis/", []*s3.ListObjectsV2Output{commonPrefixes("wikis/notes/")}, nil, "wikis/", []string{"notes"}, false},
+		{"empty bucket", "my-bucket/wikis", []*s3.ListObjectsV2Output{{}}, nil, "wikis/", []string{}, false},
+		{"no pages", "my-bucket/wikis", nil, nil, "wikis/", []string{}, false},
+		{"list error", "my-bucket/wikis", nil, errors.New("access denied"), "wikis/", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockS3{pages: tt.pages, err: tt.err}
+			s := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+			got, err := s.GetWikiList(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetWikiList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetWikiList() = %#v, want %#v", got, tt.want)
+			}
+			in := svc.inputs[0]
+			if aws.StringValue(in.Prefix) != tt.wantPrefix || aws.StringValue(in.Delimiter) != "/" || aws.StringValue(in.Bucket) != "my-bucket" {
+				t.Errorf("GetWikiList() listed %v", in)
+			}
+		})
+	}
+}
+
+func Test_fileStore_layout(t *testing.T) {
+	tests := []struct {
+		name         string
+		layout       StoreLayout
+		wantIndex    string
+		wantTiddlers string
+	}{
+		{"default layout", StoreLayout{}, "index.html", "tiddlers"},
+		{"separate folders", StoreLayout{IndexDir: "public", TiddlersDir: "data"}, filepath.Join("public", "index.html"), "data"},
+		{"nested folders", StoreLayout{IndexDir: "web/public", TiddlersDir: "store/data"}, filepath.Join("web", "public", "index.html"), filepath.Join("store", "data")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			template := filepath.Join(dir, "empty.html")
+			os.WriteFile(template, []byte("<html></html>"), 0644)
+			root, err := NewFileStore(dir, false, tt.layout)
+			if err != nil {
+				t.Fatalf("NewFileStore() error = %v", err)
+			}
+			wikiPath := filepath.Join(dir, "notes")
+			if err := root.CreateWikiFolder(wikiPath, template); err != nil {
+				t.Fatalf("CreateWikiFolder() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(wikiPath, tt.wantIndex)); err != nil {
+				t.Errorf("CreateWikiFolder() did not write %s: %v", tt.wantIndex, err)
+			}
+
+			s, err := NewFileStore(wikiPath, true, tt.layout)
+			if err != nil {
+				t.Fatalf("NewFileStore() error = %v", err)
+			}
+			if err := s.WriteTiddler(Tiddler{"title": "Note", "text": "hello"}); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(wikiPath, tt.wantTiddlers, "Note.tid")); err != nil {
+				t.Errorf("WriteTiddler() did not write to %s: %v", tt.wantTiddlers, err)
+			}
+			if b, err := readAllFromStore(s, "index.html"); err != nil || string(b) != "<html></html>" {
+				t.Errorf("ReadFile(index.html) = %q, %v", b, err)
+			}
+			if err := s.WriteFile(indexGzipFile, []byte("gz")); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(wikiPath, filepath.Dir(tt.wantIndex), indexGzipFile)); err != nil {
+				t.Errorf("WriteFile(%s) did not write next to index.html: %v", indexGzipFile, err)
+			}
+			if err := s.WriteFile("files/logo.png", []byte("png")); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(wikiPath, "files", "logo.png")); err != nil {
+				t.Errorf("WriteFile(files/logo.png) did not write to the wiki's folder: %v", err)
+			}
+
+			reread, err := NewFileStore(wikiPath, true, tt.layout)
+			if err != nil {
+				t.Fatalf("NewFileStore() error = %v", err)
+			}
+			if _, err := reread.GetTiddler("Note"); err != nil {
+				t.Errorf("GetTiddler() after reopening error = %v", err)
+			}
+		})
+	}
+}
+
+func Test_subfolderName(t *testing.T) {
+	tests := []struct {
+		name         string
+		prefix       string
+		folderPrefix string
+		want         string
+	}{
+		{"wiki folder", "site/wikis/", "site/wikis/notes/", "notes"},
+		{"bucket root", "", "notes/", "notes"},
+		{"object rather than folder", "wikis/", "", ""},
+		{"outside the prefix", "wikis/", "templates/empty/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subfolderName(tt.prefix, tt.folderPrefix); got != tt.want {
+				t.Errorf("subfolderName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_createBucketWikiFolder(t *testing.T) {
+	tests := []struct {
+		name     string
+		wikiPath string
+		template string
+		layout   StoreLayout
+		want     []string
+		wantErr  bool
+	}{
+		{"default layout", "my-bucket/site/wikis/notes", "my-bucket/site/templates/empty.html", StoreLayout{}.withDefaults(),
+			[]string{"site/templates/empty.html", "site/wikis/notes/index.html", "site/wikis/notes/tiddlers/"}, false},
+		{"custom layout", "site/wikis/notes", "site/templates/empty.html", StoreLayout{IndexDir: "public", TiddlersDir: "data"},
+			[]string{"site/templates/empty.html", "site/wikis/notes/data/", "site/wikis/notes/public/index.html"}, false},
+		{"missing template", "my-bucket/site/wikis/notes", "my-bucket/site/templates/missing.html", StoreLayout{}.withDefaults(),
+			[]string{"site/templates/empty.html"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := map[string][]byte{"site/templates/empty.html": []byte("<html></html>")}
+			copyObject := func(dst, src string) error {
+				data, ok := objects[src]
+				if !ok {
+					return fmt.Errorf("object %s does not exist", src)
+				}
+				objects[dst] = data
+				return nil
+			}
+			putObject := func(key string, data []byte) error {
+				objects[key] = data
+				return nil
+			}
+			err := createBucketWikiFolder(bucketObjectKey("my-bucket", tt.wikiPath), bucketObjectKey("my-bucket", tt.template), tt.layout, copyObject, putObject)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("createBucketWikiFolder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			keys := make([]string, 0, len(objects))
+			for key := range objects {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("createBucketWikiFolder() objects = %v, want %v", keys, tt.want)
+			}
+		})
+	}
+}
+
+func Test_awsS3Store_CreateWikiFolder(t *testing.T) {
+	tests := []struct {
+		name         string
+		template     string
+		wantSource   string
+		wantKey      string
+		wantTiddlers string
+		wantErr      bool
+	}{
+		{"copies the template", "my-bucket/site/templates/empty.html", "my-bucket%2Fsite%2Ftemplates%2Fempty.html",
+			"site/wikis/notes/index.html", "site/wikis/notes/tiddlers/Note.tid", false},
+		{"missing template", "my-bucket/site/templates/missing.html", "my-bucket%2Fsite%2Ftemplates%2Fmissing.html",
+			"site/wikis/notes/index.html", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockS3{objects: map[string]bool{"site/templates/empty.html": true}}
+			root := &awsS3Store{bucket: "my-bucket", layout: StoreLayout{}.withDefaults(), s3svc: svc}
+			err := root.CreateWikiFolder("my-bucket/site/wikis/notes", tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateWikiFolder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(svc.copies) != 1 {
+				t.Fatalf("CreateWikiFolder() made %d copies, want 1", len(svc.copies))
+			}
+			in := svc.copies[0]
+			if aws.StringValue(in.CopySource) != tt.wantSource || aws.StringValue(in.Key) != tt.wantKey || aws.StringValue(in.Bucket) != "my-bucket" {
+				t.Errorf("CreateWikiFolder() copied %s to %s/%s, want %s to my-bucket/%s",
+					aws.StringValue(in.CopySource), aws.StringValue(in.Bucket), aws.StringValue(in.Key), tt.wantSource, tt.wantKey)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			// the wiki's own store, as the server creates it from the wiki's path, writes under the wiki's tiddlers prefix
+			store, err := NewAwsS3Store("my-bucket/site/wikis/notes", false, StoreLayout{})
+			if err != nil {
+				t.Fatalf("NewAwsS3Store() error = %v", err)
+			}
+			s := store.(*awsS3Store)
+			s.s3svc = svc
+			s.tiddlerToFile, s.foldedTitles, s.tiddlerCache = map[string]string{}, foldedTitles{}, map[string]Tiddler{}
+			if err := s.WriteTiddler(Tiddler{"title": "Note", "text": "hello"}); err != nil {
+				t.Fatalf("WriteTiddler() error = %v", err)
+			}
+			if !svc.objects[tt.wantTiddlers] {
+				t.Errorf("WriteTiddler() objects = %v, want %s", svc.objects, tt.wantTiddlers)
+			}
+		})
+	}
+}
+
+func Test_parseBucketLocation(t *testing.T) {
+	tests := []struct {
+		name        string
+		location    string
+		wantBucket  string
+		wantBaseDir string
+		wantErr     bool
+	}{
+		{"uri", "s3://my-bucket/site/wikis", "my-bucket", "site/wikis", false},
+		{"uri without folder", "gs://my-bucket", "my-bucket", "", false},
+		{"bucket and folder", "my-bucket/site/wikis/notes", "my-bucket", "site/wikis/notes", false},
+		{"bucket only", "my-bucket", "my-bucket", "", false},
+		{"no bucket", "/site", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket, baseDir, err := parseBucketLocation(tt.location)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBucketLocation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if bucket != tt.wantBucket || baseDir != tt.wantBaseDir {
+				t.Errorf("parseBucketLocation() = %q, %q, want %q, %q", bucket, baseDir, tt.wantBucket, tt.wantBaseDir)
+			}
+		})
+	}
+}
+
+func Test_awsS3Store_CopyFolder_DeleteFolder(t *testing.T) {
+	newObjects := func() map[string]bool {
+		objects := map[string]bool{"wikis/bigger/index.html": true, "wikis/big/index.html": true}
+		for i := 0; i < 2499; i++ {
+			objects[fmt.Sprintf("wikis/big/tiddlers/Note%04d.tid", i)] = true
+		}
+		return objects
+	}
+	countPrefix := func(objects map[string]bool, prefix string) int {
+		n := 0
+		for key := range objects {
+			if strings.HasPrefix(key, prefix) {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("copies every page", func(t *testing.T) {
+		svc := &mockS3{objects: newObjects()}
+		store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+		if err := store.CopyFolder("my-bucket/wikis/big", "my-bucket/trash/big"); err != nil {
+			t.Fatalf("CopyFolder() error = %v", err)
+		}
+		if n := countPrefix(svc.objects, "trash/big/"); n != 2500 {
+			t.Errorf("CopyFolder() copied %d objects, want 2500", n)
+		}
+		if !svc.objects["trash/big/tiddlers/Note2498.tid"] || !svc.objects["trash/big/index.html"] || svc.objects["trash/bigger/index.html"] {
+			t.Errorf("CopyFolder() did not keep the keys relative to the folder")
+		}
+	})
+
+	t.Run("deletes in batches", func(t *testing.T) {
+		svc := &mockS3{objects: newObjects()}
+		store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+		if err := store.DeleteFolder("my-bucket/wikis/big"); err != nil {
+			t.Fatalf("DeleteFolder() error = %v", err)
+		}
+		if !reflect.DeepEqual(svc.batches, []int{1000, 1000, 500}) {
+			t.Errorf("DeleteFolder() batches = %v, want [1000 1000 500]", svc.batches)
+		}
+		if !reflect.DeepEqual(svc.objects, map[string]bool{"wikis/bigger/index.html": true}) {
+			t.Errorf("DeleteFolder() left %d objects, want only wikis/bigger/index.html", len(svc.objects))
+		}
+	})
+
+	t.Run("reports objects not deleted", func(t *testing.T) {
+		svc := &mockS3{objects: newObjects(), locked: map[string]bool{"wikis/big/tiddlers/Note1234.tid": true}}
+		store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+		err := store.DeleteFolder("my-bucket/wikis/big")
+		if err == nil || !strings.Contains(err.Error(), "1 of 2500") || !strings.Contains(err.Error(), "wikis/big/tiddlers/Note1234.tid: Access Denied") {
+			t.Errorf("DeleteFolder() error = %v, want the object not deleted", err)
+		}
+	})
+
+	t.Run("reports objects not copied", func(t *testing.T) {
+		svc := &mockS3{pages: []*s3.ListObjectsV2Output{{Contents: []*s3.Object{{Key: aws.String("wikis/big/gone.tid")}}}}, objects: newObjects()}
+		store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+		err := store.CopyFolder("my-bucket/wikis/big", "my-bucket/trash/big")
+		if err == nil || !strings.Contains(err.Error(), "wikis/big/gone.tid") {
+			t.Errorf("CopyFolder() error = %v, want the object not copied", err)
+		}
+	})
+
+	t.Run("refuses the whole bucket", func(t *testing.T) {
+		svc := &mockS3{objects: newObjects()}
+		store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+		if err := store.DeleteFolder("my-bucket"); err == nil {
+			t.Errorf("DeleteFolder() of the bucket succeeded")
+		}
+		if err := store.CopyFolder("my-bucket", "my-bucket/trash/all"); err == nil {
+			t.Errorf("CopyFolder() of the bucket succeeded")
+		}
+		if len(svc.objects) != 2501 {
+			t.Errorf("objects = %d, want 2501 untouched", len(svc.objects))
+		}
+	})
+}
+
+func Test_fileStore_Compact(t *testing.T) {
+	dir := t.TempDir()
+	tiddlers := filepath.Join(dir, "tiddlers")
+	os.MkdirAll(filepath.Join(tiddlers, "sub"), 0700)
+	os.WriteFile(filepath.Join(tiddlers, "Note.tid"), []byte("title: Note\n\nhello"), 0644)
+	os.WriteFile(filepath.Join(tiddlers, "sub", "Kept.tid"), []byte("title: Kept\n\nstill here"), 0644)
+	os.WriteFile(filepath.Join(tiddlers, "image.png"), []byte("\x89PNG"), 0644)
+	os.WriteFile(filepath.Join(tiddlers, "image.png.meta"), []byte("title: image.png\ntype: image/png\n"), 0644)
+	s, err := NewFileStore(dir, true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("NewFileStore() error = %v", err)
+	}
+
+	// what deleting and renaming tiddlers outside the store leaves behind
+	os.MkdirAll(filepath.Join(tiddlers, "old"), 0700)
+	os.MkdirAll(filepath.Join(tiddlers, "nested", "deeper"), 0700)
+	os.WriteFile(filepath.Join(tiddlers, "gone.png.meta"), []byte("title: gone.png\ntype: image/png\n"), 0644)
+	os.WriteFile(filepath.Join(tiddlers, "nested", "gone.jpg.meta"), []byte("title: gone.jpg\ntype: image/jpeg\n"), 0644)
+	os.Remove(filepath.Join(tiddlers, "Note.tid"))
+
+	report, err := s.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	wantMeta := []string{"gone.png.meta", filepath.Join("nested", "gone.jpg.meta")}
+	wantDirs := []string{"old", filepath.Join("nested", "deeper"), "nested"}
+	sort.Strings(report.OrphanedMeta)
+	sort.Strings(report.EmptyDirs)
+	sort.Strings(wantMeta)
+	sort.Strings(wantDirs)
+	if !reflect.DeepEqual(report.OrphanedMeta, wantMeta) {
+		t.Errorf("Compact() orphaned meta = %v, want %v", report.OrphanedMeta, wantMeta)
+	}
+	if !reflect.DeepEqual(report.EmptyDirs, wantDirs) {
+		t.Errorf("Compact() empty dirs = %v, want %v", report.EmptyDirs, wantDirs)
+	}
+	for _, removed := range append(wantMeta, wantDirs...) {
+		if _, err := os.Stat(filepath.Join(tiddlers, removed)); !os.IsNotExist(err) {
+			t.Errorf("Compact() left %s", removed)
+		}
+	}
+	for _, kept := range []string{"sub", filepath.Join("sub", "Kept.tid"), "image.png", "image.png.meta"} {
+		if _, err := os.Stat(filepath.Join(tiddlers, kept)); err != nil {
+			t.Errorf("Compact() removed %s: %v", kept, err)
+		}
+	}
+
+	paths := s.TiddlerPaths()
+	if _, ok := paths["Note"]; ok {
+		t.Errorf("Compact() did not rebuild the index, Note is still indexed")
+	}
+	if _, ok := paths["Kept"]; !ok {
+		t.Errorf("Compact() index = %v, want Kept", paths)
+	}
+	if _, ok := paths["image.png"]; !ok {
+		t.Errorf("Compact() index = %v, want image.png", paths)
+	}
+
+	report, err = s.Compact()
+	if err != nil || len(report.OrphanedMeta) != 0 || len(report.EmptyDirs) != 0 {
+		t.Errorf("second Compact() = %+v, %v, want nothing removed", report, err)
+	}
+}
+
+func Test_numWorkers(t *testing.T) {
+	defer func(n int) { numWorkers = n }(numWorkers)
+	paths := make([]string, 60)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("tiddlers/Note%02d.tid", i)
+	}
+	walker := func(f func(path string) error) error {
+		for _, p := range paths {
+			f(p)
+		}
+		return nil
+	}
+	for _, workers := range []int{1, 3, 8} {
+		t.Run(fmt.Sprint(workers), func(t *testing.T) {
+			numWorkers = workers
+			var mu sync.Mutex
+			running, most := 0, 0
+			// a slow read, as from a bucket, so that the workers overlap
+			reader := func(path string) (io.ReadCloser, error) {
+				mu.Lock()
+				running++
+				if running > most {
+					most = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+				title := strings.TrimSuffix(filepath.Base(path), ".tid")
+				return io.NopCloser(strings.NewReader("title: " + title + "\n\ntext")), nil
+			}
+
+			index, _, err := buildCacheAndIndex(walker, reader)
+			if err != nil {
+				t.Fatalf("buildCacheAndIndex() error = %v", err)
+			}
+			if len(index) != len(paths) {
+				t.Errorf("buildCacheAndIndex() indexed %d tiddlers, want %d", len(index), len(paths))
+			}
+			if most > workers || (workers > 1 && most < 2) {
+				t.Errorf("buildCacheAndIndex() read %d files at once, want up to %d", most, workers)
+			}
+
+			most = 0
+			tids, err := getAllTiddlerFilesFromStore(nil, reader, walker)
+			if err != nil {
+				t.Fatalf("getAllTiddlerFilesFromStore() error = %v", err)
+			}
+			if len(tids) != len(paths) {
+				t.Errorf("getAllTiddlerFilesFromStore() read %d tiddlers, want %d", len(tids), len(paths))
+			}
+			if most > workers || (workers > 1 && most < 2) {
+				t.Errorf("getAllTiddlerFilesFromStore() read %d files at once, want up to %d", most, workers)
+			}
+		})
+	}
+}
+
+func Test_forEachKey(t *testing.T) {
+	keys := make([]string, 500)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("wikis/big/tiddlers/Note%03d.tid", i)
+	}
+
+	t.Run("visits every key with bounded workers", func(t *testing.T) {
+		var mu sync.Mutex
+		seen, running, most := map[string]bool{}, 0, 0
+		err := forEachKey(keys, func(key string) error {
+			mu.Lock()
+			seen[key] = true
+			running++
+			if running > most {
+				most = running
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("forEachKey() error = %v", err)
+		}
+		if len(seen) != len(keys) {
+			t.Errorf("forEachKey() visited %d keys, want %d", len(seen), len(keys))
+		}
+		if most > numWorkers || most < 2 {
+			t.Errorf("forEachKey() ran %d at once, want 2 to %d", most, numWorkers)
+		}
+	})
+
+	t.Run("returns the first error and stops", func(t *testing.T) {
+		var mu sync.Mutex
+		calls := 0
+		err := forEachKey(keys, func(key string) error {
+			mu.Lock()
+			calls++
+			mu.Unlock()
+			if key == keys[10] {
+				return errors.New("could not copy " + key)
+			}
+			time.Sleep(time.Millisecond)
+			return nil
+		})
+		if err == nil || err.Error() != "could not copy "+keys[10] {
+			t.Errorf("forEachKey() error = %v, want the failed key", err)
+		}
+		if calls == len(keys) {
+			t.Errorf("forEachKey() kept going after the error")
+		}
+	})
+
+	t.Run("no keys", func(t *testing.T) {
+		if err := forEachKey(nil, func(key string) error { return errors.New("called") }); err != nil {
+			t.Errorf("forEachKey() error = %v", err)
+		}
+	})
+}
+
+func TestS3Endpoint_awsConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		endpoint      S3Endpoint
+		wantEndpoint  string
+		wantRegion    string
+		wantPathStyle bool
+	}{
+		{"MinIO", S3Endpoint{URL: "http://localhost:9000", Region: "us-east-1", ForcePathStyle: true}, "http://localhost:9000", "us-east-1", true},
+		{"R2", S3Endpoint{URL: "https://account.r2.cloudflarestorage.com", Region: "auto"}, "https://account.r2.cloudflarestorage.com", "auto", false},
+		{"AWS in another region", S3Endpoint{Region: "eu-west-1"}, "https://s3.eu-west-1.amazonaws.com", "eu-west-1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := s3.New(session.Must(session.NewSession(tt.endpoint.awsConfig())))
+			if svc.Endpoint != tt.wantEndpoint {
+				t.Errorf("client endpoint = %q, want %q", svc.Endpoint, tt.wantEndpoint)
+			}
+			if got := aws.StringValue(svc.Config.Region); got != tt.wantRegion {
+				t.Errorf("client region = %q, want %q", got, tt.wantRegion)
+			}
+			if got := aws.BoolValue(svc.Config.S3ForcePathStyle); got != tt.wantPathStyle {
+				t.Errorf("client S3ForcePathStyle = %v, want %v", got, tt.wantPathStyle)
+			}
+		})
+	}
+}
+
+func Test_awsS3Store_CreateRequiredFolders(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		putErr  error
+		wantKey string
+		wantErr bool
+	}{
+		{"probes the templates folder", "my-bucket/site", nil, "site/templates/.tiddlyverse-probe", false},
+		{"bucket root", "my-bucket", nil, "templates/.tiddlyverse-probe", false},
+		{"not writable", "my-bucket/site", awserr.New("AccessDenied", "Access Denied", nil), "site/templates/.tiddlyverse-probe", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockS3{objects: map[string]bool{}, putErr: tt.putErr}
+			store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+			err := store.CreateRequiredFolders(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateRequiredFolders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(svc.puts, []string{tt.wantKey}) {
+				t.Errorf("CreateRequiredFolders() wrote %v, want the probe %s", svc.puts, tt.wantKey)
+			}
+			if len(svc.objects) != 0 {
+				t.Errorf("CreateRequiredFolders() left %v in the bucket", svc.objects)
+			}
+		})
+	}
+}
+
+func Test_awsS3Store_GetWikiTemplateList(t *testing.T) {
+	svc := &mockS3{
+		objects: map[string]bool{
+			"site/templates/full.html":          true,
+			"site/templates/empty.html":         true,
+			"site/templates/empty.txt":          true,
+			"site/templates/orphan.txt":         true,
+			"site/templates/.tiddlyverse-probe": true,
+			"site/templates/old/retired.html":   true,
+			"site/wikis/notes/index.html":       true,
+		},
+		bodies: map[string]string{"site/templates/empty.txt": "An empty wiki"},
+	}
+	store := &awsS3Store{bucket: "my-bucket", s3svc: svc}
+	got, err := store.GetWikiTemplateList("my-bucket/site/templates")
+	if err != nil {
+		t.Fatalf("GetWikiTemplateList() error = %v", err)
+	}
+	want := [][]string{{"empty", "empty.html", "An empty wiki"}, {"full", "full.html", ""}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetWikiTemplateList() = %v, want %v", got, want)
+	}
+
+	delete(svc.bodies, "site/templates/empty.txt")
+	if _, err := store.GetWikiTemplateList("my-bucket/site/templates"); err == nil {
+		t.Errorf("GetWikiTemplateList() with an unreadable description succeeded")
+	}
+}
+
+// fakeBlobs is an in-memory Azure container.
+type fakeBlobs struct {
+	blobs    map[string][]byte
+	uploaded []string
+}
+
+func (f *fakeBlobs) Download(ctx context.Context, key string) ([]byte, error) {
+	data, ok := f.blobs[key]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", key)
+	}
+	return data, nil
+}
+
+func (f *fakeBlobs) Upload(ctx context.Context, key string, data []byte) error {
+	f.uploaded = append(f.uploaded, key)
+	f.blobs[key] = data
+	return nil
+}
+
+func (f *fakeBlobs) Delete(ctx context.Context, key string) error {
+	delete(f.blobs, key)
+	return nil
+}
+
+func (f *fakeBlobs) List(ctx context.Context, prefix string, delimiter string, fn func(item azureBlobItem)) error {
+	keys := []string{}
+	for key := range f.blobs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			folder := key[:len(prefix)+i+1]
+			if !seen[folder] {
+				seen[folder] = true
+				fn(azureBlobItem{Name: folder, IsPrefix: true})
+			}
+			continue
+		}
+		fn(azureBlobItem{Name: key, LastModified: time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)})
+	}
+	return nil
+}
+
+func Test_azureBlobStore(t *testing.T) {
+	blobs := &fakeBlobs{blobs: map[string][]byte{
+		"site/wikis/notes/index.html":          []byte("<html></html>"),
+		"site/wikis/notes/tiddlers/Stored.tid": []byte("title: Stored\n\nalready here"),
+		"site/wikis/recipes/index.html":        []byte("<html></html>"),
+	}}
+	s := &azureBlobStore{container: "my-container", baseDir: "site/wikis/notes", tiddlersDir: "site/wikis/notes/tiddlers",
+		layout: StoreLayout{}.withDefaults(), blobs: blobs}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if tid, err := s.GetTiddler("Stored"); err != nil || tid["text"] != "already here" {
+		t.Errorf("GetTiddler(Stored) = %v, %v", tid, err)
+	}
+
+	if err := s.WriteTiddler(Tiddler{"title": "Note", "text": "hello"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	if _, ok := blobs.blobs["site/wikis/notes/tiddlers/Note.tid"]; !ok {
+		t.Errorf("WriteTiddler() uploaded %v, want site/wikis/notes/tiddlers/Note.tid", blobs.uploaded)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if tids, err := s.GetAllTiddlers(); err != nil || len(tids) != 2 {
+		t.Errorf("GetAllTiddlers() = %v, %v, want Stored and Note", tids, err)
+	}
+	if last, err := s.LastModified(); err != nil || last.IsZero() {
+		t.Errorf("LastModified() = %v, %v", last, err)
+	}
+	if b, err := readAllFromStore(s, "index.html"); err != nil || string(b) != "<html></html>" {
+		t.Errorf("ReadFile(index.html) = %q, %v", b, err)
+	}
+
+	if err := s.DeleteTiddler("Stored"); err != nil {
+		t.Fatalf("DeleteTiddler() error = %v", err)
+	}
+	if _, ok := blobs.blobs["site/wikis/notes/tiddlers/Stored.tid"]; ok {
+		t.Errorf("DeleteTiddler() left the blob")
+	}
+	if _, ok := s.TiddlerPaths()["Stored"]; ok {
+		t.Errorf("DeleteTiddler() left Stored in the index")
+	}
+
+	root := &azureBlobStore{container: "my-container", blobs: blobs}
+	wikis, err := root.GetWikiList("my-container/site/wikis")
+	if err != nil || !reflect.DeepEqual(wikis, []string{"notes", "recipes"}) {
+		t.Errorf("GetWikiList() = %v, %v, want [notes recipes]", wikis, err)
+	}
+	blobs.uploaded = nil
+	if err := root.CreateRequiredFolders("my-container/site"); err != nil {
+		t.Fatalf("CreateRequiredFolders() error = %v", err)
+	}
+	if _, ok := blobs.blobs["site/templates/.tiddlyverse-probe"]; ok || !reflect.DeepEqual(blobs.uploaded, []string{"site/templates/.tiddlyverse-probe"}) {
+		t.Errorf("CreateRequiredFolders() uploaded %v and left the probe = %v", blobs.uploaded, ok)
+	}
+}
+
+func Test_memoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	if err := s.WriteTiddler(Tiddler{"title": "Note", "text": "hello"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	if err := s.WriteTiddler(Tiddler{"title": "Other", "text": "bye"}); err != nil {
+		t.Fatalf("WriteTiddler() error = %v", err)
+	}
+	before, _ := s.LastModified()
+	if err := s.DeleteTiddler("other"); err == nil {
+		t.Errorf("DeleteTiddler() of a missing title did not fail")
+	}
+	if err := s.DeleteTiddler("Other"); err != nil {
+		t.Fatalf("DeleteTiddler() error = %v", err)
+	}
+	if after, _ := s.LastModified(); !after.After(before) {
+		t.Errorf("LastModified() = %v after a delete, want after %v", after, before)
+	}
+
+	got, err := s.GetTiddler("Note")
+	if err != nil || got["text"] != "hello" {
+		t.Errorf("GetTiddler() = %v, %v", got, err)
+	}
+	if tids, _ := s.GetAllTiddlers(); len(tids) != 1 {
+		t.Errorf("GetAllTiddlers() = %v, want only Note", tids)
+	}
+	paths, _ := s.ListPaths()
+	if !reflect.DeepEqual(paths, []string{"tiddlers/Note.tid"}) {
+		t.Errorf("ListPaths() = %v", paths)
+	}
+	b, _ := readAllFromStore(s, "tiddlers/Note.tid")
+	if !strings.Contains(string(b), "title: Note") {
+		t.Errorf("ReadFile() = %q, want the .tid file", b)
+	}
+
+	// files written around the store are picked up by Reload and cleaned up by Compact
+	s.WriteFile("tiddlers/pic.png", []byte("\x89PNG"))
+	s.WriteFile("tiddlers/pic.png.meta", []byte("title: pic.png\ntype: image/png\n"))
+	s.WriteFile("tiddlers/old/gone.png.meta", []byte("title: gone.png\ntype: image/png\n"))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if got, err := s.GetTiddler("pic.png"); err != nil || !reflect.DeepEqual(got["text"], []byte("\x89PNG")) {
+		t.Errorf("GetTiddler() of a binary tiddler = %v, %v", got, err)
+	}
+	report, err := s.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	want := CompactReport{EmptyDirs: []string{"old"}, OrphanedMeta: []string{filepath.Join("old", "gone.png.meta")}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("Compact() = %+v, want %+v", report, want)
+	}
+}
+
+func Test_memoryStore_wikis(t *testing.T) {
+	storeFunc := newMemoryStoreFunc()
+	root, err := storeFunc("demo", false, StoreLayout{})
+	if err != nil {
+		t.Fatalf("storeFunc() error = %v", err)
+	}
+	if err := root.CreateRequiredFolders("demo"); err != nil {
+		t.Fatalf("CreateRequiredFolders() error = %v", err)
+	}
+	if err := root.CreateRequiredFolders("demo"); err != nil {
+		t.Errorf("CreateRequiredFolders() a second time error = %v", err)
+	}
+	root.WriteFile("templates/empty.html", []byte("<html></html>"))
+	root.WriteFile("templates/empty.txt", []byte("An empty wiki"))
+	templates, err := root.GetWikiTemplateList("demo/templates")
+	if err != nil || !reflect.DeepEqual(templates, [][]string{{"empty", "empty.html", "An empty wiki"}}) {
+		t.Errorf("GetWikiTemplateList() = %v, %v", templates, err)
+	}
+
+	if err := root.CreateWikiFolder("demo/wikis/notes", "demo/templates/empty.html"); err != nil {
+		t.Fatalf("CreateWikiFolder() error = %v", err)
+	}
+	if err := root.CreateWikiFolder("demo/wikis/notes", "demo/templates/empty.html"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("CreateWikiFolder() of an existing wiki error = %v, want fs.ErrExist", err)
+	}
+	notes, err := storeFunc("demo/wikis/notes", true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("storeFunc() error = %v", err)
+	}
+	if b, _ := readAllFromStore(notes, "index.html"); string(b) != "<html></html>" {
+		t.Errorf("ReadFile() of the new wiki's index = %q", b)
+	}
+	notes.WriteTiddler(Tiddler{"title": "Note", "text": "hello"})
+	if wikis, _ := root.GetWikiList("demo/wikis"); !reflect.DeepEqual(wikis, []string{"notes"}) {
+		t.Errorf("GetWikiList() = %v", wikis)
+	}
+
+	if err := root.CopyFolder("demo/wikis/notes", "demo/trash/notes"); err != nil {
+		t.Fatalf("CopyFolder() error = %v", err)
+	}
+	if err := root.DeleteFolder("demo/wikis/notes"); err != nil {
+		t.Fatalf("DeleteFolder() error = %v", err)
+	}
+	if wikis, _ := root.GetWikiList("demo/wikis"); len(wikis) != 0 {
+		t.Errorf("GetWikiList() after DeleteFolder() = %v", wikis)
+	}
+	trashed, _ := storeFunc("demo/trash/notes", true, StoreLayout{})
+	if got, err := trashed.GetTiddler("Note"); err != nil || got["text"] != "hello" {
+		t.Errorf("GetTiddler() of the trashed wiki = %v, %v", got, err)
+	}
+}
+
+// upstreamWiki is a TiddlyWeb server with one wiki at /notes, counting the tiddlers fetched from it
+type upstreamWiki struct {
+	mu        sync.Mutex
+	tiddlers  map[string]Tiddler
+	page      string
+	fetches   map[string]int
+	basicAuth string
+}
+
+func (u *upstreamWiki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if user, password, _ := r.BasicAuth(); user+":"+password != u.basicAuth {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.URL.Path == "/notes/":
+		fmt.Fprint(w, u.page)
+	case r.URL.Path == "/notes/recipes/default/tiddlers.json":
+		skinny := []Tiddler{}
+		for _, tid := range u.tiddlers {
+			skinny = append(skinny, Tiddler{"title": tid["title"], "revision": tid["revision"], "modified": tid["modified"]})
+		}
+		json.NewEncoder(w).Encode(skinny)
+	case strings.HasPrefix(r.URL.Path, "/notes/recipes/default/tiddlers/"):
+		title := strings.TrimPrefix(r.URL.Path, "/notes/recipes/default/tiddlers/")
+		tid, ok := u.tiddlers[title]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		u.fetches[title]++
+		json.NewEncoder(w).Encode(tid)
+	case r.URL.Path == "/notes/files/logo.png":
+		fmt.Fprint(w, "PNG")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_proxyStore(t *testing.T) {
+	upstream := &upstreamWiki{
+		tiddlers: map[string]Tiddler{
+			"Home":     {"title": "Home", "text": "welcome", "revision": "1", "modified": "20230101000000000", "tags": []interface{}{"Start", "Read me"}},
+			"Fix Bike": {"title": "Fix Bike", "text": "new chain", "revision": "3", "modified": "20230102000000000", "fields": map[string]interface{}{"due": "friday"}},
+		},
+		page: "<html>\n<!--~~ Ordinary tiddlers ~~-->\n" +
+			"<script class=\"tiddlywiki-tiddler-store\" type=\"application/json\">\n[{\"title\":\"Home\"}]\n</script>\n" +
+			"<script class=\"tiddlywiki-tiddler-store\" type=\"application/json\">[\n{\"title\":\"$:/core\"}\n]</script>\n</html>\n",
+		fetches:   map[string]int{},
+		basicAuth: "reader:secret",
+	}
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	location := strings.Replace(srv.URL, "http://", "http://reader:secret@", 1) + "/notes/"
+
+	s, err := newProxyStoreFunc(location)(filepath.Join("dist", "wikis", "notes"), true, StoreLayout{})
+	if err != nil {
+		t.Fatalf("newProxyStore() error = %v", err)
+	}
+
+	home, err := s.GetTiddler("Home")
+	if err != nil || home.Field("text") != "welcome" || home.Field("tags") != "Start [[Read me]]" {
+		t.Errorf("GetTiddler(Home) = %v, %v", home, err)
+	}
+	bike, err := s.GetTiddler("Fix Bike")
+	if err != nil || bike.Field("due") != "friday" {
+		t.Errorf("GetTiddler(Fix Bike) = %v, %v, want its fields flattened", bike, err)
+	}
+	if _, err := s.GetTiddler("Missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("GetTiddler(Missing) error = %v, want fs.ErrNotExist", err)
+	}
+	host, err := s.GetTiddler(tiddlyWebHostTiddler)
+	if err != nil || host.Field("text") != "$protocol$//$host$/notes/" {
+		t.Errorf("GetTiddler(%s) = %v, %v, want the mirror's own path", tiddlyWebHostTiddler, host, err)
+	}
+	if all, err := s.GetAllTiddlers(); err != nil || len(all) != 3 {
+		t.Errorf("GetAllTiddlers() = %d tiddlers, %v, want 3", len(all), err)
+	}
+	if wikis, err := s.GetWikiList(filepath.Join("dist", "wikis")); err != nil || !reflect.DeepEqual(wikis, []string{"notes"}) {
+		t.Errorf("GetWikiList() = %v, %v", wikis, err)
+	}
+	if modified, err := s.LastModified(); err != nil || !modified.Equal(time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("LastModified() = %v, %v", modified, err)
+	}
+
+	// the page's injected tiddlers are left out, the template's own store is kept
+	r, err := s.ReadFile("index.html")
+	if err != nil {
+		t.Fatalf("ReadFile(index.html) error = %v", err)
+	}
+	page, _ := io.ReadAll(r)
+	if strings.Contains(string(page), `[{"title":"Home"}]`) || !strings.Contains(string(page), `{"title":"$:/core"}`) {
+		t.Errorf("ReadFile(index.html) = %s", page)
+	}
+	if r, err := s.ReadFile("files/logo.png"); err != nil {
+		t.Errorf("ReadFile(files/logo.png) error = %v", err)
+	} else if data, _ := io.ReadAll(r); string(data) != "PNG" {
+		t.Errorf("ReadFile(files/logo.png) = %q", data)
+	}
+	if _, err := s.ReadFile("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ReadFile(missing.txt) error = %v, want fs.ErrNotExist", err)
+	}
+
+	// only the tiddlers whose revision changed are fetched again
+	upstream.mu.Lock()
+	upstream.tiddlers["Home"] = Tiddler{"title": "Home", "text": "welcome back", "revision": "2", "modified": "20230103000000000"}
+	upstream.tiddlers["New"] = Tiddler{"title": "New", "text": "fresh", "revision": "0"}
+	delete(upstream.tiddlers, "Fix Bike")
+	upstream.mu.Unlock()
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+	if home, _ := s.GetTiddler("Home"); home.Field("text") != "welcome back" {
+		t.Errorf("GetTiddler(Home) after Reload() = %v", home)
+	}
+	if _, err := s.GetTiddler("Fix Bike"); err == nil {
+		t.Errorf("GetTiddler(Fix Bike) found a tiddler deleted upstream")
+	}
+	if want := map[string]int{"Home": 2, "Fix Bike": 1, "New": 1}; !reflect.DeepEqual(upstream.fetches, want) {
+		t.Errorf("Reload() fetches = %v, want %v", upstream.fetches, want)
+	}
+
+	for name, write := range map[string]func() error{
+		"WriteTiddler":     func() error { return s.WriteTiddler(Tiddler{"title": "Home", "text": "defaced"}) },
+		"DeleteTiddler":    func() error { return s.DeleteTiddler("Home") },
+		"WriteFile":        func() error { return s.WriteFile("files/x.txt", []byte("x")) },
+		"CreateWikiFolder": func() error { return s.CreateWikiFolder("other", "empty.html") },
+	} {
+		if err := write(); !errors.Is(err, ErrReadOnlyStore) {
+			t.Errorf("%s() error = %v, want ErrReadOnlyStore", name, err)
+		}
+	}
+}
+
+func Test_proxyStore_errors(t *testing.T) {
+	upstream := &upstreamWiki{tiddlers: map[string]Tiddler{}, fetches: map[string]int{}, basicAuth: "reader:secret"}
+	srv := httptest.NewServer(upstream)
+	defer srv.Close()
+	tests := []struct {
+		name     string
+		location string
+		dir      string
+	}{
+		{"not a URL", "wiki.example.com/notes", filepath.Join("dist", "wikis", "notes")},
+		{"another wiki", srv.URL + "/notes", filepath.Join("dist", "wikis", "docs")},
+		{"no credentials", srv.URL + "/notes", filepath.Join("dist", "wikis", "notes")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newProxyStoreFunc(tt.location)(tt.dir, true, StoreLayout{}); err == nil {
+				t.Errorf("newProxyStore() error = nil, want an error")
+			}
+		})
+	}
+}
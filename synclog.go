@@ -0,0 +1,147 @@
+package tiddlybucket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+//Logs the sync requests of one wiki, for diagnosing a client whose tiddlers do not sync without the noise of the other wikis.
+//Turned on and off at runtime from /{wiki}/debug/sync-log.
+type syncLog struct {
+	logger zerolog.Logger
+	file   *os.File //the wiki's log file in Options.SyncLogDir, nil when logging to the server log
+}
+
+//Opens the wiki's log file in Options.SyncLogDir, appending to what earlier sessions logged, or logs to the server log without one
+func newSyncLog(wiki string) (*syncLog, error) {
+	if serverOptions.SyncLogDir == "" {
+		return &syncLog{logger: log.Logger.With().Str("wiki", wiki).Str("log", "sync").Logger()}, nil
+	}
+	if err := os.MkdirAll(serverOptions.SyncLogDir, 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(serverOptions.SyncLogDir, wiki+".sync.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &syncLog{logger: zerolog.New(f).With().Timestamp().Str("wiki", wiki).Logger(), file: f}, nil
+}
+
+func (l *syncLog) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+//Logs each request to a wiki whose sync logging is on with its tiddler, revisions, etags and status
+func (hr *HandlerSelector) logSync(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, err := hr.getHandlerWithStore(chi.URLParam(r, "wiki"))
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.muSyncLog.Lock()
+		l := h.syncLog
+		h.muSyncLog.Unlock()
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		title, _ := url.PathUnescape(chi.URLParam(r, "*"))
+		event := l.logger.Info().
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Str("title", title).
+			Str("if_match", r.Header.Get("If-Match")).
+			Str("etag", ww.Header().Get("Etag")).
+			Int("status", ww.Status())
+		if revision, ok := requestRevision(r); ok {
+			event = event.Int("client_revision", revision)
+		}
+		if revision, ok := etagRevision(ww.Header().Get("Etag")); ok {
+			event = event.Int("revision", revision)
+		}
+		event.Msg("sync request")
+	})
+}
+
+//Reports whether the wiki's sync requests are being logged, and to which file
+func (h *handlerWithStore) getSyncLog(w http.ResponseWriter, r *http.Request) {
+	h.muSyncLog.Lock()
+	l := h.syncLog
+	h.muSyncLog.Unlock()
+	render.JSON(w, r, syncLogStatus(h.wiki, l))
+}
+
+//Turns the logging of the wiki's sync requests on or off with ?enabled=, closing its log file when turned off
+func (h *handlerWithStore) setSyncLog(w http.ResponseWriter, r *http.Request) {
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("enabled must be true or false: %q", r.URL.Query().Get("enabled")), http.StatusBadRequest)
+		return
+	}
+
+	h.muSyncLog.Lock()
+	defer h.muSyncLog.Unlock()
+	if enabled && h.syncLog == nil {
+		if h.syncLog, err = newSyncLog(h.wiki); err != nil {
+			log.Error().Str("wiki", h.wiki).Err(err).Msg("could not open sync log")
+			http.Error(w, fmt.Sprintf("could not open sync log: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !enabled && h.syncLog != nil {
+		if err := h.syncLog.Close(); err != nil {
+			log.Warn().Str("wiki", h.wiki).Err(err).Msg("could not close sync log")
+		}
+		h.syncLog = nil
+	}
+	log.Info().Str("wiki", h.wiki).Bool("enabled", enabled).Msg("sync logging changed")
+	render.JSON(w, r, syncLogStatus(h.wiki, h.syncLog))
+}
+
+//Closes the log files of the wikis whose sync logging is on, on shutdown, so their last lines are not lost
+func (hr *HandlerSelector) closeSyncLogs(ctx context.Context) error {
+	hr.mu.RLock()
+	handlers := make([]*handlerWithStore, 0, len(hr.handlerMap))
+	for _, h := range hr.handlerMap {
+		handlers = append(handlers, h)
+	}
+	hr.mu.RUnlock()
+	var firstErr error
+	for _, h := range handlers {
+		h.muSyncLog.Lock()
+		if h.syncLog != nil {
+			if err := h.syncLog.Close(); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("sync log of %s: %w", h.wiki, err)
+			}
+			h.syncLog = nil
+		}
+		h.muSyncLog.Unlock()
+	}
+	return firstErr
+}
+
+func syncLogStatus(wiki string, l *syncLog) map[string]interface{} {
+	status := map[string]interface{}{"wiki": wiki, "enabled": l != nil}
+	if l != nil && l.file != nil {
+		status["file"] = l.file.Name()
+	}
+	return status
+}
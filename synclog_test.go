@@ -0,0 +1,128 @@
+package tiddlybucket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_syncLog(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.SyncLogDir = t.TempDir()
+	note := Tiddler{"title": "Note", "text": "hello", "revision": "3"}
+	hr := &HandlerSelector{handlerMap: map[string]*handlerWithStore{
+		"notes":   {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"Note": note}}, wiki: "notes"},
+		"journal": {Store: &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"Note": note}}, wiki: "journal"},
+	}}
+	router := chi.NewRouter()
+	// in a group, as in ListenAndServe, so the middleware runs once the wiki is routed
+	router.Group(func(r chi.Router) {
+		r.Use(hr.logSync)
+		r.Get("/{wiki}/recipes/{recipe}/tiddlers/*", hr.getTiddler)
+		r.Get("/{wiki}/debug/sync-log", hr.getSyncLog)
+		r.Post("/{wiki}/debug/sync-log", hr.setSyncLog)
+	})
+	request := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "http://foobar.com"+path, nil)
+		r.Header.Set("If-Match", `"default/Note/2:abc"`)
+		router.ServeHTTP(w, r)
+		return w
+	}
+	logLines := func(wiki string) []map[string]interface{} {
+		data, err := os.ReadFile(filepath.Join(serverOptions.SyncLogDir, wiki+".sync.log"))
+		if err != nil {
+			return nil
+		}
+		lines := []map[string]interface{}{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("sync log line %q is not JSON: %v", line, err)
+			}
+			lines = append(lines, entry)
+		}
+		return lines
+	}
+
+	request(http.MethodGet, "/notes/recipes/default/tiddlers/Note")
+	if lines := logLines("notes"); lines != nil {
+		t.Errorf("logged %v before sync logging was turned on", lines)
+	}
+
+	if w := request(http.MethodPost, "/notes/debug/sync-log?enabled=maybe"); w.Code != http.StatusBadRequest {
+		t.Errorf("setSyncLog() status = %d for an invalid value, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := request(http.MethodPost, "/notes/debug/sync-log?enabled=true"); w.Code != http.StatusOK {
+		t.Fatalf("setSyncLog() status = %d", w.Code)
+	}
+	var status map[string]interface{}
+	json.NewDecoder(request(http.MethodGet, "/notes/debug/sync-log").Body).Decode(&status)
+	if status["enabled"] != true || status["file"] != filepath.Join(serverOptions.SyncLogDir, "notes.sync.log") {
+		t.Errorf("getSyncLog() = %v", status)
+	}
+
+	request(http.MethodGet, "/notes/recipes/default/tiddlers/Note")
+	request(http.MethodGet, "/journal/recipes/default/tiddlers/Note")
+	request(http.MethodGet, "/notes/recipes/default/tiddlers/Missing")
+
+	lines := logLines("notes")
+	var syncLines []map[string]interface{}
+	for _, line := range lines {
+		if strings.Contains(line["path"].(string), "/tiddlers/") {
+			syncLines = append(syncLines, line)
+		}
+	}
+	if len(syncLines) != 2 {
+		t.Fatalf("notes sync log = %v, want the 2 tiddler requests", lines)
+	}
+	first := syncLines[0]
+	if first["wiki"] != "notes" || first["method"] != "GET" || first["title"] != "Note" || first["status"] != float64(http.StatusOK) || first["client_revision"] != float64(2) {
+		t.Errorf("sync log entry = %v", first)
+	}
+	if syncLines[1]["title"] != "Missing" || syncLines[1]["status"] != float64(http.StatusNotFound) {
+		t.Errorf("sync log entry = %v", syncLines[1])
+	}
+	if lines := logLines("journal"); lines != nil {
+		t.Errorf("journal sync log = %v, want none", lines)
+	}
+
+	request(http.MethodPost, "/notes/debug/sync-log?enabled=false")
+	before := len(logLines("notes"))
+	request(http.MethodGet, "/notes/recipes/default/tiddlers/Note")
+	if after := len(logLines("notes")); after != before {
+		t.Errorf("logged %d more lines after sync logging was turned off", after-before)
+	}
+}
+
+func TestHandlerSelector_closeSyncLogs(t *testing.T) {
+	defer func(o Options) { serverOptions = o }(serverOptions)
+	serverOptions.SyncLogDir = t.TempDir()
+	l, err := newSyncLog("notes")
+	if err != nil {
+		t.Fatalf("newSyncLog() error = %v", err)
+	}
+	hr := &HandlerSelector{handlerMap: map[string]*handlerWithStore{
+		"notes":   {wiki: "notes", syncLog: l},
+		"journal": {wiki: "journal"},
+	}}
+	if err := hr.closeSyncLogs(context.Background()); err != nil {
+		t.Fatalf("closeSyncLogs() error = %v", err)
+	}
+	if hr.handlerMap["notes"].syncLog != nil {
+		t.Errorf("closeSyncLogs() left the sync log of notes open")
+	}
+	if err := l.file.Close(); err == nil {
+		t.Errorf("closeSyncLogs() did not close %s", l.file.Name())
+	}
+}
@@ -3,11 +3,13 @@ package tiddlybucket
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -17,10 +19,23 @@ var (
 	reMatchMultiWordTags = regexp.MustCompile(`\[\[[^]]*\]\]`)
 )
 
+//When true, a tiddler file keeps an empty text apart from no text at all, as TiddlyWiki does: the blank line ending the fields
+//is only written when there is a text field, and read back as an empty text when nothing follows it
+var preserveEmptyFields = false
+
+//Type given to the tiddlers read from files without one, which TiddlyWiki treats as wikitext
+var defaultTiddlerType = "text/vnd.tiddlywiki"
+
 type Tiddler map[string]interface{}
 
+//Returns a field's value. A list field, such as the tags read from a tiddler file, is returned as a TiddlyWiki list.
 func (t *Tiddler) Field(name string) string {
 	if v, ok := (*t)[name]; ok {
+		switch v.(type) {
+		case []string, []interface{}:
+			list, _ := tagsAsString(v)
+			return list
+		}
 		return v.(string)
 	}
 	return ""
@@ -30,6 +45,72 @@ func (t *Tiddler) setField(name, value string) {
 	(*t)[name] = value
 }
 
+//Splits a TiddlyWiki tag list such as "one [[two words]]" into its tags
+func parseTagList(list string) []string {
+	tags := make([]string, 0)
+	for {
+		list = strings.TrimLeft(list, " \t\n")
+		if list == "" {
+			return tags
+		}
+		if strings.HasPrefix(list, "[[") {
+			if end := strings.Index(list, "]]"); end >= 0 {
+				tags = append(tags, list[2:end])
+				list = list[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexAny(list, " \t\n")
+		if end < 0 {
+			end = len(list)
+		}
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+}
+
+//Joins tags into a TiddlyWiki tag list, bracketing the tags that contain spaces
+func formatTagList(tags []string) string {
+	formatted := make([]string, len(tags))
+	for i, tag := range tags {
+		if strings.ContainsAny(tag, " \t\n") {
+			tag = "[[" + tag + "]]"
+		}
+		formatted[i] = tag
+	}
+	return strings.Join(formatted, " ")
+}
+
+//Layout of TiddlyWiki's date fields, which are UTC with millisecond precision and written without the dot, e.g. 20230102150405123
+const tiddlerTimeLayout = "20060102150405.000"
+
+//Formats a time for a tiddler's created or modified field
+func formatTiddlerTime(t time.Time) string {
+	return strings.Replace(t.UTC().Format(tiddlerTimeLayout), ".", "", 1)
+}
+
+//Parses a tiddler date field. Like TiddlyWiki, it accepts dates cut short after any part, e.g. without the milliseconds.
+func parseTiddlerTime(value string) (time.Time, error) {
+	switch {
+	case len(value) == 17:
+		return time.Parse(tiddlerTimeLayout, value[:14]+"."+value[14:])
+	case len(value) >= 8 && len(value) <= 14 && len(value)%2 == 0:
+		return time.Parse("20060102150405", value+strings.Repeat("0", 14-len(value)))
+	default:
+		return time.Time{}, fmt.Errorf("%q is not a TiddlyWiki date", value)
+	}
+}
+
+//Reports whether date field a is later than b. A date that cannot be parsed is older than any that can.
+func tiddlerTimeAfter(a, b string) bool {
+	ta, errA := parseTiddlerTime(a)
+	tb, errB := parseTiddlerTime(b)
+	if errA != nil {
+		return false
+	}
+	return errB != nil || ta.After(tb)
+}
+
 func (t *Tiddler) Bytes() []byte {
 	if b, err := json.Marshal(t); err == nil {
 		return b
@@ -65,49 +146,84 @@ func (t *TiddlerFile) Write(w io.Writer) error {
 
 	for f, v := range t.tid {
 		switch f {
-		/*
-			case "tags":
-				buf.WriteString(f)
-				buf.WriteString(": ")
-				for _, tag := range v.([]interface{}) {
-					numWords := len(strings.Split(tag.(string), " "))
-					if numWords > 1 {
-						buf.WriteString(fmt.Sprintf("[[%s]]", tag.(string)))
-					} else {
-						buf.WriteString(tag.(string))
-					}
-					// buf.WriteString(tag.(string))
-					buf.WriteByte(' ')
-				}
-				buf.WriteByte('\n')
-		*/
-		case "fields":
-			for f2, v2 := range v.(map[string]interface{}) {
-				buf.WriteString(f2)
-				buf.WriteString(": ")
-				buf.WriteString(v2.(string))
-				buf.WriteByte('\n')
+		case "tags":
+			//a list of tags is written as a TiddlyWiki list, bracketing the tags with spaces in them
+			tags, ok := tagsAsString(v)
+			if !ok {
+				return fmt.Errorf("tags of %q are not a list of strings: %T", t.tid["title"], v)
 			}
-		case "text":
-			continue
-		default:
 			buf.WriteString(f)
 			buf.WriteString(": ")
-			buf.WriteString(v.(string))
+			buf.WriteString(tags)
 			buf.WriteByte('\n')
+		case "fields":
+			//TiddlyWeb nests the custom fields, a tiddler file keeps them flat with the system fields and reads them back that way
+			fields, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("fields of %q are not a map: %T", t.tid["title"], v)
+			}
+			for f2, v2 := range fields {
+				if err := writeFieldLine(&buf, f2, v2); err != nil {
+					return fmt.Errorf("tiddler %q: %w", t.tid["title"], err)
+				}
+			}
+		case "text", gzippedContentField:
+			continue
+		default:
+			if err := writeFieldLine(&buf, f, v); err != nil {
+				return fmt.Errorf("tiddler %q: %w", t.tid["title"], err)
+			}
 		}
 	}
 
-	buf.WriteByte('\n') // needs to have a newline separator
+	if _, ok := t.tid["text"]; ok || !preserveEmptyFields {
+		buf.WriteByte('\n') // needs to have a newline separator
+	}
 
 	if txt, ok := t.tid["text"]; ok {
-		buf.WriteString(txt.(string))
+		//binary content only has a file of its own with a .meta file, in a .tid file it stays base64 encoded as TiddlyWiki sends it
+		if content, ok := txt.([]byte); ok {
+			buf.WriteString(base64.StdEncoding.EncodeToString(content))
+		} else {
+			buf.WriteString(txt.(string))
+		}
 	}
 
 	_, err := w.Write(buf.Bytes())
 	return err
 }
 
+//Writes a field as a "name: value" line, which only the single space after the colon and the newline are stripped from when
+//read back, so a value keeps its colons and its leading and trailing whitespace. A line break has no place in the line, so
+//a value with one is refused rather than written as a field line that would cut the tiddler short.
+func writeFieldLine(buf *bytes.Buffer, name string, v interface{}) error {
+	if name == "" || name != strings.TrimSpace(name) || strings.ContainsAny(name, ":\r\n") {
+		return fmt.Errorf("field name %q cannot be written to a tiddler file", name)
+	}
+	value, ok := fieldAsString(v)
+	if !ok {
+		return fmt.Errorf("field %q is not a string: %T", name, v)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("field %q has a line break, which cannot be written to a tiddler file", name)
+	}
+	buf.WriteString(name)
+	buf.WriteString(": ")
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+	return nil
+}
+
+//Splits a field line at its first colon, the counterpart of writeFieldLine
+func parseFieldLine(line string) (name, value string, ok bool) {
+	idx := strings.Index(line, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	value = strings.TrimSuffix(strings.TrimSuffix(line[idx+1:], "\n"), "\r")
+	return strings.TrimSpace(line[:idx]), strings.TrimPrefix(value, " "), true
+}
+
 // TODO?: https://github.com/Jermolene/TiddlyWiki5/blob/master/plugins/tiddlywiki/tiddlyweb/tiddlywebadaptor.js#L271
 func (t *TiddlerFile) Read(r io.Reader) error {
 	if r == nil {
@@ -115,7 +231,6 @@ func (t *TiddlerFile) Read(r io.Reader) error {
 	}
 
 	t.tid = make(map[string]interface{})
-	fields := make(map[string]interface{})
 
 	reader := bufio.NewReader(r)
 	for {
@@ -131,44 +246,32 @@ func (t *TiddlerFile) Read(r io.Reader) error {
 				log.Error().Err(err).Msg("could not read the tiddler body")
 				// TODO: make better error handling
 			}
-			if len(b) > 0 {
+			// a blank line at the end of the file is the separator only if it ends in a newline
+			if len(b) > 0 || (preserveEmptyFields && rerr == nil) {
 				t.tid["text"] = string(b)
 			}
 			break
 		}
-		idx := strings.Index(line, ":")
-		name := line[:idx]
-		value := strings.TrimSpace(line[idx+1:])
-		/*
-			switch name {
-			case "tags":
-				/// well, this is hideous
-				if len(value) > 0 {
-					value = reMatchMultiWordTags.ReplaceAllStringFunc(value,
-						func(str string) string {
-							return strings.ReplaceAll(str, " ", "~tb~")
-						})
-					tagsStrArr := strings.Split(value, " ")
-					tagsArr := make([]interface{}, len(tagsStrArr))
-					for i, t := range tagsStrArr {
-						tagsArr[i] = strings.TrimSuffix(strings.TrimPrefix(strings.ReplaceAll(t, "~tb~", " "), "[["), "]]")
-					}
-					t.tid[name] = tagsArr
-				}
-			default:
-				t.tid[name] = value
+		name, value, ok := parseFieldLine(line)
+		if !ok {
+			return fmt.Errorf("tiddler field line %q has no colon", line)
+		}
+		switch name {
+		case "tags":
+			//read as the list of tags TiddlyWeb sends, so a tag with spaces in it stays one tag
+			tags := make([]interface{}, 0)
+			for _, tag := range parseTagList(value) {
+				tags = append(tags, tag)
 			}
-		*/
-		t.tid[name] = value
+			t.tid[name] = tags
+		default:
+			t.tid[name] = value
+		}
 
 		if rerr == io.EOF {
 			break
 		}
 	}
-	if len(fields) > 0 {
-		t.tid["fields"] = fields
-	}
-
 	// TiddlyWiki5 <= 5.2.3 syncer is expecting the revision field to exist so it does not accept "old" and "new" revisions to be both 'undefined'
 	// https://github.com/Jermolene/TiddlyWiki5/blob/master/core/modules/syncer.js#L351-L354
 	// https://github.com/Jermolene/TiddlyWiki5/blob/master/core/modules/syncer.js#L360
@@ -192,8 +295,7 @@ func getTiddlerFileTile(f io.Reader) (string, error) {
 		if reWhitespaceOnly.MatchString(line) {
 			break
 		}
-		if strings.HasPrefix(line, "title:") {
-			title := strings.TrimSpace(line[strings.Index(line, ":")+1:])
+		if name, title, ok := parseFieldLine(line); ok && name == "title" {
 			if title == "" {
 				return "", fmt.Errorf("")
 			}
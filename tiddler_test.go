@@ -3,8 +3,10 @@ package tiddlybucket
 import (
 	"bytes"
 	"io"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestTiddler_Read(t *testing.T) {
@@ -115,6 +117,150 @@ func TestTiddlerFile_Write(t *testing.T) {
 	}
 }
 
+func TestTiddlerFile_preserveEmptyFields(t *testing.T) {
+	defer func(preserve bool) { preserveEmptyFields = preserve }(preserveEmptyFields)
+	tests := []struct {
+		name     string
+		preserve bool
+		tid      Tiddler
+		want     Tiddler
+	}{
+		{"empty text", true,
+			Tiddler{"title": "Empty", "text": "", "caption": "", "revision": "0"},
+			Tiddler{"title": "Empty", "text": "", "caption": "", "revision": "0"}},
+		{"no text", true,
+			Tiddler{"title": "Fields only", "caption": "", "revision": "0"},
+			Tiddler{"title": "Fields only", "caption": "", "revision": "0"}},
+		{"text", true,
+			Tiddler{"title": "Note", "text": "hello", "revision": "0"},
+			Tiddler{"title": "Note", "text": "hello", "revision": "0"}},
+		{"empty text dropped by default", false,
+			Tiddler{"title": "Empty", "text": "", "caption": "", "revision": "0"},
+			Tiddler{"title": "Empty", "caption": "", "revision": "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preserveEmptyFields = tt.preserve
+			w := &bytes.Buffer{}
+			if err := (&TiddlerFile{tid: tt.tid}).Write(w); err != nil {
+				t.Fatalf("TiddlerFile.Write() error = %v", err)
+			}
+			var got TiddlerFile
+			if err := got.Read(strings.NewReader(w.String())); err != nil {
+				t.Fatalf("TiddlerFile.Read() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Tiddler(), tt.want) {
+				t.Errorf("TiddlerFile round trip of %q = %v, want %v", w.String(), got.Tiddler(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTiddlerFile_tags(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     interface{}
+		wantLine string
+		want     []interface{}
+	}{
+		{"single words", []interface{}{"one", "two"}, "tags: one two\n", []interface{}{"one", "two"}},
+		{"multiple words", []interface{}{"one", "Two Words", "$:/tags/Macro"}, "tags: one [[Two Words]] $:/tags/Macro\n", []interface{}{"one", "Two Words", "$:/tags/Macro"}},
+		{"string list", []string{"Three Word Tag"}, "tags: [[Three Word Tag]]\n", []interface{}{"Three Word Tag"}},
+		{"TiddlyWiki list", "one [[Two Words]]", "tags: one [[Two Words]]\n", []interface{}{"one", "Two Words"}},
+		{"empty", []interface{}{}, "tags: \n", []interface{}{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			if err := (&TiddlerFile{tid: Tiddler{"title": "Note", "tags": tt.tags}}).Write(w); err != nil {
+				t.Fatalf("TiddlerFile.Write() error = %v", err)
+			}
+			if !strings.Contains(w.String(), tt.wantLine) {
+				t.Errorf("TiddlerFile.Write() = %q, want a line %q", w.String(), tt.wantLine)
+			}
+			var got TiddlerFile
+			if err := got.Read(strings.NewReader(w.String())); err != nil {
+				t.Fatalf("TiddlerFile.Read() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Tiddler()["tags"], tt.want) {
+				t.Errorf("TiddlerFile round trip tags = %#v, want %#v", got.Tiddler()["tags"], tt.want)
+			}
+			// the list reads the same as the tags it was written from
+			if tid := got.Tiddler(); tid.Field("tags") != strings.TrimSpace(strings.TrimPrefix(tt.wantLine, "tags: ")) {
+				t.Errorf("Field(tags) = %q", tid.Field("tags"))
+			}
+		})
+	}
+
+	if err := (&TiddlerFile{tid: Tiddler{"title": "Note", "tags": []interface{}{1}}}).Write(&bytes.Buffer{}); err == nil {
+		t.Errorf("TiddlerFile.Write() wrote tags that are not strings")
+	}
+}
+
+func TestTiddlerFile_customFields(t *testing.T) {
+	random := generateTiddler(t)
+	delete(random, "tags")
+	tests := []struct {
+		name    string
+		tid     Tiddler
+		wantErr bool
+	}{
+		{"random fields", random, false},
+		{"colons", Tiddler{"title": "Note", "url": "https://example.com:8080/a:b", "caption": "a: b: c"}, false},
+		{"whitespace", Tiddler{"title": "Note", "indent": "  two spaces", "trailing": "tab\t", "blank": " ", "empty": ""}, false},
+		{"number", Tiddler{"title": "Note", "revision": float64(3)}, false},
+		{"nested fields", Tiddler{"title": "Note", "fields": map[string]interface{}{"color": " red ", "list": "a [[b c]]"}}, false},
+		{"line break", Tiddler{"title": "Note", "caption": "two\nlines"}, true},
+		{"colon in name", Tiddler{"title": "Note", "a:b": "c"}, true},
+		{"empty name", Tiddler{"title": "Note", "": "c"}, true},
+		{"not a string", Tiddler{"title": "Note", "list": []interface{}{"a"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			err := (&TiddlerFile{tid: tt.tid}).Write(w)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TiddlerFile.Write() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got TiddlerFile
+			if err := got.Read(strings.NewReader(w.String())); err != nil {
+				t.Fatalf("TiddlerFile.Read() error = %v", err)
+			}
+			// every field comes back flat, the nested ones included
+			want := make(Tiddler)
+			for name, value := range tt.tid {
+				if fields, ok := value.(map[string]interface{}); ok && name == "fields" {
+					for name, value := range fields {
+						want[name] = value
+					}
+					continue
+				}
+				want[name], _ = fieldAsString(value)
+			}
+			if _, ok := want["revision"]; !ok {
+				want["revision"] = "0"
+			}
+			if !reflect.DeepEqual(got.Tiddler(), want) {
+				t.Errorf("TiddlerFile round trip = %#v, want %#v", got.Tiddler(), want)
+			}
+		})
+	}
+
+	var got TiddlerFile
+	if err := got.Read(strings.NewReader("title: Note\r\ncaption:no space\r\nnot a field\n\ntext")); err == nil {
+		t.Errorf("TiddlerFile.Read() read a field line without a colon")
+	}
+	if err := got.Read(strings.NewReader("title: Note\r\ncaption:no space\r\n\r\n")); err != nil {
+		t.Fatalf("TiddlerFile.Read() error = %v", err)
+	}
+	if got.Tiddler()["title"] != "Note" || got.Tiddler()["caption"] != "no space" {
+		t.Errorf("TiddlerFile.Read() = %#v, want the fields without line endings", got.Tiddler())
+	}
+}
+
 func Test_getTiddlerFileTile(t *testing.T) {
 	type args struct {
 		f io.Reader
@@ -143,3 +289,104 @@ func Test_getTiddlerFileTile(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseTagList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []string
+	}{
+		{"empty", "", []string{}},
+		{"single", "one", []string{"one"}},
+		{"multi word", "one [[two words]]  three", []string{"one", "two words", "three"}},
+		{"unclosed brackets", "[[open one", []string{"[[open", "one"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTagList(tt.list)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseTagList() = %q, want %q", got, tt.want)
+			}
+			if tt.name != "unclosed brackets" {
+				if back := parseTagList(formatTagList(got)); !reflect.DeepEqual(back, tt.want) {
+					t.Errorf("formatTagList() did not round trip: %q", formatTagList(got))
+				}
+			}
+		})
+	}
+}
+
+func Test_formatTiddlerTime(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		want string
+	}{
+		{"utc", time.Date(2023, 1, 2, 15, 4, 5, 123456789, time.UTC), "20230102150405123"},
+		{"whole second", time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC), "20230102150405000"},
+		{"converted to utc", time.Date(2023, 1, 2, 15, 4, 5, 7000000, time.FixedZone("EST", -5*3600)), "20230102200405007"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := formatTiddlerTime(tt.time)
+			if got != tt.want {
+				t.Errorf("formatTiddlerTime() = %s, want %s", got, tt.want)
+			}
+			parsed, err := parseTiddlerTime(got)
+			if err != nil || !parsed.Equal(tt.time.Truncate(time.Millisecond)) {
+				t.Errorf("parseTiddlerTime(%s) = %v, %v, want %v", got, parsed, err, tt.time.Truncate(time.Millisecond))
+			}
+		})
+	}
+}
+
+func Test_parseTiddlerTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"milliseconds", "20230102150405123", time.Date(2023, 1, 2, 15, 4, 5, 123000000, time.UTC), false},
+		{"seconds", "20230102150405", time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC), false},
+		{"day", "20230102", time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC), false},
+		{"empty", "", time.Time{}, true},
+		{"partial milliseconds", "202301021504051", time.Time{}, true},
+		{"not a date", "yesterday", time.Time{}, true},
+		{"invalid month", "20231302150405123", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTiddlerTime(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTiddlerTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("parseTiddlerTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tiddlerTimeAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"later milliseconds", "20230102150405124", "20230102150405123", true},
+		{"earlier", "20230102150405123", "20230102150405124", false},
+		{"equal", "20230102150405123", "20230102150405123", false},
+		{"seconds against milliseconds", "20230102150406", "20230102150405999", true},
+		{"seconds equal to whole milliseconds", "20230102150405", "20230102150405000", false},
+		{"valid after invalid", "20230102150405123", "", true},
+		{"invalid never after", "", "20230102150405123", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tiddlerTimeAfter(tt.a, tt.b); got != tt.want {
+				t.Errorf("tiddlerTimeAfter(%s, %s) = %v, want %v", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
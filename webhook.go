@@ -0,0 +1,134 @@
+package tiddlybucket
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+//Operations reported to the webhook
+const (
+	WebhookPut    = "put"
+	WebhookDelete = "delete"
+)
+
+//How long a webhook delivery may take, and how many may be in flight at once. Events written while that many are in flight are
+//dropped, so that a slow receiver never holds up saving tiddlers.
+var (
+	webhookTimeout       = 10 * time.Second
+	maxWebhookDeliveries = 8
+)
+
+//The webhook of Options.WebhookURL, nil without one
+var tiddlerWebhook *webhook
+
+//What is POSTed as JSON to the webhook after a tiddler was written or deleted
+type webhookEvent struct {
+	Wiki      string    `json:"wiki"`
+	Title     string    `json:"title"`
+	Operation string    `json:"operation"` //WebhookPut or WebhookDelete
+	Username  string    `json:"username"`
+	Time      time.Time `json:"time"`
+}
+
+//POSTs each tiddler written or deleted through the server to a URL, for integrations such as chat notifications or rebuilds.
+//Deliveries run in the background and are not retried.
+type webhook struct {
+	url      string
+	client   *http.Client
+	inFlight chan struct{} //holds a token for each delivery in flight
+	wg       sync.WaitGroup
+}
+
+func newWebhook(webhookURL string) *webhook {
+	return &webhook{
+		url:      webhookURL,
+		client:   &http.Client{Timeout: webhookTimeout},
+		inFlight: make(chan struct{}, maxWebhookDeliveries),
+	}
+}
+
+//Checks that the webhook URL is an absolute http or https URL
+func checkWebhookURL(webhookURL string) error {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return fmt.Errorf("webhook URL %q: %w", webhookURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an http or https URL", webhookURL)
+	}
+	return nil
+}
+
+//Delivers the event in the background, or drops it when maxWebhookDeliveries are already in flight
+func (wh *webhook) send(event webhookEvent) {
+	select {
+	case wh.inFlight <- struct{}{}:
+	default:
+		log.Warn().Str("wiki", event.Wiki).Str("title", event.Title).Str("operation", event.Operation).Msg("too many webhook deliveries in flight, dropping event")
+		return
+	}
+	wh.wg.Add(1)
+	go func() {
+		defer func() {
+			<-wh.inFlight
+			wh.wg.Done()
+		}()
+		if err := wh.post(event); err != nil {
+			log.Warn().Str("wiki", event.Wiki).Str("title", event.Title).Str("operation", event.Operation).Err(err).Msg("could not deliver webhook event")
+		}
+	}()
+}
+
+func (wh *webhook) post(event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+//Waits for the deliveries in flight on shutdown, until ctx is done
+func (wh *webhook) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		wh.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Reports a tiddler written or deleted by the request to the webhook, if there is one
+func (h *handlerWithStore) notifyWebhook(r *http.Request, operation, title string) {
+	if tiddlerWebhook == nil {
+		return
+	}
+	auth, _ := r.Context().Value("auth").(authContext)
+	tiddlerWebhook.send(webhookEvent{
+		Wiki:      h.wiki,
+		Title:     title,
+		Operation: operation,
+		Username:  auth.Username,
+		Time:      time.Now().UTC(),
+	})
+}
@@ -0,0 +1,171 @@
+package tiddlybucket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_handlerWithStore_notifyWebhook(t *testing.T) {
+	defer func(wh *webhook) { tiddlerWebhook = wh }(tiddlerWebhook)
+	received := make(chan map[string]interface{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("webhook request = %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var event map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Errorf("webhook body is not JSON: %v", err)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+	tiddlerWebhook = newWebhook(receiver.URL)
+
+	store := &dummyTiddlerStore{tiddlersByTitle: map[string]Tiddler{"Old": {"title": "Old", "text": "bye"}}}
+	h := &handlerWithStore{Store: store, wiki: "notes"}
+	withAuth := func(r *http.Request, keys, values []string) *http.Request {
+		ctx := context.WithValue(r.Context(), chi.RouteCtxKey, &chi.Context{URLParams: chi.RouteParams{Keys: keys, Values: values}})
+		return r.WithContext(context.WithValue(ctx, "auth", authContext{Username: "alice", WritingAllowed: true}))
+	}
+	next := func() map[string]interface{} {
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("webhook did not receive an event")
+			return nil
+		}
+	}
+
+	w := httptest.NewRecorder()
+	h.putTiddler(w, withAuth(httptest.NewRequest(http.MethodPut, "http://foobar.com/notes/recipes/default/tiddlers/New",
+		strings.NewReader(`{"title":"New","text":"hello"}`)), []string{"recipe", "*"}, []string{"default", "New"}))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("putTiddler() status = %d", w.Code)
+	}
+	event := next()
+	if event["wiki"] != "notes" || event["title"] != "New" || event["operation"] != WebhookPut || event["username"] != "alice" {
+		t.Errorf("webhook event = %v, want the put of New by alice", event)
+	}
+	if _, err := time.Parse(time.RFC3339, event["time"].(string)); err != nil {
+		t.Errorf("webhook event time = %v: %v", event["time"], err)
+	}
+
+	w = httptest.NewRecorder()
+	h.deleteTiddler(w, withAuth(httptest.NewRequest(http.MethodDelete, "http://foobar.com/notes/bags/default/tiddlers/Old", nil),
+		[]string{"bag", "*"}, []string{"default", "Old"}))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("deleteTiddler() status = %d", w.Code)
+	}
+	if event := next(); event["title"] != "Old" || event["operation"] != WebhookDelete {
+		t.Errorf("webhook event = %v, want the delete of Old", event)
+	}
+
+	// each imported tiddler is reported as a put
+	w = httptest.NewRecorder()
+	h.importTiddlers(w, withAuth(httptest.NewRequest(http.MethodPost, "http://foobar.com/notes/recipes/default/tiddlers/import",
+		strings.NewReader(`[{"title":"First","text":"1"},{"title":"Second","text":"2"}]`)), nil, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("importTiddlers() status = %d", w.Code)
+	}
+	// delivered concurrently, so in any order
+	puts := map[interface{}]bool{}
+	for i := 0; i < 2; i++ {
+		if event := next(); event["operation"] == WebhookPut {
+			puts[event["title"]] = true
+		}
+	}
+	if !puts["First"] || !puts["Second"] {
+		t.Errorf("webhook puts = %v, want First and Second", puts)
+	}
+
+	// as is each tiddler of a bulk delete
+	w = httptest.NewRecorder()
+	h.deleteTiddlers(w, withAuth(httptest.NewRequest(http.MethodPost, "http://foobar.com/notes/recipes/default/tiddlers/delete",
+		strings.NewReader(`["First","Second"]`)), nil, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("deleteTiddlers() status = %d", w.Code)
+	}
+	deletes := map[interface{}]bool{}
+	for i := 0; i < 2; i++ {
+		if event := next(); event["operation"] == WebhookDelete {
+			deletes[event["title"]] = true
+		}
+	}
+	if !deletes["First"] || !deletes["Second"] {
+		t.Errorf("webhook deletes = %v, want First and Second", deletes)
+	}
+
+	// a failed write is not reported
+	w = httptest.NewRecorder()
+	h.deleteTiddler(w, withAuth(httptest.NewRequest(http.MethodDelete, "http://foobar.com/notes/bags/default/tiddlers/Missing", nil),
+		[]string{"bag", "*"}, []string{"default", "Missing"}))
+	if err := tiddlerWebhook.wait(context.Background()); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	if len(received) != 0 {
+		t.Errorf("webhook received %v for a failed delete", <-received)
+	}
+}
+
+func Test_webhook_boundedDeliveries(t *testing.T) {
+	defer func(max int, timeout time.Duration) { maxWebhookDeliveries, webhookTimeout = max, timeout }(maxWebhookDeliveries, webhookTimeout)
+	maxWebhookDeliveries, webhookTimeout = 2, 100*time.Millisecond
+	release := make(chan struct{})
+	requests := make(chan struct{}, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer receiver.Close()
+	defer close(release)
+	wh := newWebhook(receiver.URL)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		wh.send(webhookEvent{Wiki: "notes", Title: "Note", Operation: WebhookPut})
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("send() blocked for %v on a slow receiver", elapsed)
+	}
+	// the deliveries time out instead of waiting for the receiver
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := wh.wait(ctx); err != nil {
+		t.Fatalf("wait() error = %v, want the deliveries timed out", err)
+	}
+	if got := len(requests); got != 2 {
+		t.Errorf("webhook received %d requests, want the %d in flight at most", got, 2)
+	}
+}
+
+func Test_checkWebhookURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://hooks.example.com/tiddlers", false},
+		{"http://localhost:9000/hook", false},
+		{"hooks.example.com/tiddlers", true},
+		{"ftp://hooks.example.com", true},
+		{"http://", true},
+		{"://bad", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			if err := checkWebhookURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("checkWebhookURL(%q) error = %v, wantErr %v", tt.url, err, tt.wantErr)
+			}
+		})
+	}
+}